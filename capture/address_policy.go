@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// AddressPolicy decides which IP addresses appear in the graph. Packets whose
+// source or destination is rejected are skipped by ProcessPacket.
+//
+// Include CIDRs always win, so a single subnet can be made visible without
+// enabling a whole address class. Exclude CIDRs are checked next, then the
+// per-class toggles.
+type AddressPolicy struct {
+	Include       []string `json:"include"`       // CIDRs that are always shown
+	Exclude       []string `json:"exclude"`       // CIDRs that are always hidden
+	ShowMulticast bool     `json:"showMulticast"` // 224.0.0.0/4, ff00::/8
+	ShowBroadcast bool     `json:"showBroadcast"` // 255.255.255.255
+	ShowULA       bool     `json:"showULA"`       // IPv6 unique local, fc00::/7
+	ShowLoopback  bool     `json:"showLoopback"`  // 127.0.0.0/8, ::1
+	ShowLinkLocal bool     `json:"showLinkLocal"` // 169.254.0.0/16, fe80::/10
+}
+
+// DefaultAddressPolicy hides link-local, multicast, loopback and ULA addresses,
+// which clutter the graph with non-routable endpoints
+func DefaultAddressPolicy() AddressPolicy {
+	return AddressPolicy{
+		ShowBroadcast: true,
+	}
+}
+
+// LoadAddressPolicy reads a policy from a JSON file. Fields missing from the
+// file keep their DefaultAddressPolicy values.
+func LoadAddressPolicy(path string) (AddressPolicy, error) {
+	policy := DefaultAddressPolicy()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, fmt.Errorf("failed to read address policy: %v", err)
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse address policy: %v", err)
+	}
+	return policy, nil
+}
+
+// compiledPolicy is an AddressPolicy with its CIDRs parsed
+type compiledPolicy struct {
+	policy  AddressPolicy
+	include []*net.IPNet
+	exclude []*net.IPNet
+}
+
+var (
+	addressPolicyMu sync.RWMutex
+	addressPolicy   = &compiledPolicy{policy: DefaultAddressPolicy()}
+)
+
+// parseCIDRs parses a list of CIDRs; bare addresses are treated as host routes
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// compilePolicy validates a policy and parses its CIDR lists
+func compilePolicy(policy AddressPolicy) (*compiledPolicy, error) {
+	include, err := parseCIDRs(policy.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %v", err)
+	}
+	exclude, err := parseCIDRs(policy.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %v", err)
+	}
+	return &compiledPolicy{policy: policy, include: include, exclude: exclude}, nil
+}
+
+// SetAddressPolicy validates and installs a new address policy
+func SetAddressPolicy(policy AddressPolicy) error {
+	cp, err := compilePolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	addressPolicyMu.Lock()
+	addressPolicy = cp
+	addressPolicyMu.Unlock()
+	return nil
+}
+
+// CurrentAddressPolicy returns the policy in effect
+func CurrentAddressPolicy() AddressPolicy {
+	addressPolicyMu.RLock()
+	defer addressPolicyMu.RUnlock()
+	return addressPolicy.policy
+}
+
+// AddressAllowed reports whether an address passes the current policy
+func AddressAllowed(ipStr string) bool {
+	addressPolicyMu.RLock()
+	cp := addressPolicy
+	addressPolicyMu.RUnlock()
+	return cp.allows(ipStr)
+}
+
+// allows applies the include list, exclude list and class toggles in that order
+func (cp *compiledPolicy) allows(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return true
+	}
+
+	for _, n := range cp.include {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range cp.exclude {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	p := cp.policy
+	switch {
+	case ip.IsLoopback():
+		return p.ShowLoopback
+	case ip.IsLinkLocalUnicast():
+		return p.ShowLinkLocal
+	case ip.IsMulticast():
+		return p.ShowMulticast
+	case ip.Equal(net.IPv4bcast):
+		return p.ShowBroadcast
+	case ip.To4() == nil && ip.IsPrivate():
+		// IsPrivate covers fc00::/7 for IPv6
+		return p.ShowULA
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package capture
+
+// Defaults for the AF_PACKET backend
+const (
+	DefaultAFPacketSnapLen   = 65536   // Frame size: largest packet captured in full
+	DefaultAFPacketBlockSize = 1 << 22 // 4 MiB ring blocks
+	DefaultAFPacketNumBlocks = 32      // Blocks per fanout socket
+)
+
+// AFPacketConfig holds configuration for the Linux AF_PACKET (TPACKET_V3) backend.
+// Each worker owns its own memory-mapped ring, so the kernel memory used is
+// roughly Workers * BlockSize * NumBlocks.
+type AFPacketConfig struct {
+	Interface    string   // Network interface to capture from
+	Filter       string   // BPF filter expression (empty captures everything)
+	ExcludeHosts []string // Hosts whose ExcludePort traffic is filtered out
+	ExcludePort  int      // Port to exclude on ExcludeHosts (0 disables exclusion)
+	SnapLen      int      // Ring frame size in bytes (default DefaultAFPacketSnapLen)
+	BlockSize    int      // Ring block size; a multiple of the page size and SnapLen
+	NumBlocks    int      // Ring blocks per worker
+	Workers      int      // Fanout sockets, each with its own decoding goroutine (default: CPU count)
+	Rotation     RotationConfig
+}
@@ -0,0 +1,354 @@
+//go:build linux
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketPollTimeout bounds how long a worker blocks in poll(2), so it
+// notices cancellation on idle links
+const afpacketPollTimeout = 100 * time.Millisecond
+
+// AFPacketCapture captures from a Linux interface through memory-mapped
+// TPACKET_V3 rings. Traffic is spread over several sockets with PACKET_FANOUT,
+// hashed by flow so each connection stays on one worker, and every socket is
+// read and decoded by its own goroutine.
+type AFPacketCapture struct {
+	config     AFPacketConfig
+	handles    []*afpacket.TPacket
+	handleMu   sync.Mutex // Guards handles against Stats and SetFilter after close
+	closed     bool
+	filter     string // User filter expression
+	exclude    string // Automatic exclusion clause (our own UI traffic)
+	filterMu   sync.RWMutex
+	packetChan chan *PacketInfo
+	pcapWriter *PcapWriter // nil when pcap saving is disabled
+	paused     atomic.Bool
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	workers    []*afpacketWorker // Decoding state of each handle's goroutine
+	counters   sourceCounters
+}
+
+// afpacketWorker is the decoding state of one fanout socket. The fanout
+// group hashes each flow, and with FanoutHashWithDefrag each datagram's
+// fragments, to a single socket, so workers never need each other's state.
+type afpacketWorker struct {
+	defrag  *Defragmenter // Reassembles IP fragments before decoding
+	decoder *PacketDecoder
+}
+
+// NewAFPacketCapture opens one AF_PACKET socket per worker and joins them to
+// a fanout group
+func NewAFPacketCapture(config AFPacketConfig, packetChan chan *PacketInfo) (*AFPacketCapture, error) {
+	if config.SnapLen <= 0 {
+		config.SnapLen = DefaultAFPacketSnapLen
+	}
+	if config.BlockSize <= 0 {
+		config.BlockSize = DefaultAFPacketBlockSize
+	}
+	if config.NumBlocks <= 0 {
+		config.NumBlocks = DefaultAFPacketNumBlocks
+	}
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+
+	c := &AFPacketCapture{
+		config:     config,
+		exclude:    ExclusionClause(config.ExcludeHosts, config.ExcludePort),
+		packetChan: packetChan,
+		closeChan:  make(chan struct{}),
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		handle, err := afpacket.NewTPacket(
+			afpacket.OptInterface(config.Interface),
+			afpacket.OptFrameSize(config.SnapLen),
+			afpacket.OptBlockSize(config.BlockSize),
+			afpacket.OptNumBlocks(config.NumBlocks),
+			afpacket.OptPollTimeout(afpacketPollTimeout),
+			afpacket.TPacketVersion3,
+		)
+		if err != nil {
+			c.closeHandles()
+			return nil, fmt.Errorf("failed to open AF_PACKET socket on %s: %v", config.Interface, err)
+		}
+		c.handles = append(c.handles, handle)
+		c.workers = append(c.workers, &afpacketWorker{defrag: NewDefragmenter(), decoder: NewPacketDecoder()})
+	}
+
+	// Install the filter before joining the fanout group so no unfiltered
+	// packets are delivered
+	if err := c.SetFilter(config.Filter); err != nil {
+		c.closeHandles()
+		return nil, err
+	}
+
+	if len(c.handles) > 1 {
+		fanoutID, err := afpacketFanoutID(config.Interface)
+		if err != nil {
+			c.closeHandles()
+			return nil, err
+		}
+		for _, handle := range c.handles {
+			if err := handle.SetFanout(afpacket.FanoutHashWithDefrag, fanoutID); err != nil {
+				c.closeHandles()
+				return nil, fmt.Errorf("failed to join AF_PACKET fanout group %d on %s: %v", fanoutID, config.Interface, err)
+			}
+		}
+	}
+
+	// Save packets to rotating pcap files (enabled by default)
+	writer, err := NewPcapWriter(config.Rotation, interfacePrefix("capture", config.Interface), uint32(config.SnapLen), layers.LinkTypeEthernet)
+	if err != nil {
+		log.Printf("Warning: Pcap saving disabled: %v", err)
+	} else {
+		c.pcapWriter = writer
+	}
+
+	return c, nil
+}
+
+// afpacketFanoutID returns the fanout group for an interface's sockets. A
+// group is bound to one interface, so each interface captured by this
+// process needs its own ID: the process ID offset by the interface index.
+func afpacketFanoutID(name string) (uint16, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up interface %s: %v", name, err)
+	}
+	return uint16((os.Getpid() + iface.Index) & 0xffff), nil
+}
+
+// Start runs the fanout workers until the context is cancelled or Close is called
+func (c *AFPacketCapture) Start(ctx context.Context) {
+	defer c.closeHandles()
+	defer func() {
+		if c.pcapWriter != nil {
+			c.pcapWriter.Close()
+		}
+	}()
+
+	log.Printf("AF_PACKET capture started on %s (%d workers)", c.config.Interface, len(c.handles))
+	if c.pcapWriter != nil {
+		log.Printf("Saving packets to: %s", c.pcapWriter.CurrentFile())
+	}
+
+	var wg sync.WaitGroup
+	for i, handle := range c.handles {
+		wg.Add(1)
+		go func(handle *afpacket.TPacket, w *afpacketWorker) {
+			defer wg.Done()
+			c.readLoop(ctx, handle, w)
+		}(handle, c.workers[i])
+	}
+	wg.Wait()
+
+	log.Println("AF_PACKET capture stopped")
+}
+
+// readLoop reads, decodes and forwards packets from one ring
+func (c *AFPacketCapture) readLoop(ctx context.Context, handle *afpacket.TPacket, w *afpacketWorker) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.closeChan:
+			return
+		default:
+		}
+
+		// data points into the ring and is only valid until the next read
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if err == afpacket.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			log.Printf("AF_PACKET read error: %v", err)
+			return
+		}
+		if c.paused.Load() {
+			continue
+		}
+		c.handleFrame(w, data, ci)
+	}
+}
+
+// handleFrame decodes one frame read from a worker's ring and forwards it
+func (c *AFPacketCapture) handleFrame(w *afpacketWorker, data []byte, ci gopacket.CaptureInfo) {
+	c.counters.received.Add(1)
+
+	// gopacket.Default copies data out of the ring before decoding
+	packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+	packet.Metadata().CaptureInfo = ci
+
+	// Write packet to pcap file if enabled
+	if c.pcapWriter != nil {
+		if err := writePcap(c.pcapWriter, packet); err != nil {
+			log.Printf("Warning: Failed to write packet to pcap: %v", err)
+		}
+	}
+
+	// Fanout hashes fragments of a datagram to the same worker
+	packet, fragments := w.defrag.Defrag(packet)
+	if packet == nil {
+		return
+	}
+	packetInfo := w.decoder.ProcessPacket(packet)
+	if packetInfo == nil {
+		c.counters.filtered.Add(1)
+		return
+	}
+	packetInfo.Interface = c.config.Interface
+	packetInfo.Fragments = fragments
+
+	c.counters.deliver(c.packetChan, packetInfo)
+}
+
+// Pause stops forwarding packets; the rings keep draining so the kernel
+// does not report drops while paused
+func (c *AFPacketCapture) Pause() {
+	if !c.paused.Swap(true) {
+		log.Println("AF_PACKET capture paused")
+	}
+}
+
+// Resume continues forwarding packets after Pause
+func (c *AFPacketCapture) Resume() {
+	if c.paused.Swap(false) {
+		log.Println("AF_PACKET capture resumed")
+	}
+}
+
+// Filter returns the user-supplied filter expression
+func (c *AFPacketCapture) Filter() string {
+	c.filterMu.RLock()
+	defer c.filterMu.RUnlock()
+	return c.filter
+}
+
+// EffectiveFilter returns the BPF expression installed on the sockets
+func (c *AFPacketCapture) EffectiveFilter() string {
+	c.filterMu.RLock()
+	defer c.filterMu.RUnlock()
+	return combineFilters(c.filter, c.exclude)
+}
+
+// SetFilter compiles an expression with libpcap and attaches it to every
+// socket. The previous filter stays active if the expression is invalid.
+func (c *AFPacketCapture) SetFilter(expr string) error {
+	c.filterMu.Lock()
+	defer c.filterMu.Unlock()
+
+	expr = strings.TrimSpace(expr)
+	effective := combineFilters(expr, c.exclude)
+	if effective == "" && c.filter == "" {
+		// Nothing to install or clear
+		return nil
+	}
+
+	// An empty expression compiles to accept-all, which clears the filter
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, c.config.SnapLen, effective)
+	if err != nil {
+		return fmt.Errorf("invalid BPF filter %q: %v", expr, err)
+	}
+	program := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		program[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+
+	c.handleMu.Lock()
+	defer c.handleMu.Unlock()
+	if c.closed {
+		return fmt.Errorf("capture on %s is closed", c.config.Interface)
+	}
+	for _, handle := range c.handles {
+		if err := handle.SetBPF(program); err != nil {
+			return fmt.Errorf("failed to attach BPF filter: %v", err)
+		}
+	}
+
+	c.filter = expr
+	if effective != "" {
+		log.Printf("Capture filter set: %s", effective)
+	} else {
+		log.Println("Capture filter cleared")
+	}
+	return nil
+}
+
+// CurrentPcapFile returns the pcap file currently being written
+func (c *AFPacketCapture) CurrentPcapFile() string {
+	if c.pcapWriter == nil {
+		return ""
+	}
+	return c.pcapWriter.CurrentFile()
+}
+
+// Stats returns the capture's packet counters. Kernel drops are the ring
+// overflows reported by PACKET_STATISTICS, summed over all workers.
+func (c *AFPacketCapture) Stats() SourceStats {
+	c.handleMu.Lock()
+	if !c.closed {
+		var drops uint64
+		ok := true
+		for _, handle := range c.handles {
+			_, stats, err := handle.SocketStats()
+			if err != nil {
+				ok = false
+				break
+			}
+			drops += uint64(stats.Drops())
+		}
+		if ok {
+			c.counters.kernelDropped.Store(drops)
+		}
+	}
+	c.handleMu.Unlock()
+
+	stats := c.counters.stats("af_packet " + c.config.Interface)
+	for _, w := range c.workers {
+		w.defrag.addStats(&stats)
+	}
+	return stats
+}
+
+// closeHandles releases the rings; the last drop counts are kept
+func (c *AFPacketCapture) closeHandles() {
+	c.Stats()
+
+	c.handleMu.Lock()
+	defer c.handleMu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, handle := range c.handles {
+		handle.Close()
+	}
+}
+
+// Close stops packet capture; the rings are released when Start returns
+func (c *AFPacketCapture) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+	return nil
+}
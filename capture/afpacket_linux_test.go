@@ -0,0 +1,203 @@
+package capture
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// benchFlows and benchFrames size the recording
+const (
+	benchFlows  = 256
+	benchFrames = 8192
+)
+
+// recordBenchFrames builds the recording of TCP and UDP traffic over IPv4
+// and IPv6 that both decode paths replay from memory
+func recordBenchFrames(b *testing.B) ([][]byte, []gopacket.CaptureInfo) {
+	b.Helper()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	start := time.Unix(1700000000, 0)
+	frames := make([][]byte, 0, benchFrames)
+	infos := make([]gopacket.CaptureInfo, 0, benchFrames)
+	for i := 0; i < benchFrames; i++ {
+		flow := i % benchFlows
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		var network gopacket.NetworkLayer
+		if flow%4 == 3 {
+			eth.EthernetType = layers.EthernetTypeIPv6
+			network = &layers.IPv6{
+				Version:  6,
+				HopLimit: 64,
+				SrcIP:    net.ParseIP(fmt.Sprintf("2001:db8::%x", flow+1)),
+				DstIP:    net.ParseIP("2001:db8::ffff"),
+			}
+		} else {
+			network = &layers.IPv4{
+				Version: 4,
+				TTL:     64,
+				SrcIP:   net.IPv4(10, 0, byte(flow>>8), byte(flow)),
+				DstIP:   net.IPv4(192, 0, 2, 1),
+			}
+		}
+		payload := gopacket.Payload(make([]byte, 64+(i*37)%1400))
+		var transport gopacket.SerializableLayer
+		var proto layers.IPProtocol
+		if flow%8 == 7 {
+			udp := &layers.UDP{SrcPort: layers.UDPPort(40000 + flow), DstPort: 53}
+			udp.SetNetworkLayerForChecksum(network)
+			transport, proto = udp, layers.IPProtocolUDP
+		} else {
+			tcp := &layers.TCP{SrcPort: layers.TCPPort(40000 + flow), DstPort: 443, Seq: uint32(i), ACK: true, PSH: true, Window: 65535}
+			tcp.SetNetworkLayerForChecksum(network)
+			transport, proto = tcp, layers.IPProtocolTCP
+		}
+		switch ip := network.(type) {
+		case *layers.IPv4:
+			ip.Protocol = proto
+		case *layers.IPv6:
+			ip.NextHeader = proto
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, eth, network.(gopacket.SerializableLayer), transport, payload); err != nil {
+			b.Fatal(err)
+		}
+		data := buf.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(data), Length: len(data)}
+		frames = append(frames, data)
+		infos = append(infos, ci)
+	}
+	return frames, infos
+}
+
+// benchSource replays frames as a packet data source, copying each frame
+// out like a pcap handle does
+type benchSource struct {
+	frames [][]byte
+	infos  []gopacket.CaptureInfo
+	next   int
+}
+
+func (s *benchSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if s.next == len(s.frames) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	i := s.next
+	s.next++
+	return append([]byte(nil), s.frames[i]...), s.infos[i], nil
+}
+
+// drainPackets consumes delivered packets until the channel is closed
+func drainPackets(packetChan chan *PacketInfo) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range packetChan {
+		}
+	}()
+	return &wg
+}
+
+// reportPacketRate reports the frames decoded per second
+func reportPacketRate(b *testing.B, frames int) {
+	b.ReportMetric(float64(frames*b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+// BenchmarkAFPacketDecode decodes the recording the way the AF_PACKET
+// workers do, with frames spread over the workers by flow like the fanout
+// group spreads them over the sockets. Frames are read in place, as from
+// a ring. Comparable with BenchmarkLibpcapDecode, which decodes the same
+// frames.
+func BenchmarkAFPacketDecode(b *testing.B) {
+	frames, infos := recordBenchFrames(b)
+	var size int64
+	for _, data := range frames {
+		size += int64(len(data))
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			shares := make([][]int, workers)
+			for i, data := range frames {
+				packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.NoCopy)
+				hash := packet.NetworkLayer().NetworkFlow().FastHash() ^ packet.TransportLayer().TransportFlow().FastHash()
+				shares[hash%uint64(workers)] = append(shares[hash%uint64(workers)], i)
+			}
+			packetChan := make(chan *PacketInfo, 10000)
+			drained := drainPackets(packetChan)
+			c := &AFPacketCapture{
+				config:     AFPacketConfig{Interface: "bench0", Workers: workers},
+				packetChan: packetChan,
+				closeChan:  make(chan struct{}),
+			}
+			for range shares {
+				c.workers = append(c.workers, &afpacketWorker{defrag: NewDefragmenter(), decoder: NewPacketDecoder()})
+			}
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				var wg sync.WaitGroup
+				for i, share := range shares {
+					wg.Add(1)
+					go func(w *afpacketWorker, share []int) {
+						defer wg.Done()
+						for _, i := range share {
+							c.handleFrame(w, frames[i], infos[i])
+						}
+					}(c.workers[i], share)
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+			reportPacketRate(b, len(frames))
+			close(packetChan)
+			drained.Wait()
+		})
+	}
+}
+
+// BenchmarkLibpcapDecode decodes the same recording the way Capture reads
+// a libpcap handle: one packet source, decoded by one goroutine
+func BenchmarkLibpcapDecode(b *testing.B) {
+	frames, infos := recordBenchFrames(b)
+	var size int64
+	for _, data := range frames {
+		size += int64(len(data))
+	}
+
+	packetChan := make(chan *PacketInfo, 10000)
+	drained := drainPackets(packetChan)
+	c := &Capture{
+		iface:      "bench0",
+		packetChan: packetChan,
+		closeChan:  make(chan struct{}),
+		defrag:     NewDefragmenter(),
+		decoder:    NewPacketDecoder(),
+	}
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		source := gopacket.NewPacketSource(&benchSource{frames: frames, infos: infos}, layers.LinkTypeEthernet)
+		for packet := range source.Packets() {
+			c.processPacket(packet)
+		}
+	}
+	b.StopTimer()
+	reportPacketRate(b, len(frames))
+	close(packetChan)
+	drained.Wait()
+}
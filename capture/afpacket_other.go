@@ -0,0 +1,15 @@
+//go:build !linux
+
+package capture
+
+import "fmt"
+
+// AFPacketCapture is only available on Linux
+type AFPacketCapture struct {
+	Capture
+}
+
+// NewAFPacketCapture always fails on non-Linux platforms
+func NewAFPacketCapture(config AFPacketConfig, packetChan chan *PacketInfo) (*AFPacketCapture, error) {
+	return nil, fmt.Errorf("AF_PACKET capture is only supported on Linux")
+}
@@ -0,0 +1,514 @@
+package capture
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// AnonymizeKeySize is the length of a Crypto-PAn key: an AES-128 key
+// followed by the secret used to pad address prefixes
+const AnonymizeKeySize = 32
+
+// maxAnonymizeCache bounds the address cache; it is cleared when full
+const maxAnonymizeCache = 65536
+
+// AnonymizeConfig holds settings for address anonymization
+type AnonymizeConfig struct {
+	Key  string // 64 hex digits, or a passphrase hashed with SHA-256; empty generates a per-run key
+	Pcap bool   // Also rewrite addresses in saved pcap files
+}
+
+// Anonymizer applies Crypto-PAn prefix-preserving pseudonymization: two
+// addresses sharing an n-bit prefix map to addresses sharing an n-bit
+// prefix, so subnets stay recognisable while real addresses stay on the
+// sensor. The same key always gives the same mapping. MAC addresses are
+// mapped the same way and hostnames label by label.
+type Anonymizer struct {
+	block  cipher.Block
+	pad    [aes.BlockSize]byte
+	secret []byte // HMAC key for hostnames
+	pcap   bool
+
+	mu    sync.Mutex
+	cache map[string][]byte // Addresses and MACs by raw bytes
+}
+
+// NewAnonymizer creates an anonymizer from a configuration
+func NewAnonymizer(config AnonymizeConfig) (*Anonymizer, error) {
+	key, err := parseAnonymizeKey(config.Key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	a := &Anonymizer{
+		block:  block,
+		secret: key[16:],
+		pcap:   config.Pcap,
+		cache:  make(map[string][]byte),
+	}
+	block.Encrypt(a.pad[:], key[16:])
+	return a, nil
+}
+
+// parseAnonymizeKey decodes a hex key or derives one from a passphrase
+func parseAnonymizeKey(s string) ([]byte, error) {
+	if s == "" {
+		key := make([]byte, AnonymizeKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate anonymization key: %v", err)
+		}
+		return key, nil
+	}
+	if len(s) == 2*AnonymizeKeySize {
+		if key, err := hex.DecodeString(s); err == nil {
+			return key, nil
+		}
+	}
+	sum := sha256.Sum256([]byte(s))
+	return sum[:], nil
+}
+
+var (
+	anonymizerMu sync.RWMutex
+	anonymizer   *Anonymizer // nil when anonymization is off
+)
+
+// SetAnonymizer enables anonymization, or disables it when a is nil. It must
+// be called before capture starts so that no real address is stored.
+func SetAnonymizer(a *Anonymizer) {
+	anonymizerMu.Lock()
+	defer anonymizerMu.Unlock()
+	anonymizer = a
+}
+
+// CurrentAnonymizer returns the anonymizer in effect, or nil
+func CurrentAnonymizer() *Anonymizer {
+	anonymizerMu.RLock()
+	defer anonymizerMu.RUnlock()
+	return anonymizer
+}
+
+// RewritesPcap reports whether saved pcap files hold anonymized addresses
+func (a *Anonymizer) RewritesPcap() bool {
+	return a.pcap
+}
+
+// AnonymizeIP returns the pseudonym of an address string when anonymization
+// is enabled; anything else is returned unchanged
+func AnonymizeIP(ipStr string) string {
+	a := CurrentAnonymizer()
+	if a == nil {
+		return ipStr
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return ipStr
+	}
+	return a.IP(ip).String()
+}
+
+// RealAddress reverses AnonymizeIP so the sensor can still resolve names
+// for anonymized addresses
+func RealAddress(ipStr string) string {
+	a := CurrentAnonymizer()
+	if a == nil {
+		return ipStr
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return ipStr
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return net.IP(a.unmap(ip)).String()
+}
+
+// AnonymizeHostname pseudonymizes a resolved hostname. Address literals
+// are anonymized like packet addresses.
+func AnonymizeHostname(name string) string {
+	a := CurrentAnonymizer()
+	if a == nil || name == "" {
+		return name
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		return a.IP(ip).String()
+	}
+	return a.Hostname(name)
+}
+
+// AnonymizeName pseudonymizes an opaque name such as the user part of an
+// email address when anonymization is enabled
+func AnonymizeName(name string) string {
+	a := CurrentAnonymizer()
+	if a == nil || name == "" {
+		return name
+	}
+	return a.token(name)
+}
+
+// ipLiteral matches IPv4 and IPv6 address candidates in free text
+var ipLiteral = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}`)
+
+// AnonymizeText anonymizes address literals in metadata such as stream
+// summaries
+func AnonymizeText(s string) string {
+	a := CurrentAnonymizer()
+	if a == nil {
+		return s
+	}
+	return ipLiteral.ReplaceAllStringFunc(s, func(m string) string {
+		if ip := net.ParseIP(m); ip != nil {
+			return a.IP(ip).String()
+		}
+		return m
+	})
+}
+
+// IP returns the pseudonym of an address. IPv4 addresses (including
+// IPv4-mapped IPv6) map to IPv4 addresses.
+func (a *Anonymizer) IP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return a.lookup(ip)
+}
+
+// lookup returns the cached mapping of an address, computing it if needed
+func (a *Anonymizer) lookup(addr []byte) []byte {
+	key := string(addr)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if out, ok := a.cache[key]; ok {
+		return out
+	}
+	if len(a.cache) >= maxAnonymizeCache {
+		a.cache = make(map[string][]byte)
+	}
+	out := a.mapBits(addr)
+	a.cache[key] = out
+	return out
+}
+
+// Hostname replaces every label but the top-level domain with a keyed
+// hash of the label and its parent domain, so hosts in the same domain
+// still share a suffix. Single-label names are replaced entirely.
+func (a *Anonymizer) Hostname(name string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	keep := 1
+	if len(labels) == 1 {
+		keep = 0
+	}
+	for i := len(labels) - 1 - keep; i >= 0; i-- {
+		labels[i] = a.token(strings.Join(labels[i:], "."))
+	}
+	return strings.Join(labels, ".")
+}
+
+// token returns a short keyed hash standing in for a name
+func (a *Anonymizer) token(name string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(name))
+	return "h" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// mapBits applies Crypto-PAn to an address of up to 128 bits: output bit i
+// is input bit i flipped by the first bit of AES(first i input bits, padded
+// with the key's pad)
+func (a *Anonymizer) mapBits(addr []byte) []byte {
+	out := make([]byte, len(addr))
+	var input, enc [aes.BlockSize]byte
+	for i := 0; i < len(addr)*8; i++ {
+		a.prefixBlock(&input, addr, i)
+		a.block.Encrypt(enc[:], input[:])
+		bit := byte(0x80) >> (i % 8)
+		out[i/8] |= addr[i/8] & bit
+		if enc[0]&0x80 != 0 {
+			out[i/8] ^= bit
+		}
+	}
+	return out
+}
+
+// unmap inverts mapBits; each original bit follows from the original prefix
+// recovered so far
+func (a *Anonymizer) unmap(anon []byte) []byte {
+	orig := make([]byte, len(anon))
+	var input, enc [aes.BlockSize]byte
+	for i := 0; i < len(anon)*8; i++ {
+		a.prefixBlock(&input, orig, i)
+		a.block.Encrypt(enc[:], input[:])
+		bit := byte(0x80) >> (i % 8)
+		orig[i/8] |= anon[i/8] & bit
+		if enc[0]&0x80 != 0 {
+			orig[i/8] ^= bit
+		}
+	}
+	return orig
+}
+
+// prefixBlock fills input with the first n bits of addr followed by the pad
+func (a *Anonymizer) prefixBlock(input *[aes.BlockSize]byte, addr []byte, n int) {
+	*input = a.pad
+	copy(input[:n/8], addr[:n/8])
+	if rem := n % 8; rem != 0 {
+		mask := byte(0xff) << (8 - rem)
+		input[n/8] = addr[n/8]&mask | a.pad[n/8]&^mask
+	}
+}
+
+// mac anonymizes a MAC address in place, keeping the group and
+// locally-administered bits so multicast frames stay recognisable. The
+// broadcast address is left as is.
+func (a *Anonymizer) mac(b []byte) {
+	if net.HardwareAddr(b).String() == "ff:ff:ff:ff:ff:ff" {
+		return
+	}
+	flags := b[0] & 0x03
+	copy(b, a.lookup(b))
+	b[0] = b[0]&^0x03 | flags
+}
+
+// rewriteAddr anonymizes a raw 4- or 16-byte address in place
+func (a *Anonymizer) rewriteAddr(b []byte) {
+	copy(b, a.anonymizeRaw(b))
+}
+
+// anonymizeInfo replaces the addresses ProcessPacket reports
+func (a *Anonymizer) anonymizeInfo(info *PacketInfo) {
+	info.SrcIP = a.IP(net.ParseIP(info.SrcIP)).String()
+	info.DstIP = a.IP(net.ParseIP(info.DstIP)).String()
+
+	if src, dst := info.NetFlow.Endpoints(); src.EndpointType() == layers.EndpointIPv4 || src.EndpointType() == layers.EndpointIPv6 {
+		info.NetFlow = gopacket.NewFlow(src.EndpointType(),
+			a.anonymizeRaw(src.Raw()), a.anonymizeRaw(dst.Raw()))
+	}
+
+	if e := info.Encap; e != nil && (e.OuterSrcIP != "" || e.OuterDstIP != "") {
+		encap := *e
+		encap.OuterSrcIP = AnonymizeIP(e.OuterSrcIP)
+		encap.OuterDstIP = AnonymizeIP(e.OuterDstIP)
+		info.Encap = &encap
+	}
+}
+
+// anonymizeRaw returns the pseudonym of a raw 4- or 16-byte address
+func (a *Anonymizer) anonymizeRaw(raw []byte) []byte {
+	out := a.IP(net.IP(raw))
+	if len(raw) == net.IPv6len {
+		return out.To16()
+	}
+	return out
+}
+
+// anonymizeFrame rewrites the MAC and IP addresses of a frame in place and
+// fixes the checksums that cover them. data must hold the bytes packet was
+// decoded from. IP headers quoted in ICMP errors are rewritten too; other
+// payload bytes (DNS answers, HTTP headers) are left to the payload policy.
+func (a *Anonymizer) anonymizeFrame(packet gopacket.Packet, data []byte) {
+	offset := 0
+	var pseudoOld, pseudoNew []byte // Addresses of the enclosing IP header
+	ipEnd := len(data)              // End of the enclosing IP datagram
+
+	for _, layer := range packet.Layers() {
+		size := len(layer.LayerContents())
+		if offset+size > len(data) {
+			return // Truncated or not contiguous; nothing more to rewrite
+		}
+		hdr := data[offset : offset+size]
+
+		switch l := layer.(type) {
+		case *layers.Ethernet:
+			if size >= 12 {
+				a.mac(hdr[0:6])
+				a.mac(hdr[6:12])
+			}
+		case *layers.ARP:
+			if l.HwAddressSize == 6 && l.ProtAddressSize == 4 && size >= 28 {
+				a.mac(hdr[8:14])
+				a.rewriteAddr(hdr[14:18])
+				a.mac(hdr[18:24])
+				a.rewriteAddr(hdr[24:28])
+			}
+		case *layers.IPv4:
+			if size >= 20 {
+				pseudoOld = append([]byte(nil), hdr[12:20]...)
+				a.rewriteAddr(hdr[12:16])
+				a.rewriteAddr(hdr[16:20])
+				pseudoNew = hdr[12:20]
+				binary.BigEndian.PutUint16(hdr[10:12], 0)
+				binary.BigEndian.PutUint16(hdr[10:12], checksum(hdr, 0))
+				ipEnd = min(len(data), offset+int(l.Length))
+			}
+		case *layers.IPv6:
+			if size >= 40 {
+				pseudoOld = append([]byte(nil), hdr[8:40]...)
+				a.rewriteAddr(hdr[8:24])
+				a.rewriteAddr(hdr[24:40])
+				pseudoNew = hdr[8:40]
+				ipEnd = min(len(data), offset+40+int(l.Length))
+			}
+		case *layers.TCP:
+			if size >= 18 && pseudoOld != nil {
+				adjustChecksum(hdr[16:18], pseudoOld, pseudoNew)
+			}
+		case *layers.UDP:
+			// A zero UDP checksum means none was computed
+			if size >= 8 && pseudoOld != nil && binary.BigEndian.Uint16(hdr[6:8]) != 0 {
+				adjustChecksum(hdr[6:8], pseudoOld, pseudoNew)
+				if binary.BigEndian.Uint16(hdr[6:8]) == 0 {
+					binary.BigEndian.PutUint16(hdr[6:8], 0xffff)
+				}
+			}
+		case *layers.ICMPv4:
+			if offset < ipEnd && size >= 4 {
+				msg := data[offset:ipEnd]
+				if icmpv4Error(l.TypeCode.Type()) && len(msg) >= 8+20 {
+					a.rewriteQuoted(msg[8:], 4)
+				}
+				binary.BigEndian.PutUint16(msg[2:4], 0)
+				binary.BigEndian.PutUint16(msg[2:4], checksum(msg, 0))
+			}
+		case *layers.ICMPv6:
+			if offset < ipEnd && size >= 4 && len(pseudoNew) == 32 {
+				msg := data[offset:ipEnd]
+				if l.TypeCode.Type() < 128 && len(msg) >= 8+40 {
+					a.rewriteQuoted(msg[8:], 6)
+				} else {
+					a.rewriteNDP(l.TypeCode.Type(), msg)
+				}
+				binary.BigEndian.PutUint16(msg[2:4], 0)
+				binary.BigEndian.PutUint16(msg[2:4], icmpv6Checksum(pseudoNew, msg))
+			}
+		}
+		offset += size
+	}
+}
+
+// icmpv4Error reports whether an ICMPv4 type quotes the offending IP header
+func icmpv4Error(t uint8) bool {
+	switch t {
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench,
+		layers.ICMPv4TypeRedirect, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// rewriteQuoted anonymizes the addresses of an IP header quoted in an ICMP
+// error. Checksums of the quoted transport header are left alone.
+func (a *Anonymizer) rewriteQuoted(quoted []byte, version int) {
+	if version == 4 {
+		if quoted[0]>>4 != 4 {
+			return
+		}
+		a.rewriteAddr(quoted[12:16])
+		a.rewriteAddr(quoted[16:20])
+		ihl := int(quoted[0]&0x0f) * 4
+		if ihl >= 20 && ihl <= len(quoted) {
+			binary.BigEndian.PutUint16(quoted[10:12], 0)
+			binary.BigEndian.PutUint16(quoted[10:12], checksum(quoted[:ihl], 0))
+		}
+		return
+	}
+	if quoted[0]>>4 == 6 {
+		a.rewriteAddr(quoted[8:24])
+		a.rewriteAddr(quoted[24:40])
+	}
+}
+
+// rewriteNDP anonymizes the target addresses and link-layer address options
+// of neighbor discovery messages
+func (a *Anonymizer) rewriteNDP(t uint8, msg []byte) {
+	var options int
+	switch t {
+	case layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement:
+		if len(msg) < 24 {
+			return
+		}
+		a.rewriteAddr(msg[8:24])
+		options = 24
+	case layers.ICMPv6TypeRedirect:
+		if len(msg) < 40 {
+			return
+		}
+		a.rewriteAddr(msg[8:24])
+		a.rewriteAddr(msg[24:40])
+		options = 40
+	case layers.ICMPv6TypeRouterSolicitation:
+		options = 8
+	case layers.ICMPv6TypeRouterAdvertisement:
+		options = 16
+	default:
+		return
+	}
+
+	// Source (1) and target (2) link-layer address options carry MACs
+	for options+2 <= len(msg) {
+		size := int(msg[options+1]) * 8
+		if size == 0 || options+size > len(msg) {
+			return
+		}
+		if opt := msg[options : options+size]; (opt[0] == 1 || opt[0] == 2) && size == 8 {
+			a.mac(opt[2:8])
+		}
+		options += size
+	}
+}
+
+// checksum computes the Internet checksum of data, starting from a partial sum
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// icmpv6Checksum computes the ICMPv6 checksum, which covers a pseudo-header
+// of the source and destination addresses
+func icmpv6Checksum(addrs, msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(addrs); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(addrs[i:]))
+	}
+	sum += uint32(len(msg)>>16) + uint32(len(msg)&0xffff)
+	sum += uint32(layers.IPProtocolICMPv6)
+	return checksum(msg, sum)
+}
+
+// adjustChecksum updates a checksum for replaced 16-bit words (RFC 1624)
+func adjustChecksum(field, old, new []byte) {
+	sum := uint32(^binary.BigEndian.Uint16(field))
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(field, ^uint16(sum))
+}
@@ -0,0 +1,40 @@
+package capture
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// TestAnonymizerCryptoPAn checks addresses against the sample mappings
+// published with the reference Crypto-PAn implementation
+func TestAnonymizerCryptoPAn(t *testing.T) {
+	key := []byte{
+		21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+		216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+	}
+	a, err := NewAnonymizer(AnonymizeConfig{Key: hex.EncodeToString(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ addr, want string }{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"195.205.63.100", "255.186.223.5"},
+		{"207.25.71.27", "241.33.119.156"},
+		{"208.52.56.122", "227.8.63.165"},
+	}
+	for _, tt := range tests {
+		got := a.IP(net.ParseIP(tt.addr))
+		if got.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.addr, got, tt.want)
+			continue
+		}
+		if orig := net.IP(a.unmap(got.To4())); orig.String() != tt.addr {
+			t.Errorf("%s: unmap(%s) = %s", tt.addr, got, orig)
+		}
+	}
+}
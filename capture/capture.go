@@ -4,188 +4,172 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
-	"os"
-	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
 )
 
 // PacketInfo contains parsed packet information
 type PacketInfo struct {
-	SrcIP    string
-	DstIP    string
-	SrcPort  uint16
-	DstPort  uint16
-	Protocol Protocol
-	Length   int
-	Payload  []byte // Raw packet payload data
+	Timestamp time.Time // Capture time from packet metadata
+	Interface string    // Ingress interface, empty when unknown (e.g. pcap files)
+	SrcIP     string
+	DstIP     string
+	SrcPort   uint16
+	DstPort   uint16
+	Protocol  Protocol
+	// How Protocol was identified: from payload evidence, port rules only, or neither
+	Confidence Confidence
+	Length     int
+	Payload    []byte // Raw packet payload data
+	HeaderLen  int    // Bytes of Payload in front of the application data
+
+	// Transport-layer fields used for stream reconstruction
+	AppPayload []byte        // TCP/UDP payload (application-layer bytes only)
+	NetFlow    gopacket.Flow // Network-layer flow (IPv4/IPv6 endpoints)
+	TCP        *layers.TCP   // Decoded TCP header, nil for non-TCP packets
+
+	Encap     *Encapsulation // VLAN/MPLS/tunnel metadata, nil for plain packets
+	Fragments int            // IP fragments the datagram was reassembled from, 0 if unfragmented
+
+	// Flow export records summarise many packets and carry no payload
+	Packets    int    // Packets the record stands for; 0 for a single captured packet
+	FlowSource string // Export format (NetFlow v5/v9, IPFIX, sFlow), empty for captured packets
 }
 
-// isLocalOrMulticastAddress checks if an IP address is local/link-local/multicast
-// These are filtered out as they clutter the graph with non-routable addresses
-func isLocalOrMulticastAddress(ipStr string) bool {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false
-	}
-
-	// Check IPv4
-	if ip4 := ip.To4(); ip4 != nil {
-		// Link-local: 169.254.x.x
-		if ip4[0] == 169 && ip4[1] == 254 {
-			return true
-		}
-		// Multicast: 224.0.0.0 - 239.255.255.255
-		if ip4[0] >= 224 && ip4[0] <= 239 {
-			return true
-		}
-		// Loopback: 127.x.x.x
-		if ip4[0] == 127 {
-			return true
-		}
-		return false
-	}
-
-	// Check IPv6
-	lowerIP := strings.ToLower(ipStr)
-
-	// Link-local: fe80::/10
-	if strings.HasPrefix(lowerIP, "fe80:") {
-		return true
-	}
-
-	// Multicast: ff00::/8 (includes ff02::, ff01::, etc.)
-	if strings.HasPrefix(lowerIP, "ff") {
-		return true
-	}
-
-	// Loopback: ::1
-	if ip.Equal(net.IPv6loopback) {
-		return true
+// PacketCount returns the number of packets the record stands for
+func (p *PacketInfo) PacketCount() int {
+	if p.Packets > 0 {
+		return p.Packets
 	}
+	return 1
+}
 
-	// Unique local addresses: fc00::/7 (fd00::/8 is commonly used)
-	if strings.HasPrefix(lowerIP, "fc") || strings.HasPrefix(lowerIP, "fd") {
-		return true
-	}
+// FlowDerived reports whether the record came from a flow exporter rather
+// than a captured packet
+func (p *PacketInfo) FlowDerived() bool {
+	return p.FlowSource != ""
+}
 
-	return false
+// CaptureConfig holds configuration for local interface capture
+type CaptureConfig struct {
+	Interface    string   // Network interface to capture from
+	Filter       string   // BPF filter expression (empty captures everything)
+	ExcludeHosts []string // Hosts whose ExcludePort traffic is filtered out
+	ExcludePort  int      // Port to exclude on ExcludeHosts (0 disables exclusion)
+	Rotation     RotationConfig
 }
 
 // Capture manages packet capture from a network interface
 type Capture struct {
-	handle      *pcap.Handle
-	packetChan  chan *PacketInfo
-	pcapWriter  *pcapgo.Writer
-	pcapFile    *os.File
-	pcapDir     string
-	enablePcap  bool
-	paused      bool
-	pauseChan   chan bool
-	resumeChan  chan bool
+	iface      string
+	handle     *pcap.Handle
+	handleMu   sync.Mutex // Guards handle against Stats and SetFilter after close
+	closed     bool
+	filter     string // User filter expression
+	exclude    string // Automatic exclusion clause (our own UI traffic)
+	filterMu   sync.RWMutex
+	packetChan chan *PacketInfo
+	pcapWriter *PcapWriter // nil when pcap saving is disabled
+	paused     bool
+	pauseChan  chan bool
+	resumeChan chan bool
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	defrag     *Defragmenter // Reassembles IP fragments before decoding
+	decoder    *PacketDecoder
+	counters   sourceCounters
 }
 
 // NewCapture creates a new packet capture instance
 func NewCapture(iface string, packetChan chan *PacketInfo) (*Capture, error) {
+	return NewCaptureWithConfig(CaptureConfig{Interface: iface}, packetChan)
+}
+
+// NewCaptureWithConfig creates a new packet capture instance with a BPF filter
+func NewCaptureWithConfig(config CaptureConfig, packetChan chan *PacketInfo) (*Capture, error) {
 	// Open device for capture
-	handle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
+	handle, err := pcap.OpenLive(config.Interface, 1600, true, pcap.BlockForever)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open interface %s: %v", iface, err)
+		return nil, fmt.Errorf("failed to open interface %s: %v", config.Interface, err)
 	}
 
 	c := &Capture{
+		iface:      config.Interface,
 		handle:     handle,
+		exclude:    ExclusionClause(config.ExcludeHosts, config.ExcludePort),
 		packetChan: packetChan,
-		pcapDir:    "pcaps",
-		enablePcap: true, // Enable pcap saving by default
 		paused:     false,
 		pauseChan:  make(chan bool, 1),
 		resumeChan: make(chan bool, 1),
+		closeChan:  make(chan struct{}),
+		defrag:     NewDefragmenter(),
+		decoder:    NewPacketDecoder(),
 	}
 
-	// Create pcaps directory if it doesn't exist
-	if c.enablePcap {
-		if err := os.MkdirAll(c.pcapDir, 0755); err != nil {
-			log.Printf("Warning: Failed to create pcaps directory: %v", err)
-			c.enablePcap = false
-		} else {
-			// Create initial pcap file
-			if err := c.createPcapFile(); err != nil {
-				log.Printf("Warning: Failed to create pcap file: %v", err)
-				c.enablePcap = false
-			}
-		}
-	}
-
-	return c, nil
-}
-
-// createPcapFile creates a new pcap file with timestamp
-func (c *Capture) createPcapFile() error {
-	// Close existing file if open
-	if c.pcapFile != nil {
-		c.pcapFile.Close()
+	// Install the filter before any packets are read; invalid expressions fail here
+	if err := c.SetFilter(config.Filter); err != nil {
+		handle.Close()
+		return nil, err
 	}
 
-	// Generate filename with timestamp
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	filename := filepath.Join(c.pcapDir, fmt.Sprintf("capture_%s.pcap", timestamp))
-
-	// Create file
-	file, err := os.Create(filename)
+	// Save packets to rotating pcap files (enabled by default)
+	writer, err := NewPcapWriter(config.Rotation, interfacePrefix("capture", config.Interface), 1600, handle.LinkType())
 	if err != nil {
-		return fmt.Errorf("failed to create pcap file: %v", err)
-	}
-
-	// Create pcap writer
-	writer := pcapgo.NewWriter(file)
-	if err := writer.WriteFileHeader(1600, c.handle.LinkType()); err != nil {
-		file.Close()
-		return fmt.Errorf("failed to write pcap header: %v", err)
+		log.Printf("Warning: Pcap saving disabled: %v", err)
+	} else {
+		c.pcapWriter = writer
 	}
 
-	c.pcapFile = file
-	c.pcapWriter = writer
-
-	log.Printf("Created pcap file: %s", filename)
-	return nil
+	return c, nil
 }
 
 // Start begins packet capture and runs until context is cancelled
 func (c *Capture) Start(ctx context.Context) {
-	defer c.handle.Close()
+	defer c.closeHandle()
 	defer func() {
-		if c.pcapFile != nil {
-			c.pcapFile.Close()
-			log.Println("Closed pcap file")
+		if c.pcapWriter != nil {
+			c.pcapWriter.Close()
 		}
 	}()
 
 	packetSource := gopacket.NewPacketSource(c.handle, c.handle.LinkType())
 	log.Println("Packet capture started")
-	if c.enablePcap {
-		log.Printf("Saving packets to: %s/", c.pcapDir)
+	if c.pcapWriter != nil {
+		log.Printf("Saving packets to: %s", c.pcapWriter.CurrentFile())
 	}
 
+	packets := packetSource.Packets()
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Packet capture stopped")
 			return
+		case <-c.closeChan:
+			log.Println("Packet capture closed")
+			return
 		case <-c.pauseChan:
 			c.paused = true
 			log.Println("Packet capture paused")
 			// Wait for resume signal
-			<-c.resumeChan
+			select {
+			case <-c.resumeChan:
+			case <-ctx.Done():
+				return
+			case <-c.closeChan:
+				return
+			}
 			c.paused = false
 			log.Println("Packet capture resumed")
-		case packet := <-packetSource.Packets():
+		case packet, ok := <-packets:
+			if !ok {
+				log.Println("Packet source ended")
+				return
+			}
 			if !c.paused {
 				c.processPacket(packet)
 			}
@@ -193,24 +177,58 @@ func (c *Capture) Start(ctx context.Context) {
 	}
 }
 
-// ProcessPacket extracts information from a packet (exported for replay usage)
+// PacketDecoder extracts information from packets. Each decoder keeps its
+// own per-flow classification, so capture workers that see disjoint flows,
+// like the sockets of a fanout group, decode without sharing a lock.
+type PacketDecoder struct {
+	classifier *flowClassifier
+	clock      Clock // Dates packets without a timestamp; nil follows CurrentClock
+}
+
+// NewPacketDecoder creates a decoder with an empty classification cache
+func NewPacketDecoder() *PacketDecoder {
+	return NewPacketDecoderWithClock(nil)
+}
+
+// NewPacketDecoderWithClock creates a decoder that dates packets without a
+// capture timestamp from clock
+func NewPacketDecoderWithClock(clock Clock) *PacketDecoder {
+	return &PacketDecoder{classifier: newFlowClassifier(), clock: clock}
+}
+
+// now returns the decoder's current time
+func (pd *PacketDecoder) now() time.Time {
+	if pd.clock != nil {
+		return pd.clock.Now()
+	}
+	return CurrentClock().Now()
+}
+
+// defaultDecoder serves ProcessPacket
+var defaultDecoder = NewPacketDecoder()
+
+// ProcessPacket extracts information from a packet with a decoder shared
+// by the whole process (exported for replay usage)
 func ProcessPacket(packet gopacket.Packet) *PacketInfo {
+	return defaultDecoder.ProcessPacket(packet)
+}
+
+// ProcessPacket extracts information from a packet
+func (pd *PacketDecoder) ProcessPacket(packet gopacket.Packet) *PacketInfo {
+	// Pick the outer or inner IP layer and record any encapsulation
+	mode := CurrentTunnelMode()
+	d := dissect(packet, mode)
+
 	// Extract IP addresses
 	var srcIP, dstIP string
+	var netFlow gopacket.Flow
 
-	// Try IPv4 first
-	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-		ip, _ := ipLayer.(*layers.IPv4)
-		srcIP = ip.SrcIP.String()
-		dstIP = ip.DstIP.String()
-	} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
-		// Try IPv6
-		ip, _ := ipLayer.(*layers.IPv6)
-		srcIP = ip.SrcIP.String()
-		dstIP = ip.DstIP.String()
-	} else if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+	if d.network != nil {
+		netFlow = d.network.NetworkFlow()
+		srcIP = netFlow.Src().String()
+		dstIP = netFlow.Dst().String()
+	} else if arp := d.arp; arp != nil {
 		// Handle ARP packets
-		arp, _ := arpLayer.(*layers.ARP)
 		srcIP = fmt.Sprintf("%d.%d.%d.%d", arp.SourceProtAddress[0], arp.SourceProtAddress[1],
 			arp.SourceProtAddress[2], arp.SourceProtAddress[3])
 		dstIP = fmt.Sprintf("%d.%d.%d.%d", arp.DstProtAddress[0], arp.DstProtAddress[1],
@@ -220,44 +238,87 @@ func ProcessPacket(packet gopacket.Packet) *PacketInfo {
 		return nil
 	}
 
-	// Skip local/multicast addresses (clutters the graph)
-	if isLocalOrMulticastAddress(srcIP) || isLocalOrMulticastAddress(dstIP) {
+	// Skip addresses hidden by the address policy (local/multicast by default)
+	if !AddressAllowed(srcIP) || !AddressAllowed(dstIP) {
 		return nil
 	}
 
-	// Extract port information from transport layer
+	// Extract port information from the transport layer of the chosen IP layer
 	var srcPort, dstPort uint16
-	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-		tcp, _ := tcpLayer.(*layers.TCP)
+	var tcp *layers.TCP
+	var appPayload []byte
+	var protocol Protocol
+	switch transport := d.transport.(type) {
+	case *layers.TCP:
+		tcp = transport
 		srcPort = uint16(tcp.SrcPort)
 		dstPort = uint16(tcp.DstPort)
-	} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-		udp, _ := udpLayer.(*layers.UDP)
-		srcPort = uint16(udp.SrcPort)
-		dstPort = uint16(udp.DstPort)
+		appPayload = tcp.Payload
+		protocol = detectTCPProtocol(tcp)
+	case *layers.UDP:
+		srcPort = uint16(transport.SrcPort)
+		dstPort = uint16(transport.DstPort)
+		appPayload = transport.Payload
+		protocol = detectUDPProtocol(transport)
+	default:
+		// Note: ICMP and ARP don't have ports, so srcPort and dstPort will be 0
+		if mode == TunnelModeOuter && d.encap != nil && d.encap.Tunnel != "" {
+			protocol = LookupProtocol(ProtocolNameTunnel)
+		} else {
+			protocol = DetectProtocol(packet)
+		}
 	}
-	// Note: ICMP and ARP don't have ports, so srcPort and dstPort will be 0
-
-	// Detect protocol
-	protocol := DetectProtocol(packet)
 
 	// Get packet length and payload
 	payload := packet.Data()
 	length := len(payload)
 
+	// Use the capture timestamp when available, falling back to the clock
+	timestamp := packet.Metadata().Timestamp
+	if timestamp.IsZero() {
+		timestamp = pd.now()
+	}
+
+	// Confirm or correct the port-based guess from the flow's payloads
+	var confidence Confidence
+	if _, ok := d.transport.(*layers.UDP); ok || tcp != nil {
+		protocol, confidence = pd.classifier.classifyTransport(netFlow, tcp, srcPort, dstPort, appPayload, protocol, timestamp)
+	}
+
 	// Copy payload to avoid data race (packet data may be reused)
 	payloadCopy := make([]byte, length)
 	copy(payloadCopy, payload)
 
-	return &PacketInfo{
-		SrcIP:    srcIP,
-		DstIP:    dstIP,
-		SrcPort:  srcPort,
-		DstPort:  dstPort,
-		Protocol: protocol,
-		Length:   length,
-		Payload:  payloadCopy,
+	// Application bytes are copied separately so stream buffers never alias the frame
+	var appPayloadCopy []byte
+	if len(appPayload) > 0 {
+		appPayloadCopy = make([]byte, len(appPayload))
+		copy(appPayloadCopy, appPayload)
 	}
+
+	info := &PacketInfo{
+		Timestamp:  timestamp,
+		SrcIP:      srcIP,
+		DstIP:      dstIP,
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+		Protocol:   protocol,
+		Confidence: confidence,
+		Length:     length,
+		Payload:    payloadCopy,
+		HeaderLen:  headerLength(packet),
+		AppPayload: appPayloadCopy,
+		NetFlow:    netFlow,
+		TCP:        tcp,
+		Encap:      d.encap,
+	}
+
+	// Pseudonymize addresses after the address policy has seen the real ones
+	if a := CurrentAnonymizer(); a != nil {
+		a.anonymizeInfo(info)
+		a.anonymizeFrame(packet, payloadCopy)
+	}
+	return info
 }
 
 // Pause pauses packet capture
@@ -278,26 +339,122 @@ func (c *Capture) Resume() {
 	}
 }
 
+// CurrentPcapFile returns the pcap file currently being written
+func (c *Capture) CurrentPcapFile() string {
+	if c.pcapWriter == nil {
+		return ""
+	}
+	return c.pcapWriter.CurrentFile()
+}
+
+// Filter returns the user-supplied BPF filter expression
+func (c *Capture) Filter() string {
+	c.filterMu.RLock()
+	defer c.filterMu.RUnlock()
+	return c.filter
+}
+
+// EffectiveFilter returns the BPF expression installed on the handle
+func (c *Capture) EffectiveFilter() string {
+	c.filterMu.RLock()
+	defer c.filterMu.RUnlock()
+	return combineFilters(c.filter, c.exclude)
+}
+
+// SetFilter compiles and installs a new BPF filter on the running handle.
+// The previous filter stays active if the expression is invalid.
+func (c *Capture) SetFilter(expr string) error {
+	c.filterMu.Lock()
+	defer c.filterMu.Unlock()
+
+	expr = strings.TrimSpace(expr)
+	effective := combineFilters(expr, c.exclude)
+	if effective == "" && c.filter == "" {
+		// Nothing to install or clear
+		return nil
+	}
+
+	c.handleMu.Lock()
+	defer c.handleMu.Unlock()
+	if c.closed {
+		return fmt.Errorf("capture on %s is closed", c.iface)
+	}
+
+	// An empty expression matches everything, which clears the filter
+	if err := c.handle.SetBPFFilter(effective); err != nil {
+		return fmt.Errorf("invalid BPF filter %q: %v", expr, err)
+	}
+
+	c.filter = expr
+	if effective != "" {
+		log.Printf("Capture filter set: %s", effective)
+	} else {
+		log.Println("Capture filter cleared")
+	}
+	return nil
+}
+
+// Stats returns the capture's packet counters, including the kernel and
+// interface drop counts reported by libpcap
+func (c *Capture) Stats() SourceStats {
+	c.handleMu.Lock()
+	if !c.closed {
+		if ps, err := c.handle.Stats(); err == nil {
+			c.counters.kernelDropped.Store(uint64(ps.PacketsDropped))
+			c.counters.interfaceDropped.Store(uint64(ps.PacketsIfDropped))
+		}
+	}
+	c.handleMu.Unlock()
+
+	stats := c.counters.stats("interface " + c.iface)
+	c.defrag.addStats(&stats)
+	return stats
+}
+
+// closeHandle releases the pcap handle; the last drop counts are kept
+func (c *Capture) closeHandle() {
+	c.Stats()
+
+	c.handleMu.Lock()
+	defer c.handleMu.Unlock()
+	c.closed = true
+	c.handle.Close()
+}
+
+// Close stops packet capture; the handle is released when Start returns
+func (c *Capture) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+	return nil
+}
+
 // processPacket extracts information from a packet and sends it to the channel
 func (c *Capture) processPacket(packet gopacket.Packet) {
+	c.counters.received.Add(1)
+
 	// Write packet to pcap file if enabled
-	if c.enablePcap && c.pcapWriter != nil {
-		metadata := packet.Metadata()
-		if err := c.pcapWriter.WritePacket(metadata.CaptureInfo, packet.Data()); err != nil {
+	if c.pcapWriter != nil {
+		if err := writePcap(c.pcapWriter, packet); err != nil {
 			log.Printf("Warning: Failed to write packet to pcap: %v", err)
 		}
 	}
 
+	// Hold fragments back until their datagram is complete
+	packet, fragments := c.defrag.Defrag(packet)
+	if packet == nil {
+		return
+	}
+
 	// Process packet using shared function
-	packetInfo := ProcessPacket(packet)
+	packetInfo := c.decoder.ProcessPacket(packet)
 	if packetInfo == nil {
+		c.counters.filtered.Add(1)
 		return
 	}
+	packetInfo.Interface = c.iface
+	packetInfo.Fragments = fragments
 
 	// Send packet info to channel (non-blocking)
-	select {
-	case c.packetChan <- packetInfo:
-	default:
-		// Channel is full, drop packet to avoid blocking
-	}
+	c.counters.deliver(c.packetChan, packetInfo)
 }
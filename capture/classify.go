@@ -0,0 +1,161 @@
+package capture
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Confidence says how a packet's protocol was identified
+type Confidence string
+
+const (
+	ConfidenceNone Confidence = ""     // Transport or link-level protocol; nothing more was claimed
+	ConfidenceLow  Confidence = "low"  // Port rule only
+	ConfidenceHigh Confidence = "high" // Payload inspected: a signature matched, or ruled out the port's protocol
+)
+
+// Limits for per-flow classification
+const (
+	maxInspectedPayloads = 4                // Payload-carrying packets looked at before a flow is settled
+	maxClassifiedFlows   = 65536            // Flows cached at once; the cache is cleared when full
+	classifyFlowTimeout  = 5 * time.Minute  // Idle flows are forgotten after this long
+	classifySweepPeriod  = 30 * time.Second // How often idle flows are looked for
+)
+
+// flowKey identifies a transport flow in both directions
+type flowKey struct {
+	a, b         gopacket.Endpoint
+	aPort, bPort uint16
+	tcp          bool
+}
+
+// newFlowKey orders the endpoints so both directions share a key
+func newFlowKey(netFlow gopacket.Flow, srcPort, dstPort uint16, tcp bool) flowKey {
+	src, dst := netFlow.Endpoints()
+	if dst.LessThan(src) || (src == dst && dstPort < srcPort) {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	return flowKey{a: src, b: dst, aPort: srcPort, bPort: dstPort, tcp: tcp}
+}
+
+// flowClass is the classification state of one flow
+type flowClass struct {
+	name       string // Registry name once decided
+	confidence Confidence
+	decided    bool
+	inspected  int  // Payload-carrying packets looked at
+	sawStart   bool // TCP SYN seen, so the first payloads are the protocol's opening bytes
+	lastSeen   time.Time
+}
+
+// flowClassifier caches payload classification per flow so each flow's
+// payloads are inspected only until it is decided. It is safe for
+// concurrent use, but each PacketDecoder has its own so that workers seeing
+// disjoint flows don't contend for it.
+type flowClassifier struct {
+	mu        sync.Mutex
+	flows     map[flowKey]*flowClass
+	lastSweep time.Time
+}
+
+// newFlowClassifier creates an empty classification cache
+func newFlowClassifier() *flowClassifier {
+	return &flowClassifier{flows: make(map[flowKey]*flowClass)}
+}
+
+// classifyTransport refines a port-based protocol with payload evidence
+// for the flow the packet belongs to
+func (c *flowClassifier) classifyTransport(netFlow gopacket.Flow, tcp *layers.TCP, srcPort, dstPort uint16, payload []byte, byPort Protocol, now time.Time) (Protocol, Confidence) {
+	key := newFlowKey(netFlow, srcPort, dstPort, tcp != nil)
+	name, confidence := c.classify(key, tcp, payload, byPort.Name, now)
+	if name == byPort.Name {
+		return byPort, confidence
+	}
+	return LookupProtocol(name), confidence
+}
+
+// classify returns the protocol name and confidence for a packet
+func (c *flowClassifier) classify(key flowKey, tcp *layers.TCP, payload []byte, portName string, now time.Time) (string, Confidence) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+
+	flow, ok := c.flows[key]
+	if !ok {
+		if len(c.flows) >= maxClassifiedFlows {
+			c.flows = make(map[flowKey]*flowClass)
+		}
+		flow = &flowClass{}
+		c.flows[key] = flow
+	}
+	if tcp != nil && tcp.SYN && !tcp.ACK {
+		// A new connection, possibly reusing the ports of a closed one
+		*flow = flowClass{sawStart: true}
+	}
+	flow.lastSeen = now
+
+	if !flow.decided && len(payload) > 0 {
+		flow.inspected++
+		flow.decide(payload, key.tcp, portName)
+	}
+	if flow.decided {
+		return flow.name, flow.confidence
+	}
+
+	// Undecided: the port rules are all there is
+	if IsApplicationProtocol(portName) {
+		return portName, ConfidenceLow
+	}
+	return portName, ConfidenceNone
+}
+
+// decide settles the flow if the payload matches a signature or enough
+// payloads have been seen to rule out the port's protocol
+func (f *flowClass) decide(payload []byte, tcp bool, portName string) {
+	expected := expectedSignature(portName)
+	if sig, ok := matchSignature(payload, tcp, portName); ok {
+		f.decided, f.confidence = true, ConfidenceHigh
+		f.name = sig
+		if sig == expected || (expected == "" && carrierSignatures[sig] && IsApplicationProtocol(portName)) {
+			// Consistent with the port, which may name something more specific
+			f.name = portName
+		}
+		return
+	}
+	if f.inspected < maxInspectedPayloads {
+		return
+	}
+
+	f.decided = true
+	f.name, f.confidence = portName, ConfidenceLow
+	if !IsApplicationProtocol(portName) {
+		f.confidence = ConfidenceNone
+	}
+	// Without the opening bytes of a TCP connection a missing signature
+	// proves nothing; datagrams stand on their own
+	if expected != "" && (!tcp || f.sawStart) {
+		f.name, f.confidence = ProtocolNameUDP, ConfidenceHigh
+		if tcp {
+			f.name = ProtocolNameTCP
+		}
+	}
+}
+
+// sweep forgets idle flows. Called with mu held.
+func (c *flowClassifier) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < classifySweepPeriod {
+		return
+	}
+	c.lastSweep = now
+
+	cutoff := now.Add(-classifyFlowTimeout)
+	for key, flow := range c.flows {
+		if flow.lastSeen.Before(cutoff) {
+			delete(c.flows, key)
+		}
+	}
+}
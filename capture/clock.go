@@ -0,0 +1,83 @@
+package capture
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock supplies the current time for graph and stream bookkeeping
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock reports wall-clock time
+type SystemClock struct{}
+
+// Now returns the current wall-clock time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// PacketClock follows capture timestamps instead of the local wall clock.
+// Between packets it advances at wall-clock speed from the newest timestamp
+// observed, so decay still works in live mode while remaining correct for
+// replayed captures and remote sensors whose clocks differ from ours.
+type PacketClock struct {
+	latest     time.Time // Newest capture timestamp observed
+	observedAt time.Time // Wall-clock time when latest was observed
+	mu         sync.RWMutex
+}
+
+// NewPacketClock creates a clock driven by packet timestamps
+func NewPacketClock() *PacketClock {
+	return &PacketClock{}
+}
+
+// Observe advances the clock to a packet's capture timestamp
+func (c *PacketClock) Observe(ts time.Time) {
+	if ts.IsZero() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ts.After(c.latest) {
+		c.latest = ts
+		c.observedAt = time.Now()
+	}
+}
+
+// Now returns the current time in capture time
+func (c *PacketClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.latest.IsZero() {
+		return time.Now()
+	}
+	return c.latest.Add(time.Since(c.observedAt))
+}
+
+var (
+	clockMu      sync.RWMutex
+	processClock Clock = SystemClock{}
+)
+
+// SetClock sets the clock that dates packets without a capture timestamp.
+// It should be called before capture starts.
+func SetClock(c Clock) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	if c == nil {
+		c = SystemClock{}
+	}
+	processClock = c
+}
+
+// CurrentClock returns the clock set with SetClock, or the system clock
+func CurrentClock() Clock {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return processClock
+}
@@ -0,0 +1,411 @@
+package capture
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// Defaults for IP fragment reassembly
+const (
+	DefaultDefragTimeout      = 30 * time.Second // Incomplete datagrams older than this are dropped
+	DefaultDefragMaxDatagrams = 1024             // Datagrams reassembled at once (at most 64 KiB each)
+	DefaultDefragMaxBytes     = 16 << 20         // IPv6 fragment bytes buffered across all datagrams
+)
+
+// defragSweepInterval is how often expired datagrams are looked for
+const defragSweepInterval = 5 * time.Second
+
+// DefragConfig holds limits for IP fragment reassembly
+type DefragConfig struct {
+	Timeout      time.Duration // Discard incomplete datagrams after this long
+	MaxDatagrams int           // Pending datagrams kept per family; the oldest is evicted beyond this
+	MaxBytes     int           // IPv6 fragment bytes buffered in total; the oldest datagrams are evicted beyond this
+	Clock        Clock         // Dates fragments without a timestamp; nil follows CurrentClock
+}
+
+// Defragmenter reassembles fragmented IPv4 and IPv6 datagrams so protocol
+// detection and stream tracking see the complete transport payload. Only the
+// outermost IP layer is reassembled. Time is taken from packet timestamps, so
+// pcap files expire fragments the same way live captures do. It is safe for
+// concurrent use by several capture workers.
+type Defragmenter struct {
+	config DefragConfig
+
+	mu        sync.Mutex
+	ip4       *ip4defrag.IPv4Defragmenter
+	ip4Seen   map[ip4Key]*ip4Pending // Pending IPv4 datagrams, mirrored to enforce MaxDatagrams
+	ip6       map[ip6Key]*ip6Datagram
+	ip6Bytes  int // Fragment bytes buffered in ip6
+	lastSweep time.Time
+
+	fragments   atomic.Uint64
+	reassembled atomic.Uint64
+	discarded   atomic.Uint64
+}
+
+type ip4Key struct {
+	flow gopacket.Flow
+	id   uint16
+}
+
+// ip4Pending tracks an IPv4 datagram held by ip4defrag
+type ip4Pending struct {
+	count    int // Fragments received so far
+	lastSeen time.Time
+}
+
+type ip6Key struct {
+	flow gopacket.Flow
+	id   uint32
+}
+
+// ip6Datagram collects the fragments of one IPv6 datagram. Fragments never
+// overlap, so their bytes add up to at most 64 KiB.
+type ip6Datagram struct {
+	fragments  []ip6Fragment // Ordered by offset
+	total      int           // Payload length, known once the last fragment arrives (-1 before)
+	bytes      int           // Payload bytes buffered
+	nextHeader layers.IPProtocol
+	lastSeen   time.Time
+}
+
+type ip6Fragment struct {
+	offset int
+	data   []byte
+}
+
+// NewDefragmenter creates a defragmenter with the default limits
+func NewDefragmenter() *Defragmenter {
+	return NewDefragmenterWithConfig(DefragConfig{})
+}
+
+// NewDefragmenterWithConfig creates a defragmenter with custom limits
+func NewDefragmenterWithConfig(config DefragConfig) *Defragmenter {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultDefragTimeout
+	}
+	if config.MaxDatagrams <= 0 {
+		config.MaxDatagrams = DefaultDefragMaxDatagrams
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultDefragMaxBytes
+	}
+	return &Defragmenter{
+		config:  config,
+		ip4:     ip4defrag.NewIPv4Defragmenter(),
+		ip4Seen: make(map[ip4Key]*ip4Pending),
+		ip6:     make(map[ip6Key]*ip6Datagram),
+	}
+}
+
+// now returns the defragmenter's current time
+func (d *Defragmenter) now() time.Time {
+	if d.config.Clock != nil {
+		return d.config.Clock.Now()
+	}
+	return CurrentClock().Now()
+}
+
+// Defrag returns the packet to process. Unfragmented packets are returned
+// unchanged with a fragment count of 0. A fragment that completes a datagram
+// yields a rebuilt packet carrying the whole datagram and the number of
+// fragments it was made of; other fragments are held back and yield nil.
+func (d *Defragmenter) Defrag(packet gopacket.Packet) (gopacket.Packet, int) {
+	timestamp := packet.Metadata().Timestamp
+	if timestamp.IsZero() {
+		timestamp = d.now()
+	}
+
+	for i, layer := range packet.Layers() {
+		switch ip := layer.(type) {
+		case *layers.IPv4:
+			if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+				return packet, 0
+			}
+			d.fragments.Add(1)
+			return d.defragIPv4(packet, i, ip, timestamp)
+		case *layers.IPv6:
+			frag, ok := ipv6FragmentHeader(packet.Layers()[i+1:])
+			if !ok {
+				return packet, 0
+			}
+			d.fragments.Add(1)
+			return d.defragIPv6(packet, i, ip, frag, timestamp)
+		}
+	}
+	return packet, 0
+}
+
+// defragIPv4 feeds a fragment to ip4defrag
+func (d *Defragmenter) defragIPv4(packet gopacket.Packet, index int, ip *layers.IPv4, timestamp time.Time) (gopacket.Packet, int) {
+	d.mu.Lock()
+	d.sweep(timestamp)
+
+	key := ip4Key{flow: ip.NetworkFlow(), id: ip.Id}
+	pending, ok := d.ip4Seen[key]
+	if !ok {
+		if len(d.ip4Seen) >= d.config.MaxDatagrams {
+			d.evictOldestIPv4()
+		}
+		pending = &ip4Pending{}
+	}
+	pending.count++
+	pending.lastSeen = timestamp
+
+	out, err := d.ip4.DefragIPv4WithTimestamp(ip, timestamp)
+	if err != nil || out != nil {
+		delete(d.ip4Seen, key)
+	} else {
+		d.ip4Seen[key] = pending
+	}
+	d.mu.Unlock()
+
+	if err != nil {
+		// Invalid or overlapping fragments; ip4defrag has dropped the datagram
+		d.discarded.Add(1)
+		return nil, 0
+	}
+	if out == nil {
+		return nil, 0
+	}
+
+	// ip4defrag does not recompute the length of the reassembled header
+	out.Length = 0
+	rebuilt := rebuildPacket(packet, index, out)
+	if rebuilt == nil {
+		d.discarded.Add(1)
+		return nil, 0
+	}
+	d.reassembled.Add(1)
+	return rebuilt, pending.count
+}
+
+// evictOldestIPv4 drops the least recently updated IPv4 datagram
+func (d *Defragmenter) evictOldestIPv4() {
+	var oldest time.Time
+	for _, pending := range d.ip4Seen {
+		if oldest.IsZero() || pending.lastSeen.Before(oldest) {
+			oldest = pending.lastSeen
+		}
+	}
+	// ip4defrag can only discard by age, so datagrams last updated at the
+	// same instant go together
+	d.discarded.Add(uint64(d.ip4.DiscardOlderThan(oldest.Add(time.Nanosecond))))
+	for key, pending := range d.ip4Seen {
+		if !pending.lastSeen.After(oldest) {
+			delete(d.ip4Seen, key)
+		}
+	}
+}
+
+// ipv6FragmentHeader returns the fragment header among the extension
+// headers that follow an IPv6 header. A fragment header after any other
+// layer, e.g. in a tunnelled packet, belongs to another IPv6 header.
+func ipv6FragmentHeader(next []gopacket.Layer) (*layers.IPv6Fragment, bool) {
+	for _, layer := range next {
+		switch l := layer.(type) {
+		case *layers.IPv6Fragment:
+			return l, true
+		case *layers.IPv6HopByHop, *layers.IPv6Destination, *layers.IPv6Routing:
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// defragIPv6 collects a fragment and rebuilds the datagram once it is complete
+func (d *Defragmenter) defragIPv6(packet gopacket.Packet, index int, ip *layers.IPv6, frag *layers.IPv6Fragment, timestamp time.Time) (gopacket.Packet, int) {
+	d.mu.Lock()
+	d.sweep(timestamp)
+
+	key := ip6Key{flow: ip.NetworkFlow(), id: frag.Identification}
+	dg, pending := d.ip6[key]
+	if !pending {
+		if len(d.ip6) >= d.config.MaxDatagrams {
+			d.evictOldestIPv6()
+		}
+		dg = &ip6Datagram{total: -1}
+		d.ip6[key] = dg
+	}
+	dg.lastSeen = timestamp
+
+	offset := int(frag.FragmentOffset) * 8
+	if !dg.insert(offset, frag.Payload, frag.MoreFragments) {
+		// Oversized, malformed, overlapping or repeated fragment: RFC 5722
+		// has the whole datagram dropped
+		d.dropIPv6(key)
+		d.mu.Unlock()
+		return nil, 0
+	}
+	d.ip6Bytes += len(frag.Payload)
+	if offset == 0 {
+		dg.nextHeader = frag.NextHeader
+	}
+
+	if dg.total < 0 || dg.bytes != dg.total {
+		for d.ip6Bytes > d.config.MaxBytes {
+			d.evictOldestIPv6()
+		}
+		d.mu.Unlock()
+		return nil, 0
+	}
+	delete(d.ip6, key)
+	d.ip6Bytes -= dg.bytes
+	d.mu.Unlock()
+
+	// Fragments don't overlap and cover the payload, so they join end to end
+	payload := make([]byte, 0, dg.total)
+	for _, f := range dg.fragments {
+		payload = append(payload, f.data...)
+	}
+	out := &layers.IPv6{
+		Version:      ip.Version,
+		TrafficClass: ip.TrafficClass,
+		FlowLabel:    ip.FlowLabel,
+		NextHeader:   dg.nextHeader,
+		HopLimit:     ip.HopLimit,
+		SrcIP:        ip.SrcIP,
+		DstIP:        ip.DstIP,
+	}
+	out.Payload = payload
+	rebuilt := rebuildPacket(packet, index, out)
+	if rebuilt == nil {
+		d.discarded.Add(1)
+		return nil, 0
+	}
+	d.reassembled.Add(1)
+	return rebuilt, len(dg.fragments)
+}
+
+// insert adds a fragment in offset order. It reports false for fragments the
+// datagram must be dropped for: empty, past 64 KiB, not a multiple of eight
+// bytes before the last, beyond or redefining the end, or overlapping
+// another fragment, which includes repeats.
+func (dg *ip6Datagram) insert(offset int, payload []byte, more bool) bool {
+	end := offset + len(payload)
+	if len(payload) == 0 || end > 65535 || (more && len(payload)%8 != 0) {
+		return false
+	}
+	if !more {
+		if (dg.total >= 0 && dg.total != end) || (len(dg.fragments) > 0 && dg.fragments[len(dg.fragments)-1].end() > end) {
+			return false
+		}
+		dg.total = end
+	} else if dg.total >= 0 && end >= dg.total {
+		return false
+	}
+
+	i := sort.Search(len(dg.fragments), func(i int) bool { return dg.fragments[i].offset >= offset })
+	if i > 0 && dg.fragments[i-1].end() > offset {
+		return false
+	}
+	if i < len(dg.fragments) && end > dg.fragments[i].offset {
+		return false
+	}
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	dg.fragments = slices.Insert(dg.fragments, i, ip6Fragment{offset: offset, data: data})
+	dg.bytes += len(data)
+	return true
+}
+
+// end returns the offset just past a fragment
+func (f ip6Fragment) end() int {
+	return f.offset + len(f.data)
+}
+
+// evictOldestIPv6 drops the least recently updated IPv6 datagram
+func (d *Defragmenter) evictOldestIPv6() {
+	var oldestKey ip6Key
+	var oldest *ip6Datagram
+	for key, dg := range d.ip6 {
+		if oldest == nil || dg.lastSeen.Before(oldest.lastSeen) {
+			oldestKey, oldest = key, dg
+		}
+	}
+	if oldest != nil {
+		d.dropIPv6(oldestKey)
+	}
+}
+
+// dropIPv6 discards a pending IPv6 datagram. Called with mu held.
+func (d *Defragmenter) dropIPv6(key ip6Key) {
+	if dg, ok := d.ip6[key]; ok {
+		d.ip6Bytes -= dg.bytes
+		delete(d.ip6, key)
+		d.discarded.Add(1)
+	}
+}
+
+// sweep drops incomplete datagrams that timed out. Called with mu held.
+func (d *Defragmenter) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < defragSweepInterval {
+		return
+	}
+	d.lastSweep = now
+
+	cutoff := now.Add(-d.config.Timeout)
+	d.discarded.Add(uint64(d.ip4.DiscardOlderThan(cutoff)))
+	for key, pending := range d.ip4Seen {
+		if pending.lastSeen.Before(cutoff) {
+			delete(d.ip4Seen, key)
+		}
+	}
+	for key, dg := range d.ip6 {
+		if dg.lastSeen.Before(cutoff) {
+			d.dropIPv6(key)
+		}
+	}
+}
+
+// addStats adds the fragment counters to a source's stats
+func (d *Defragmenter) addStats(stats *SourceStats) {
+	stats.Fragments += d.fragments.Load()
+	stats.Reassembled += d.reassembled.Load()
+	stats.FragmentsDiscarded += d.discarded.Load()
+}
+
+// rebuildPacket replaces the IP layer at index and everything after it with
+// the reassembled datagram and decodes the result from the link layer, so the
+// new packet looks as if it had been captured unfragmented. IPv6 extension
+// headers that preceded the fragment header are not carried over.
+func rebuildPacket(packet gopacket.Packet, index int, ip gopacket.SerializableLayer) gopacket.Packet {
+	all := packet.Layers()
+	var prefix []byte
+	for _, layer := range all[:index] {
+		prefix = append(prefix, layer.LayerContents()...)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	var payload []byte
+	switch l := ip.(type) {
+	case *layers.IPv4:
+		payload = l.Payload
+	case *layers.IPv6:
+		payload = l.Payload
+	}
+	if err := gopacket.SerializeLayers(buf, opts, ip, gopacket.Payload(payload)); err != nil {
+		return nil
+	}
+
+	data := append(prefix, buf.Bytes()...)
+	first := all[0].LayerType()
+	if index == 0 {
+		first = ip.LayerType()
+	}
+	rebuilt := gopacket.NewPacket(data, first, gopacket.Default)
+	metadata := rebuilt.Metadata()
+	metadata.CaptureInfo = packet.Metadata().CaptureInfo
+	metadata.Length = len(data)
+	metadata.CaptureLength = len(data)
+	return rebuilt
+}
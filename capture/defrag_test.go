@@ -0,0 +1,207 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var defragTestStart = time.Unix(1700000000, 0)
+
+// ipv6Fragment serializes an IPv6 header, a fragment header and data.
+// gopacket can't serialize fragment headers, so it is written by hand.
+func ipv6Fragment(t *testing.T, id uint32, offset int, more bool, data []byte) []byte {
+	t.Helper()
+	ip := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolIPv6Fragment,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	header := make([]byte, 8)
+	header[0] = byte(layers.IPProtocolUDP)
+	field := uint16(offset/8) << 3
+	if more {
+		field |= 1
+	}
+	binary.BigEndian.PutUint16(header[2:], field)
+	binary.BigEndian.PutUint32(header[4:], id)
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(append(header, data...))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fragmentPacket decodes a fragment from the IPv6 layer on
+func fragmentPacket(t *testing.T, ts time.Time, id uint32, offset int, more bool, data []byte) gopacket.Packet {
+	t.Helper()
+	packet := gopacket.NewPacket(ipv6Fragment(t, id, offset, more, data), layers.LayerTypeIPv6, gopacket.Default)
+	packet.Metadata().Timestamp = ts
+	return packet
+}
+
+// udpDatagram returns a UDP header and payload of the given total size
+func udpDatagram(size int) []byte {
+	b := make([]byte, size)
+	binary.BigEndian.PutUint16(b[0:], 40000)
+	binary.BigEndian.PutUint16(b[2:], 53)
+	binary.BigEndian.PutUint16(b[4:], uint16(size))
+	for i := 8; i < size; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestDefragIPv6(t *testing.T) {
+	udp := udpDatagram(32)
+	type frag struct {
+		offset int
+		more   bool
+		data   []byte
+	}
+	tests := []struct {
+		name      string
+		frags     []frag
+		complete  bool
+		discarded uint64
+	}{
+		{"in order", []frag{{0, true, udp[:16]}, {16, false, udp[16:]}}, true, 0},
+		{"out of order", []frag{{16, false, udp[16:]}, {8, true, udp[8:16]}, {0, true, udp[:8]}}, true, 0},
+		{"repeated", []frag{{0, true, udp[:16]}, {0, true, udp[:16]}, {16, false, udp[16:]}}, false, 1},
+		{"overlapping", []frag{{0, true, udp[:16]}, {8, false, udp[8:]}}, false, 1},
+		{"conflicting ends", []frag{{16, false, udp[16:]}, {0, false, udp[:24]}}, false, 1},
+		{"past the end", []frag{{16, false, udp[16:]}, {24, true, udp[16:24]}}, false, 1},
+		{"unaligned", []frag{{0, true, udp[:12]}, {12, false, udp[12:]}}, false, 1},
+		{"past 64 KiB", []frag{{65528, false, udp[:16]}}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDefragmenter()
+			var out gopacket.Packet
+			var count int
+			for _, f := range tt.frags {
+				out, count = d.Defrag(fragmentPacket(t, defragTestStart, 1, f.offset, f.more, f.data))
+			}
+			if tt.complete {
+				if out == nil {
+					t.Fatal("datagram was not reassembled")
+				}
+				u, ok := out.Layer(layers.LayerTypeUDP).(*layers.UDP)
+				if !ok || count != len(tt.frags) || string(append(u.Contents, u.Payload...)) != string(udp) {
+					t.Errorf("got %d fragments and %v, want %d and the whole datagram", count, out.Layers(), len(tt.frags))
+				}
+			} else if out != nil {
+				t.Errorf("got a packet from an invalid datagram: %v", out)
+			}
+			if got := d.discarded.Load(); got != tt.discarded {
+				t.Errorf("got %d discarded, want %d", got, tt.discarded)
+			}
+			if tt.complete && d.ip6Bytes != 0 {
+				t.Errorf("%d bytes still buffered", d.ip6Bytes)
+			}
+		})
+	}
+}
+
+func TestDefragIPv6Timeout(t *testing.T) {
+	d := NewDefragmenterWithConfig(DefragConfig{Timeout: 10 * time.Second})
+	udp := udpDatagram(32)
+	d.Defrag(fragmentPacket(t, defragTestStart, 1, 0, true, udp[:16]))
+	d.Defrag(fragmentPacket(t, defragTestStart.Add(20*time.Second), 2, 0, true, udp[:16]))
+
+	if _, ok := d.ip6[ip6Key{flow: testIPv6Flow(), id: 1}]; ok || len(d.ip6) != 1 {
+		t.Errorf("timed out datagram still pending: %d datagrams", len(d.ip6))
+	}
+	if got := d.discarded.Load(); got != 1 {
+		t.Errorf("got %d discarded, want 1", got)
+	}
+	// The rest of the expired datagram starts a new one that can't complete
+	if out, _ := d.Defrag(fragmentPacket(t, defragTestStart.Add(20*time.Second), 1, 16, false, udp[16:])); out != nil {
+		t.Error("reassembled a datagram whose first fragment timed out")
+	}
+}
+
+func TestDefragIPv6MemoryLimit(t *testing.T) {
+	d := NewDefragmenterWithConfig(DefragConfig{MaxBytes: 20000})
+	data := make([]byte, 1400)
+	for id := uint32(0); id < 20; id++ {
+		d.Defrag(fragmentPacket(t, defragTestStart.Add(time.Duration(id)*time.Millisecond), id, 0, true, data))
+		if d.ip6Bytes > 20000 {
+			t.Fatalf("%d bytes buffered, above the 20000 byte limit", d.ip6Bytes)
+		}
+	}
+	if len(d.ip6) != 14 || d.discarded.Load() != 6 {
+		t.Errorf("got %d pending and %d discarded, want 14 and 6", len(d.ip6), d.discarded.Load())
+	}
+	// The oldest datagrams were evicted first
+	for id := uint32(0); id < 6; id++ {
+		if _, ok := d.ip6[ip6Key{flow: testIPv6Flow(), id: id}]; ok {
+			t.Errorf("datagram %d should have been evicted", id)
+		}
+	}
+}
+
+func TestDefragIgnoresTunnelledFragment(t *testing.T) {
+	inner := ipv6Fragment(t, 1, 0, true, udpDatagram(32)[:16])
+	outer := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolIPv6,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("2001:db8::a"),
+		DstIP:      net.ParseIP("2001:db8::b"),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, outer, gopacket.Payload(inner)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default)
+	if packet.Layer(layers.LayerTypeIPv6Fragment) == nil {
+		t.Fatal("inner fragment header was not decoded")
+	}
+
+	d := NewDefragmenter()
+	out, count := d.Defrag(packet)
+	if out != packet || count != 0 || len(d.ip6) != 0 {
+		t.Errorf("the outer packet was treated as a fragment: %d fragments, %d pending", count, len(d.ip6))
+	}
+}
+
+// testIPv6Flow returns the network flow of the test fragments
+func testIPv6Flow() gopacket.Flow {
+	return gopacket.NewFlow(layers.EndpointIPv6, net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16())
+}
+
+// fixedClock always reports the same time
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestUntimestampedPacketsUseClock(t *testing.T) {
+	clock := fixedClock(defragTestStart)
+	udp := udpDatagram(32)
+
+	// Fragments without a timestamp expire in clock time
+	d := NewDefragmenterWithConfig(DefragConfig{Timeout: 10 * time.Second, Clock: clock})
+	d.Defrag(fragmentPacket(t, time.Time{}, 1, 0, true, udp[:16]))
+	if p := d.ip6[ip6Key{flow: testIPv6Flow(), id: 1}]; p == nil || !p.lastSeen.Equal(defragTestStart) {
+		t.Fatalf("fragment was not dated from the clock: %+v", p)
+	}
+	d.Defrag(fragmentPacket(t, defragTestStart.Add(20*time.Second), 2, 0, true, udp[:16]))
+	if len(d.ip6) != 1 || d.discarded.Load() != 1 {
+		t.Errorf("got %d pending and %d discarded, want the first datagram expired", len(d.ip6), d.discarded.Load())
+	}
+
+	// The decoder dates the packet from its clock too
+	packet := testFrame(t, layers.IPProtocolUDP, &layers.UDP{SrcPort: 40000, DstPort: 9999}, gopacket.Payload("data"))
+	info := NewPacketDecoderWithClock(clock).ProcessPacket(packet)
+	if info == nil || !info.Timestamp.Equal(defragTestStart) {
+		t.Errorf("got %+v, want a packet dated %v", info, defragTestStart)
+	}
+}
@@ -0,0 +1,89 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// Filterable is implemented by capture sources whose BPF filter can be
+// changed while capture is running
+type Filterable interface {
+	// Filter returns the user-supplied filter expression
+	Filter() string
+	// EffectiveFilter returns the expression installed on the handle,
+	// including any automatic exclusion clause
+	EffectiveFilter() string
+	// SetFilter validates and installs a new filter expression
+	SetFilter(expr string) error
+}
+
+// ExclusionClause builds a BPF expression matching TCP traffic to or from
+// port on any of the given hosts. Used to keep our own UI traffic out of the graph.
+func ExclusionClause(hosts []string, port int) string {
+	if port <= 0 {
+		return ""
+	}
+	if len(hosts) == 0 {
+		return fmt.Sprintf("tcp port %d", port)
+	}
+
+	hostTerms := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		hostTerms = append(hostTerms, "host "+h)
+	}
+	return fmt.Sprintf("tcp port %d and (%s)", port, strings.Join(hostTerms, " or "))
+}
+
+// combineFilters joins a user filter with an exclusion clause
+func combineFilters(filter, exclude string) string {
+	filter = strings.TrimSpace(filter)
+	switch {
+	case filter == "" && exclude == "":
+		return ""
+	case exclude == "":
+		return filter
+	case filter == "":
+		return fmt.Sprintf("not (%s)", exclude)
+	default:
+		return fmt.Sprintf("(%s) and not (%s)", filter, exclude)
+	}
+}
+
+// InterfaceAddresses returns the IP addresses assigned to a capture interface
+func InterfaceAddresses(iface string) ([]string, error) {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate interfaces: %v", err)
+	}
+
+	for _, device := range devices {
+		if device.Name != iface {
+			continue
+		}
+		addrs := make([]string, 0, len(device.Addresses))
+		for _, addr := range device.Addresses {
+			addrs = append(addrs, addr.IP.String())
+		}
+		return addrs, nil
+	}
+
+	return nil, fmt.Errorf("interface %s not found", iface)
+}
+
+// SelfExclusionHosts returns the hosts our server is reachable on. A wildcard
+// bind address expands to every address on the capture interface.
+func SelfExclusionHosts(bindIP, iface string) []string {
+	ip := net.ParseIP(bindIP)
+	if ip != nil && !ip.IsUnspecified() {
+		return []string{bindIP}
+	}
+
+	addrs, err := InterfaceAddresses(iface)
+	if err != nil {
+		return nil
+	}
+	return addrs
+}
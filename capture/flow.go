@@ -0,0 +1,546 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Flow export formats reported in PacketInfo.FlowSource
+const (
+	FlowNetFlowV5 = "NetFlow v5"
+	FlowNetFlowV9 = "NetFlow v9"
+	FlowIPFIX     = "IPFIX"
+	FlowSFlow     = "sFlow"
+)
+
+// maxFlowTemplates bounds the NetFlow v9/IPFIX templates kept across exporters
+const maxFlowTemplates = 4096
+
+// flowRecord is one decoded flow. Counters are already scaled by the
+// exporter's sampling rate. Flow start/end times are not kept: records are
+// timestamped on arrival so long-lived flows exported after an active
+// timeout do not appear already stale.
+type flowRecord struct {
+	format  string
+	srcIP   net.IP
+	dstIP   net.IP
+	srcPort uint16
+	dstPort uint16
+	proto   layers.IPProtocol
+	packets uint64
+	bytes   uint64
+	header  gopacket.Packet // sFlow sampled packet header, nil otherwise
+}
+
+// templateKey identifies a NetFlow v9/IPFIX template. Template IDs are only
+// unique per exporter and observation domain.
+type templateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+// templateField is one field of a NetFlow v9/IPFIX template
+type templateField struct {
+	id     uint16
+	length uint16 // 65535 marks an IPFIX variable-length field
+}
+
+// flowTemplate is a data template; options templates only record their ID
+// so their data sets are skipped quietly
+type flowTemplate struct {
+	fields  []templateField
+	options bool
+}
+
+// Information elements shared by NetFlow v9 and IPFIX
+const (
+	ieOctetDelta       = 1
+	iePacketDelta      = 2
+	ieProtocol         = 4
+	ieSrcPort          = 7
+	ieSrcIPv4          = 8
+	ieDstPort          = 11
+	ieDstIPv4          = 12
+	ieOutOctets        = 23
+	ieOutPackets       = 24
+	ieSrcIPv6          = 27
+	ieDstIPv6          = 28
+	ieSamplingInterval = 34
+	ieOctetTotal       = 85
+	iePacketTotal      = 86
+	ieSamplingPacket   = 305 // IPFIX samplingPacketInterval
+	ipfixVariableLen   = 65535
+)
+
+// flowDecoder decodes flow export datagrams, remembering the templates
+// each exporter announces. It is not safe for concurrent use.
+type flowDecoder struct {
+	templates map[templateKey]*flowTemplate
+}
+
+func newFlowDecoder() *flowDecoder {
+	return &flowDecoder{templates: make(map[templateKey]*flowTemplate)}
+}
+
+// decode parses one datagram from exporter
+func (d *flowDecoder) decode(exporter string, data []byte) ([]flowRecord, error) {
+	if len(data) >= 4 && binary.BigEndian.Uint32(data) == 5 {
+		return decodeSFlow(data)
+	}
+	if len(data) < 2 {
+		return nil, fmt.Errorf("datagram too short")
+	}
+	switch version := binary.BigEndian.Uint16(data); version {
+	case 5:
+		return decodeNetFlowV5(data)
+	case 9:
+		return d.decodeNetFlowV9(exporter, data)
+	case 10:
+		return d.decodeIPFIX(exporter, data)
+	default:
+		return nil, fmt.Errorf("unknown flow export version %d", version)
+	}
+}
+
+// decodeNetFlowV5 parses a NetFlow v5 datagram of fixed-size records
+func decodeNetFlowV5(data []byte) ([]flowRecord, error) {
+	const headerLen, recordLen = 24, 48
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("NetFlow v5 header truncated")
+	}
+	count := int(binary.BigEndian.Uint16(data[2:4]))
+	if len(data) < headerLen+count*recordLen {
+		return nil, fmt.Errorf("NetFlow v5 datagram truncated: %d records in %d bytes", count, len(data))
+	}
+	sampling := uint64(binary.BigEndian.Uint16(data[22:24]) & 0x3fff)
+	if sampling == 0 {
+		sampling = 1
+	}
+
+	records := make([]flowRecord, 0, count)
+	for i := 0; i < count; i++ {
+		r := data[headerLen+i*recordLen:]
+		records = append(records, flowRecord{
+			format:  FlowNetFlowV5,
+			srcIP:   net.IP(append([]byte(nil), r[0:4]...)),
+			dstIP:   net.IP(append([]byte(nil), r[4:8]...)),
+			packets: uint64(binary.BigEndian.Uint32(r[16:20])) * sampling,
+			bytes:   uint64(binary.BigEndian.Uint32(r[20:24])) * sampling,
+			srcPort: binary.BigEndian.Uint16(r[32:34]),
+			dstPort: binary.BigEndian.Uint16(r[34:36]),
+			proto:   layers.IPProtocol(r[38]),
+		})
+	}
+	return records, nil
+}
+
+// decodeNetFlowV9 parses a NetFlow v9 datagram: template and data flowsets
+func (d *flowDecoder) decodeNetFlowV9(exporter string, data []byte) ([]flowRecord, error) {
+	const headerLen = 20
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("NetFlow v9 header truncated")
+	}
+	domain := binary.BigEndian.Uint32(data[16:20])
+
+	msg := flowMessage{format: FlowNetFlowV9}
+	for sets := data[headerLen:]; len(sets) >= 4; {
+		id := binary.BigEndian.Uint16(sets[0:2])
+		length := int(binary.BigEndian.Uint16(sets[2:4]))
+		if length < 4 || length > len(sets) {
+			return msg.records, fmt.Errorf("NetFlow v9 flowset length %d invalid", length)
+		}
+		body := sets[4:length]
+		sets = sets[length:]
+
+		switch {
+		case id == 0:
+			if err := d.parseTemplates(exporter, domain, body, false, false); err != nil {
+				return msg.records, err
+			}
+		case id == 1:
+			d.parseV9OptionsTemplates(exporter, domain, body)
+		case id >= 256:
+			msg.decodeDataSet(d.templates[templateKey{exporter, domain, id}], body)
+		}
+	}
+	return msg.records, nil
+}
+
+// decodeIPFIX parses an IPFIX message: template, options template and data sets
+func (d *flowDecoder) decodeIPFIX(exporter string, data []byte) ([]flowRecord, error) {
+	const headerLen = 16
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("IPFIX header truncated")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < headerLen || length > len(data) {
+		return nil, fmt.Errorf("IPFIX message length %d invalid", length)
+	}
+	domain := binary.BigEndian.Uint32(data[12:16])
+
+	msg := flowMessage{format: FlowIPFIX}
+	for sets := data[headerLen:length]; len(sets) >= 4; {
+		id := binary.BigEndian.Uint16(sets[0:2])
+		setLen := int(binary.BigEndian.Uint16(sets[2:4]))
+		if setLen < 4 || setLen > len(sets) {
+			return msg.records, fmt.Errorf("IPFIX set length %d invalid", setLen)
+		}
+		body := sets[4:setLen]
+		sets = sets[setLen:]
+
+		switch {
+		case id == 2:
+			if err := d.parseTemplates(exporter, domain, body, true, false); err != nil {
+				return msg.records, err
+			}
+		case id == 3:
+			if err := d.parseTemplates(exporter, domain, body, true, true); err != nil {
+				return msg.records, err
+			}
+		case id >= 256:
+			msg.decodeDataSet(d.templates[templateKey{exporter, domain, id}], body)
+		}
+	}
+	return msg.records, nil
+}
+
+// parseTemplates stores the templates in a template set. IPFIX fields may
+// carry an enterprise number, and options templates have an extra scope
+// field count.
+func (d *flowDecoder) parseTemplates(exporter string, domain uint32, body []byte, ipfix, options bool) error {
+	headerLen := 4
+	if options {
+		headerLen = 6
+	}
+	for len(body) >= headerLen {
+		id := binary.BigEndian.Uint16(body[0:2])
+		count := int(binary.BigEndian.Uint16(body[2:4]))
+		body = body[headerLen:]
+		if id < 256 {
+			// Padding at the end of the set
+			return nil
+		}
+
+		key := templateKey{exporter, domain, id}
+		if count == 0 {
+			// IPFIX template withdrawal
+			delete(d.templates, key)
+			continue
+		}
+
+		fields := make([]templateField, 0, count)
+		for i := 0; i < count; i++ {
+			if len(body) < 4 {
+				return fmt.Errorf("template %d truncated", id)
+			}
+			field := templateField{
+				id:     binary.BigEndian.Uint16(body[0:2]),
+				length: binary.BigEndian.Uint16(body[2:4]),
+			}
+			body = body[4:]
+			if ipfix && field.id&0x8000 != 0 {
+				// Enterprise-specific element: skip the enterprise number
+				if len(body) < 4 {
+					return fmt.Errorf("template %d truncated", id)
+				}
+				body = body[4:]
+				field.id = 0
+			}
+			fields = append(fields, field)
+		}
+		d.storeTemplate(key, &flowTemplate{fields: fields, options: options})
+	}
+	return nil
+}
+
+// parseV9OptionsTemplates records NetFlow v9 options template IDs. Their
+// layout differs from data templates and their records carry no flows.
+func (d *flowDecoder) parseV9OptionsTemplates(exporter string, domain uint32, body []byte) {
+	for len(body) >= 6 {
+		id := binary.BigEndian.Uint16(body[0:2])
+		scopeLen := int(binary.BigEndian.Uint16(body[2:4]))
+		optionLen := int(binary.BigEndian.Uint16(body[4:6]))
+		if id < 256 || 6+scopeLen+optionLen > len(body) {
+			return
+		}
+		d.storeTemplate(templateKey{exporter, domain, id}, &flowTemplate{options: true})
+		body = body[6+scopeLen+optionLen:]
+	}
+}
+
+// storeTemplate adds a template, forgetting all templates if the cache is
+// full; exporters re-announce them periodically
+func (d *flowDecoder) storeTemplate(key templateKey, template *flowTemplate) {
+	if _, ok := d.templates[key]; !ok && len(d.templates) >= maxFlowTemplates {
+		d.templates = make(map[templateKey]*flowTemplate)
+	}
+	d.templates[key] = template
+}
+
+// flowMessage collects the records decoded from one datagram
+type flowMessage struct {
+	format  string
+	records []flowRecord
+}
+
+// decodeDataSet decodes the records of a data set. Sets for unknown or
+// options templates are skipped.
+func (m *flowMessage) decodeDataSet(template *flowTemplate, body []byte) {
+	if template == nil || template.options || len(template.fields) == 0 {
+		return
+	}
+	for len(body) > 0 {
+		record, n, ok := m.decodeDataRecord(template, body)
+		if !ok {
+			return // Padding or a truncated record
+		}
+		body = body[n:]
+		if record.srcIP != nil && record.dstIP != nil {
+			m.records = append(m.records, record)
+		}
+	}
+}
+
+// decodeDataRecord decodes one record, returning the bytes it used
+func (m *flowMessage) decodeDataRecord(template *flowTemplate, body []byte) (flowRecord, int, bool) {
+	record := flowRecord{format: m.format}
+	var outPackets, outBytes, sampling uint64
+	offset := 0
+	for _, field := range template.fields {
+		length := int(field.length)
+		if field.length == ipfixVariableLen {
+			if offset >= len(body) {
+				return record, 0, false
+			}
+			length = int(body[offset])
+			offset++
+			if length == 255 {
+				if offset+2 > len(body) {
+					return record, 0, false
+				}
+				length = int(binary.BigEndian.Uint16(body[offset : offset+2]))
+				offset += 2
+			}
+		}
+		if offset+length > len(body) {
+			return record, 0, false
+		}
+		value := body[offset : offset+length]
+		offset += length
+
+		switch field.id {
+		case ieOctetDelta, ieOctetTotal:
+			if record.bytes == 0 {
+				record.bytes = readUint(value)
+			}
+		case iePacketDelta, iePacketTotal:
+			if record.packets == 0 {
+				record.packets = readUint(value)
+			}
+		case ieOutOctets:
+			outBytes = readUint(value)
+		case ieOutPackets:
+			outPackets = readUint(value)
+		case ieProtocol:
+			record.proto = layers.IPProtocol(readUint(value))
+		case ieSrcPort:
+			record.srcPort = uint16(readUint(value))
+		case ieDstPort:
+			record.dstPort = uint16(readUint(value))
+		case ieSrcIPv4, ieSrcIPv6:
+			if length == 4 || length == 16 {
+				record.srcIP = net.IP(append([]byte(nil), value...))
+			}
+		case ieDstIPv4, ieDstIPv6:
+			if length == 4 || length == 16 {
+				record.dstIP = net.IP(append([]byte(nil), value...))
+			}
+		case ieSamplingInterval, ieSamplingPacket:
+			sampling = readUint(value)
+		}
+	}
+	if offset == 0 {
+		return record, 0, false
+	}
+
+	// Egress-only exporters report OUT_BYTES/OUT_PKTS
+	if record.bytes == 0 && record.packets == 0 {
+		record.bytes, record.packets = outBytes, outPackets
+	}
+	if sampling > 1 {
+		record.bytes *= sampling
+		record.packets *= sampling
+	}
+	return record, offset, true
+}
+
+// readUint reads a big-endian unsigned integer of up to 8 bytes
+func readUint(b []byte) uint64 {
+	var v uint64
+	for i, c := range b {
+		if i == 8 {
+			break
+		}
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// sFlow v5 sample and record formats (enterprise 0)
+const (
+	sflowFlowSample         = 1
+	sflowExpandedFlowSample = 3
+	sflowRawHeader          = 1
+	sflowSampledIPv4        = 3
+	sflowSampledIPv6        = 4
+	sflowHeaderEthernet     = 1
+	sflowHeaderIPv4         = 11
+	sflowHeaderIPv6         = 12
+)
+
+// decodeSFlow parses an sFlow v5 datagram. Each flow sample stands for
+// sampling-rate packets of its frame length; counter samples are ignored.
+func decodeSFlow(data []byte) ([]flowRecord, error) {
+	r := xdrReader{data: data}
+	r.uint32() // Version
+	switch r.uint32() {
+	case 1:
+		r.skip(4)
+	case 2:
+		r.skip(16)
+	default:
+		return nil, fmt.Errorf("sFlow agent address type invalid")
+	}
+	r.skip(12) // Sub-agent ID, sequence number, uptime
+	numSamples := int(r.uint32())
+	if r.err != nil {
+		return nil, fmt.Errorf("sFlow header truncated")
+	}
+
+	var records []flowRecord
+	for i := 0; i < numSamples; i++ {
+		format := r.uint32()
+		sample := xdrReader{data: r.bytes(int(r.uint32()))}
+		if r.err != nil {
+			return records, fmt.Errorf("sFlow sample truncated")
+		}
+
+		switch format {
+		case sflowFlowSample:
+			sample.skip(8) // Sequence number, source ID
+		case sflowExpandedFlowSample:
+			sample.skip(12) // Sequence number, source ID type and index
+		default:
+			continue
+		}
+		rate := uint64(sample.uint32())
+		if format == sflowFlowSample {
+			sample.skip(16) // Sample pool, drops, input, output
+		} else {
+			sample.skip(24) // Sample pool, drops, input and output format/value
+		}
+		if rate == 0 {
+			rate = 1
+		}
+		if record, ok := decodeSFlowRecords(&sample, rate); ok {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// decodeSFlowRecords turns the records of one flow sample into a flow,
+// preferring the raw packet header over the sampled IP summaries
+func decodeSFlowRecords(sample *xdrReader, rate uint64) (flowRecord, bool) {
+	var best flowRecord
+	found := false
+	numRecords := int(sample.uint32())
+	for i := 0; i < numRecords && sample.err == nil; i++ {
+		format := sample.uint32()
+		rec := xdrReader{data: sample.bytes(int(sample.uint32()))}
+		if sample.err != nil {
+			break
+		}
+
+		record := flowRecord{format: FlowSFlow, packets: rate}
+		switch format {
+		case sflowRawHeader:
+			headerProto := rec.uint32()
+			frameLen := uint64(rec.uint32())
+			rec.skip(4) // Bytes stripped
+			header := rec.bytes(int(rec.uint32()))
+			if rec.err != nil {
+				continue
+			}
+			var first gopacket.Decoder
+			switch headerProto {
+			case sflowHeaderEthernet:
+				first = layers.LayerTypeEthernet
+			case sflowHeaderIPv4:
+				first = layers.LayerTypeIPv4
+			case sflowHeaderIPv6:
+				first = layers.LayerTypeIPv6
+			default:
+				continue
+			}
+			record.header = gopacket.NewPacket(append([]byte(nil), header...), first, gopacket.Default)
+			record.bytes = frameLen * rate
+			return record, true
+		case sflowSampledIPv4, sflowSampledIPv6:
+			addrLen := 4
+			if format == sflowSampledIPv6 {
+				addrLen = 16
+			}
+			length := uint64(rec.uint32())
+			record.proto = layers.IPProtocol(rec.uint32())
+			record.srcIP = net.IP(append([]byte(nil), rec.bytes(addrLen)...))
+			record.dstIP = net.IP(append([]byte(nil), rec.bytes(addrLen)...))
+			record.srcPort = uint16(rec.uint32())
+			record.dstPort = uint16(rec.uint32())
+			if rec.err != nil {
+				continue
+			}
+			record.bytes = length * rate
+			best, found = record, true
+		}
+	}
+	return best, found
+}
+
+// xdrReader reads big-endian XDR fields, remembering the first overrun
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+func (r *xdrReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = fmt.Errorf("truncated")
+		return nil
+	}
+	b := r.data[:n]
+	// XDR opaque data is padded to a multiple of four bytes
+	padded := (n + 3) &^ 3
+	if padded > len(r.data) {
+		padded = len(r.data)
+	}
+	r.data = r.data[padded:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *xdrReader) skip(n int) {
+	r.bytes(n)
+}
@@ -0,0 +1,278 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxFlowDatagram is the largest flow export datagram read from the socket
+const maxFlowDatagram = 65535
+
+// FlowCollectorConfig holds configuration for the flow export collector.
+// Exactly one of Listen and File is set.
+type FlowCollectorConfig struct {
+	Listen string // UDP address to receive NetFlow/IPFIX/sFlow exports on, e.g. ":2055"
+	File   string // Pcap or pcapng file of recorded flow exports, read once like a capture file
+}
+
+// FlowCollector receives NetFlow v5/v9, IPFIX and sFlow v5 exports and turns
+// each flow record into a flow-derived PacketInfo carrying the flow's packet
+// and byte counts. Records have no payload, so they update the graph and
+// packet list but not stream tracking.
+type FlowCollector struct {
+	config     FlowCollectorConfig
+	packetChan chan *PacketInfo
+	decoder    *flowDecoder
+	headers    *PacketDecoder // Decodes sFlow sampled headers apart from captured traffic
+	paused     atomic.Bool
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	counters   sourceCounters
+}
+
+// NewFlowCollector creates a flow collector
+func NewFlowCollector(config FlowCollectorConfig, packetChan chan *PacketInfo) (*FlowCollector, error) {
+	if (config.Listen == "") == (config.File == "") {
+		return nil, fmt.Errorf("flow collector needs either a listen address or a file")
+	}
+	return &FlowCollector{
+		config:     config,
+		packetChan: packetChan,
+		decoder:    newFlowDecoder(),
+		headers:    NewPacketDecoder(),
+		closeChan:  make(chan struct{}),
+	}, nil
+}
+
+// Start collects flows until the context is cancelled or Close is called.
+// A file source also stops at the end of the file.
+func (c *FlowCollector) Start(ctx context.Context) {
+	if c.config.File != "" {
+		c.readFile(ctx)
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", c.config.Listen)
+	if err != nil {
+		log.Printf("Invalid flow collector address %s: %v", c.config.Listen, err)
+		return
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Printf("Failed to listen for flow exports on %s: %v", c.config.Listen, err)
+		return
+	}
+	defer conn.Close()
+
+	// Unblock the read on shutdown
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.closeChan:
+		}
+		conn.Close()
+	}()
+
+	log.Printf("Flow collector listening on %s (NetFlow v5/v9, IPFIX, sFlow)", conn.LocalAddr())
+	buf := make([]byte, maxFlowDatagram)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case <-c.closeChan:
+			default:
+				log.Printf("Flow collector read error: %v", err)
+			}
+			log.Println("Flow collector stopped")
+			return
+		}
+		if c.paused.Load() {
+			continue
+		}
+		for _, packetInfo := range c.decodeDatagram(from.IP.String(), buf[:n], time.Now()) {
+			c.counters.deliver(c.packetChan, packetInfo)
+		}
+	}
+}
+
+// readFile replays flow exports recorded in a pcap or pcapng file. Like
+// FileCapture it never drops records: sends block until the pipeline
+// accepts them.
+func (c *FlowCollector) readFile(ctx context.Context) {
+	file, err := os.Open(c.config.File)
+	if err != nil {
+		log.Printf("Failed to open flow export file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	reader, err := newPacketDataReader(file)
+	if err != nil {
+		log.Printf("Failed to read flow export file %s: %v", c.config.File, err)
+		return
+	}
+	packets := gopacket.NewPacketSource(reader, reader.LinkType()).Packets()
+	for {
+		for c.paused.Load() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.closeChan:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		var packet gopacket.Packet
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.closeChan:
+			return
+		case packet, ok = <-packets:
+		}
+		if !ok {
+			log.Printf("Finished reading flow exports from %s", c.config.File)
+			return
+		}
+
+		udp, isUDP := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		network := packet.NetworkLayer()
+		if !isUDP || network == nil {
+			continue // Not a flow export datagram
+		}
+		exporter := network.NetworkFlow().Src().String()
+		for _, packetInfo := range c.decodeDatagram(exporter, udp.Payload, packet.Metadata().Timestamp) {
+			select {
+			case c.packetChan <- packetInfo:
+				c.counters.delivered.Add(1)
+			case <-ctx.Done():
+				return
+			case <-c.closeChan:
+				return
+			}
+		}
+	}
+}
+
+// decodeDatagram decodes one export datagram into packet records, counting
+// every flow as received and those hidden by the address policy as filtered
+func (c *FlowCollector) decodeDatagram(exporter string, data []byte, received time.Time) []*PacketInfo {
+	records, err := c.decoder.decode(exporter, data)
+	if err != nil {
+		log.Printf("Warning: Malformed flow export from %s: %v", exporter, err)
+	}
+
+	infos := make([]*PacketInfo, 0, len(records))
+	for i := range records {
+		c.counters.received.Add(1)
+		packetInfo := records[i].packetInfo(c.headers, exporter, received)
+		if packetInfo == nil {
+			c.counters.filtered.Add(1)
+			continue
+		}
+		infos = append(infos, packetInfo)
+	}
+	return infos
+}
+
+// packetInfo converts a flow record, returning nil if the address policy
+// hides either endpoint. Sampled headers are decoded with headers, so their
+// classification never mixes with that of captured flows.
+func (r *flowRecord) packetInfo(headers *PacketDecoder, exporter string, received time.Time) *PacketInfo {
+	if received.IsZero() {
+		received = CurrentClock().Now()
+	}
+
+	var packetInfo *PacketInfo
+	if r.header != nil {
+		// sFlow sampled header: decode it like a captured packet
+		packetInfo = headers.ProcessPacket(r.header)
+		if packetInfo == nil {
+			return nil
+		}
+		packetInfo.AppPayload = nil
+		packetInfo.TCP = nil
+	} else {
+		srcIP, dstIP := r.srcIP.String(), r.dstIP.String()
+		if !AddressAllowed(srcIP) || !AddressAllowed(dstIP) {
+			return nil
+		}
+		packetInfo = &PacketInfo{
+			SrcIP:    AnonymizeIP(srcIP),
+			DstIP:    AnonymizeIP(dstIP),
+			SrcPort:  r.srcPort,
+			DstPort:  r.dstPort,
+			Protocol: flowProtocol(r.proto, r.srcPort, r.dstPort),
+		}
+		if IsApplicationProtocol(packetInfo.Protocol.Name) {
+			packetInfo.Confidence = ConfidenceLow
+		}
+	}
+
+	packetInfo.Timestamp = received
+	packetInfo.Interface = AnonymizeIP(exporter)
+	packetInfo.Length = int(r.bytes)
+	packetInfo.Packets = int(r.packets)
+	if packetInfo.Packets == 0 {
+		packetInfo.Packets = 1
+	}
+	packetInfo.FlowSource = r.format
+	return packetInfo
+}
+
+// flowProtocol detects the protocol of a flow from its IP protocol and ports
+func flowProtocol(proto layers.IPProtocol, srcPort, dstPort uint16) Protocol {
+	switch proto {
+	case layers.IPProtocolTCP:
+		return detectTCPProtocol(&layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort)})
+	case layers.IPProtocolUDP:
+		return detectUDPProtocol(&layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)})
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		return LookupProtocol(ProtocolNameICMP)
+	default:
+		return LookupProtocol(ProtocolNameOther)
+	}
+}
+
+// Pause stops forwarding flows; exports received while paused are discarded
+func (c *FlowCollector) Pause() {
+	if !c.paused.Swap(true) {
+		log.Println("Flow collector paused")
+	}
+}
+
+// Resume continues forwarding flows after Pause
+func (c *FlowCollector) Resume() {
+	if c.paused.Swap(false) {
+		log.Println("Flow collector resumed")
+	}
+}
+
+// Stats returns the collector's counters. Received counts flow records, not
+// export datagrams.
+func (c *FlowCollector) Stats() SourceStats {
+	if c.config.File != "" {
+		return c.counters.stats("flows " + c.config.File)
+	}
+	return c.counters.stats("flows udp " + c.config.Listen)
+}
+
+// Close stops the collector; the socket is released when Start returns
+func (c *FlowCollector) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+	return nil
+}
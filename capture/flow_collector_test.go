@@ -0,0 +1,189 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Flow exports as an exporter would send them, from 192.0.2.10 to 198.51.100.20
+
+// netFlowV5Export has one record of 10 packets and 1500 bytes, sampled 1 in 10
+var netFlowV5Export = concat(
+	// Version, count, uptime, secs, nsecs, sequence, engine, sampling
+	u16(5), u16(1), u32(1000), u32(1700000000), u32(0), u32(1), []byte{0, 0}, u16(0x4000|10),
+	// Addresses, next hop, interfaces, packets, bytes, first, last
+	ip4(192, 0, 2, 10), ip4(198, 51, 100, 20), ip4(0, 0, 0, 0), u16(1), u16(2), u32(10), u32(1500), u32(0), u32(0),
+	// Ports, pad, TCP flags, protocol, TOS, AS numbers, masks, pad
+	u16(40000), u16(443), []byte{0, 0x18, 6, 0}, u16(0), u16(0), []byte{24, 24}, u16(0),
+)
+
+// netFlowV9Template announces template 256; netFlowV9Data uses it in a later
+// datagram
+var (
+	netFlowV9Template = concat(
+		u16(9), u16(1), u32(1000), u32(1700000000), u32(1), u32(7),
+		u16(0), u16(36), u16(256), u16(7),
+		u16(ieSrcIPv4), u16(4), u16(ieDstIPv4), u16(4), u16(ieSrcPort), u16(2), u16(ieDstPort), u16(2),
+		u16(ieProtocol), u16(1), u16(ieOctetDelta), u16(4), u16(iePacketDelta), u16(4),
+	)
+	netFlowV9Data = concat(
+		u16(9), u16(1), u32(2000), u32(1700000001), u32(2), u32(7),
+		u16(256), u16(28),
+		ip4(192, 0, 2, 10), ip4(198, 51, 100, 20), u16(40001), u16(53), []byte{17}, u32(120), u32(2),
+		[]byte{0, 0, 0}, // Padding
+	)
+)
+
+// ipfixExport has a template with an enterprise-specific field and a data
+// record using it
+var ipfixExport = func() []byte {
+	template := concat(
+		u16(256), u16(6),
+		u16(ieSrcIPv4), u16(4), u16(ieDstIPv4), u16(4), u16(ieProtocol), u16(1),
+		u16(0x8000|1), u16(2), u32(9), // Enterprise 9, element 1
+		u16(iePacketTotal), u16(8), u16(ieOctetTotal), u16(8),
+	)
+	data := concat(ip4(192, 0, 2, 10), ip4(198, 51, 100, 20), []byte{1}, u16(0xffff), u64(3), u64(252))
+	sets := concat(u16(2), u16(uint16(4+len(template))), template, u16(256), u16(uint16(4+len(data))), data)
+	return concat(u16(10), u16(uint16(16+len(sets))), u32(1700000000), u32(1), u32(0), sets)
+}()
+
+// sflowExport has one flow sample, 1 in 100, carrying a raw Ethernet header
+func sflowExport(t *testing.T) []byte {
+	frame := testFrame(t, layers.IPProtocolTCP,
+		&layers.TCP{SrcPort: 40002, DstPort: 80, DataOffset: 5, PSH: true, ACK: true},
+		gopacket.Payload("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+	).Data()
+	header := concat(u32(sflowHeaderEthernet), u32(800), u32(4), u32(uint32(len(frame))), frame, make([]byte, (4-len(frame)%4)%4))
+	records := concat(u32(sflowRawHeader), u32(uint32(len(header))), header)
+	sample := concat(u32(1), u32(3), u32(100), u32(5000), u32(0), u32(1), u32(2), u32(1), records)
+	return concat(
+		u32(5), u32(1), ip4(192, 0, 2, 10), u32(0), u32(1), u32(1000), u32(1),
+		u32(sflowFlowSample), u32(uint32(len(sample))), sample,
+	)
+}
+
+func TestFlowCollectorFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		datagrams [][]byte
+		want      PacketInfo
+	}{
+		{"NetFlow v5", [][]byte{netFlowV5Export},
+			PacketInfo{SrcIP: "192.0.2.10", DstIP: "198.51.100.20", SrcPort: 40000, DstPort: 443, Length: 15000, Packets: 100, FlowSource: FlowNetFlowV5}},
+		{"NetFlow v9", [][]byte{netFlowV9Template, netFlowV9Data},
+			PacketInfo{SrcIP: "192.0.2.10", DstIP: "198.51.100.20", SrcPort: 40001, DstPort: 53, Length: 120, Packets: 2, FlowSource: FlowNetFlowV9}},
+		{"IPFIX", [][]byte{ipfixExport},
+			PacketInfo{SrcIP: "192.0.2.10", DstIP: "198.51.100.20", Length: 252, Packets: 3, FlowSource: FlowIPFIX}},
+		{"sFlow", [][]byte{sflowExport(t)},
+			PacketInfo{SrcIP: "192.0.2.1", DstIP: "192.0.2.2", SrcPort: 40002, DstPort: 80, Length: 80000, Packets: 100, FlowSource: FlowSFlow}},
+		{"v9 data without its template", [][]byte{netFlowV9Data}, PacketInfo{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			infos, _ := collectFlows(t, tt.datagrams...)
+			if tt.want.FlowSource == "" {
+				if len(infos) != 0 {
+					t.Errorf("got %d flows, want none", len(infos))
+				}
+				return
+			}
+			if len(infos) != 1 {
+				t.Fatalf("got %d flows, want 1", len(infos))
+			}
+			got := infos[0]
+			if got.SrcIP != tt.want.SrcIP || got.DstIP != tt.want.DstIP || got.SrcPort != tt.want.SrcPort || got.DstPort != tt.want.DstPort ||
+				got.Length != tt.want.Length || got.Packets != tt.want.Packets || got.FlowSource != tt.want.FlowSource {
+				t.Errorf("got %s %s:%d > %s:%d, %d bytes in %d packets; want %s %s:%d > %s:%d, %d bytes in %d packets",
+					got.FlowSource, got.SrcIP, got.SrcPort, got.DstIP, got.DstPort, got.Length, got.Packets,
+					tt.want.FlowSource, tt.want.SrcIP, tt.want.SrcPort, tt.want.DstIP, tt.want.DstPort, tt.want.Length, tt.want.Packets)
+			}
+			if got.Interface != "192.0.2.1" {
+				t.Errorf("got exporter %q, want 192.0.2.1", got.Interface)
+			}
+			if !got.Timestamp.Equal(flowTestStart) {
+				t.Errorf("got timestamp %v, want the capture time %v", got.Timestamp, flowTestStart)
+			}
+		})
+	}
+}
+
+func TestSFlowHeadersClassifiedApart(t *testing.T) {
+	before := len(defaultDecoder.classifier.flows)
+	infos, collector := collectFlows(t, sflowExport(t))
+	if len(infos) != 1 {
+		t.Fatalf("got %d flows, want 1", len(infos))
+	}
+	if infos[0].AppPayload != nil || infos[0].TCP != nil {
+		t.Error("sampled header payload reached stream tracking")
+	}
+	if len(collector.headers.classifier.flows) == 0 {
+		t.Error("sampled header was not classified by the collector")
+	}
+	if len(defaultDecoder.classifier.flows) != before {
+		t.Error("sampled header was classified with captured traffic")
+	}
+}
+
+var flowTestStart = time.Unix(1700000000, 0)
+
+// collectFlows records datagrams sent from 192.0.2.1 in a pcap file and
+// reads it back with a flow collector
+func collectFlows(t *testing.T, datagrams ...[]byte) ([]*PacketInfo, *FlowCollector) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "flows.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, datagram := range datagrams {
+		data := testFrame(t, layers.IPProtocolUDP, &layers.UDP{SrcPort: 50000, DstPort: 2055}, gopacket.Payload(datagram)).Data()
+		ci := gopacket.CaptureInfo{Timestamp: flowTestStart, CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan *PacketInfo, 16)
+	collector, err := NewFlowCollector(FlowCollectorConfig{File: path}, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector.Start(context.Background())
+	close(packets)
+	var infos []*PacketInfo
+	for info := range packets {
+		infos = append(infos, info)
+	}
+	return infos, collector
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func ip4(a, b, c, d byte) []byte { return net.IPv4(a, b, c, d).To4() }
@@ -0,0 +1,74 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// AnyInterface selects every capture-capable interface
+const AnyInterface = "any"
+
+// pcap_if flags from pcap.h
+const (
+	pcapIfLoopback = 0x00000001
+	pcapIfUp       = 0x00000002
+)
+
+// SplitInterfaces flattens repeated and comma-separated interface flags,
+// dropping blanks and duplicates while keeping order
+func SplitInterfaces(values []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ExpandInterfaces validates local interface names. "any" expands to every
+// interface that is up and not a loopback, each captured as its own source
+// so packets keep their ingress interface.
+func ExpandInterfaces(names []string) ([]string, error) {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate network interfaces: %v", err)
+	}
+
+	known := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		known[device.Name] = true
+	}
+
+	var expanded []string
+	for _, name := range names {
+		if name != AnyInterface {
+			if !known[name] {
+				return nil, fmt.Errorf("network interface '%s' not found", name)
+			}
+			expanded = append(expanded, name)
+			continue
+		}
+
+		for _, device := range devices {
+			if device.Name == AnyInterface || device.Flags&pcapIfLoopback != 0 || device.Flags&pcapIfUp == 0 {
+				continue
+			}
+			expanded = append(expanded, device.Name)
+		}
+	}
+
+	expanded = SplitInterfaces(expanded)
+	if len(expanded) == 0 {
+		return nil, fmt.Errorf("no capture interfaces available")
+	}
+	return expanded, nil
+}
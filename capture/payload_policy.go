@@ -0,0 +1,288 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PayloadMode selects how much of each packet's payload is retained
+type PayloadMode string
+
+const (
+	PayloadFull     PayloadMode = "full"     // Keep whole frames (default)
+	PayloadNone     PayloadMode = "none"     // Keep protocol headers only
+	PayloadTruncate PayloadMode = "truncate" // Keep headers and the first MaxBytes of payload
+	PayloadRedact   PayloadMode = "redact"   // Keep payloads with sensitive values masked
+)
+
+// redactMask replaces redacted bytes; lengths are preserved so offsets in
+// hex dumps still line up with the original traffic
+const redactMask = '*'
+
+// DefaultRedactKeywords are the field names whose values are masked in
+// redact mode when the policy lists no keywords of its own
+var DefaultRedactKeywords = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+	"password", "passwd", "pwd", "secret", "token", "api_key", "apikey",
+}
+
+// PayloadPolicy decides what is kept of packet payloads once protocol
+// detection has run. It applies to the packet store (and so to snapshots
+// and WebSocket updates), stream packets and reassembled stream data, and,
+// if ApplyToPcap is set, to saved pcap files. Link, network and transport
+// headers are always kept.
+type PayloadPolicy struct {
+	Mode        PayloadMode `json:"mode"`
+	MaxBytes    int         `json:"maxBytes"`    // Payload bytes kept per packet and per stream direction in truncate mode; also caps redact mode when > 0
+	Keywords    []string    `json:"keywords"`    // Field names whose "name: value" / "name=value" values are masked
+	Patterns    []string    `json:"patterns"`    // Regular expressions to mask; only capture groups are masked if the pattern has any
+	ApplyToPcap bool        `json:"applyToPcap"` // Apply the policy to saved pcap files too
+}
+
+// DefaultPayloadPolicy keeps full payloads, matching earlier releases
+func DefaultPayloadPolicy() PayloadPolicy {
+	return PayloadPolicy{Mode: PayloadFull}
+}
+
+// LoadPayloadPolicy reads a policy from a JSON file. Fields missing from the
+// file keep their DefaultPayloadPolicy values.
+func LoadPayloadPolicy(path string) (PayloadPolicy, error) {
+	policy := DefaultPayloadPolicy()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, fmt.Errorf("failed to read payload policy: %v", err)
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse payload policy: %v", err)
+	}
+	return policy, nil
+}
+
+// compiledPayloadPolicy is a PayloadPolicy with its patterns compiled
+type compiledPayloadPolicy struct {
+	policy   PayloadPolicy
+	patterns []*regexp.Regexp
+}
+
+var (
+	payloadPolicyMu sync.RWMutex
+	payloadPolicy   = &compiledPayloadPolicy{policy: DefaultPayloadPolicy()}
+)
+
+// compilePayloadPolicy validates a policy and compiles its keywords and patterns
+func compilePayloadPolicy(policy PayloadPolicy) (*compiledPayloadPolicy, error) {
+	if policy.Mode == "" {
+		policy.Mode = PayloadFull
+	}
+	switch policy.Mode {
+	case PayloadFull, PayloadNone, PayloadTruncate, PayloadRedact:
+	default:
+		return nil, fmt.Errorf("unknown payload mode %q (want full, none, truncate or redact)", policy.Mode)
+	}
+	if policy.MaxBytes < 0 {
+		return nil, fmt.Errorf("maxBytes must not be negative")
+	}
+	if policy.Mode == PayloadTruncate && policy.MaxBytes == 0 {
+		return nil, fmt.Errorf("truncate mode needs maxBytes")
+	}
+
+	cp := &compiledPayloadPolicy{policy: policy}
+	if policy.Mode != PayloadRedact {
+		return cp, nil
+	}
+
+	keywords := policy.Keywords
+	if len(keywords) == 0 {
+		keywords = DefaultRedactKeywords
+	}
+	var quoted []string
+	for _, kw := range keywords {
+		if kw = strings.TrimSpace(kw); kw != "" {
+			quoted = append(quoted, regexp.QuoteMeta(kw))
+		}
+	}
+	if len(quoted) > 0 {
+		// Matches header lines, form fields and JSON members alike:
+		// "Authorization: Basic ...", "password=...", "\"token\": \"...\""
+		cp.patterns = append(cp.patterns, regexp.MustCompile(
+			`(?i)\b(?:`+strings.Join(quoted, "|")+`)"?\s*[:=]\s*"?([^\r\n&;"]*)`))
+	}
+	for _, pattern := range policy.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		cp.patterns = append(cp.patterns, re)
+	}
+	return cp, nil
+}
+
+// SetPayloadPolicy validates and installs a new payload policy
+func SetPayloadPolicy(policy PayloadPolicy) error {
+	cp, err := compilePayloadPolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	payloadPolicyMu.Lock()
+	payloadPolicy = cp
+	payloadPolicyMu.Unlock()
+	return nil
+}
+
+// CurrentPayloadPolicy returns the policy in effect
+func CurrentPayloadPolicy() PayloadPolicy {
+	return currentPayloadPolicy().policy
+}
+
+func currentPayloadPolicy() *compiledPayloadPolicy {
+	payloadPolicyMu.RLock()
+	defer payloadPolicyMu.RUnlock()
+	return payloadPolicy
+}
+
+// RetainedPayload returns the part of a packet's frame that may be stored.
+// The frame itself is never modified; a copy is returned when anything is
+// removed or masked.
+func (p *PacketInfo) RetainedPayload() []byte {
+	return currentPayloadPolicy().frame(p.Payload, p.HeaderLen)
+}
+
+// RetainStreamData applies the payload policy to application bytes about to
+// be appended to a stream direction that already holds stored bytes
+func RetainStreamData(data []byte, stored int) []byte {
+	cp := currentPayloadPolicy()
+	switch cp.policy.Mode {
+	case PayloadNone:
+		return nil
+	case PayloadTruncate:
+		return capBytes(data, cp.policy.MaxBytes-stored)
+	case PayloadRedact:
+		// Values split across segments are only masked if each part matches
+		if cp.policy.MaxBytes > 0 {
+			data = capBytes(data, cp.policy.MaxBytes-stored)
+		}
+		return cp.redact(data)
+	}
+	return data
+}
+
+// frame keeps the first headerLen bytes of a frame and applies the policy
+// to the rest
+func (cp *compiledPayloadPolicy) frame(frame []byte, headerLen int) []byte {
+	if headerLen > len(frame) {
+		headerLen = len(frame)
+	}
+	switch cp.policy.Mode {
+	case PayloadNone:
+		return frame[:headerLen]
+	case PayloadTruncate:
+		return frame[:headerLen+len(capBytes(frame[headerLen:], cp.policy.MaxBytes))]
+	case PayloadRedact:
+		payload := frame[headerLen:]
+		if cp.policy.MaxBytes > 0 {
+			payload = capBytes(payload, cp.policy.MaxBytes)
+		}
+		masked := cp.redact(payload)
+		out := make([]byte, 0, headerLen+len(masked))
+		out = append(out, frame[:headerLen]...)
+		return append(out, masked...)
+	}
+	return frame
+}
+
+// redact masks every pattern match, or only the capture groups of patterns
+// that have them. The input is returned unchanged if nothing matches.
+func (cp *compiledPayloadPolicy) redact(data []byte) []byte {
+	var out []byte
+	for _, re := range cp.patterns {
+		for _, loc := range re.FindAllSubmatchIndex(data, -1) {
+			if out == nil {
+				out = make([]byte, len(data))
+				copy(out, data)
+			}
+			spans := loc[2:]
+			if len(spans) == 0 {
+				spans = loc[:2]
+			}
+			for i := 0; i+1 < len(spans); i += 2 {
+				for j := spans[i]; j >= 0 && j < spans[i+1]; j++ {
+					out[j] = redactMask
+				}
+			}
+		}
+	}
+	if out == nil {
+		return data
+	}
+	return out
+}
+
+// capBytes returns at most n bytes of data
+func capBytes(data []byte, n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+	if len(data) > n {
+		return data[:n]
+	}
+	return data
+}
+
+// headerLength returns the number of bytes in front of the packet's payload:
+// the frame up to the end of its innermost TCP or UDP header, so that
+// protocols gopacket decodes as layers of their own, such as DHCP, count as
+// payload. Frames without a transport header end at the application layer
+// or at undecodable bytes; frames without either are all headers.
+func headerLength(packet gopacket.Packet) int {
+	n, transportEnd := 0, -1
+	for _, layer := range packet.Layers() {
+		if _, ok := layer.(gopacket.ErrorLayer); ok {
+			break
+		}
+		n += len(layer.LayerContents())
+		switch layer.LayerType() {
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+			transportEnd = n
+		}
+	}
+	if transportEnd >= 0 {
+		return transportEnd
+	}
+
+	n = 0
+	for _, layer := range packet.Layers() {
+		if _, ok := layer.(gopacket.ApplicationLayer); ok {
+			return n
+		}
+		if _, ok := layer.(gopacket.ErrorLayer); ok {
+			return n
+		}
+		n += len(layer.LayerContents())
+	}
+	return len(packet.Data())
+}
+
+// writePcap saves a decoded packet, anonymizing it and applying the payload
+// policy first if they cover pcap files
+func writePcap(writer *PcapWriter, packet gopacket.Packet) error {
+	ci := packet.Metadata().CaptureInfo
+	data := packet.Data()
+	if a := CurrentAnonymizer(); a != nil && a.pcap {
+		data = append([]byte(nil), data...)
+		a.anonymizeFrame(packet, data)
+	}
+	if cp := currentPayloadPolicy(); cp.policy.ApplyToPcap && cp.policy.Mode != PayloadFull {
+		data = cp.frame(data, headerLength(packet))
+		ci.CaptureLength = len(data)
+	}
+	return writer.WritePacket(ci, data)
+}
@@ -0,0 +1,78 @@
+package capture
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testFrame serializes layers after an Ethernet and IPv4 header and decodes
+// the frame
+func testFrame(t *testing.T, protocol layers.IPProtocol, ls ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(192, 0, 2, 2)}
+	for _, l := range ls {
+		switch transport := l.(type) {
+		case *layers.TCP:
+			transport.SetNetworkLayerForChecksum(ip)
+		case *layers.UDP:
+			transport.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth, ip}, ls...)...); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+}
+
+func TestHeaderLengthEndsAtTransport(t *testing.T) {
+	const headers = 14 + 20 // Ethernet and IPv4
+	dhcp := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          0x1234,
+		ClientHWAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		Options: layers.DHCPOptions{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(layers.DHCPMsgTypeRequest)}),
+			layers.NewDHCPOption(layers.DHCPOptHostname, []byte("secret-laptop")),
+		},
+	}
+	tests := []struct {
+		name   string
+		packet gopacket.Packet
+		want   int
+	}{
+		{"DHCP", testFrame(t, layers.IPProtocolUDP, &layers.UDP{SrcPort: 68, DstPort: 67}, dhcp), headers + 8},
+		{"UDP payload", testFrame(t, layers.IPProtocolUDP, &layers.UDP{SrcPort: 40000, DstPort: 9999}, gopacket.Payload("data")), headers + 8},
+		{"TCP payload", testFrame(t, layers.IPProtocolTCP, &layers.TCP{SrcPort: 40000, DstPort: 80, DataOffset: 5}, gopacket.Payload("GET / HTTP/1.1\r\n\r\n")), headers + 20},
+		{"ICMP", testFrame(t, layers.IPProtocolICMPv4, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}, gopacket.Payload("ping")), headers + 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := headerLength(tt.packet); got != tt.want {
+				t.Errorf("headerLength = %d, want %d (layers %v)", got, tt.want, tt.packet.Layers())
+			}
+		})
+	}
+
+	// In none mode nothing of the DHCP message is kept
+	cp, err := compilePayloadPolicy(PayloadPolicy{Mode: PayloadNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := tests[0].packet
+	if kept := cp.frame(packet.Data(), headerLength(packet)); bytes.Contains(kept, []byte("secret-laptop")) {
+		t.Errorf("none mode kept the DHCP hostname: %q", kept)
+	}
+}
@@ -0,0 +1,264 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic is the block type of a pcapng section header
+const pcapngMagic = 0x0A0D0D0A
+
+// streamSnapLen is the snapshot length recorded in pcap files saved from streams
+const streamSnapLen = 65535
+
+// packetDataReader is implemented by pcapgo.Reader and pcapgo.NgReader
+type packetDataReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// newPacketDataReader reads the stream header and returns a pcap or pcapng
+// reader depending on the magic number
+func newPacketDataReader(reader io.Reader) (packetDataReader, error) {
+	br := bufio.NewReader(reader)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+
+	// The section header block type reads the same in either byte order
+	if binary.BigEndian.Uint32(magic) == pcapngMagic {
+		ngReader, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pcapng reader: %v", err)
+		}
+		return ngReader, nil
+	}
+
+	pcapReader, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap reader: %v", err)
+	}
+	return pcapReader, nil
+}
+
+// pcapStream decodes live pcap or pcapng byte streams. It holds the pause,
+// shutdown and pcap saving state shared by the streaming sources: SSH
+// sessions, stdin, named pipes and TCP connections.
+type pcapStream struct {
+	label      string // Used in log messages, e.g. "SSH"
+	iface      string // Ingress interface reported on packets, may be empty
+	pcapPrefix string
+	rotation   RotationConfig
+	enablePcap bool
+	packetChan chan *PacketInfo
+	pcapWriter *PcapWriter // Created when the first stream header is read
+	writerMu   sync.RWMutex
+	pauseChan  chan bool
+	resumeChan chan bool
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	defrag     *Defragmenter // Reassembles IP fragments before decoding
+	decoder    *PacketDecoder
+	counters   sourceCounters
+}
+
+// newPcapStream creates the shared state for a streaming source
+func newPcapStream(label, iface, pcapPrefix string, rotation RotationConfig, packetChan chan *PacketInfo) *pcapStream {
+	return &pcapStream{
+		label:      label,
+		iface:      iface,
+		pcapPrefix: pcapPrefix,
+		rotation:   rotation,
+		enablePcap: true,
+		packetChan: packetChan,
+		pauseChan:  make(chan bool, 1),
+		resumeChan: make(chan bool, 1),
+		closeChan:  make(chan struct{}),
+		defrag:     NewDefragmenter(),
+		decoder:    NewPacketDecoder(),
+	}
+}
+
+// processPcapStream reads and processes packets until the stream ends, the
+// context is cancelled or Close is called. A clean end of stream returns nil.
+func (s *pcapStream) processPcapStream(ctx context.Context, reader io.Reader) error {
+	pcapReader, err := newPacketDataReader(reader)
+	if err != nil {
+		return err
+	}
+
+	linkType := pcapReader.LinkType()
+	s.openWriter(linkType)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.closeChan:
+			return nil
+		case <-s.pauseChan:
+			// Block until resumed; the stream is not read meanwhile
+			log.Printf("%s packet capture paused", s.label)
+			select {
+			case <-s.resumeChan:
+			case <-ctx.Done():
+				return nil
+			case <-s.closeChan:
+				return nil
+			}
+			log.Printf("%s packet capture resumed", s.label)
+		default:
+			// Read next packet
+			data, ci, err := pcapReader.ReadPacketData()
+			if err != nil {
+				if err == io.EOF {
+					log.Printf("%s pcap stream ended", s.label)
+					return nil
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-s.closeChan:
+					return nil
+				default:
+				}
+				// A truncated or corrupt stream cannot be resynchronised
+				return fmt.Errorf("error reading packet: %v", err)
+			}
+			s.counters.received.Add(1)
+
+			// Parse packet
+			packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+			packet.Metadata().CaptureInfo = ci
+
+			// Write to local pcap file
+			if writer := s.currentWriter(); writer != nil {
+				if err := writePcap(writer, packet); err != nil {
+					log.Printf("Warning: Failed to write packet to pcap: %v", err)
+				}
+			}
+			packet, fragments := s.defrag.Defrag(packet)
+			if packet == nil {
+				continue // Waiting for the rest of the datagram
+			}
+			packetInfo := s.decoder.ProcessPacket(packet)
+			if packetInfo == nil {
+				s.counters.filtered.Add(1)
+				continue
+			}
+			packetInfo.Interface = s.iface
+			packetInfo.Fragments = fragments
+
+			s.counters.deliver(s.packetChan, packetInfo)
+		}
+	}
+}
+
+// openWriter creates the rotating pcap writer for the stream's link type.
+// A writer from an earlier stream is reused if the link type matches.
+func (s *pcapStream) openWriter(linkType layers.LinkType) {
+	if !s.enablePcap {
+		return
+	}
+
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
+	if s.pcapWriter != nil {
+		if s.pcapWriter.linkType == linkType {
+			return
+		}
+		s.pcapWriter.Close()
+		s.pcapWriter = nil
+	}
+
+	writer, err := NewPcapWriter(s.rotation, s.pcapPrefix, streamSnapLen, linkType)
+	if err != nil {
+		log.Printf("Warning: Pcap saving disabled: %v", err)
+		s.enablePcap = false
+		return
+	}
+	s.pcapWriter = writer
+	log.Printf("Saving packets to: %s", writer.CurrentFile())
+}
+
+// closeWriter closes the pcap writer, if any
+func (s *pcapStream) closeWriter() {
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
+	if s.pcapWriter != nil {
+		s.pcapWriter.Close()
+		s.pcapWriter = nil
+	}
+}
+
+// currentWriter returns the pcap writer, or nil before a stream starts
+func (s *pcapStream) currentWriter() *PcapWriter {
+	s.writerMu.RLock()
+	defer s.writerMu.RUnlock()
+	return s.pcapWriter
+}
+
+// CurrentPcapFile returns the pcap file currently being written
+func (s *pcapStream) CurrentPcapFile() string {
+	if writer := s.currentWriter(); writer != nil {
+		return writer.CurrentFile()
+	}
+	return ""
+}
+
+// Pause pauses packet processing
+func (s *pcapStream) Pause() {
+	select {
+	case s.pauseChan <- true:
+	default:
+	}
+}
+
+// Resume resumes packet processing
+func (s *pcapStream) Resume() {
+	select {
+	case s.resumeChan <- true:
+	default:
+	}
+}
+
+// stats returns the packet counters including reassembly
+func (s *pcapStream) stats(source string) SourceStats {
+	stats := s.counters.stats(source)
+	s.defrag.addStats(&stats)
+	return stats
+}
+
+// Close stops the stream; resources are released when Start returns
+func (s *pcapStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+	return nil
+}
+
+// closeOnDone closes c once the context is cancelled or Close is called, so
+// a read blocked on it returns. The returned function stops the watcher.
+func (s *pcapStream) closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.closeChan:
+		case <-done:
+			return
+		}
+		c.Close()
+	}()
+	return func() { close(done) }
+}
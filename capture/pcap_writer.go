@@ -0,0 +1,304 @@
+package capture
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapFileHeaderSize is the size of the global pcap file header
+const pcapFileHeaderSize = 24
+
+// RotationConfig controls pcap file rotation and retention, like dumpcap's ring buffer
+type RotationConfig struct {
+	Dir          string        // Directory for pcap files (default "pcaps")
+	MaxFileSize  int64         // Start a new file after this many bytes (0 = no size limit)
+	MaxDuration  time.Duration // Start a new file after this long (0 = no time limit)
+	MaxFiles     int           // Keep at most this many capture files (0 = unlimited)
+	MaxTotalSize int64         // Delete oldest capture files above this many bytes (0 = unlimited)
+}
+
+// PcapRecorder is implemented by sources that save packets to pcap files
+type PcapRecorder interface {
+	// CurrentPcapFile returns the path of the file being written, or "" if none
+	CurrentPcapFile() string
+}
+
+// PcapWriter writes packets to a series of pcap files, rotating by size
+// and/or age and deleting the oldest files beyond the retention policy.
+// Retention covers every pcap file in the directory, so the limits hold for
+// the directory however many interfaces are captured.
+type PcapWriter struct {
+	config    RotationConfig
+	prefix    string
+	retention *pcapRetention
+	snaplen   uint32
+	linkType  layers.LinkType
+	file      *os.File
+	writer    *pcapgo.Writer
+	filename  string
+	written   int64
+	openedAt  time.Time
+	mu        sync.Mutex
+}
+
+// pcapRetention applies the retention policy to every pcap file in a
+// directory, shared by the writers in it
+type pcapRetention struct {
+	dir     string
+	mu      sync.Mutex
+	current map[*PcapWriter]string // Files being written, never deleted
+}
+
+var (
+	retentionMu sync.Mutex
+	retentions  = make(map[string]*pcapRetention) // By directory
+)
+
+// retentionFor returns the retention shared by writers in a directory
+func retentionFor(dir string) *pcapRetention {
+	key := filepath.Clean(dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		key = abs
+	}
+
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	r, ok := retentions[key]
+	if !ok {
+		r = &pcapRetention{
+			dir:     dir,
+			current: make(map[*PcapWriter]string),
+		}
+		retentions[key] = r
+	}
+	return r
+}
+
+// unsafeFilenameChars matches characters not allowed in pcap filenames
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+// interfacePrefix appends a filename-safe interface name to a pcap prefix,
+// giving each capture interface its own series of files
+func interfacePrefix(prefix, iface string) string {
+	if iface == "" {
+		return prefix
+	}
+	return prefix + "_" + unsafeFilenameChars.ReplaceAllString(iface, "-")
+}
+
+// NewPcapWriter creates the pcap directory and opens the first file
+func NewPcapWriter(config RotationConfig, prefix string, snaplen uint32, linkType layers.LinkType) (*PcapWriter, error) {
+	if config.Dir == "" {
+		config.Dir = "pcaps"
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pcaps directory: %v", err)
+	}
+
+	w := &PcapWriter{
+		config:    config,
+		prefix:    prefix,
+		retention: retentionFor(config.Dir),
+		snaplen:   snaplen,
+		linkType:  linkType,
+	}
+
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// WritePacket appends a packet, rotating to a new file first if a limit is reached
+func (w *PcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.writer == nil {
+		return fmt.Errorf("pcap writer is closed")
+	}
+
+	if w.shouldRotate() {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writer.WritePacket(ci, data); err != nil {
+		return err
+	}
+	w.written += int64(16 + len(data)) // record header + data
+	return nil
+}
+
+// shouldRotate reports whether the current file has reached a rotation limit
+func (w *PcapWriter) shouldRotate() bool {
+	if w.config.MaxFileSize > 0 && w.written >= w.config.MaxFileSize {
+		return true
+	}
+	if w.config.MaxDuration > 0 && time.Since(w.openedAt) >= w.config.MaxDuration {
+		return true
+	}
+	return false
+}
+
+// rotate closes the current file, opens a new one and applies retention
+func (w *PcapWriter) rotate() error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+		w.writer = nil
+	}
+
+	filename := w.nextFilename()
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create pcap file: %v", err)
+	}
+
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(w.snaplen, w.linkType); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write pcap header: %v", err)
+	}
+
+	w.file = file
+	w.writer = writer
+	w.filename = filename
+	w.written = pcapFileHeaderSize
+	w.openedAt = time.Now()
+
+	log.Printf("Created pcap file: %s", filename)
+
+	w.retention.enforce(w, w.config)
+	return nil
+}
+
+// nextFilename returns a timestamped filename that does not exist yet
+func (w *PcapWriter) nextFilename() string {
+	timestamp := time.Now().Format("2006-01-02_15-04-05")
+	base := fmt.Sprintf("%s_%s", w.prefix, timestamp)
+
+	filename := filepath.Join(w.config.Dir, base+".pcap")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return filename
+		}
+		filename = filepath.Join(w.config.Dir, fmt.Sprintf("%s_%d.pcap", base, i))
+	}
+}
+
+// enforce records the file w is writing and deletes the oldest pcap files
+// in the directory beyond MaxFiles/MaxTotalSize, whichever run or source
+// wrote them. Files being written are never deleted.
+func (r *pcapRetention) enforce(w *PcapWriter, config RotationConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current[w] = w.filename
+	if config.MaxFiles <= 0 && config.MaxTotalSize <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		log.Printf("Warning: Failed to read pcaps directory for retention: %v", err)
+		return
+	}
+
+	type captureFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	writing := make(map[string]bool, len(r.current))
+	for _, filename := range r.current {
+		writing[filename] = true
+	}
+
+	var files []captureFile
+	var totalSize int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".pcap" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, captureFile{
+			path:    filepath.Join(r.dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		totalSize += info.Size()
+	}
+
+	// Oldest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	count := len(files)
+	for _, f := range files {
+		overCount := config.MaxFiles > 0 && count > config.MaxFiles
+		overSize := config.MaxTotalSize > 0 && totalSize > config.MaxTotalSize
+		if !overCount && !overSize {
+			break
+		}
+		if writing[f.path] {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Warning: Failed to remove old pcap file %s: %v", f.path, err)
+			continue
+		}
+		log.Printf("Removed old pcap file: %s", f.path)
+		count--
+		totalSize -= f.size
+	}
+}
+
+// release stops protecting the file of a closed writer
+func (r *pcapRetention) release(w *PcapWriter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.current, w)
+}
+
+// CurrentFile returns the path of the file currently being written
+func (w *PcapWriter) CurrentFile() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.filename
+}
+
+// Close closes the current pcap file
+func (w *PcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	w.writer = nil
+	w.retention.release(w)
+	log.Println("Closed pcap file")
+	return err
+}
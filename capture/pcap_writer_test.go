@@ -0,0 +1,57 @@
+package capture
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestPcapRetentionCoversDirectory(t *testing.T) {
+	dir := t.TempDir()
+	// Files of an earlier run and of another source
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"capture_2024-01-01_00-00-00.pcap", "ssh_capture_host_2024-01-01_00-00-00.pcap", "notes.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := RotationConfig{Dir: dir, MaxFiles: 2}
+	eth0, err := NewPcapWriter(config, "capture_eth0", 1600, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eth0.Close()
+	eth1, err := NewPcapWriter(config, "capture_eth1", 1600, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eth1.Close()
+
+	var pcaps []string
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".pcap" {
+			pcaps = append(pcaps, filepath.Join(dir, entry.Name()))
+		}
+	}
+	// Only the files being written are left, and other files are untouched
+	if len(pcaps) != 2 {
+		t.Errorf("got pcap files %q, want the two being written", pcaps)
+	}
+	for _, w := range []*PcapWriter{eth0, eth1} {
+		if _, err := os.Stat(w.CurrentFile()); err != nil {
+			t.Errorf("file being written was deleted: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("non-pcap file was deleted: %v", err)
+	}
+}
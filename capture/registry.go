@@ -0,0 +1,381 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Protocols that detection assigns without port rules. The registry always
+// contains them so their colors can be configured like any other.
+const (
+	ProtocolNameTCP    = "TCP"
+	ProtocolNameUDP    = "UDP"
+	ProtocolNameICMP   = "ICMP"
+	ProtocolNameARP    = "ARP"
+	ProtocolNameIPv6   = "IPv6"
+	ProtocolNameTunnel = "Tunnel"
+	ProtocolNameOther  = "Other"
+)
+
+// ProtocolDef is a registry entry: a protocol's display color and the TCP
+// and UDP ports it is detected on. When both ports of a packet match, or
+// two entries claim the same port, the higher Priority wins; ties go to the
+// lower port number, then to the entry listed first.
+type ProtocolDef struct {
+	Name     string   `json:"name"`
+	Color    string   `json:"color"`
+	TCP      PortList `json:"tcp,omitempty"`
+	UDP      PortList `json:"udp,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	First, Last uint16
+}
+
+// PortList is a list of ports and port ranges. In JSON each element is a
+// number or a "first-last" string.
+type PortList []PortRange
+
+// UnmarshalJSON accepts numbers, "443" and "8000-8099"
+func (p *PortList) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+
+	list := make(PortList, 0, len(items))
+	for _, item := range items {
+		var s string
+		if err := json.Unmarshal(item, &s); err != nil {
+			s = string(item)
+		}
+		r, err := parsePortRange(s)
+		if err != nil {
+			return err
+		}
+		list = append(list, r)
+	}
+	*p = list
+	return nil
+}
+
+// MarshalJSON writes single ports as numbers and ranges as strings
+func (p PortList) MarshalJSON() ([]byte, error) {
+	items := make([]interface{}, len(p))
+	for i, r := range p {
+		if r.First == r.Last {
+			items[i] = r.First
+		} else {
+			items[i] = fmt.Sprintf("%d-%d", r.First, r.Last)
+		}
+	}
+	return json.Marshal(items)
+}
+
+// parsePortRange parses "443" or "8000-8099"
+func parsePortRange(s string) (PortRange, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	lo, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if isRange {
+		hi, err = strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+		if err != nil || hi < lo {
+			return PortRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return PortRange{First: uint16(lo), Last: uint16(hi)}, nil
+}
+
+// ports is a shorthand for single-port lists in the defaults
+func ports(list ...uint16) PortList {
+	p := make(PortList, len(list))
+	for i, port := range list {
+		p[i] = PortRange{First: port, Last: port}
+	}
+	return p
+}
+
+// DefaultProtocols returns the built-in registry
+func DefaultProtocols() []ProtocolDef {
+	return []ProtocolDef{
+		{Name: ProtocolNameTCP, Color: "#3498db"},
+		{Name: ProtocolNameUDP, Color: "#2ecc71"},
+		{Name: ProtocolNameICMP, Color: "#f39c12"},
+		{Name: "HTTP", Color: "#e67e22", TCP: ports(80, 8080, 8000, 3000)},
+		{Name: "HTTPS", Color: "#9b59b6", TCP: ports(443, 8443)},
+		{Name: ProtocolNameTLS, Color: "#8e44ad"}, // TLS on ports without a rule, see signatures.go
+		{Name: "QUIC", Color: "#00b894", UDP: ports(443)},
+		{Name: "DNS", Color: "#1abc9c", TCP: ports(53), UDP: ports(53)},
+		{Name: "SSH", Color: "#e74c3c", TCP: ports(22)},
+		{Name: "FTP", Color: "#ff6b9d", TCP: ports(21, 20)},
+		{Name: "SMTP", Color: "#8b4513", TCP: ports(25, 465, 587)},
+		{Name: "Telnet", Color: "#c0392b", TCP: ports(23)},
+		{Name: "MySQL", Color: "#34495e", TCP: ports(3306)},
+		{Name: "PostgreSQL", Color: "#16a085", TCP: ports(5432)},
+		{Name: "Redis", Color: "#d35400", TCP: ports(6379)},
+		{Name: "InfluxDB", Color: "#22ADF6", TCP: ports(8086)},
+		{Name: "Slurm", Color: "#ff7f50", TCP: ports(6817, 6818)}, // slurmctld, slurmd
+		{Name: "DHCP", Color: "#f1c40f", UDP: ports(67, 68)},
+		{Name: "NTP", Color: "#6c5ce7", UDP: ports(123)},
+		{Name: "SNMP", Color: "#a29bfe", UDP: ports(161, 162)}, // agents, trap receivers
+		{Name: "LDAP", Color: "#0984e3", TCP: ports(389, 3268), UDP: ports(389)},
+		{Name: "Kerberos", Color: "#b33939", TCP: ports(88), UDP: ports(88)},
+		{Name: "SMB", Color: "#2d3436", TCP: ports(445)},
+		{Name: "RDP", Color: "#e84393", TCP: ports(3389)},
+		{Name: "Syslog", Color: "#636e72", TCP: ports(601), UDP: ports(514)},
+		{Name: "Modbus", Color: "#e17055", TCP: ports(502)},
+		{Name: "DNP3", Color: "#fab1a0", TCP: ports(20000), UDP: ports(20000)},
+		{Name: "S7comm", Color: "#009432", TCP: ports(102)},
+		{Name: "BACnet", Color: "#c44569", UDP: ports(47808)},
+		{Name: "MQTT", Color: "#660066", TCP: ports(1883)},
+		{Name: "CoAP", Color: "#3dc1d3", UDP: ports(5683)},
+		{Name: ProtocolNameARP, Color: "#95a5a6"},
+		{Name: ProtocolNameIPv6, Color: "#7f8c8d"},
+		{Name: ProtocolNameTunnel, Color: "#5d6d7e"},
+		{Name: ProtocolNameOther, Color: "#ecf0f1"},
+	}
+}
+
+// protocolRegistryFile is the JSON layout read by LoadProtocols
+type protocolRegistryFile struct {
+	Protocols []ProtocolDef `json:"protocols"`
+}
+
+// LoadProtocols reads registry entries from a JSON file and merges them
+// over the defaults: an entry replaces the default of the same name
+// (ports included) and new names are appended.
+func LoadProtocols(path string) ([]ProtocolDef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read protocol registry: %v", err)
+	}
+	var file protocolRegistryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse protocol registry: %v", err)
+	}
+
+	defs := DefaultProtocols()
+	index := make(map[string]int, len(defs))
+	for i, def := range defs {
+		index[def.Name] = i
+	}
+	for _, def := range file.Protocols {
+		if i, ok := index[def.Name]; ok {
+			defs[i] = def
+			continue
+		}
+		index[def.Name] = len(defs)
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+// protocolRegistry is a validated set of entries with its port tables
+type protocolRegistry struct {
+	defs   []ProtocolDef
+	byName map[string]int
+	tcp    []int16 // Entry index by port, -1 if unassigned
+	udp    []int16
+}
+
+var (
+	protocolRegistryMu   sync.RWMutex
+	registry             = mustCompileRegistry(DefaultProtocols())
+	protocolRegistryPath string // File reloaded by ReloadProtocols, empty for the defaults
+)
+
+func mustCompileRegistry(defs []ProtocolDef) *protocolRegistry {
+	r, err := compileRegistry(defs)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// compileRegistry validates entries and builds the port tables
+func compileRegistry(defs []ProtocolDef) (*protocolRegistry, error) {
+	r := &protocolRegistry{
+		defs:   make([]ProtocolDef, 0, len(defs)),
+		byName: make(map[string]int, len(defs)),
+		tcp:    make([]int16, 1<<16),
+		udp:    make([]int16, 1<<16),
+	}
+	for i := range r.tcp {
+		r.tcp[i], r.udp[i] = -1, -1
+	}
+
+	for _, def := range defs {
+		def.Name = strings.TrimSpace(def.Name)
+		if def.Name == "" {
+			return nil, fmt.Errorf("protocol without a name")
+		}
+		if _, dup := r.byName[def.Name]; dup {
+			return nil, fmt.Errorf("protocol %s listed twice", def.Name)
+		}
+		if !validColor(def.Color) {
+			return nil, fmt.Errorf("protocol %s: invalid color %q (want #rrggbb)", def.Name, def.Color)
+		}
+		if len(r.defs) >= 1<<15-1 {
+			return nil, fmt.Errorf("too many protocols")
+		}
+		r.byName[def.Name] = len(r.defs)
+		r.defs = append(r.defs, def)
+	}
+
+	// Built-in protocols must exist even if a file leaves them out
+	for _, def := range DefaultProtocols() {
+		if len(def.TCP) == 0 && len(def.UDP) == 0 {
+			if _, ok := r.byName[def.Name]; !ok {
+				r.byName[def.Name] = len(r.defs)
+				r.defs = append(r.defs, def)
+			}
+		}
+	}
+
+	for i, def := range r.defs {
+		r.assign(r.tcp, def.TCP, i)
+		r.assign(r.udp, def.UDP, i)
+	}
+	return r, nil
+}
+
+// assign claims ports for entry i unless an entry with a higher (or equal
+// and earlier) priority already holds them
+func (r *protocolRegistry) assign(table []int16, ranges PortList, i int) {
+	for _, pr := range ranges {
+		for port := int(pr.First); port <= int(pr.Last); port++ {
+			if cur := table[port]; cur < 0 || r.defs[i].Priority > r.defs[cur].Priority {
+				table[port] = int16(i)
+			}
+		}
+	}
+}
+
+// validColor accepts CSS hex colors (#rgb or #rrggbb)
+func validColor(color string) bool {
+	if len(color) != 4 && len(color) != 7 || color[0] != '#' {
+		return false
+	}
+	_, err := strconv.ParseUint(color[1:], 16, 32)
+	return err == nil
+}
+
+// SetProtocols validates and installs registry entries
+func SetProtocols(defs []ProtocolDef) error {
+	r, err := compileRegistry(defs)
+	if err != nil {
+		return err
+	}
+
+	protocolRegistryMu.Lock()
+	registry = r
+	protocolRegistryMu.Unlock()
+	return nil
+}
+
+// LoadProtocolsFile installs the registry from a JSON file and remembers
+// the path for ReloadProtocols
+func LoadProtocolsFile(path string) error {
+	defs, err := LoadProtocols(path)
+	if err != nil {
+		return err
+	}
+	if err := SetProtocols(defs); err != nil {
+		return fmt.Errorf("invalid protocol registry: %v", err)
+	}
+
+	protocolRegistryMu.Lock()
+	protocolRegistryPath = path
+	protocolRegistryMu.Unlock()
+	return nil
+}
+
+// ReloadProtocols re-reads the registry file given to LoadProtocolsFile.
+// Without one the defaults are reinstalled. On error the current registry
+// stays in effect.
+func ReloadProtocols() error {
+	protocolRegistryMu.RLock()
+	path := protocolRegistryPath
+	protocolRegistryMu.RUnlock()
+
+	if path == "" {
+		return SetProtocols(DefaultProtocols())
+	}
+	return LoadProtocolsFile(path)
+}
+
+// CurrentProtocols returns the registry entries in effect
+func CurrentProtocols() []ProtocolDef {
+	r := currentRegistry()
+	defs := make([]ProtocolDef, len(r.defs))
+	copy(defs, r.defs)
+	return defs
+}
+
+func currentRegistry() *protocolRegistry {
+	protocolRegistryMu.RLock()
+	defer protocolRegistryMu.RUnlock()
+	return registry
+}
+
+// LookupProtocol returns a registered protocol by name. Unknown names keep
+// their name and take the color of Other.
+func LookupProtocol(name string) Protocol {
+	return currentRegistry().lookup(name)
+}
+
+func (r *protocolRegistry) lookup(name string) Protocol {
+	if i, ok := r.byName[name]; ok {
+		return Protocol{Name: name, Color: r.defs[i].Color}
+	}
+	return Protocol{Name: name, Color: r.defs[r.byName[ProtocolNameOther]].Color}
+}
+
+// IsApplicationProtocol reports whether a name is a registered protocol
+// other than the built-in transport and link-level ones
+func IsApplicationProtocol(name string) bool {
+	switch name {
+	case ProtocolNameTCP, ProtocolNameUDP, ProtocolNameICMP, ProtocolNameARP,
+		ProtocolNameIPv6, ProtocolNameTunnel, ProtocolNameOther:
+		return false
+	}
+	_, ok := currentRegistry().byName[name]
+	return ok
+}
+
+// portProtocol picks the registry entry for a port pair
+func (r *protocolRegistry) portProtocol(table []int16, srcPort, dstPort uint16) (Protocol, bool) {
+	src, dst := table[srcPort], table[dstPort]
+	switch {
+	case src < 0 && dst < 0:
+		return Protocol{}, false
+	case src < 0:
+		return r.protocolAt(dst), true
+	case dst < 0:
+		return r.protocolAt(src), true
+	}
+
+	if ps, pd := r.defs[src].Priority, r.defs[dst].Priority; ps != pd {
+		if ps > pd {
+			return r.protocolAt(src), true
+		}
+		return r.protocolAt(dst), true
+	}
+	if srcPort < dstPort || (srcPort == dstPort && src < dst) {
+		return r.protocolAt(src), true
+	}
+	return r.protocolAt(dst), true
+}
+
+func (r *protocolRegistry) protocolAt(i int16) Protocol {
+	return Protocol{Name: r.defs[i].Name, Color: r.defs[i].Color}
+}
@@ -0,0 +1,506 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+)
+
+// Protocol names assigned from payload signatures that have no port rule
+// of their own in the default registry
+const ProtocolNameTLS = "TLS"
+
+// carrierSignatures are signatures other application protocols run over.
+// A flow on a registered port whose protocol has no signature of its own
+// (e.g. InfluxDB's HTTP API) keeps the port's protocol when one matches.
+var carrierSignatures = map[string]bool{
+	"HTTP":          true,
+	ProtocolNameTLS: true,
+}
+
+// expectedSignatures maps registry protocols onto the signature their
+// traffic must match when it differs from their own name
+var expectedSignatures = map[string]string{
+	"HTTPS": ProtocolNameTLS,
+}
+
+// expectedSignature returns the signature a protocol's payload should
+// match, or "" if it has none
+func expectedSignature(name string) string {
+	if sig, ok := expectedSignatures[name]; ok {
+		return sig
+	}
+	switch name {
+	case ProtocolNameTLS, "HTTP", "SSH", "SMTP", "FTP", "DNS", "MySQL", "PostgreSQL", "Redis", "QUIC",
+		"DHCP", "NTP", "SNMP", "LDAP", "Kerberos", "SMB", "RDP", "Syslog",
+		"Modbus", "DNP3", "S7comm", "BACnet", "MQTT", "CoAP":
+		return name
+	}
+	return ""
+}
+
+var (
+	httpRequestLine = regexp.MustCompile(`^(GET|POST|PUT|DELETE|HEAD|OPTIONS|PATCH|CONNECT|TRACE) \S+ HTTP/1\.[01]\r?\n`)
+	httpStatusLine  = regexp.MustCompile(`^HTTP/1\.[01] \d{3}[ \r\n]`)
+	respCommand     = regexp.MustCompile(`^\*\d{1,6}\r\n\$\d{1,9}\r\n`)
+	greetingLine    = regexp.MustCompile(`^220[ -][^\r\n]*`)
+	syslogPriority  = regexp.MustCompile(`^(?:\d{1,5} )?<(\d{1,3})>`)
+)
+
+// http2Preface starts every cleartext HTTP/2 connection
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// matchSignature identifies a protocol from the first payload of a segment
+// or datagram. portName is the protocol the port rules chose; it settles
+// greetings shared by several protocols.
+func matchSignature(payload []byte, tcp bool, portName string) (string, bool) {
+	if len(payload) == 0 {
+		return "", false
+	}
+	if !tcp {
+		switch {
+		case isQUICPacket(payload, portName == "QUIC"):
+			return "QUIC", true
+		case isDHCPMessage(payload):
+			return "DHCP", true
+		case isBACnetIP(payload):
+			return "BACnet", true
+		case isDNP3Frame(payload):
+			return "DNP3", true
+		case isSNMPMessage(payload):
+			return "SNMP", true
+		case isKerberosMessage(payload, false):
+			return "Kerberos", true
+		case isLDAPMessage(payload, false):
+			return "LDAP", true
+		case portName == "NTP" && isNTPMessage(payload):
+			return "NTP", true
+		case portName == "Syslog" && isSyslogMessage(payload):
+			return "Syslog", true
+		case portName == "CoAP" && isCoAPMessage(payload):
+			return "CoAP", true
+		}
+		if isDNSMessage(payload) {
+			return "DNS", true
+		}
+		return "", false
+	}
+
+	switch {
+	case isTLSRecord(payload):
+		return ProtocolNameTLS, true
+	case httpRequestLine.Match(payload), httpStatusLine.Match(payload), bytes.HasPrefix(payload, http2Preface):
+		return "HTTP", true
+	case bytes.HasPrefix(payload, []byte("SSH-2.0-")), bytes.HasPrefix(payload, []byte("SSH-1.99-")):
+		return "SSH", true
+	case isMySQLGreeting(payload):
+		return "MySQL", true
+	case isPostgresStartup(payload):
+		return "PostgreSQL", true
+	case respCommand.Match(payload), bytes.HasPrefix(payload, []byte("-NOAUTH ")), bytes.HasPrefix(payload, []byte("+PONG\r\n")):
+		return "Redis", true
+	case bytes.HasPrefix(payload, []byte("EHLO ")), bytes.HasPrefix(payload, []byte("HELO ")):
+		return "SMTP", true
+	case isSMBMessage(payload):
+		return "SMB", true
+	case isS7comm(payload): // Before RDP, which also opens with an X.224 connection request
+		return "S7comm", true
+	case isRDPConnection(payload):
+		return "RDP", true
+	case isModbusTCP(payload):
+		return "Modbus", true
+	case isDNP3Frame(payload):
+		return "DNP3", true
+	case isMQTTConnect(payload):
+		return "MQTT", true
+	case isKerberosMessage(payload, true):
+		return "Kerberos", true
+	case isLDAPMessage(payload, true):
+		return "LDAP", true
+	case portName == "Syslog" && isSyslogMessage(payload):
+		return "Syslog", true
+	}
+
+	if line := greetingLine.Find(payload); line != nil {
+		// SMTP and FTP servers both greet with 220
+		upper := bytes.ToUpper(line)
+		switch {
+		case portName == "SMTP" || portName == "FTP":
+			return portName, true
+		case bytes.Contains(upper, []byte("SMTP")) || bytes.Contains(upper, []byte("MAIL")):
+			return "SMTP", true
+		case bytes.Contains(upper, []byte("FTP")):
+			return "FTP", true
+		}
+	}
+
+	// DNS over TCP carries a two-byte length prefix
+	if len(payload) > 2 && int(binary.BigEndian.Uint16(payload)) == len(payload)-2 && isDNSMessage(payload[2:]) {
+		return "DNS", true
+	}
+	return "", false
+}
+
+// isTLSRecord recognises a TLS handshake (ClientHello/ServerHello), or an
+// application data record for flows picked up mid-connection
+func isTLSRecord(p []byte) bool {
+	if len(p) < 6 || p[1] != 3 || p[2] > 4 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(p[3:5]))
+	if length == 0 || length > 1<<14+2048 {
+		return false
+	}
+	switch p[0] {
+	case 0x16: // Handshake
+		return p[5] == 1 || p[5] == 2
+	case 0x17: // Application data, TLS 1.0 to 1.3 record versions
+		return p[2] >= 1 && p[2] <= 3
+	}
+	return false
+}
+
+// isQUICPacket recognises QUIC long header packets of known versions and
+// version negotiation. Short headers have no fixed bytes beyond the first
+// two bits, so they only count when the port already says QUIC.
+func isQUICPacket(p []byte, onPort bool) bool {
+	if len(p) < 7 || p[0]&0x80 == 0 {
+		return onPort && len(p) > 0 && p[0]&0xc0 == 0x40
+	}
+	version := binary.BigEndian.Uint32(p[1:5])
+	switch {
+	case version == 0: // Version negotiation
+		return true
+	case version == 0x00000001, version == 0x6b3343cf, version>>8 == 0xff0000: // v1, v2, drafts
+		return p[0]&0x40 != 0 && p[5] <= 20
+	}
+	return false
+}
+
+// isMySQLGreeting recognises the server's protocol v10 handshake packet
+func isMySQLGreeting(p []byte) bool {
+	if len(p) < 10 || p[3] != 0 || p[4] != 10 {
+		return false
+	}
+	length := int(p[0]) | int(p[1])<<8 | int(p[2])<<16
+	if length < 6 || length+4 > len(p) {
+		return false
+	}
+	// Printable server version terminated by NUL
+	end := bytes.IndexByte(p[5:], 0)
+	if end < 1 {
+		return false
+	}
+	for _, c := range p[5 : 5+end] {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// PostgreSQL protocol codes sent by clients in place of a version
+const (
+	pgProtocolV3     = 0x00030000
+	pgSSLRequest     = 80877103
+	pgGSSENCRequest  = 80877104
+	pgCancelRequest  = 80877102
+	pgMaxStartupSize = 10000
+)
+
+// isPostgresStartup recognises a StartupMessage, SSLRequest, GSSENCRequest
+// or CancelRequest
+func isPostgresStartup(p []byte) bool {
+	if len(p) < 8 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint32(p))
+	if length != len(p) || length > pgMaxStartupSize {
+		return false
+	}
+	switch binary.BigEndian.Uint32(p[4:]) {
+	case pgProtocolV3:
+		return length > 8 && p[len(p)-1] == 0
+	case pgSSLRequest, pgGSSENCRequest:
+		return length == 8
+	case pgCancelRequest:
+		return length == 16
+	}
+	return false
+}
+
+// isDNSMessage checks the header counts and the first question of a DNS
+// message
+func isDNSMessage(p []byte) bool {
+	if len(p) < 12 {
+		return false
+	}
+	opcode := (p[2] >> 3) & 0x0f
+	if opcode > 5 || opcode == 3 {
+		return false
+	}
+	qd := binary.BigEndian.Uint16(p[4:])
+	an := binary.BigEndian.Uint16(p[6:])
+	ns := binary.BigEndian.Uint16(p[8:])
+	ar := binary.BigEndian.Uint16(p[10:])
+	if qd == 0 || qd > 16 || an > 256 || ns > 256 || ar > 256 {
+		return false
+	}
+
+	// Walk the first question's name, which is never compressed
+	off := 12
+	for {
+		if off >= len(p) {
+			return false
+		}
+		n := int(p[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 {
+			return false
+		}
+		off += n
+	}
+	if off+4 > len(p) {
+		return false
+	}
+	class := binary.BigEndian.Uint16(p[off+2:]) &^ 0x8000 // mDNS unicast-response bit
+	return class == 1 || class == 3 || class == 4 || class == 255
+}
+
+// berHeader reads the identifier and definite length of a BER element
+// with a single-byte tag
+func berHeader(p []byte) (tag byte, header, length int, ok bool) {
+	if len(p) < 2 || p[0]&0x1f == 0x1f {
+		return 0, 0, 0, false
+	}
+	tag, n := p[0], int(p[1])
+	if n < 0x80 {
+		return tag, 2, n, true
+	}
+	size := n & 0x7f
+	if size == 0 || size > 4 || len(p) < 2+size {
+		return 0, 0, 0, false
+	}
+	n = 0
+	for _, b := range p[2 : 2+size] {
+		n = n<<8 | int(b)
+	}
+	return tag, 2 + size, n, n >= 0
+}
+
+// isDHCPMessage checks the BOOTP header and the DHCP magic cookie
+func isDHCPMessage(p []byte) bool {
+	return len(p) >= 240 && (p[0] == 1 || p[0] == 2) && p[2] <= 16 &&
+		binary.BigEndian.Uint32(p[236:]) == 0x63825363
+}
+
+// isSNMPMessage recognises a v1, v2c or v3 message: a SEQUENCE holding the
+// version and then the community string or v3 header data
+func isSNMPMessage(p []byte) bool {
+	tag, hdr, length, ok := berHeader(p)
+	if !ok || tag != 0x30 || hdr+length != len(p) || len(p) < hdr+5 {
+		return false
+	}
+	body := p[hdr:]
+	if body[0] != 0x02 || body[1] != 1 {
+		return false
+	}
+	switch body[2] {
+	case 0, 1: // v1, v2c
+		return body[3] == 0x04
+	case 3:
+		return body[3] == 0x30
+	}
+	return false
+}
+
+// isLDAPMessage recognises an LDAPMessage: a SEQUENCE holding the message
+// ID and an APPLICATION-tagged operation. A TCP segment may hold part of a
+// message; a datagram (connectionless LDAP) must hold exactly one.
+func isLDAPMessage(p []byte, tcp bool) bool {
+	tag, hdr, length, ok := berHeader(p)
+	if !ok || tag != 0x30 || (!tcp && hdr+length != len(p)) {
+		return false
+	}
+	body := p[hdr:]
+	if len(body) < 4 || body[0] != 0x02 || body[1] == 0 || body[1] > 4 || len(body) < 3+int(body[1]) {
+		return false
+	}
+	op := body[2+int(body[1])]
+	return op&0xc0 == 0x40 && op&0x1f <= 25
+}
+
+// isKerberosMessage recognises KDC requests, replies and errors. Over TCP
+// they carry a four-byte length prefix, and a ticket-laden request may
+// continue in later segments.
+func isKerberosMessage(p []byte, tcp bool) bool {
+	size := len(p)
+	if tcp {
+		if len(p) < 4 || binary.BigEndian.Uint32(p) > 1<<20 {
+			return false
+		}
+		size = int(binary.BigEndian.Uint32(p))
+		p = p[4:]
+		if len(p) > size {
+			return false
+		}
+	}
+	tag, hdr, length, ok := berHeader(p)
+	if !ok || hdr+length != size || len(p) <= hdr {
+		return false
+	}
+	switch tag {
+	case 0x6a, 0x6b, 0x6c, 0x6d, 0x7e: // AS-REQ, AS-REP, TGS-REQ, TGS-REP, KRB-ERROR
+		return p[hdr] == 0x30
+	}
+	return false
+}
+
+// isSMBMessage recognises SMB1, SMB2 and SMB3 transform or compression
+// headers behind the direct TCP transport's length field
+func isSMBMessage(p []byte) bool {
+	if len(p) < 8 || p[0] != 0 || !bytes.Equal(p[5:8], []byte("SMB")) {
+		return false
+	}
+	switch p[4] {
+	case 0xff, 0xfe, 0xfd, 0xfc:
+		return true
+	}
+	return false
+}
+
+// isRDPConnection recognises the X.224 connection request and confirm that
+// open RDP connections, carried in a TPKT
+func isRDPConnection(p []byte) bool {
+	if len(p) < 11 || p[0] != 3 || p[1] != 0 || int(binary.BigEndian.Uint16(p[2:])) != len(p) {
+		return false
+	}
+	code := p[5] & 0xf0
+	return int(p[4]) == len(p)-5 && (code == 0xe0 || code == 0xd0)
+}
+
+// isNTPMessage checks the version and mode of an NTP packet. Nothing else
+// in the header is fixed, so it only counts on the NTP port.
+func isNTPMessage(p []byte) bool {
+	if len(p) < 12 {
+		return false
+	}
+	version, mode := (p[0]>>3)&7, p[0]&7
+	if version < 1 || version > 4 || mode == 0 {
+		return false
+	}
+	return mode >= 6 || len(p) >= 48 // Control and private messages are shorter
+}
+
+// isSyslogMessage recognises the <PRI> that starts BSD and RFC 5424
+// messages, after an octet count on TCP. It only counts on syslog ports.
+func isSyslogMessage(p []byte) bool {
+	m := syslogPriority.FindSubmatch(p)
+	if m == nil {
+		return false
+	}
+	pri := 0
+	for _, c := range m[1] {
+		pri = pri*10 + int(c-'0')
+	}
+	return pri <= 191
+}
+
+// isModbusTCP checks the MBAP header of a Modbus/TCP request or response:
+// protocol ID 0, a length matching the segment, and a known function code
+func isModbusTCP(p []byte) bool {
+	if len(p) < 8 || p[2] != 0 || p[3] != 0 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(p[4:]))
+	if length < 2 || length > 254 || length != len(p)-6 {
+		return false
+	}
+	switch p[7] & 0x7f { // Exception responses set the top bit
+	case 1, 2, 3, 4, 5, 6, 7, 8, 11, 12, 15, 16, 17, 20, 21, 22, 23, 24, 43:
+		return true
+	}
+	return false
+}
+
+// isDNP3Frame checks the start bytes and header CRC of a DNP3 link frame
+func isDNP3Frame(p []byte) bool {
+	if len(p) < 10 || p[0] != 0x05 || p[1] != 0x64 || p[2] < 5 {
+		return false
+	}
+	return dnp3CRC(p[:8]) == binary.LittleEndian.Uint16(p[8:])
+}
+
+// dnp3CRC is the CRC-16/DNP of a block
+func dnp3CRC(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa6bc
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+// isS7comm recognises S7 traffic in a TPKT: a COTP connection request or
+// confirm carrying TSAP parameters, or COTP data holding an S7comm (0x32)
+// or S7comm-plus (0x72) PDU
+func isS7comm(p []byte) bool {
+	if len(p) < 8 || p[0] != 3 || p[1] != 0 || int(binary.BigEndian.Uint16(p[2:])) != len(p) {
+		return false
+	}
+	li := int(p[4])
+	if 5+li > len(p) {
+		return false
+	}
+	switch p[5] & 0xf0 {
+	case 0xe0, 0xd0:
+		return li >= 9 && p[11] >= 0xc0 && p[11] <= 0xc2
+	case 0xf0:
+		return 5+li < len(p) && (p[5+li] == 0x32 || p[5+li] == 0x72)
+	}
+	return false
+}
+
+// isBACnetIP checks the BACnet Virtual Link Control header of BACnet/IP
+func isBACnetIP(p []byte) bool {
+	return len(p) >= 4 && p[0] == 0x81 && p[1] <= 0x0c && int(binary.BigEndian.Uint16(p[2:])) == len(p)
+}
+
+// isMQTTConnect recognises the CONNECT packet that opens MQTT 3.1, 3.1.1
+// and 5 connections
+func isMQTTConnect(p []byte) bool {
+	if len(p) < 2 || p[0] != 0x10 {
+		return false
+	}
+	off := 1
+	for ; off < len(p) && off <= 4; off++ {
+		if p[off]&0x80 == 0 {
+			break
+		}
+	}
+	off++
+	rest := p[min(off, len(p)):]
+	return bytes.HasPrefix(rest, []byte("\x00\x04MQTT")) || bytes.HasPrefix(rest, []byte("\x00\x06MQIsdp"))
+}
+
+// isCoAPMessage checks the version, token length and code class of a CoAP
+// header. Little else is fixed, so it only counts on the CoAP port.
+func isCoAPMessage(p []byte) bool {
+	if len(p) < 4 || p[0]>>6 != 1 || int(p[0]&0x0f) > 8 || len(p) < 4+int(p[0]&0x0f) {
+		return false
+	}
+	switch p[1] >> 5 {
+	case 0, 2, 4, 5: // Requests and empty messages, success, client and server errors
+		return true
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package capture
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// berSequence wraps body in a BER SEQUENCE with a short length
+func berSequence(body ...byte) []byte {
+	return append([]byte{0x30, byte(len(body))}, body...)
+}
+
+// dnp3Frame is a DNP3 link header (reset link states, 1 to 1024) with its CRC
+func dnp3Frame() []byte {
+	header := []byte{0x05, 0x64, 0x05, 0xc0, 0x01, 0x00, 0x00, 0x04}
+	crc := dnp3CRC(header)
+	return append(header, byte(crc), byte(crc>>8))
+}
+
+// dnsQuery asks for the A record of example.com
+var dnsQuery = []byte{
+	0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00, 0x00, 0x01, 0x00, 0x01,
+}
+
+func TestMatchSignature(t *testing.T) {
+	dhcp := make([]byte, 244)
+	dhcp[0], dhcp[1], dhcp[2] = 1, 1, 6
+	copy(dhcp[236:], []byte{0x63, 0x82, 0x53, 0x63, 0xff})
+	ntp := make([]byte, 48)
+	ntp[0] = 0x23 // Version 4, client
+	smb := append([]byte{0x00, 0x00, 0x00, 0x40, 0xfe, 'S', 'M', 'B'}, make([]byte, 60)...)
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		tcp      bool
+		portName string
+		want     string // "" for no match
+	}{
+		// TCP signatures
+		{"TLS ClientHello", []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x03}, true, "", ProtocolNameTLS},
+		{"TLS application data", []byte{0x17, 0x03, 0x03, 0x00, 0x10, 0xaa}, true, "", ProtocolNameTLS},
+		{"TLS unknown record version", []byte{0x16, 0x03, 0x05, 0x00, 0x05, 0x01}, true, "", ""},
+		{"HTTP request", []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), true, "", "HTTP"},
+		{"HTTP response", []byte("HTTP/1.1 200 OK\r\n"), true, "", "HTTP"},
+		{"HTTP/2 preface", http2Preface, true, "", "HTTP"},
+		{"HTTP unknown method", []byte("FETCH / HTTP/1.1\r\n"), true, "", ""},
+		{"SSH", []byte("SSH-2.0-OpenSSH_9.6\r\n"), true, "", "SSH"},
+		{"MySQL greeting", []byte{0x0c, 0x00, 0x00, 0x00, 0x0a, '8', '.', '0', '.', '3', '6', 0x00, 0x01, 0x00, 0x00, 0x00}, true, "", "MySQL"},
+		{"PostgreSQL SSLRequest", []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}, true, "", "PostgreSQL"},
+		{"PostgreSQL wrong length", []byte{0x00, 0x00, 0x00, 0x09, 0x04, 0xd2, 0x16, 0x2f}, true, "", ""},
+		{"Redis command", []byte("*1\r\n$4\r\nPING\r\n"), true, "", "Redis"},
+		{"SMTP EHLO", []byte("EHLO mail.example.com\r\n"), true, "", "SMTP"},
+		{"SMTP greeting", []byte("220 mx.example.com ESMTP ready\r\n"), true, "", "SMTP"},
+		{"FTP greeting", []byte("220 ProFTPD Server ready\r\n"), true, "", "FTP"},
+		{"220 greeting on the FTP port", []byte("220 Welcome\r\n"), true, "FTP", "FTP"},
+		{"220 greeting elsewhere", []byte("220 Welcome\r\n"), true, "", ""},
+		{"SMB2", smb, true, "", "SMB"},
+		{"RDP connection request", []byte{0x03, 0x00, 0x00, 0x0b, 0x06, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00}, true, "", "RDP"},
+		{"S7 connection request", []byte{
+			0x03, 0x00, 0x00, 0x16, 0x11, 0xe0, 0x00, 0x00, 0x00, 0x01, 0x00,
+			0xc1, 0x02, 0x01, 0x00, 0xc2, 0x02, 0x01, 0x02, 0xc0, 0x01, 0x0a,
+		}, true, "", "S7comm"},
+		{"Modbus read holding registers", []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x01, 0x03, 0x00, 0x00, 0x00, 0x0a}, true, "", "Modbus"},
+		{"Modbus wrong protocol ID", []byte{0x00, 0x01, 0x00, 0x01, 0x00, 0x06, 0x01, 0x03, 0x00, 0x00, 0x00, 0x0a}, true, "", ""},
+		{"DNP3 over TCP", dnp3Frame(), true, "", "DNP3"},
+		{"DNP3 bad CRC", append(dnp3Frame()[:8], 0x00, 0x00), true, "", ""},
+		{"MQTT CONNECT", []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x00}, true, "", "MQTT"},
+		{"Kerberos over TCP", []byte{0x00, 0x00, 0x00, 0x05, 0x6a, 0x03, 0x30, 0x01, 0x00}, true, "", "Kerberos"},
+		{"LDAP bind over TCP", berSequence(0x02, 0x01, 0x01, 0x60, 0x07, 0x02, 0x01, 0x03, 0x04, 0x00, 0x80, 0x00), true, "", "LDAP"},
+		{"DNS over TCP", append([]byte{0x00, byte(len(dnsQuery))}, dnsQuery...), true, "", "DNS"},
+		{"Syslog over TCP on its port", []byte("<34>Oct 11 22:14:15 host su: test\n"), true, "Syslog", "Syslog"},
+		{"plain text", []byte("hello world\r\n"), true, "", ""},
+
+		// UDP signatures
+		{"QUIC Initial", []byte{0xc0, 0x00, 0x00, 0x00, 0x01, 0x08, 1, 2, 3, 4, 5, 6, 7, 8, 0x00}, false, "", "QUIC"},
+		{"QUIC short header on its port", []byte{0x41, 1, 2, 3, 4, 5, 6}, false, "QUIC", "QUIC"},
+		{"QUIC short header elsewhere", []byte{0x41, 1, 2, 3, 4, 5, 6}, false, "", ""},
+		{"DHCP", dhcp, false, "", "DHCP"},
+		{"DHCP without magic cookie", dhcp[:236], false, "", ""},
+		{"BACnet/IP", []byte{0x81, 0x0a, 0x00, 0x08, 0x01, 0x20, 0xff, 0xff}, false, "", "BACnet"},
+		{"DNP3 over UDP", dnp3Frame(), false, "", "DNP3"},
+		{"SNMPv2c", berSequence(0x02, 0x01, 0x01, 0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c', 0xa0, 0x00), false, "", "SNMP"},
+		{"Kerberos over UDP", []byte{0x6a, 0x03, 0x30, 0x01, 0x00}, false, "", "Kerberos"},
+		{"CLDAP search", berSequence(0x02, 0x01, 0x01, 0x63, 0x00), false, "", "LDAP"},
+		{"NTP on its port", ntp, false, "NTP", "NTP"},
+		{"NTP elsewhere", ntp, false, "", ""},
+		{"Syslog on its port", []byte("<34>Oct 11 22:14:15 host su: test"), false, "Syslog", "Syslog"},
+		{"Syslog priority out of range", []byte("<999>Oct 11 22:14:15 host su: test"), false, "Syslog", ""},
+		{"CoAP on its port", []byte{0x40, 0x01, 0x12, 0x34}, false, "CoAP", "CoAP"},
+		{"DNS query", dnsQuery, false, "", "DNS"},
+		{"DNS without a question", dnsQuery[:12], false, "", ""},
+		{"empty", nil, false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := matchSignature(tt.payload, tt.tcp, tt.portName)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("matchSignature = %q, %v; want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignatureOnNonStandardPort(t *testing.T) {
+	decoder := NewPacketDecoder()
+	request := testFrame(t, layers.IPProtocolTCP,
+		&layers.TCP{SrcPort: 40000, DstPort: 18080, DataOffset: 5, PSH: true, ACK: true},
+		gopacket.Payload("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+	)
+	info := decoder.ProcessPacket(request)
+	if info == nil || info.Protocol.Name != "HTTP" || info.Confidence != ConfidenceHigh {
+		t.Fatalf("got %+v, want HTTP with high confidence", info)
+	}
+
+	// The decision is cached for the rest of the flow
+	next := testFrame(t, layers.IPProtocolTCP,
+		&layers.TCP{SrcPort: 40000, DstPort: 18080, DataOffset: 5, ACK: true},
+		gopacket.Payload(bytes.Repeat([]byte{0xaa}, 32)),
+	)
+	if info := decoder.ProcessPacket(next); info == nil || info.Protocol.Name != "HTTP" {
+		t.Errorf("got %+v, want the flow to stay HTTP", info)
+	}
+}
@@ -0,0 +1,73 @@
+package capture
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Source is a producer of parsed packets. Local interfaces, SSH sessions and
+// pcap files all implement it and write PacketInfo records to the channel they
+// were created with, so the ingestion pipeline does not care where packets
+// come from.
+type Source interface {
+	// Start reads packets until the context is cancelled, Close is called,
+	// or the source is exhausted
+	Start(ctx context.Context)
+	// Pause temporarily stops packet processing
+	Pause()
+	// Resume continues packet processing after Pause
+	Resume()
+	// Stats returns the source's packet counters
+	Stats() SourceStats
+	// Close stops the source and releases its resources
+	Close() error
+}
+
+// SourceStats holds packet and loss counters for a capture source
+type SourceStats struct {
+	Source           string `json:"source"`           // Human-readable source description
+	Received         uint64 `json:"received"`         // Packets read from the source
+	Delivered        uint64 `json:"delivered"`        // Packets handed to the ingestion pipeline
+	KernelDropped    uint64 `json:"kernelDropped"`    // Dropped by the kernel before we could read them
+	InterfaceDropped uint64 `json:"interfaceDropped"` // Dropped by the network interface or driver
+	ChannelDropped   uint64 `json:"channelDropped"`   // Dropped because the pipeline was saturated
+	Filtered         uint64 `json:"filtered"`         // Skipped as non-IP or excluded addresses
+
+	Fragments          uint64 `json:"fragments"`          // IP fragments received
+	Reassembled        uint64 `json:"reassembled"`        // Datagrams rebuilt from fragments
+	FragmentsDiscarded uint64 `json:"fragmentsDiscarded"` // Incomplete datagrams dropped (timeout, memory limit or malformed)
+}
+
+// sourceCounters tracks SourceStats with atomic updates
+type sourceCounters struct {
+	received         atomic.Uint64
+	delivered        atomic.Uint64
+	kernelDropped    atomic.Uint64
+	interfaceDropped atomic.Uint64
+	channelDropped   atomic.Uint64
+	filtered         atomic.Uint64
+}
+
+// stats returns a snapshot of the counters
+func (sc *sourceCounters) stats(source string) SourceStats {
+	return SourceStats{
+		Source:           source,
+		Received:         sc.received.Load(),
+		Delivered:        sc.delivered.Load(),
+		KernelDropped:    sc.kernelDropped.Load(),
+		InterfaceDropped: sc.interfaceDropped.Load(),
+		ChannelDropped:   sc.channelDropped.Load(),
+		Filtered:         sc.filtered.Load(),
+	}
+}
+
+// deliver sends a packet to the pipeline without blocking, counting drops
+func (sc *sourceCounters) deliver(packetChan chan *PacketInfo, packetInfo *PacketInfo) {
+	select {
+	case packetChan <- packetInfo:
+		sc.delivered.Add(1)
+	default:
+		// Channel is full, drop packet to avoid blocking
+		sc.channelDropped.Add(1)
+	}
+}
@@ -1,17 +1,17 @@
 package capture
 
 import (
+	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -22,41 +22,22 @@ type SSHCaptureConfig struct {
 	PrivateKey string // Path to private key file (for key-based auth)
 	Username   string // SSH username
 	Password   string // SSH password (for password-based auth)
+	Rotation   RotationConfig
 }
 
 // SSHCapture manages packet capture from a remote host via SSH
 type SSHCapture struct {
-	config      SSHCaptureConfig
-	packetChan  chan *PacketInfo
-	sshClient   *ssh.Client
-	sshSession  *ssh.Session
-	pcapWriter  *pcapgo.Writer
-	pcapFile    *os.File
-	pcapDir     string
-	enablePcap  bool
-	paused      bool
-	pauseChan   chan bool
-	resumeChan  chan bool
+	*pcapStream
+	config     SSHCaptureConfig
+	sshClient  *ssh.Client
+	sshSession *ssh.Session
 }
 
 // NewSSHCapture creates a new SSH-based packet capture instance
 func NewSSHCapture(config SSHCaptureConfig, packetChan chan *PacketInfo) (*SSHCapture, error) {
 	c := &SSHCapture{
+		pcapStream: newPcapStream("SSH", config.Interface, interfacePrefix("ssh_capture", config.Interface), config.Rotation, packetChan),
 		config:     config,
-		packetChan: packetChan,
-		pcapDir:    "pcaps",
-		enablePcap: true,
-		paused:     false,
-		pauseChan:  make(chan bool, 1),
-		resumeChan: make(chan bool, 1),
-	}
-
-	// Create pcaps directory if it doesn't exist
-	if c.enablePcap {
-		if err := os.MkdirAll(c.pcapDir, 0755); err != nil {
-			log.Printf("Warning: Failed to create pcaps directory: %v", err)
-			c.enablePcap = false
-		}
 	}
 
 	return c, nil
@@ -105,10 +86,7 @@ func (c *SSHCapture) Start(ctx context.Context) {
 		if c.sshClient != nil {
 			c.sshClient.Close()
 		}
-		if c.pcapFile != nil {
-			c.pcapFile.Close()
-			log.Println("Closed pcap file")
-		}
+		c.closeWriter()
 	}()
 
 	// Build SSH config
@@ -136,6 +114,16 @@ func (c *SSHCapture) Start(ctx context.Context) {
 	}
 	c.sshSession = session
 
+	// Tear down the session on shutdown so a blocked stream read returns
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.closeChan:
+		}
+		session.Close()
+		client.Close()
+	}()
+
 	// Get stdout pipe for tcpdump output
 	stdout, err := session.StdoutPipe()
 	if err != nil {
@@ -150,17 +138,13 @@ func (c *SSHCapture) Start(ctx context.Context) {
 		return
 	}
 
-	// Log stderr in background
+	// Log stderr in background, picking up tcpdump's drop statistics
 	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stderr.Read(buf)
-			if n > 0 {
-				log.Printf("SSH stderr: %s", string(buf[:n]))
-			}
-			if err != nil {
-				return
-			}
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			log.Printf("SSH stderr: %s", line)
+			c.parseTcpdumpStats(line)
 		}
 	}()
 
@@ -189,19 +173,11 @@ func (c *SSHCapture) Start(ctx context.Context) {
 
 	log.Println("Remote packet capture started")
 
-	// Create pcap file for local storage
-	if c.enablePcap {
-		if err := c.createPcapFile(); err != nil {
-			log.Printf("Warning: Failed to create pcap file: %v", err)
-			c.enablePcap = false
-		} else {
-			log.Printf("Saving packets to: %s/", c.pcapDir)
-		}
+	// Read and process pcap stream, saving it to rotating pcap files
+	if err := c.processPcapStream(ctx, stdout); err != nil {
+		log.Printf("SSH pcap stream failed: %v", err)
 	}
 
-	// Read and process pcap stream
-	c.processPcapStream(ctx, stdout)
-
 	// Wait for session to complete
 	if err := session.Wait(); err != nil {
 		log.Printf("SSH session ended: %v", err)
@@ -210,108 +186,29 @@ func (c *SSHCapture) Start(ctx context.Context) {
 	log.Println("Remote packet capture stopped")
 }
 
-// createPcapFile creates a new pcap file with timestamp
-func (c *SSHCapture) createPcapFile() error {
-	if c.pcapFile != nil {
-		c.pcapFile.Close()
-	}
-
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	filename := fmt.Sprintf("%s/ssh_capture_%s.pcap", c.pcapDir, timestamp)
+// tcpdumpDropPattern matches the drop summary tcpdump prints on exit,
+// e.g. "12 packets dropped by kernel" or "3 packets dropped by interface"
+var tcpdumpDropPattern = regexp.MustCompile(`^(\d+) packets? dropped by (kernel|interface)`)
 
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create pcap file: %v", err)
-	}
-
-	writer := pcapgo.NewWriter(file)
-	// Write pcap header with Ethernet link type
-	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
-		file.Close()
-		return fmt.Errorf("failed to write pcap header: %v", err)
+// parseTcpdumpStats records remote drop counts reported by tcpdump
+func (c *SSHCapture) parseTcpdumpStats(line string) {
+	match := tcpdumpDropPattern.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return
 	}
-
-	c.pcapFile = file
-	c.pcapWriter = writer
-
-	log.Printf("Created pcap file: %s", filename)
-	return nil
-}
-
-// processPcapStream reads and processes the pcap stream from SSH
-func (c *SSHCapture) processPcapStream(ctx context.Context, reader io.Reader) {
-	// Create a pcap reader from the stream
-	pcapReader, err := pcapgo.NewReader(reader)
+	count, err := strconv.ParseUint(match[1], 10, 64)
 	if err != nil {
-		log.Printf("Failed to create pcap reader: %v", err)
 		return
 	}
-
-	linkType := pcapReader.LinkType()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-c.pauseChan:
-			c.paused = true
-			log.Println("SSH packet capture paused")
-			<-c.resumeChan
-			c.paused = false
-			log.Println("SSH packet capture resumed")
-		default:
-			if c.paused {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-
-			// Read next packet
-			data, ci, err := pcapReader.ReadPacketData()
-			if err != nil {
-				if err == io.EOF {
-					log.Println("SSH pcap stream ended")
-					return
-				}
-				log.Printf("Error reading packet: %v", err)
-				continue
-			}
-
-			// Write to local pcap file
-			if c.enablePcap && c.pcapWriter != nil {
-				if err := c.pcapWriter.WritePacket(ci, data); err != nil {
-					log.Printf("Warning: Failed to write packet to pcap: %v", err)
-				}
-			}
-
-			// Parse packet
-			packet := gopacket.NewPacket(data, linkType, gopacket.Default)
-			packetInfo := ProcessPacket(packet)
-			if packetInfo == nil {
-				continue
-			}
-
-			// Send packet info to channel (non-blocking)
-			select {
-			case c.packetChan <- packetInfo:
-			default:
-				// Channel is full, drop packet
-			}
-		}
-	}
-}
-
-// Pause pauses SSH packet capture
-func (c *SSHCapture) Pause() {
-	select {
-	case c.pauseChan <- true:
-	default:
+	if match[2] == "kernel" {
+		c.counters.kernelDropped.Store(count)
+	} else {
+		c.counters.interfaceDropped.Store(count)
 	}
 }
 
-// Resume resumes SSH packet capture
-func (c *SSHCapture) Resume() {
-	select {
-	case c.resumeChan <- true:
-	default:
-	}
+// Stats returns the SSH capture's packet counters. Remote kernel drops are
+// only known once tcpdump exits and reports them.
+func (c *SSHCapture) Stats() SourceStats {
+	return c.stats(fmt.Sprintf("ssh %s:%s", c.config.Host, c.config.Interface))
 }
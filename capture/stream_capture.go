@@ -0,0 +1,154 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// StdinPath selects standard input as a live pcap stream
+const StdinPath = "-"
+
+// streamRetryDelay is how long the listener waits after a failed accept
+const streamRetryDelay = time.Second
+
+// StreamCaptureConfig holds configuration for live pcap/pcapng byte streams,
+// e.g. `tcpdump -w - | go-etherape -f -` or pcap sent over `nc`. Exactly one
+// of Path and Listen is set.
+type StreamCaptureConfig struct {
+	Path     string // "-" for stdin, or a named pipe
+	Listen   string // TCP address to accept pcap streams on, e.g. ":5555"
+	Rotation RotationConfig
+}
+
+// StreamCapture ingests a live pcap stream from stdin, a named pipe or a
+// listening TCP socket. The socket accepts one sender at a time and waits
+// for the next connection when a sender disconnects, so appliances can
+// reconnect without restarting the capture.
+type StreamCapture struct {
+	*pcapStream
+	config StreamCaptureConfig
+}
+
+// IsLiveStream reports whether a -f path is a live stream (stdin or a named
+// pipe) rather than a finished pcap file
+func IsLiveStream(path string) bool {
+	if path == StdinPath {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// NewStreamCapture creates a live pcap stream source
+func NewStreamCapture(config StreamCaptureConfig, packetChan chan *PacketInfo) (*StreamCapture, error) {
+	if (config.Path == "") == (config.Listen == "") {
+		return nil, fmt.Errorf("stream capture needs either a path or a listen address")
+	}
+	if config.Path != "" && !IsLiveStream(config.Path) {
+		return nil, fmt.Errorf("%s is not stdin or a named pipe", config.Path)
+	}
+
+	return &StreamCapture{
+		pcapStream: newPcapStream("Live", "", "stream", config.Rotation, packetChan),
+		config:     config,
+	}, nil
+}
+
+// Start reads the stream until it ends, the context is cancelled or Close is
+// called. A listening socket keeps accepting new senders until shutdown.
+func (c *StreamCapture) Start(ctx context.Context) {
+	defer c.closeWriter()
+
+	if c.config.Listen != "" {
+		c.serve(ctx)
+		return
+	}
+
+	var input io.ReadCloser = os.Stdin
+	if c.config.Path != StdinPath {
+		// Opening a FIFO blocks until a writer connects
+		log.Printf("Waiting for a writer on %s...", c.config.Path)
+		file, err := os.Open(c.config.Path)
+		if err != nil {
+			log.Printf("Failed to open %s: %v", c.config.Path, err)
+			return
+		}
+		input = file
+	}
+	defer input.Close()
+	defer c.closeOnDone(ctx, input)()
+
+	log.Printf("Reading pcap stream from %s", c.source())
+	if err := c.processPcapStream(ctx, input); err != nil {
+		log.Printf("Pcap stream from %s failed: %v", c.source(), err)
+	}
+}
+
+// serve accepts pcap senders one at a time until shutdown
+func (c *StreamCapture) serve(ctx context.Context) {
+	listener, err := net.Listen("tcp", c.config.Listen)
+	if err != nil {
+		log.Printf("Failed to listen for pcap streams on %s: %v", c.config.Listen, err)
+		return
+	}
+	defer listener.Close()
+	defer c.closeOnDone(ctx, listener)()
+
+	log.Printf("Listening for pcap streams on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.closeChan:
+				return
+			default:
+			}
+			log.Printf("Failed to accept pcap stream: %v", err)
+			time.Sleep(streamRetryDelay)
+			continue
+		}
+
+		remote := conn.RemoteAddr().String()
+		log.Printf("Pcap stream connected from %s", remote)
+		stop := c.closeOnDone(ctx, conn)
+		if err := c.processPcapStream(ctx, conn); err != nil {
+			log.Printf("Pcap stream from %s failed: %v", remote, err)
+		}
+		stop()
+		conn.Close()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.closeChan:
+			return
+		default:
+		}
+		log.Printf("Pcap stream from %s disconnected, waiting for reconnect", remote)
+	}
+}
+
+// source describes the stream for logs and stats
+func (c *StreamCapture) source() string {
+	switch {
+	case c.config.Listen != "":
+		return "tcp " + c.config.Listen
+	case c.config.Path == StdinPath:
+		return "stdin"
+	default:
+		return "fifo " + c.config.Path
+	}
+}
+
+// Stats returns the stream's packet counters. Drops upstream of the stream
+// (e.g. in the sending tcpdump) are not visible here.
+func (c *StreamCapture) Stats() SourceStats {
+	return c.stats(c.source())
+}
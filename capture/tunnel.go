@@ -0,0 +1,187 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TunnelMode selects which hosts represent tunnelled traffic in the graph
+type TunnelMode string
+
+const (
+	TunnelModeInner TunnelMode = "inner" // Hosts inside the tunnel (default)
+	TunnelModeOuter TunnelMode = "outer" // Tunnel endpoints
+)
+
+// ParseTunnelMode validates a tunnel mode name
+func ParseTunnelMode(s string) (TunnelMode, error) {
+	switch mode := TunnelMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case TunnelModeInner, TunnelModeOuter:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown tunnel mode %q (use inner or outer)", s)
+	}
+}
+
+var (
+	tunnelModeMu sync.RWMutex
+	tunnelMode   = TunnelModeInner
+)
+
+// SetTunnelMode changes which addresses ProcessPacket reports for tunnelled packets
+func SetTunnelMode(mode TunnelMode) {
+	tunnelModeMu.Lock()
+	defer tunnelModeMu.Unlock()
+	tunnelMode = mode
+}
+
+// CurrentTunnelMode returns the tunnel mode in effect
+func CurrentTunnelMode() TunnelMode {
+	tunnelModeMu.RLock()
+	defer tunnelModeMu.RUnlock()
+	return tunnelMode
+}
+
+// Tunnel types reported in Encapsulation.Tunnel
+const (
+	TunnelGRE    = "GRE"
+	TunnelVXLAN  = "VXLAN"
+	TunnelGENEVE = "GENEVE"
+	Tunnel6in4   = "6in4"
+	TunnelIPinIP = "IPIP"
+)
+
+// Encapsulation describes the VLAN tags, MPLS labels and tunnel a packet was
+// carried in. For nested tunnels the innermost one is recorded.
+type Encapsulation struct {
+	VLANs      []uint16 `json:"vlans,omitempty"`      // 802.1Q tags, outermost first (two for QinQ)
+	MPLSLabels []uint32 `json:"mplsLabels,omitempty"` // MPLS label stack, top first
+	Tunnel     string   `json:"tunnel,omitempty"`     // GRE, VXLAN, GENEVE, 6in4 or IPIP
+	TunnelKey  uint32   `json:"tunnelKey,omitempty"`  // VXLAN/GENEVE VNI or GRE key
+	OuterSrcIP string   `json:"outerSrc,omitempty"`   // Tunnel endpoints
+	OuterDstIP string   `json:"outerDst,omitempty"`
+}
+
+// IDs returns identifiers usable as a filter dimension, e.g. "vlan:100",
+// "mpls:16", "vxlan:5001", "gre" or "gre:42"
+func (e *Encapsulation) IDs() []string {
+	if e == nil {
+		return nil
+	}
+
+	var ids []string
+	for _, vlan := range e.VLANs {
+		ids = append(ids, fmt.Sprintf("vlan:%d", vlan))
+	}
+	for _, label := range e.MPLSLabels {
+		ids = append(ids, fmt.Sprintf("mpls:%d", label))
+	}
+	if e.Tunnel != "" {
+		id := strings.ToLower(e.Tunnel)
+		if e.TunnelKey != 0 || e.Tunnel == TunnelVXLAN || e.Tunnel == TunnelGENEVE {
+			id = fmt.Sprintf("%s:%d", id, e.TunnelKey)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// dissection is the result of walking a packet's layers
+type dissection struct {
+	network   gopacket.NetworkLayer // Selected IPv4/IPv6 layer, nil if none
+	transport gopacket.Layer        // TCP/UDP layer belonging to network, nil if none
+	arp       *layers.ARP
+	encap     *Encapsulation // nil for plain packets
+}
+
+// dissect walks the decoded layers once, recording encapsulation and picking
+// the outer or inner IP layer according to mode. The transport layer is the
+// first TCP/UDP layer that follows the chosen IP layer, so a VXLAN packet
+// yields the outer UDP header in outer mode and the inner one in inner mode.
+func dissect(packet gopacket.Packet, mode TunnelMode) dissection {
+	var d dissection
+	var encap Encapsulation
+	var ipLayers []int
+	arpIndex := -1
+
+	all := packet.Layers()
+	for i, layer := range all {
+		switch l := layer.(type) {
+		case *layers.Dot1Q:
+			encap.VLANs = append(encap.VLANs, l.VLANIdentifier)
+		case *layers.MPLS:
+			encap.MPLSLabels = append(encap.MPLSLabels, l.Label)
+		case *layers.GRE:
+			encap.Tunnel, encap.TunnelKey = TunnelGRE, 0
+			if l.KeyPresent {
+				encap.TunnelKey = l.Key
+			}
+		case *layers.VXLAN:
+			encap.Tunnel, encap.TunnelKey = TunnelVXLAN, l.VNI
+		case *layers.Geneve:
+			encap.Tunnel, encap.TunnelKey = TunnelGENEVE, l.VNI
+		case *layers.ARP:
+			d.arp, arpIndex = l, i
+		case *layers.IPv4, *layers.IPv6:
+			// IP directly inside IP is 6in4 or IP-in-IP
+			if len(ipLayers) > 0 && ipLayers[len(ipLayers)-1] == i-1 {
+				encap.Tunnel, encap.TunnelKey = TunnelIPinIP, 0
+				if _, inner6 := l.(*layers.IPv6); inner6 {
+					if _, outer4 := all[i-1].(*layers.IPv4); outer4 {
+						encap.Tunnel = Tunnel6in4
+					}
+				}
+			}
+			ipLayers = append(ipLayers, i)
+		}
+	}
+
+	if len(ipLayers) == 0 {
+		if encap.hasAny() {
+			d.encap = &encap
+		}
+		return d
+	}
+
+	if len(ipLayers) > 1 || encap.Tunnel != "" {
+		outer := all[ipLayers[0]].(gopacket.NetworkLayer).NetworkFlow()
+		encap.OuterSrcIP = outer.Src().String()
+		encap.OuterDstIP = outer.Dst().String()
+	}
+	if encap.hasAny() {
+		d.encap = &encap
+	}
+
+	// An ARP frame carried inside a tunnel (e.g. VXLAN) is the inner payload
+	if mode == TunnelModeInner && arpIndex > ipLayers[len(ipLayers)-1] {
+		return d
+	}
+	d.arp = nil
+
+	selected := ipLayers[len(ipLayers)-1]
+	end := len(all)
+	if mode == TunnelModeOuter {
+		selected = ipLayers[0]
+		if len(ipLayers) > 1 {
+			end = ipLayers[1]
+		}
+	}
+	d.network = all[selected].(gopacket.NetworkLayer)
+
+	for _, layer := range all[selected+1 : end] {
+		if t := layer.LayerType(); t == layers.LayerTypeTCP || t == layers.LayerTypeUDP {
+			d.transport = layer
+			break
+		}
+	}
+	return d
+}
+
+// hasAny reports whether any encapsulation was found
+func (e *Encapsulation) hasAny() bool {
+	return len(e.VLANs) > 0 || len(e.MPLSLabels) > 0 || e.Tunnel != ""
+}
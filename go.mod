@@ -6,9 +6,7 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/gorilla/websocket v1.5.1
 	golang.org/x/crypto v0.47.0
+	golang.org/x/net v0.48.0
 )
 
-require (
-	golang.org/x/net v0.48.0 // indirect
-	golang.org/x/sys v0.40.0 // indirect
-)
+require golang.org/x/sys v0.40.0 // indirect
@@ -0,0 +1,322 @@
+package graph
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// Cluster roles read from a slurm.conf
+const (
+	RoleController = "controller"
+	RoleCompute    = "compute"
+	RoleLogin      = "login"
+)
+
+// Limits on slurm.conf parsing
+const (
+	maxSlurmIncludeDepth = 8
+	maxHostlistHosts     = 65536
+)
+
+// ClusterRoles maps the hosts named in a slurm.conf to their roles. Hosts
+// are matched by address or hostname; short names also match the first
+// label of a node's resolved name.
+type ClusterRoles struct {
+	Cluster string              // ClusterName
+	hosts   map[string][]string // Lowercased hostname or address -> roles
+}
+
+// LoadSlurmConf reads host roles from a slurm.conf and the files it
+// includes:
+//   - controller: SlurmctldHost, or the older ControlMachine/ControlAddr and
+//     BackupController/BackupAddr
+//   - compute: NodeName entries with their NodeAddr and NodeHostname
+//   - login: nodes whose Features include "login", and the AllocNodes of
+//     partitions
+//
+// With anonymization enabled, names and addresses are anonymized like the
+// graph's, so the anonymizer must be installed first.
+func LoadSlurmConf(path string) (*ClusterRoles, error) {
+	c := &ClusterRoles{hosts: make(map[string][]string)}
+	if err := c.load(path, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load parses one file; Include paths are relative to its directory
+func (c *ClusterRoles) load(path string, depth int) error {
+	if depth > maxSlurmIncludeDepth {
+		return fmt.Errorf("slurm.conf includes nested too deeply at %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read slurm.conf: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo, line := 0, ""
+	for scanner.Scan() {
+		lineNo++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if cont, ok := strings.CutSuffix(text, `\`); ok {
+			line += cont + " "
+			continue
+		}
+		line += text
+		if line == "" {
+			continue
+		}
+		if err := c.parseLine(line, filepath.Dir(path), depth); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		line = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read slurm.conf: %v", err)
+	}
+	return nil
+}
+
+// parseLine applies one logical line of key=value pairs
+func (c *ClusterRoles) parseLine(line, dir string, depth int) error {
+	if rest, ok := cutKeyword(line, "include"); ok {
+		include := strings.Trim(strings.TrimSpace(rest), `"`)
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+		return c.load(include, depth+1)
+	}
+
+	params := make(map[string]string)
+	var first string
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(key)
+		if first == "" {
+			first = key
+		}
+		params[key] = strings.Trim(value, `"`)
+	}
+
+	switch first {
+	case "clustername":
+		c.Cluster = params["clustername"]
+	case "slurmctldhost":
+		// name(address)
+		name, addr, _ := strings.Cut(params["slurmctldhost"], "(")
+		c.add(name, RoleController)
+		c.add(strings.TrimSuffix(addr, ")"), RoleController)
+	case "controlmachine", "controllermachine", "controladdr", "backupcontroller", "backupaddr":
+		for _, key := range []string{"controlmachine", "controllermachine", "controladdr", "backupcontroller", "backupaddr"} {
+			for _, host := range strings.Split(params[key], ",") {
+				c.add(host, RoleController)
+			}
+		}
+	case "nodename":
+		if strings.EqualFold(params["nodename"], "DEFAULT") {
+			break
+		}
+		role := RoleCompute
+		for _, feature := range strings.Split(params["features"], ",") {
+			if strings.EqualFold(feature, "login") {
+				role = RoleLogin
+			}
+		}
+		for _, key := range []string{"nodename", "nodeaddr", "nodehostname"} {
+			if params[key] == "" {
+				continue
+			}
+			hosts, err := expandHostlist(params[key])
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			for _, host := range hosts {
+				c.add(host, role)
+			}
+		}
+	case "partitionname":
+		alloc := params["allocnodes"]
+		if alloc == "" || strings.EqualFold(alloc, "ALL") {
+			break
+		}
+		hosts, err := expandHostlist(alloc)
+		if err != nil {
+			return fmt.Errorf("allocnodes: %v", err)
+		}
+		for _, host := range hosts {
+			c.add(host, RoleLogin)
+		}
+	}
+	return nil
+}
+
+// cutKeyword reports whether line starts with the keyword, which slurm.conf
+// matches case-insensitively, followed by whitespace
+func cutKeyword(line, keyword string) (string, bool) {
+	if len(line) <= len(keyword) || !strings.EqualFold(line[:len(keyword)], keyword) {
+		return "", false
+	}
+	rest := line[len(keyword):]
+	if rest[0] != ' ' && rest[0] != '\t' {
+		return "", false
+	}
+	return rest, true
+}
+
+// add gives a host a role, keyed the way the graph shows it
+func (c *ClusterRoles) add(host, role string) {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host == "" {
+		return
+	}
+	if net.ParseIP(host) != nil {
+		host = capture.AnonymizeIP(host)
+	} else {
+		host = capture.AnonymizeHostname(host)
+	}
+	if !containsString(c.hosts[host], role) {
+		c.hosts[host] = append(c.hosts[host], role)
+		sort.Strings(c.hosts[host])
+	}
+}
+
+// Roles returns the roles of a node from its hostname and addresses
+func (c *ClusterRoles) Roles(hostname string, ips []string) []string {
+	if c == nil || len(c.hosts) == 0 {
+		return nil
+	}
+	var roles []string
+	keys := append([]string{}, ips...)
+	if hostname != "" {
+		hostname = strings.ToLower(hostname)
+		short, _, _ := strings.Cut(hostname, ".")
+		keys = append(keys, hostname, short)
+	}
+	for _, key := range keys {
+		for _, role := range c.hosts[key] {
+			if !containsString(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Len returns the number of hosts with roles
+func (c *ClusterRoles) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.hosts)
+}
+
+// expandHostlist expands a Slurm hostlist such as "node[01-04,07],login1"
+// or "10.0.0.[1-16]". Zero padding of range bounds is kept.
+func expandHostlist(expr string) ([]string, error) {
+	var hosts []string
+	depth, start := 0, 0
+	for i := 0; i <= len(expr); i++ {
+		if i < len(expr) {
+			switch expr[i] {
+			case '[':
+				depth++
+				continue
+			case ']':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if depth != 0 {
+			return nil, fmt.Errorf("unbalanced brackets in %q", expr)
+		}
+		expanded, err := expandHostPattern(expr[start:i])
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, expanded...)
+		if len(hosts) > maxHostlistHosts {
+			return nil, fmt.Errorf("hostlist %q has more than %d hosts", expr, maxHostlistHosts)
+		}
+		start = i + 1
+	}
+	return hosts, nil
+}
+
+// expandHostPattern expands one hostname with bracketed ranges, e.g.
+// rack[1-2]n[01-04]
+func expandHostPattern(pattern string) ([]string, error) {
+	open := strings.IndexByte(pattern, '[')
+	if open < 0 {
+		if pattern == "" {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	end := strings.IndexByte(pattern[open:], ']')
+	if end < 0 {
+		return nil, fmt.Errorf("unbalanced brackets in %q", pattern)
+	}
+	prefix, ranges, suffix := pattern[:open], pattern[open+1:open+end], pattern[open+end+1:]
+
+	tails, err := expandHostPattern(suffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(tails) == 0 {
+		tails = []string{""}
+	}
+	var hosts []string
+	for _, r := range strings.Split(ranges, ",") {
+		lo, hi, isRange := strings.Cut(r, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(lo)
+		to, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || to < from {
+			return nil, fmt.Errorf("invalid range %q in %q", r, pattern)
+		}
+		if (to-from+1)*len(tails) > maxHostlistHosts {
+			return nil, fmt.Errorf("range %q in %q is too large", r, pattern)
+		}
+		for n := from; n <= to; n++ {
+			num := fmt.Sprintf("%0*d", len(lo), n)
+			for _, tail := range tails {
+				hosts = append(hosts, prefix+num+tail)
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// SetClusterRoles installs the roles shown on nodes; nil removes them
+func (m *Manager) SetClusterRoles(roles *ClusterRoles) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clusterRoles = roles
+}
@@ -5,6 +5,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"go-etherape/capture"
 )
 
 // DNSResolver performs reverse DNS lookups with caching
@@ -79,7 +81,8 @@ func (r *DNSResolver) performLookup(ip string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	// Anonymized addresses are looked up by their real address
+	names, err := net.DefaultResolver.LookupAddr(ctx, capture.RealAddress(ip))
 
 	hostname := ip
 	if err == nil && len(names) > 0 {
@@ -88,6 +91,7 @@ func (r *DNSResolver) performLookup(ip string) {
 		if len(hostname) > 0 && hostname[len(hostname)-1] == '.' {
 			hostname = hostname[:len(hostname)-1]
 		}
+		hostname = capture.AnonymizeHostname(hostname)
 	}
 
 	// Store in cache
@@ -117,7 +121,7 @@ func (r *DNSResolver) ResolveSync(ip string) string {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	names, err := net.DefaultResolver.LookupAddr(ctx, capture.RealAddress(ip))
 	if err != nil || len(names) == 0 {
 		r.cacheMu.Lock()
 		r.cache[ip] = ip
@@ -130,6 +134,7 @@ func (r *DNSResolver) ResolveSync(ip string) string {
 	if len(hostname) > 0 && hostname[len(hostname)-1] == '.' {
 		hostname = hostname[:len(hostname)-1]
 	}
+	hostname = capture.AnonymizeHostname(hostname)
 
 	// Cache the result
 	r.cacheMu.Lock()
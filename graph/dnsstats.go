@@ -0,0 +1,132 @@
+package graph
+
+import (
+	"sort"
+)
+
+// Limits for per-client DNS statistics
+const (
+	maxNodeDNSDomains = 1000 // Names counted per client
+	topDNSDomains     = 10   // Names shown per client
+)
+
+// DNSStats summarises the DNS queries a node made as a client
+type DNSStats struct {
+	Queries      int           `json:"queries"`
+	Responses    int           `json:"responses"`
+	NXDomain     int           `json:"nxdomain"`
+	Failures     int           `json:"failures"`     // Other error codes, e.g. SERVFAIL and REFUSED
+	NXDomainRate float64       `json:"nxdomainRate"` // Share of responses that were NXDOMAIN
+	TopDomains   []DomainCount `json:"topDomains,omitempty"`
+	domains      map[string]int
+}
+
+// DomainCount is the number of queries for a name
+type DomainCount struct {
+	Name    string `json:"name"`
+	Queries int    `json:"queries"`
+}
+
+// add counts a query (empty rcode) or a response
+func (d *DNSStats) add(name, rcode string, queries int) {
+	switch rcode {
+	case "":
+		d.Queries += queries
+		if d.domains == nil {
+			d.domains = make(map[string]int)
+		}
+		if _, ok := d.domains[name]; ok || len(d.domains) < maxNodeDNSDomains {
+			d.domains[name] += queries
+		}
+	case "NOERROR":
+		d.Responses++
+	case "NXDOMAIN":
+		d.Responses++
+		d.NXDomain++
+	default:
+		d.Responses++
+		d.Failures++
+	}
+}
+
+// merge adds another client's statistics
+func (d *DNSStats) merge(other *DNSStats) {
+	d.Responses += other.Responses
+	d.NXDomain += other.NXDomain
+	d.Failures += other.Failures
+	for name, queries := range other.domains {
+		d.add(name, "", queries)
+	}
+	// Queries for names beyond the cap were counted but not kept by name
+	d.Queries += other.Queries - sumCounts(other.domains)
+}
+
+// snapshot returns a copy with the top domains and NXDOMAIN rate filled in
+func (d *DNSStats) snapshot() *DNSStats {
+	if d == nil {
+		return nil
+	}
+	s := *d
+	s.domains = nil
+	if d.Responses > 0 {
+		s.NXDomainRate = float64(d.NXDomain) / float64(d.Responses)
+	}
+	s.TopDomains = make([]DomainCount, 0, min(len(d.domains), topDNSDomains))
+	for name, queries := range d.domains {
+		s.TopDomains = append(s.TopDomains, DomainCount{Name: name, Queries: queries})
+	}
+	sort.Slice(s.TopDomains, func(i, j int) bool {
+		if s.TopDomains[i].Queries != s.TopDomains[j].Queries {
+			return s.TopDomains[i].Queries > s.TopDomains[j].Queries
+		}
+		return s.TopDomains[i].Name < s.TopDomains[j].Name
+	})
+	if len(s.TopDomains) > topDNSDomains {
+		s.TopDomains = s.TopDomains[:topDNSDomains]
+	}
+	return &s
+}
+
+// sumCounts adds up the counts of a map
+func sumCounts(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+// AddDNSEvent records a DNS query (empty rcode) or response on the client's
+// node. Nothing is recorded for clients that are not in the graph.
+func (m *Manager) AddDNSEvent(clientIP, name, rcode string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodeID := clientIP
+	if id, ok := m.ipToNodeID[clientIP]; ok {
+		nodeID = id
+	}
+	node, exists := m.nodes[nodeID]
+	if !exists {
+		return
+	}
+	if node.DNS == nil {
+		node.DNS = &DNSStats{}
+	}
+	node.DNS.add(name, rcode, 1)
+}
+
+// GetDNSStats returns the DNS statistics of every node that made queries,
+// by node ID
+func (m *Manager) GetDNSStats() map[string]*DNSStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := make(map[string]*DNSStats)
+	for id, node := range m.nodes {
+		if node.DNS != nil {
+			stats[id] = node.DNS.snapshot()
+		}
+	}
+	return stats
+}
@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"maps"
 	"sync"
 	"time"
 
@@ -9,23 +10,37 @@ import (
 
 // Node represents a network node (IP address)
 type Node struct {
-	IP         string    `json:"id"`
-	Hostname   string    `json:"label"`
-	IPs        []string  `json:"ips"` // All IPs that map to this hostname
-	PacketCount int      `json:"packetCount"`
-	ByteCount  int64     `json:"byteCount"`
-	LastSeen   time.Time `json:"lastSeen"`
+	IP          string    `json:"id"`
+	Hostname    string    `json:"label"`
+	IPs         []string  `json:"ips"` // All IPs that map to this hostname
+	PacketCount int       `json:"packetCount"`
+	ByteCount   int64     `json:"byteCount"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Interfaces  []string  `json:"interfaces,omitempty"` // Capture interfaces this node was seen on
+	Tunnels     []string  `json:"tunnels,omitempty"`    // VLAN/MPLS/tunnel IDs this node was seen in
+	// TLS clients: server names requested (SNI) and ClientHello fingerprints (JA4)
+	ServerNames     []string `json:"serverNames,omitempty"`
+	TLSFingerprints []string `json:"tlsFingerprints,omitempty"`
+	Roles           []string `json:"roles,omitempty"` // Cluster roles from the slurm.conf, see ClusterRoles
+	// InfluxDB clients: points written per measurement
+	Measurements map[string]int `json:"measurements,omitempty"`
+	DNS          *DNSStats      `json:"dns,omitempty"` // DNS clients: queries and response codes
 }
 
 // Edge represents a bidirectional connection between two nodes
 type Edge struct {
-	ID          string            `json:"id"`
-	From        string            `json:"from"`
-	To          string            `json:"to"`
-	Protocol    capture.Protocol  `json:"protocol"`
-	PacketCount int               `json:"packetCount"`
-	ByteCount   int64             `json:"byteCount"`
-	LastSeen    time.Time         `json:"lastSeen"`
+	ID          string                     `json:"id"`
+	From        string                     `json:"from"`
+	To          string                     `json:"to"`
+	Protocol    capture.Protocol           `json:"protocol"`             // Dominant protocol, used for coloring
+	Confidence  capture.Confidence         `json:"confidence,omitempty"` // How Protocol was identified, see capture.Confidence
+	Protocols   map[string]ProtocolTraffic `json:"protocols,omitempty"`  // Traffic per protocol name
+	PacketCount int                        `json:"packetCount"`
+	ByteCount   int64                      `json:"byteCount"`
+	LastSeen    time.Time                  `json:"lastSeen"`
+	Interfaces  []string                   `json:"interfaces,omitempty"`  // Capture interfaces this edge was seen on
+	Tunnels     []string                   `json:"tunnels,omitempty"`     // VLAN/MPLS/tunnel IDs this edge was seen in
+	FlowDerived bool                       `json:"flowDerived,omitempty"` // Traffic reported by flow exports, so no payloads are available
 	// Bidirectional tracking
 	ForwardPackets int   `json:"forwardPackets"` // From -> To
 	ReversePackets int   `json:"reversePackets"` // To -> From
@@ -33,6 +48,15 @@ type Edge struct {
 	ReverseBytes   int64 `json:"reverseBytes"`
 }
 
+// ProtocolTraffic is the part of an edge's traffic identified as one protocol
+type ProtocolTraffic struct {
+	Protocol    capture.Protocol   `json:"protocol"`
+	Confidence  capture.Confidence `json:"confidence,omitempty"` // Strongest evidence seen for this protocol
+	PacketCount int                `json:"packetCount"`
+	ByteCount   int64              `json:"byteCount"`
+	LastSeen    time.Time          `json:"lastSeen"`
+}
+
 // getCanonicalEdgeID returns a consistent edge ID regardless of direction
 func getCanonicalEdgeID(nodeA, nodeB string) (edgeID, from, to string) {
 	if nodeA < nodeB {
@@ -41,6 +65,56 @@ func getCanonicalEdgeID(nodeA, nodeB string) (edgeID, from, to string) {
 	return nodeB + "<->" + nodeA, nodeB, nodeA
 }
 
+// Labels are capture attributes recorded on the nodes and edges a packet touches
+type Labels struct {
+	Interface   string             // Ingress capture interface (or flow exporter), empty when unknown
+	Tunnels     []string           // VLAN/MPLS/tunnel IDs, see capture.Encapsulation.IDs
+	FlowDerived bool               // Counts come from a flow record rather than a captured packet
+	Confidence  capture.Confidence // How the packet's protocol was identified
+}
+
+// LabelsFor returns the labels carried by a packet
+func LabelsFor(pkt *capture.PacketInfo) Labels {
+	return Labels{
+		Interface:   pkt.Interface,
+		Tunnels:     pkt.Encap.IDs(),
+		FlowDerived: pkt.FlowDerived(),
+		Confidence:  pkt.Confidence,
+	}
+}
+
+// addUnique appends value to a list if it is set and not already present
+func addUnique(list []string, value string) []string {
+	if value == "" {
+		return list
+	}
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// mergeUnique adds every value in src to dst
+func mergeUnique(dst, src []string) []string {
+	for _, value := range src {
+		dst = addUnique(dst, value)
+	}
+	return dst
+}
+
+// mergeCapped adds values in src to dst until dst holds max values
+func mergeCapped(dst, src []string, max int) []string {
+	for _, value := range src {
+		if len(dst) >= max {
+			break
+		}
+		dst = addUnique(dst, value)
+	}
+	return dst
+}
+
 // GraphSnapshot represents the current state of the graph
 type GraphSnapshot struct {
 	Nodes   []Node       `json:"nodes"`
@@ -50,12 +124,14 @@ type GraphSnapshot struct {
 
 // Manager manages the network graph data
 type Manager struct {
-	nodes           map[string]*Node  // Key: node ID (hostname or IP)
-	edges           map[string]*Edge
-	ipToNodeID      map[string]string // Maps IP -> node ID (for lookup)
+	nodes            map[string]*Node // Key: node ID (hostname or IP)
+	edges            map[string]*Edge
+	ipToNodeID       map[string]string // Maps IP -> node ID (for lookup)
 	hostnameToNodeID map[string]string // Maps hostname -> node ID (for merging)
-	packetStore     *PacketStore
-	mu              sync.RWMutex
+	packetStore      *PacketStore
+	clock            capture.Clock // Time source for decay and untimestamped updates
+	clusterRoles     *ClusterRoles // Optional: roles shown on nodes
+	mu               sync.RWMutex
 }
 
 // NewManager creates a new graph manager
@@ -66,13 +142,34 @@ func NewManager() *Manager {
 		ipToNodeID:       make(map[string]string),
 		hostnameToNodeID: make(map[string]string),
 		packetStore:      NewPacketStore(1000), // Store last 1000 packets
+		clock:            capture.SystemClock{},
 	}
 }
 
-// AddOrUpdateNode adds a new node or updates an existing one
-func (m *Manager) AddOrUpdateNode(ip, hostname string, bytes int) {
+// SetClock replaces the time source used for decay.
+// Use a capture.PacketClock so stale-node removal follows capture time.
+func (m *Manager) SetClock(clock capture.Clock) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.clock = clock
+}
+
+// timestampOrNow returns seen, or the manager clock's time if seen is unset
+func (m *Manager) timestampOrNow(seen time.Time) time.Time {
+	if seen.IsZero() {
+		return m.clock.Now()
+	}
+	return seen
+}
+
+// AddOrUpdateNode adds a new node or updates an existing one.
+// packets is 1 for a captured packet and the flow's count for flow records;
+// seen is the packet's capture timestamp.
+func (m *Manager) AddOrUpdateNode(ip, hostname string, labels Labels, packets, bytes int, seen time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen = m.timestampOrNow(seen)
 
 	// Determine if we should merge based on hostname
 	useHostname := hostname != "" && hostname != ip
@@ -112,6 +209,19 @@ func (m *Manager) AddOrUpdateNode(ip, hostname string, bytes int) {
 				// Merge stats into existing node
 				m.nodes[nodeID].PacketCount += oldNode.PacketCount
 				m.nodes[nodeID].ByteCount += oldNode.ByteCount
+				m.nodes[nodeID].Interfaces = mergeUnique(m.nodes[nodeID].Interfaces, oldNode.Interfaces)
+				m.nodes[nodeID].Tunnels = mergeUnique(m.nodes[nodeID].Tunnels, oldNode.Tunnels)
+				m.nodes[nodeID].ServerNames = mergeCapped(m.nodes[nodeID].ServerNames, oldNode.ServerNames, maxNodeTLSValues)
+				m.nodes[nodeID].TLSFingerprints = mergeCapped(m.nodes[nodeID].TLSFingerprints, oldNode.TLSFingerprints, maxNodeTLSValues)
+				for measurement, points := range oldNode.Measurements {
+					m.nodes[nodeID].addMeasurement(measurement, points)
+				}
+				if oldNode.DNS != nil {
+					if m.nodes[nodeID].DNS == nil {
+						m.nodes[nodeID].DNS = &DNSStats{}
+					}
+					m.nodes[nodeID].DNS.merge(oldNode.DNS)
+				}
 				// Merge IPs, avoiding duplicates
 				for _, oldIP := range oldNode.IPs {
 					found := false
@@ -169,6 +279,10 @@ func (m *Manager) AddOrUpdateNode(ip, hostname string, bytes int) {
 						existingEdge.ReversePackets += edge.ReversePackets
 						existingEdge.ForwardBytes += edge.ForwardBytes
 						existingEdge.ReverseBytes += edge.ReverseBytes
+						existingEdge.Interfaces = mergeUnique(existingEdge.Interfaces, edge.Interfaces)
+						existingEdge.Tunnels = mergeUnique(existingEdge.Tunnels, edge.Tunnels)
+						existingEdge.FlowDerived = existingEdge.FlowDerived || edge.FlowDerived
+						existingEdge.mergeProtocols(edge.Protocols)
 						if edge.LastSeen.After(existingEdge.LastSeen) {
 							existingEdge.LastSeen = edge.LastSeen
 						}
@@ -180,6 +294,10 @@ func (m *Manager) AddOrUpdateNode(ip, hostname string, bytes int) {
 						pendingEdge.ReversePackets += edge.ReversePackets
 						pendingEdge.ForwardBytes += edge.ForwardBytes
 						pendingEdge.ReverseBytes += edge.ReverseBytes
+						pendingEdge.Interfaces = mergeUnique(pendingEdge.Interfaces, edge.Interfaces)
+						pendingEdge.Tunnels = mergeUnique(pendingEdge.Tunnels, edge.Tunnels)
+						pendingEdge.FlowDerived = pendingEdge.FlowDerived || edge.FlowDerived
+						pendingEdge.mergeProtocols(edge.Protocols)
 						if edge.LastSeen.After(pendingEdge.LastSeen) {
 							pendingEdge.LastSeen = edge.LastSeen
 						}
@@ -214,14 +332,20 @@ func (m *Manager) AddOrUpdateNode(ip, hostname string, bytes int) {
 			IP:          nodeID,
 			Hostname:    hostname,
 			IPs:         ips,
-			PacketCount: 1,
+			PacketCount: packets,
 			ByteCount:   int64(bytes),
-			LastSeen:    time.Now(),
+			LastSeen:    seen,
+			Interfaces:  addUnique(nil, labels.Interface),
+			Tunnels:     mergeUnique(nil, labels.Tunnels),
 		}
 	} else {
-		node.PacketCount++
+		node.PacketCount += packets
+		node.Interfaces = addUnique(node.Interfaces, labels.Interface)
+		node.Tunnels = mergeUnique(node.Tunnels, labels.Tunnels)
 		node.ByteCount += int64(bytes)
-		node.LastSeen = time.Now()
+		if seen.After(node.LastSeen) {
+			node.LastSeen = seen
+		}
 
 		// Add IP to list if not already present
 		found := false
@@ -242,11 +366,15 @@ func (m *Manager) AddOrUpdateNode(ip, hostname string, bytes int) {
 	}
 }
 
-// AddOrUpdateEdge adds a new edge or updates an existing one (bidirectional)
-func (m *Manager) AddOrUpdateEdge(srcIP, dstIP string, protocol capture.Protocol, bytes int) {
+// AddOrUpdateEdge adds a new edge or updates an existing one (bidirectional).
+// packets is 1 for a captured packet and the flow's count for flow records;
+// seen is the packet's capture timestamp.
+func (m *Manager) AddOrUpdateEdge(srcIP, dstIP string, labels Labels, protocol capture.Protocol, packets, bytes int, seen time.Time) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	seen = m.timestampOrNow(seen)
+
 	// Map IPs to node IDs (might be hostnames)
 	srcNodeID := srcIP
 	if nodeID, ok := m.ipToNodeID[srcIP]; ok {
@@ -269,34 +397,177 @@ func (m *Manager) AddOrUpdateEdge(srcIP, dstIP string, protocol capture.Protocol
 			ID:          edgeID,
 			From:        canonicalFrom,
 			To:          canonicalTo,
-			Protocol:    protocol,
-			PacketCount: 1,
+			PacketCount: packets,
 			ByteCount:   int64(bytes),
-			LastSeen:    time.Now(),
+			LastSeen:    seen,
+			Interfaces:  addUnique(nil, labels.Interface),
+			Tunnels:     mergeUnique(nil, labels.Tunnels),
+			FlowDerived: labels.FlowDerived,
 		}
 		if isForward {
-			newEdge.ForwardPackets = 1
+			newEdge.ForwardPackets = packets
 			newEdge.ForwardBytes = int64(bytes)
 		} else {
-			newEdge.ReversePackets = 1
+			newEdge.ReversePackets = packets
 			newEdge.ReverseBytes = int64(bytes)
 		}
+		newEdge.addProtocol(ProtocolTraffic{Protocol: protocol, Confidence: labels.Confidence, PacketCount: packets, ByteCount: int64(bytes), LastSeen: seen})
 		m.edges[edgeID] = newEdge
 	} else {
-		edge.PacketCount++
+		edge.PacketCount += packets
 		edge.ByteCount += int64(bytes)
-		edge.LastSeen = time.Now()
+		edge.Interfaces = addUnique(edge.Interfaces, labels.Interface)
+		edge.Tunnels = mergeUnique(edge.Tunnels, labels.Tunnels)
+		edge.FlowDerived = edge.FlowDerived || labels.FlowDerived
+		if seen.After(edge.LastSeen) {
+			edge.LastSeen = seen
+		}
 		if isForward {
-			edge.ForwardPackets++
+			edge.ForwardPackets += packets
 			edge.ForwardBytes += int64(bytes)
 		} else {
-			edge.ReversePackets++
+			edge.ReversePackets += packets
 			edge.ReverseBytes += int64(bytes)
 		}
-		// Update protocol if it's more specific
-		if protocol.Name != "TCP" && protocol.Name != "UDP" {
-			edge.Protocol = protocol
+		edge.addProtocol(ProtocolTraffic{Protocol: protocol, Confidence: labels.Confidence, PacketCount: packets, ByteCount: int64(bytes), LastSeen: seen})
+	}
+}
+
+// addProtocol adds traffic to the edge's per-protocol totals and picks the
+// dominant protocol again
+func (e *Edge) addProtocol(t ProtocolTraffic) {
+	if e.Protocols == nil {
+		e.Protocols = make(map[string]ProtocolTraffic)
+	}
+	name := t.Protocol.Name
+	if cur, ok := e.Protocols[name]; ok {
+		cur.PacketCount += t.PacketCount
+		cur.ByteCount += t.ByteCount
+		if confidenceRank(t.Confidence) > confidenceRank(cur.Confidence) {
+			cur.Confidence = t.Confidence
+		}
+		if t.LastSeen.After(cur.LastSeen) {
+			cur.LastSeen = t.LastSeen
 		}
+		t = cur
+	}
+	e.Protocols[name] = t
+	e.updateDominant()
+}
+
+// mergeProtocols adds another edge's per-protocol totals
+func (e *Edge) mergeProtocols(protocols map[string]ProtocolTraffic) {
+	for _, t := range protocols {
+		e.addProtocol(t)
+	}
+}
+
+// updateDominant sets Protocol to the one that carried the most bytes
+func (e *Edge) updateDominant() {
+	var best ProtocolTraffic
+	found := false
+	for _, t := range e.Protocols {
+		if !found || t.outweighs(best) {
+			best, found = t, true
+		}
+	}
+	if found {
+		e.Protocol, e.Confidence = best.Protocol, best.Confidence
+	}
+}
+
+// outweighs orders an edge's protocols for dominance. Bare TCP or UDP that
+// nothing was claimed for comes last, so an application's unclassified side
+// flows (e.g. FTP data) don't hide it; a transport that ruled out a port
+// guess counts like any other protocol.
+func (t ProtocolTraffic) outweighs(o ProtocolTraffic) bool {
+	if t.claimed() != o.claimed() {
+		return t.claimed()
+	}
+	if t.ByteCount != o.ByteCount {
+		return t.ByteCount > o.ByteCount
+	}
+	if t.PacketCount != o.PacketCount {
+		return t.PacketCount > o.PacketCount
+	}
+	return t.Protocol.Name < o.Protocol.Name
+}
+
+// claimed reports whether anything beyond a bare transport was identified
+func (t ProtocolTraffic) claimed() bool {
+	return t.Confidence != capture.ConfidenceNone ||
+		(t.Protocol.Name != capture.ProtocolNameTCP && t.Protocol.Name != capture.ProtocolNameUDP)
+}
+
+// carried reports whether the edge carried any of the named protocols
+func (e Edge) carried(names []string) bool {
+	for _, name := range names {
+		if _, ok := e.Protocols[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// confidenceRank orders confidences from no claim to payload evidence
+func confidenceRank(c capture.Confidence) int {
+	switch c {
+	case capture.ConfidenceHigh:
+		return 2
+	case capture.ConfidenceLow:
+		return 1
+	}
+	return 0
+}
+
+// maxNodeTLSValues caps the server names and fingerprints kept per node
+const maxNodeTLSValues = 64
+
+// AddTLSClient records a TLS handshake on the client's node: the server name
+// it asked for and its ClientHello fingerprint. Nothing is recorded for
+// clients that are not in the graph.
+func (m *Manager) AddTLSClient(clientIP, serverName, fingerprint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodeID := clientIP
+	if id, ok := m.ipToNodeID[clientIP]; ok {
+		nodeID = id
+	}
+	node, exists := m.nodes[nodeID]
+	if !exists {
+		return
+	}
+	node.ServerNames = mergeCapped(node.ServerNames, []string{serverName}, maxNodeTLSValues)
+	node.TLSFingerprints = mergeCapped(node.TLSFingerprints, []string{fingerprint}, maxNodeTLSValues)
+}
+
+// maxNodeMeasurements caps the InfluxDB measurements kept per node
+const maxNodeMeasurements = 64
+
+// AddMeasurementWrite records InfluxDB points written by a client to a
+// measurement. Nothing is recorded for clients that are not in the graph.
+func (m *Manager) AddMeasurementWrite(clientIP, measurement string, points int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodeID := clientIP
+	if id, ok := m.ipToNodeID[clientIP]; ok {
+		nodeID = id
+	}
+	if node, exists := m.nodes[nodeID]; exists {
+		node.addMeasurement(measurement, points)
+	}
+}
+
+// addMeasurement adds points to a measurement, up to maxNodeMeasurements
+// measurements
+func (n *Node) addMeasurement(measurement string, points int) {
+	if n.Measurements == nil {
+		n.Measurements = make(map[string]int)
+	}
+	if _, ok := n.Measurements[measurement]; ok || len(n.Measurements) < maxNodeMeasurements {
+		n.Measurements[measurement] += points
 	}
 }
 
@@ -307,12 +578,18 @@ func (m *Manager) GetSnapshot() GraphSnapshot {
 
 	nodes := make([]Node, 0, len(m.nodes))
 	for _, node := range m.nodes {
-		nodes = append(nodes, *node)
+		n := *node
+		n.Roles = m.clusterRoles.Roles(node.Hostname, node.IPs)
+		n.Measurements = maps.Clone(node.Measurements)
+		n.DNS = node.DNS.snapshot()
+		nodes = append(nodes, n)
 	}
 
 	edges := make([]Edge, 0, len(m.edges))
 	for _, edge := range m.edges {
-		edges = append(edges, *edge)
+		e := *edge
+		e.Protocols = maps.Clone(edge.Protocols)
+		edges = append(edges, e)
 	}
 
 	// Get recent packets (limit to 100 for performance)
@@ -325,18 +602,85 @@ func (m *Manager) GetSnapshot() GraphSnapshot {
 	}
 }
 
+// FilterByTunnel returns the part of a snapshot seen inside the given
+// VLAN/MPLS/tunnel ID. Packets are filtered by the edges that remain.
+func (s GraphSnapshot) FilterByTunnel(id string) GraphSnapshot {
+	filtered := GraphSnapshot{
+		Nodes:   make([]Node, 0),
+		Edges:   make([]Edge, 0),
+		Packets: make([]PacketData, 0),
+	}
+
+	for _, node := range s.Nodes {
+		if containsString(node.Tunnels, id) {
+			filtered.Nodes = append(filtered.Nodes, node)
+		}
+	}
+	for _, edge := range s.Edges {
+		if containsString(edge.Tunnels, id) {
+			filtered.Edges = append(filtered.Edges, edge)
+		}
+	}
+	for _, pkt := range s.Packets {
+		if containsString(pkt.Tunnels, id) {
+			filtered.Packets = append(filtered.Packets, pkt)
+		}
+	}
+	return filtered
+}
+
+// FilterByProtocol returns the part of the snapshot that carried any of the
+// named protocols: edges that carried one at any time, the nodes they
+// connect, and matching packets
+func (s GraphSnapshot) FilterByProtocol(names []string) GraphSnapshot {
+	filtered := GraphSnapshot{
+		Nodes:   make([]Node, 0),
+		Edges:   make([]Edge, 0),
+		Packets: make([]PacketData, 0),
+	}
+
+	endpoints := make(map[string]bool)
+	for _, edge := range s.Edges {
+		if edge.carried(names) {
+			filtered.Edges = append(filtered.Edges, edge)
+			endpoints[edge.From] = true
+			endpoints[edge.To] = true
+		}
+	}
+	for _, node := range s.Nodes {
+		if endpoints[node.IP] {
+			filtered.Nodes = append(filtered.Nodes, node)
+		}
+	}
+	for _, pkt := range s.Packets {
+		if containsString(names, pkt.Protocol) {
+			filtered.Packets = append(filtered.Packets, pkt)
+		}
+	}
+	return filtered
+}
+
+// containsString reports whether list contains value
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // AddPacket adds a packet to the packet store
 func (m *Manager) AddPacket(pkt *capture.PacketInfo) {
 	m.packetStore.AddPacket(pkt)
 }
 
-
 // RemoveStaleNodes removes nodes that haven't been seen recently
 func (m *Manager) RemoveStaleNodes(threshold time.Duration) int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	now := time.Now()
+	now := m.clock.Now()
 	removed := 0
 
 	// Collect stale node IDs first to avoid modifying map during iteration
@@ -374,7 +718,7 @@ func (m *Manager) RemoveStaleEdges(threshold time.Duration) int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	now := time.Now()
+	now := m.clock.Now()
 
 	// Collect stale edge IDs first to avoid modifying map during iteration
 	staleEdgeIDs := make([]string, 0)
@@ -2,6 +2,7 @@ package graph
 
 import (
 	"encoding/base64"
+	"fmt"
 	"sync"
 	"time"
 
@@ -10,16 +11,23 @@ import (
 
 // PacketData represents a captured packet with payload
 type PacketData struct {
-	ID          int              `json:"id"`
-	Timestamp   time.Time        `json:"timestamp"`
-	SrcIP       string           `json:"src"`
-	DstIP       string           `json:"dst"`
-	SrcPort     uint16           `json:"srcPort"`
-	DstPort     uint16           `json:"dstPort"`
-	Protocol    string           `json:"protocol"`
-	Length      int              `json:"length"`
-	Payload     string           `json:"payload"` // Base64 encoded payload
-	Summary     string           `json:"summary"`
+	ID         int                    `json:"id"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Interface  string                 `json:"interface,omitempty"`
+	Encap      *capture.Encapsulation `json:"encap,omitempty"`
+	Tunnels    []string               `json:"tunnels,omitempty"`
+	SrcIP      string                 `json:"src"`
+	DstIP      string                 `json:"dst"`
+	SrcPort    uint16                 `json:"srcPort"`
+	DstPort    uint16                 `json:"dstPort"`
+	Protocol   string                 `json:"protocol"`
+	Confidence capture.Confidence     `json:"confidence,omitempty"` // How Protocol was identified
+	Length     int                    `json:"length"`
+	Fragments  int                    `json:"fragments,omitempty"`  // IP fragments reassembled into this packet
+	Packets    int                    `json:"packets,omitempty"`    // Packets summarised by a flow record
+	FlowSource string                 `json:"flowSource,omitempty"` // Flow export format, empty for captured packets
+	Payload    string                 `json:"payload"`              // Base64 encoded payload
+	Summary    string                 `json:"summary"`
 }
 
 // PacketStore manages a sliding window of recent packets
@@ -46,16 +54,26 @@ func (ps *PacketStore) AddPacket(pkt *capture.PacketInfo) {
 
 	// Create packet data with base64 encoded payload
 	packetData := PacketData{
-		ID:        ps.nextID,
-		Timestamp: time.Now(),
-		SrcIP:     pkt.SrcIP,
-		DstIP:     pkt.DstIP,
-		SrcPort:   pkt.SrcPort,
-		DstPort:   pkt.DstPort,
-		Protocol:  pkt.Protocol.Name,
-		Length:    pkt.Length,
-		Payload:   base64.StdEncoding.EncodeToString(pkt.Payload),
-		Summary:   pkt.Protocol.Name + " packet",
+		ID:         ps.nextID,
+		Timestamp:  pkt.Timestamp,
+		Interface:  pkt.Interface,
+		Encap:      pkt.Encap,
+		Tunnels:    pkt.Encap.IDs(),
+		SrcIP:      pkt.SrcIP,
+		DstIP:      pkt.DstIP,
+		SrcPort:    pkt.SrcPort,
+		DstPort:    pkt.DstPort,
+		Protocol:   pkt.Protocol.Name,
+		Confidence: pkt.Confidence,
+		Length:     pkt.Length,
+		Fragments:  pkt.Fragments,
+		Payload:    base64.StdEncoding.EncodeToString(pkt.RetainedPayload()),
+		Summary:    pkt.Protocol.Name + " packet",
+	}
+	if pkt.FlowDerived() {
+		packetData.Packets = pkt.PacketCount()
+		packetData.FlowSource = pkt.FlowSource
+		packetData.Summary = fmt.Sprintf("%s %s flow (%d packets)", pkt.FlowSource, pkt.Protocol.Name, packetData.Packets)
 	}
 
 	ps.nextID++
@@ -0,0 +1,128 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+
+	"go-etherape/capture"
+	"go-etherape/graph"
+	"go-etherape/stream"
+)
+
+// Resolver maps an IP address to a display hostname
+type Resolver interface {
+	Resolve(ip string) string
+}
+
+// Config holds the consumers a Pipeline fans packets out to
+type Config struct {
+	GraphMgr  *graph.Manager
+	StreamMgr *stream.Manager      // Optional: stream tracking
+	Resolver  Resolver             // Optional: hostnames default to the IP
+	Clock     *capture.PacketClock // Optional: advanced with each packet's timestamp
+}
+
+// Pipeline consumes packets from any capture.Source and updates the graph,
+// packet store and stream tracker
+type Pipeline struct {
+	config     Config
+	packetChan chan *capture.PacketInfo
+}
+
+// NewPipeline creates a new ingestion pipeline
+func NewPipeline(config Config) *Pipeline {
+	return &Pipeline{
+		config:     config,
+		packetChan: make(chan *capture.PacketInfo, 1000),
+	}
+}
+
+// Packets returns the channel sources should be created with
+func (p *Pipeline) Packets() chan *capture.PacketInfo {
+	return p.packetChan
+}
+
+// Run starts the given sources and processes their packets until the context
+// is cancelled or every source has finished. Finite sources (files) are fully
+// drained and TCP reassembly is flushed before Run returns.
+func (p *Pipeline) Run(ctx context.Context, sources ...capture.Source) {
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src capture.Source) {
+			defer wg.Done()
+			src.Start(ctx)
+		}(src)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt := <-p.packetChan:
+			p.Process(pkt)
+		case <-done:
+			// All sources finished: process whatever they queued, then flush
+			for {
+				select {
+				case pkt := <-p.packetChan:
+					p.Process(pkt)
+				default:
+					if p.config.StreamMgr != nil {
+						p.config.StreamMgr.FlushReassembly()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Process applies a single packet to the graph, packet store and streams
+func (p *Pipeline) Process(pkt *capture.PacketInfo) {
+	if pkt == nil {
+		return
+	}
+
+	if p.config.Clock != nil {
+		p.config.Clock.Observe(pkt.Timestamp)
+	}
+
+	// Resolve hostnames (asynchronously for live resolvers)
+	srcHostname, dstHostname := pkt.SrcIP, pkt.DstIP
+	if p.config.Resolver != nil {
+		srcHostname = p.config.Resolver.Resolve(pkt.SrcIP)
+		dstHostname = p.config.Resolver.Resolve(pkt.DstIP)
+	}
+
+	// Update graph
+	labels := graph.LabelsFor(pkt)
+	packets := pkt.PacketCount()
+	p.config.GraphMgr.AddOrUpdateNode(pkt.SrcIP, srcHostname, labels, packets, pkt.Length, pkt.Timestamp)
+	p.config.GraphMgr.AddOrUpdateNode(pkt.DstIP, dstHostname, labels, packets, pkt.Length, pkt.Timestamp)
+	p.config.GraphMgr.AddOrUpdateEdge(pkt.SrcIP, pkt.DstIP, labels, pkt.Protocol, packets, pkt.Length, pkt.Timestamp)
+
+	// Store packet with payload for inspection
+	p.config.GraphMgr.AddPacket(pkt)
+
+	// Add packet to stream tracking; flow records have no payload to reassemble
+	if p.config.StreamMgr != nil && !pkt.FlowDerived() {
+		events := p.config.StreamMgr.AddPacket(pkt)
+		if hello := events.TLS; hello != nil {
+			// Remember which servers each client asked for, even without DNS
+			p.config.GraphMgr.AddTLSClient(hello.ClientIP, hello.ServerName, hello.JA4)
+		}
+		for _, w := range events.Measurements {
+			p.config.GraphMgr.AddMeasurementWrite(w.ClientIP, w.Measurement, w.Points)
+		}
+		for _, q := range events.DNS {
+			p.config.GraphMgr.AddDNSEvent(q.ClientIP, q.Name, q.RCode)
+		}
+	}
+}
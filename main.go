@@ -14,22 +14,76 @@ import (
 	"go-etherape/capture"
 	"go-etherape/daemon"
 	"go-etherape/graph"
-	"go-etherape/replay"
+	"go-etherape/ingest"
 	"go-etherape/server"
 	"go-etherape/stream"
-
-	"github.com/google/gopacket/pcap"
 )
 
 func main() {
 	// Parse command-line flags
-	iface := flag.String("i", "", "Network interface to capture from (required for capture mode)")
-	replayFile := flag.String("f", "", "Pcap file path for replay-only mode (disables live capture)")
+	var ifaceFlags flagSlice
+	flag.Var(&ifaceFlags, "i", "Network interface to capture from; repeat or comma-separate for several, or \"any\" for all (required for capture mode)")
+	replayFile := flag.String("f", "", "Pcap file path for replay-only mode (disables live capture); \"-\" or a named pipe reads a live pcap stream")
+	pcapListen := flag.String("pcap-listen", "", "TCP address to receive a live pcap stream on, e.g. :5555 (accepts reconnecting senders)")
+	flowListen := flag.String("flow-listen", "", "UDP address to collect NetFlow v5/v9, IPFIX and sFlow exports on, e.g. :2055 (alone or alongside another live input)")
+	flowFile := flag.String("flow-file", "", "Pcap file of recorded flow exports to load in replay-only mode")
 	port := flag.Int("p", 8443, "HTTPS server port")
 	bindIP := flag.String("ip", "0.0.0.0", "IP address to bind server to")
 	daemonCmd := flag.String("daemon", "", "Daemon command: start, stop, pause, resume, status, rotate-logs, log-status, cleanup-logs")
 	background := flag.Bool("background", false, "Run in background (internal use)")
 
+	// Pcap rotation flags
+	pcapMaxSize := flag.String("pcap-max-size", "", "Start a new pcap file after this size (e.g., 100MB; empty = no limit)")
+	pcapRotateInterval := flag.Duration("pcap-rotate-interval", 0, "Start a new pcap file after this duration (e.g., 1h; 0 = no limit)")
+	pcapMaxFiles := flag.Int("pcap-max-files", 0, "Maximum number of capture files to keep in pcaps/ (0 = unlimited)")
+	pcapQuota := flag.String("pcap-quota", "", "Delete the oldest capture files when pcaps/ exceeds this size (e.g., 10GB; empty = unlimited)")
+
+	// Capture backend flags
+	captureBackend := flag.String("capture-backend", "pcap", "Local capture backend: pcap (libpcap) or afpacket (Linux TPACKET_V3 ring)")
+	afpacketWorkers := flag.Int("afpacket-workers", 0, "AF_PACKET fanout sockets, each decoded by its own goroutine (0 = CPU count)")
+	afpacketSnapLen := flag.Int("afpacket-snaplen", capture.DefaultAFPacketSnapLen, "AF_PACKET ring frame size in bytes (largest packet captured in full)")
+	afpacketBlockSize := flag.String("afpacket-block-size", "4MB", "AF_PACKET ring block size (multiple of the page size and snaplen)")
+	afpacketBlocks := flag.Int("afpacket-blocks", capture.DefaultAFPacketNumBlocks, "AF_PACKET ring blocks per worker")
+
+	// Capture filter flags
+	bpfFilter := flag.String("filter", "", "BPF filter expression for local capture (e.g., \"not port 22\")")
+	excludeUI := flag.Bool("exclude-ui", true, "Exclude traffic to this server's own bind IP and port from local capture")
+
+	// Address policy flags (explicitly set flags override the policy file)
+	addressPolicyFile := flag.String("address-policy", "", "JSON file with the address inclusion policy")
+	var includeCIDRs, excludeCIDRs flagSlice
+	flag.Var(&includeCIDRs, "include-cidr", "CIDR that is always shown, even if its address class is hidden (can be specified multiple times)")
+	flag.Var(&excludeCIDRs, "exclude-cidr", "CIDR that is always hidden (can be specified multiple times)")
+	flag.Bool("show-multicast", false, "Show multicast addresses (224.0.0.0/4, ff00::/8)")
+	flag.Bool("show-broadcast", true, "Show the IPv4 broadcast address")
+	flag.Bool("show-ula", false, "Show IPv6 unique local addresses (fc00::/7)")
+	flag.Bool("show-loopback", false, "Show loopback addresses")
+	flag.Bool("show-link-local", false, "Show link-local addresses (169.254.0.0/16, fe80::/10)")
+
+	// Protocol registry
+	protocolsFile := flag.String("protocols", "", "JSON file with protocol registry entries (name, color, tcp/udp ports and ranges, priority) merged over the built-in ones; reloadable via /api/protocols/reload")
+
+	// Payload retention flags (explicitly set flags override the policy file)
+	payloadPolicyFile := flag.String("payload-policy", "", "JSON file with the payload retention policy")
+	payloadMode := flag.String("payload-mode", "full", "Payload retention: full, none (headers only), truncate or redact")
+	payloadMaxBytes := flag.Int("payload-max-bytes", 0, "Payload bytes kept per packet and stream direction (truncate mode; optional cap in redact mode)")
+	var redactKeywords, redactPatterns flagSlice
+	flag.Var(&redactKeywords, "redact-keyword", "Field name whose value is masked in redact mode, replacing the built-in list (can be specified multiple times)")
+	flag.Var(&redactPatterns, "redact-pattern", "Regular expression masked in redact mode (can be specified multiple times)")
+	flag.Bool("payload-pcap", false, "Apply the payload retention policy to saved pcap files")
+
+	// Anonymization flags
+	anonymize := flag.Bool("anonymize", false, "Replace IP and MAC addresses and hostnames with prefix-preserving pseudonyms (Crypto-PAn)")
+	anonymizeKey := flag.String("anonymize-key", "", "Anonymization key: 64 hex digits or a passphrase (implies -anonymize; default is a random per-run key)")
+	anonymizeKeyFile := flag.String("anonymize-key-file", "", "File holding the anonymization key (implies -anonymize)")
+	anonymizePcap := flag.Bool("anonymize-pcap", false, "Also anonymize addresses in saved pcap files")
+
+	// Tunnel flags
+	tunnelView := flag.String("tunnel-view", "inner", "Graph tunnelled traffic (GRE, VXLAN, GENEVE, 6in4) by its inner hosts or outer tunnel endpoints: inner or outer")
+
+	// Cluster flags
+	slurmConf := flag.String("slurm-conf", "", "slurm.conf whose SlurmctldHost/ControlMachine, NodeName and login entries label graph nodes with cluster roles (controller, compute, login)")
+
 	// SSH capture flags
 	sshHost := flag.String("ssh", "", "SSH host for remote capture (host:port format, e.g., 192.168.1.1:22)")
 	sshPrivateKey := flag.String("pkey", "", "Path to SSH private key file (for key-based authentication)")
@@ -81,14 +135,113 @@ func main() {
 		}
 	}
 
+	// Build pcap rotation config from flags
+	rotationConfig, err := buildRotationConfig(*pcapMaxSize, *pcapRotateInterval, *pcapMaxFiles, *pcapQuota)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Install the address inclusion policy before any packets are parsed
+	addressPolicy, err := buildAddressPolicy(*addressPolicyFile, includeCIDRs, excludeCIDRs)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := capture.SetAddressPolicy(addressPolicy); err != nil {
+		fmt.Printf("Error: invalid address policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Install the protocol registry before any packets are classified
+	if *protocolsFile != "" {
+		if err := capture.LoadProtocolsFile(*protocolsFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Install the payload retention policy before any packets are stored
+	payloadPolicy, err := buildPayloadPolicy(*payloadPolicyFile, *payloadMode, *payloadMaxBytes, redactKeywords, redactPatterns)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := capture.SetPayloadPolicy(payloadPolicy); err != nil {
+		fmt.Printf("Error: invalid payload policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Install the anonymizer before any packets are parsed
+	if *anonymize || *anonymizeKey != "" || *anonymizeKeyFile != "" {
+		anonymizer, err := buildAnonymizer(*anonymizeKey, *anonymizeKeyFile, *anonymizePcap)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		capture.SetAnonymizer(anonymizer)
+	} else if *anonymizePcap {
+		fmt.Println("Error: -anonymize-pcap requires -anonymize")
+		os.Exit(1)
+	}
+
+	mode, err := capture.ParseTunnelMode(*tunnelView)
+	if err != nil {
+		fmt.Printf("Error: invalid -tunnel-view: %v\n", err)
+		os.Exit(1)
+	}
+	capture.SetTunnelMode(mode)
+
 	// Determine mode based on flags
-	replayOnlyMode := *replayFile != ""
+	ifaces := capture.SplitInterfaces(ifaceFlags)
+	streamMode := *pcapListen != "" || (*replayFile != "" && capture.IsLiveStream(*replayFile))
+	replayOnlyMode := (*replayFile != "" && !streamMode) || *flowFile != ""
 	sshCaptureMode := *sshHost != ""
+	flowOnlyMode := *flowListen != "" && !streamMode && !sshCaptureMode && len(ifaces) == 0
 
 	// Validate flags based on mode
-	if replayOnlyMode {
-		// Replay-only mode: -f is specified, -i and -ssh are not allowed
-		if *iface != "" {
+	if *captureBackend != "pcap" && *captureBackend != "afpacket" {
+		fmt.Printf("Error: unknown -capture-backend %q (use pcap or afpacket)\n", *captureBackend)
+		os.Exit(1)
+	}
+	if *captureBackend != "pcap" && (replayOnlyMode || streamMode || sshCaptureMode) {
+		fmt.Println("Error: -capture-backend is only supported for local capture (-i)")
+		os.Exit(1)
+	}
+	if *bpfFilter != "" && (replayOnlyMode || streamMode || sshCaptureMode || flowOnlyMode) {
+		fmt.Println("Error: -filter is only supported for local capture (-i)")
+		os.Exit(1)
+	}
+
+	if streamMode {
+		// Live stream mode: -f - / FIFO or -pcap-listen, no other inputs
+		if *pcapListen != "" && *replayFile != "" {
+			fmt.Println("Error: Cannot use -pcap-listen with -f")
+			os.Exit(1)
+		}
+		if *flowFile != "" {
+			fmt.Println("Error: Cannot use -flow-file with a live pcap stream")
+			os.Exit(1)
+		}
+		if len(ifaces) > 0 || sshCaptureMode {
+			fmt.Println("Error: Cannot use -i or -ssh with a live pcap stream (-f - or -pcap-listen)")
+			os.Exit(1)
+		}
+	} else if replayOnlyMode {
+		// Replay-only mode: -f or -flow-file is specified, live inputs are not allowed
+		if *replayFile != "" && *flowFile != "" {
+			fmt.Println("Error: Cannot use -f with -flow-file")
+			os.Exit(1)
+		}
+		if *flowListen != "" {
+			fmt.Println("Error: Cannot use -flow-listen in replay-only mode")
+			os.Exit(1)
+		}
+		replayPath := *replayFile
+		if *flowFile != "" {
+			replayPath = *flowFile
+		}
+		if len(ifaces) > 0 {
 			fmt.Println("Error: Cannot use -i (interface) with -f (replay file)")
 			fmt.Println("  -f enables replay-only mode which does not capture from interfaces")
 			os.Exit(1)
@@ -100,12 +253,12 @@ func main() {
 		}
 
 		// Validate replay file exists
-		if _, err := os.Stat(*replayFile); os.IsNotExist(err) {
-			log.Fatalf("Replay file not found: %s", *replayFile)
+		if _, err := os.Stat(replayPath); os.IsNotExist(err) {
+			log.Fatalf("Replay file not found: %s", replayPath)
 		}
 	} else if sshCaptureMode {
 		// SSH capture mode: validate SSH flags
-		if *iface == "" {
+		if len(ifaces) == 0 {
 			fmt.Println("Error: -i (interface) is required for SSH capture mode")
 			fmt.Println("  Specify the remote interface to capture from")
 			os.Exit(1)
@@ -128,33 +281,23 @@ func main() {
 				log.Fatalf("SSH private key file not found: %s", *sshPrivateKey)
 			}
 		}
-	} else {
+	} else if !flowOnlyMode {
 		// Local capture mode: -i is required
-		if *iface == "" {
+		if len(ifaces) == 0 {
 			fmt.Println("Error: One of the following is required:")
 			fmt.Println("  -i: Network interface for live capture mode")
-			fmt.Println("  -f: Pcap file for replay-only mode")
+			fmt.Println("  -f: Pcap file for replay-only mode (\"-\" or a named pipe for a live pcap stream)")
+			fmt.Println("  -pcap-listen: TCP address to receive a live pcap stream on")
 			fmt.Println("  -ssh: SSH host for remote capture mode (requires -i, -user, and -pkey or -pass)")
+			fmt.Println("  -flow-listen: UDP address for NetFlow/IPFIX/sFlow collection")
 			flag.Usage()
 			os.Exit(1)
 		}
 
-		// Validate network interface exists
-		devices, err := pcap.FindAllDevs()
+		// Validate network interfaces exist and expand "any"
+		ifaces, err = capture.ExpandInterfaces(ifaces)
 		if err != nil {
-			log.Fatalf("Failed to enumerate network interfaces: %v", err)
-		}
-
-		interfaceExists := false
-		for _, device := range devices {
-			if device.Name == *iface {
-				interfaceExists = true
-				break
-			}
-		}
-
-		if !interfaceExists {
-			log.Fatalf("Network interface '%s' not found. Available interfaces:", *iface)
+			log.Fatalf("%v", err)
 		}
 	}
 
@@ -162,198 +305,210 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Initialize graph manager
+	// Initialize graph manager, timed by packet capture timestamps
 	graphMgr := graph.NewManager()
+	clock := capture.NewPacketClock()
+	graphMgr.SetClock(clock)
+	capture.SetClock(clock)
+	if *slurmConf != "" {
+		roles, err := graph.LoadSlurmConf(*slurmConf)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		graphMgr.SetClusterRoles(roles)
+		log.Printf("Loaded cluster roles for %d hosts from %s", roles.Len(), *slurmConf)
+	}
 
 	// Initialize stream manager (track last 1000 streams)
 	streamMgr := stream.NewManager(1000)
+	streamMgr.SetClock(clock)
+	streamMgr.StartFlushing(ctx)
+
+	// Single ingestion pipeline shared by every capture source
+	pipelineConfig := ingest.Config{
+		GraphMgr:  graphMgr,
+		StreamMgr: streamMgr,
+		Clock:     clock,
+	}
+	var sources []capture.Source
 
 	if replayOnlyMode {
 		// REPLAY-ONLY MODE
 		log.Printf("Starting go-etherape in REPLAY-ONLY mode...")
-		log.Printf("  Replay file: %s", *replayFile)
-		log.Printf("  Server: https://%s:%d", *bindIP, *port)
+		pipeline := ingest.NewPipeline(pipelineConfig)
 
-		// Load the initial pcap file and populate the graph
-		reader, err := replay.NewReader(*replayFile)
-		if err != nil {
-			log.Fatalf("Failed to load replay file: %v", err)
-		}
+		if *flowFile != "" {
+			log.Printf("  Flow export file: %s", *flowFile)
+			log.Printf("  Server: https://%s:%d", *bindIP, *port)
 
-		// Get all packets from the file (full replay)
-		allPackets := reader.GetPacketsUpToTime(reader.GetDuration().Seconds() + 1)
-		reader.Close()
+			// Load recorded flow exports (flows have no payloads to track as streams)
+			flowSource, err := capture.NewFlowCollector(capture.FlowCollectorConfig{File: *flowFile}, pipeline.Packets())
+			if err != nil {
+				log.Fatalf("Failed to load flow export file: %v", err)
+			}
+			pipeline.Run(ctx, flowSource)
 
-		log.Printf("  Loaded %d packets from replay file", len(allPackets))
-		log.Printf("  Duration: %.2f seconds", reader.GetDuration().Seconds())
+			log.Printf("  Loaded %d flow records from flow export file", flowSource.Stats().Delivered)
+		} else {
+			log.Printf("  Replay file: %s", *replayFile)
+			log.Printf("  Server: https://%s:%d", *bindIP, *port)
 
-		// Populate graph with all packets
-		for _, pwt := range allPackets {
-			pkt := pwt.Info
-			graphMgr.AddOrUpdateNode(pkt.SrcIP, pkt.SrcIP, pkt.Length)
-			graphMgr.AddOrUpdateNode(pkt.DstIP, pkt.DstIP, pkt.Length)
-			graphMgr.AddOrUpdateEdge(pkt.SrcIP, pkt.DstIP, pkt.Protocol, pkt.Length)
-			graphMgr.AddPacket(pkt)
-			streamMgr.AddPacket(pkt)
-		}
+			// Load the pcap file and populate the graph (full replay, no DNS)
+			fileSource, err := capture.NewFileCapture(*replayFile, pipeline.Packets())
+			if err != nil {
+				log.Fatalf("Failed to load replay file: %v", err)
+			}
+			pipeline.Run(ctx, fileSource)
 
-		log.Printf("  Stream tracking: enabled")
-	} else if sshCaptureMode {
-		// SSH CAPTURE MODE
-		log.Printf("Starting go-etherape in SSH CAPTURE mode...")
-		log.Printf("  SSH Host: %s", *sshHost)
-		log.Printf("  Remote Interface: %s", *iface)
-		log.Printf("  SSH User: %s", *sshUser)
-		if *sshPrivateKey != "" {
-			log.Printf("  Auth: Public Key (%s)", *sshPrivateKey)
-		} else {
-			log.Printf("  Auth: Password")
+			log.Printf("  Loaded %d packets from replay file", fileSource.Stats().Delivered)
+			log.Printf("  Duration: %.2f seconds", fileSource.Duration().Seconds())
+			log.Printf("  Stream tracking: enabled")
 		}
-		log.Printf("  Server: https://%s:%d", *bindIP, *port)
-		log.Printf("  Stream tracking: enabled")
-
+	} else {
 		// Start DNS resolver
 		dnsResolver := graph.NewDNSResolver()
 		dnsResolver.Start(ctx)
+		pipelineConfig.Resolver = dnsResolver
 
-		// Start decay manager
-		decayMgr := graph.NewDecayManager(graphMgr, 60) // 60 second timeout
-		decayMgr.Start(ctx)
+		pipeline := ingest.NewPipeline(pipelineConfig)
 
-		// Initialize SSH packet capture
-		packetChan := make(chan *capture.PacketInfo, 1000)
-		sshConfig := capture.SSHCaptureConfig{
-			Host:       *sshHost,
-			Interface:  *iface,
-			PrivateKey: *sshPrivateKey,
-			Username:   *sshUser,
-			Password:   *sshPass,
-		}
-		sshCaptureEngine, err := capture.NewSSHCapture(sshConfig, packetChan)
-		if err != nil {
-			log.Fatalf("Failed to initialize SSH capture: %v", err)
-		}
-
-		// Setup signal handlers for pause/resume
-		pauseSigChan := make(chan os.Signal, 1)
-		resumeSigChan := make(chan os.Signal, 1)
-		signal.Notify(pauseSigChan, syscall.SIGUSR1)
-		signal.Notify(resumeSigChan, syscall.SIGUSR2)
+		if streamMode {
+			// LIVE PCAP STREAM MODE
+			streamConfig := capture.StreamCaptureConfig{
+				Path:     *replayFile,
+				Listen:   *pcapListen,
+				Rotation: rotationConfig,
+			}
+			streamSource, err := capture.NewStreamCapture(streamConfig, pipeline.Packets())
+			if err != nil {
+				log.Fatalf("Failed to initialize pcap stream: %v", err)
+			}
+			log.Printf("Starting go-etherape in LIVE STREAM mode...")
+			log.Printf("  Input: %s", streamSource.Stats().Source)
+			log.Printf("  Server: https://%s:%d", *bindIP, *port)
+			log.Printf("  Stream tracking: enabled")
+			sources = append(sources, streamSource)
+		} else if sshCaptureMode {
+			// SSH CAPTURE MODE
+			log.Printf("Starting go-etherape in SSH CAPTURE mode...")
+			log.Printf("  SSH Host: %s", *sshHost)
+			log.Printf("  Remote Interfaces: %s", strings.Join(ifaces, ", "))
+			log.Printf("  SSH User: %s", *sshUser)
+			if *sshPrivateKey != "" {
+				log.Printf("  Auth: Public Key (%s)", *sshPrivateKey)
+			} else {
+				log.Printf("  Auth: Password")
+			}
+			log.Printf("  Server: https://%s:%d", *bindIP, *port)
+			log.Printf("  Stream tracking: enabled")
+
+			// Initialize one SSH packet capture per remote interface
+			for _, name := range ifaces {
+				sshConfig := capture.SSHCaptureConfig{
+					Host:       *sshHost,
+					Interface:  name,
+					PrivateKey: *sshPrivateKey,
+					Username:   *sshUser,
+					Password:   *sshPass,
+					Rotation:   rotationConfig,
+				}
+				sshCaptureEngine, err := capture.NewSSHCapture(sshConfig, pipeline.Packets())
+				if err != nil {
+					log.Fatalf("Failed to initialize SSH capture on %s: %v", name, err)
+				}
+				sources = append(sources, sshCaptureEngine)
+			}
+		} else if flowOnlyMode {
+			// FLOW COLLECTOR MODE
+			log.Printf("Starting go-etherape in FLOW COLLECTOR mode...")
+			log.Printf("  Server: https://%s:%d", *bindIP, *port)
+		} else {
+			// LOCAL CAPTURE MODE (original behavior)
+			log.Printf("Starting go-etherape...")
+			log.Printf("  Interfaces: %s", strings.Join(ifaces, ", "))
+			log.Printf("  Server: https://%s:%d", *bindIP, *port)
+			log.Printf("  Stream tracking: enabled")
+			if *captureBackend == "afpacket" {
+				log.Printf("  Backend: AF_PACKET")
+			}
 
-		// Handle pause/resume signals
-		go func() {
-			for {
-				select {
-				case <-pauseSigChan:
-					log.Println("Received pause signal")
-					sshCaptureEngine.Pause()
-				case <-resumeSigChan:
-					log.Println("Received resume signal")
-					sshCaptureEngine.Resume()
-				case <-ctx.Done():
-					return
+			var blockSize int64
+			if *captureBackend == "afpacket" {
+				blockSize, err = daemon.ParseSizeString(*afpacketBlockSize)
+				if err != nil {
+					log.Fatalf("Invalid -afpacket-block-size: %v", err)
 				}
 			}
-		}()
-
-		// Start SSH packet capture
-		go sshCaptureEngine.Start(ctx)
-
-		// Process packets and update graph
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case pkt := <-packetChan:
-					// Resolve hostnames asynchronously
-					srcHostname := dnsResolver.Resolve(pkt.SrcIP)
-					dstHostname := dnsResolver.Resolve(pkt.DstIP)
-
-					// Update graph
-					graphMgr.AddOrUpdateNode(pkt.SrcIP, srcHostname, pkt.Length)
-					graphMgr.AddOrUpdateNode(pkt.DstIP, dstHostname, pkt.Length)
-					graphMgr.AddOrUpdateEdge(pkt.SrcIP, pkt.DstIP, pkt.Protocol, pkt.Length)
-
-					// Store packet with payload for inspection
-					graphMgr.AddPacket(pkt)
-
-					// Add packet to stream tracking
-					streamMgr.AddPacket(pkt)
+
+			// Initialize one packet capture per interface (an invalid -filter fails here)
+			for _, name := range ifaces {
+				var excludeHosts []string
+				excludePort := 0
+				if *excludeUI {
+					excludeHosts = capture.SelfExclusionHosts(*bindIP, name)
+					excludePort = *port
+				}
+
+				var source capture.Source
+				var filterable capture.Filterable
+				if *captureBackend == "afpacket" {
+					afpacketConfig := capture.AFPacketConfig{
+						Interface:    name,
+						Filter:       *bpfFilter,
+						ExcludeHosts: excludeHosts,
+						ExcludePort:  excludePort,
+						SnapLen:      *afpacketSnapLen,
+						BlockSize:    int(blockSize),
+						NumBlocks:    *afpacketBlocks,
+						Workers:      *afpacketWorkers,
+						Rotation:     rotationConfig,
+					}
+					afpacketEngine, err := capture.NewAFPacketCapture(afpacketConfig, pipeline.Packets())
+					if err != nil {
+						log.Fatalf("Failed to initialize AF_PACKET capture on %s: %v", name, err)
+					}
+					source, filterable = afpacketEngine, afpacketEngine
+				} else {
+					captureConfig := capture.CaptureConfig{
+						Interface:    name,
+						Filter:       *bpfFilter,
+						ExcludeHosts: excludeHosts,
+						ExcludePort:  excludePort,
+						Rotation:     rotationConfig,
+					}
+					captureEngine, err := capture.NewCaptureWithConfig(captureConfig, pipeline.Packets())
+					if err != nil {
+						log.Fatalf("Failed to initialize packet capture on %s: %v", name, err)
+					}
+					source, filterable = captureEngine, captureEngine
+				}
+				if f := filterable.EffectiveFilter(); f != "" {
+					log.Printf("  Filter (%s): %s", name, f)
 				}
+				sources = append(sources, source)
 			}
-		}()
-	} else {
-		// LOCAL CAPTURE MODE (original behavior)
-		log.Printf("Starting go-etherape...")
-		log.Printf("  Interface: %s", *iface)
-		log.Printf("  Server: https://%s:%d", *bindIP, *port)
-		log.Printf("  Stream tracking: enabled")
+		}
 
-		// Start DNS resolver
-		dnsResolver := graph.NewDNSResolver()
-		dnsResolver.Start(ctx)
+		// Flow exports can be collected alongside any live input
+		if *flowListen != "" {
+			flowSource, err := capture.NewFlowCollector(capture.FlowCollectorConfig{Listen: *flowListen}, pipeline.Packets())
+			if err != nil {
+				log.Fatalf("Failed to initialize flow collector: %v", err)
+			}
+			log.Printf("  Flow collector: udp %s", *flowListen)
+			sources = append(sources, flowSource)
+		}
 
 		// Start decay manager
 		decayMgr := graph.NewDecayManager(graphMgr, 60) // 60 second timeout
 		decayMgr.Start(ctx)
 
-		// Initialize packet capture
-		packetChan := make(chan *capture.PacketInfo, 1000)
-		captureEngine, err := capture.NewCapture(*iface, packetChan)
-		if err != nil {
-			log.Fatalf("Failed to initialize packet capture: %v", err)
-		}
-
-		// Setup signal handlers for pause/resume
-		pauseSigChan := make(chan os.Signal, 1)
-		resumeSigChan := make(chan os.Signal, 1)
-		signal.Notify(pauseSigChan, syscall.SIGUSR1)
-		signal.Notify(resumeSigChan, syscall.SIGUSR2)
-
 		// Handle pause/resume signals
-		go func() {
-			for {
-				select {
-				case <-pauseSigChan:
-					log.Println("Received pause signal")
-					captureEngine.Pause()
-				case <-resumeSigChan:
-					log.Println("Received resume signal")
-					captureEngine.Resume()
-				case <-ctx.Done():
-					return
-				}
-			}
-		}()
-
-		// Start packet capture
-		go captureEngine.Start(ctx)
-
-		// Process packets and update graph
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case pkt := <-packetChan:
-					// Resolve hostnames asynchronously
-					srcHostname := dnsResolver.Resolve(pkt.SrcIP)
-					dstHostname := dnsResolver.Resolve(pkt.DstIP)
-
-					// Update graph
-					graphMgr.AddOrUpdateNode(pkt.SrcIP, srcHostname, pkt.Length)
-					graphMgr.AddOrUpdateNode(pkt.DstIP, dstHostname, pkt.Length)
-					graphMgr.AddOrUpdateEdge(pkt.SrcIP, pkt.DstIP, pkt.Protocol, pkt.Length)
-
-					// Store packet with payload for inspection
-					graphMgr.AddPacket(pkt)
-
-					// Add packet to stream tracking
-					streamMgr.AddPacket(pkt)
-				}
-			}
-		}()
+		handlePauseSignals(ctx, sources...)
+
+		// Start packet capture and process packets into the graph
+		go pipeline.Run(ctx, sources...)
 	}
 
 	// Build server config with rate limiting
@@ -367,6 +522,7 @@ func main() {
 			ClientMaxAge:      10 * time.Minute,
 		},
 		StreamMgr:      streamMgr,
+		Sources:        sources,
 		ReplayOnlyMode: replayOnlyMode,
 		Hostnames:      hostnames,
 	}
@@ -393,11 +549,43 @@ func main() {
 	<-sigChan
 
 	log.Println("Shutting down gracefully...")
+	for _, src := range sources {
+		st := src.Stats()
+		log.Printf("%s: %d received, %d delivered, %d kernel dropped, %d interface dropped, %d channel dropped, %d filtered",
+			st.Source, st.Received, st.Delivered, st.KernelDropped, st.InterfaceDropped, st.ChannelDropped, st.Filtered)
+	}
 	cancel()
 	srv.Shutdown(context.Background())
 	log.Println("Shutdown complete")
 }
 
+// handlePauseSignals pauses and resumes capture sources on SIGUSR1/SIGUSR2
+func handlePauseSignals(ctx context.Context, sources ...capture.Source) {
+	pauseSigChan := make(chan os.Signal, 1)
+	resumeSigChan := make(chan os.Signal, 1)
+	signal.Notify(pauseSigChan, syscall.SIGUSR1)
+	signal.Notify(resumeSigChan, syscall.SIGUSR2)
+
+	go func() {
+		for {
+			select {
+			case <-pauseSigChan:
+				log.Println("Received pause signal")
+				for _, source := range sources {
+					source.Pause()
+				}
+			case <-resumeSigChan:
+				log.Println("Received resume signal")
+				for _, source := range sources {
+					source.Resume()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
 // handleDaemonCommand handles daemon control commands
 func handleDaemonCommand(cmd string, logConfig daemon.LogRotateConfig) {
 	switch cmd {
@@ -469,6 +657,128 @@ func buildLogRotateConfig(maxSize string, maxBackups, maxAge int, compress bool,
 	return config
 }
 
+// buildRotationConfig parses pcap rotation flags into a RotationConfig
+func buildRotationConfig(maxSize string, interval time.Duration, maxFiles int, quota string) (capture.RotationConfig, error) {
+	config := capture.RotationConfig{
+		Dir:         "pcaps",
+		MaxDuration: interval,
+		MaxFiles:    maxFiles,
+	}
+
+	if maxSize != "" {
+		size, err := daemon.ParseSizeString(maxSize)
+		if err != nil {
+			return config, fmt.Errorf("invalid -pcap-max-size: %v", err)
+		}
+		config.MaxFileSize = size
+	}
+
+	if quota != "" {
+		size, err := daemon.ParseSizeString(quota)
+		if err != nil {
+			return config, fmt.Errorf("invalid -pcap-quota: %v", err)
+		}
+		config.MaxTotalSize = size
+	}
+
+	if interval < 0 || maxFiles < 0 {
+		return config, fmt.Errorf("pcap rotation limits must not be negative")
+	}
+
+	return config, nil
+}
+
+// buildAddressPolicy loads the policy file (if any) and applies the
+// include/exclude CIDRs and any address class flags set on the command line
+func buildAddressPolicy(path string, include, exclude []string) (capture.AddressPolicy, error) {
+	policy := capture.DefaultAddressPolicy()
+	if path != "" {
+		var err error
+		policy, err = capture.LoadAddressPolicy(path)
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	policy.Include = append(policy.Include, include...)
+	policy.Exclude = append(policy.Exclude, exclude...)
+
+	flag.Visit(func(f *flag.Flag) {
+		enabled := f.Value.String() == "true"
+		switch f.Name {
+		case "show-multicast":
+			policy.ShowMulticast = enabled
+		case "show-broadcast":
+			policy.ShowBroadcast = enabled
+		case "show-ula":
+			policy.ShowULA = enabled
+		case "show-loopback":
+			policy.ShowLoopback = enabled
+		case "show-link-local":
+			policy.ShowLinkLocal = enabled
+		}
+	})
+
+	return policy, nil
+}
+
+// buildPayloadPolicy loads the policy file (if any) and applies the redaction
+// keywords and patterns and any payload flags set on the command line
+func buildPayloadPolicy(path, mode string, maxBytes int, keywords, patterns []string) (capture.PayloadPolicy, error) {
+	policy := capture.DefaultPayloadPolicy()
+	if path != "" {
+		var err error
+		policy, err = capture.LoadPayloadPolicy(path)
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	policy.Keywords = append(policy.Keywords, keywords...)
+	policy.Patterns = append(policy.Patterns, patterns...)
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "payload-mode":
+			policy.Mode = capture.PayloadMode(mode)
+		case "payload-max-bytes":
+			policy.MaxBytes = maxBytes
+		case "payload-pcap":
+			policy.ApplyToPcap = f.Value.String() == "true"
+		}
+	})
+
+	return policy, nil
+}
+
+// buildAnonymizer creates the anonymizer from a key or key file. Without
+// either a random key is used, so pseudonyms change between runs.
+func buildAnonymizer(key, keyFile string, pcap bool) (*capture.Anonymizer, error) {
+	if key != "" && keyFile != "" {
+		return nil, fmt.Errorf("-anonymize-key and -anonymize-key-file are mutually exclusive")
+	}
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read anonymization key: %v", err)
+		}
+		key = strings.TrimSpace(string(data))
+		if key == "" {
+			return nil, fmt.Errorf("anonymization key file %s is empty", keyFile)
+		}
+	}
+	if key == "" {
+		log.Println("Warning: No anonymization key given; pseudonyms will differ between runs")
+	}
+
+	anonymizer, err := capture.NewAnonymizer(capture.AnonymizeConfig{Key: key, Pcap: pcap})
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Address anonymization enabled")
+	return anonymizer, nil
+}
+
 // flagSlice implements flag.Value for collecting multiple flag values
 type flagSlice []string
 
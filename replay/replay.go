@@ -11,6 +11,7 @@ import (
 
 	"go-etherape/capture"
 	"go-etherape/graph"
+	"go-etherape/ingest"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
@@ -143,14 +144,24 @@ func NewReader(filename string) (*Reader, error) {
 // loadPackets reads all packets from the pcap file
 func (r *Reader) loadPackets() error {
 	packetSource := gopacket.NewPacketSource(r.handle, r.handle.LinkType())
+	// Packets without a timestamp are dated from the file's own timeline
+	clock := capture.NewPacketClock()
+	defrag := capture.NewDefragmenterWithConfig(capture.DefragConfig{Clock: clock})
+	decoder := capture.NewPacketDecoderWithClock(clock)
 
 	for packet := range packetSource.Packets() {
-		packetInfo := capture.ProcessPacket(packet)
+		clock.Observe(packet.Metadata().Timestamp)
+		packet, fragments := defrag.Defrag(packet)
+		if packet == nil {
+			continue
+		}
+		packetInfo := decoder.ProcessPacket(packet)
 		if packetInfo == nil {
 			continue
 		}
+		packetInfo.Fragments = fragments
 
-		timestamp := packet.Metadata().Timestamp
+		timestamp := packetInfo.Timestamp
 
 		if len(r.packets) == 0 {
 			r.startTime = timestamp
@@ -207,30 +218,35 @@ func (r *Reader) Close() error {
 
 // BuildSnapshotFromPackets creates a graph snapshot from a list of packets
 func BuildSnapshotFromPackets(packetsWithTime []PacketWithTime) graph.GraphSnapshot {
-	// Create temporary graph manager for replay
+	// Create temporary graph manager for replay, timed by the capture itself
 	tempGraph := graph.NewManager()
-
-	// Create DNS cache for synchronous lookups
-	dnsCache := make(map[string]string)
-
-	// Process each packet
+	clock := capture.NewPacketClock()
+	tempGraph.SetClock(clock)
+
+	// Feed packets through the same ingestion path as live capture,
+	// resolving hostnames synchronously with simple caching
+	pipeline := ingest.NewPipeline(ingest.Config{
+		GraphMgr: tempGraph,
+		Resolver: &syncResolver{cache: make(map[string]string)},
+		Clock:    clock,
+	})
 	for _, pwt := range packetsWithTime {
-		pkt := pwt.Info
-
-		// Resolve hostnames with simple caching
-		srcHostname := resolveIPSync(pkt.SrcIP, dnsCache)
-		dstHostname := resolveIPSync(pkt.DstIP, dnsCache)
-
-		// Update graph
-		tempGraph.AddOrUpdateNode(pkt.SrcIP, srcHostname, pkt.Length)
-		tempGraph.AddOrUpdateNode(pkt.DstIP, dstHostname, pkt.Length)
-		tempGraph.AddOrUpdateEdge(pkt.SrcIP, pkt.DstIP, pkt.Protocol, pkt.Length)
-		tempGraph.AddPacket(pkt)
+		pipeline.Process(pwt.Info)
 	}
 
 	return tempGraph.GetSnapshot()
 }
 
+// syncResolver performs blocking reverse lookups for snapshot building
+type syncResolver struct {
+	cache map[string]string
+}
+
+// Resolve returns the hostname for an IP, looking it up if not cached
+func (r *syncResolver) Resolve(ip string) string {
+	return resolveIPSync(ip, r.cache)
+}
+
 // resolveIPSync performs synchronous DNS resolution with caching
 func resolveIPSync(ip string, cache map[string]string) string {
 	// Check cache first
@@ -239,7 +255,7 @@ func resolveIPSync(ip string, cache map[string]string) string {
 	}
 
 	// Perform reverse lookup
-	names, err := net.LookupAddr(ip)
+	names, err := net.LookupAddr(capture.RealAddress(ip))
 	if err != nil || len(names) == 0 {
 		cache[ip] = ip
 		return ip
@@ -247,7 +263,7 @@ func resolveIPSync(ip string, cache map[string]string) string {
 
 	hostname := names[0]
 	// Remove trailing dot if present
-	hostname = strings.TrimSuffix(hostname, ".")
+	hostname = capture.AnonymizeHostname(strings.TrimSuffix(hostname, "."))
 
 	// Cache the result
 	cache[ip] = hostname
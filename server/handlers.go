@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -10,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 
+	"go-etherape/capture"
+	"go-etherape/graph"
 	"go-etherape/replay"
 	"go-etherape/stream"
 )
@@ -19,6 +22,8 @@ const (
 	maxFilenameLength = 255
 	maxOffsetSeconds  = 86400 * 365 // 1 year max offset
 	minOffsetSeconds  = 0
+	maxFilterLength   = 4096
+	maxDNSLogLimit    = 2000
 )
 
 // validFilenameRegex allows only safe characters in filenames
@@ -49,6 +54,16 @@ func (m *Manager) handleIndex(w http.ResponseWriter, r *http.Request) {
 func (m *Manager) handleGraphAPI(w http.ResponseWriter, r *http.Request) {
 	snapshot := m.graphMgr.GetSnapshot()
 
+	// Optional tunnel filter, e.g. ?tunnel=vxlan:5001 or ?tunnel=vlan:100
+	if tunnel := r.URL.Query().Get("tunnel"); tunnel != "" {
+		snapshot = snapshot.FilterByTunnel(tunnel)
+	}
+	// Optional protocol filter: edges that carried any of the listed
+	// protocols, e.g. ?protocol=SSH,DNS
+	if protocol := r.URL.Query().Get("protocol"); protocol != "" {
+		snapshot = snapshot.FilterByProtocol(strings.Split(protocol, ","))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
 		http.Error(w, "Failed to encode graph data", http.StatusInternalServerError)
@@ -183,21 +198,38 @@ func (m *Manager) handleReplayPcap(w http.ResponseWriter, r *http.Request) {
 
 // handleDownloadCurrentPcap returns the current live capture pcap file
 func (m *Manager) handleDownloadCurrentPcap(w http.ResponseWriter, r *http.Request) {
-	// Get the most recent pcap file
-	pcapFiles, err := replay.GetPcapFiles("pcaps")
-	if err != nil || len(pcapFiles) == 0 {
-		http.Error(w, "No pcap files available", http.StatusNotFound)
+	// Saved pcaps hold real addresses unless they are rewritten too
+	if a := capture.CurrentAnonymizer(); a != nil && !a.RewritesPcap() {
+		http.Error(w, "Pcap download disabled: anonymization is on but saved pcaps are not anonymized (use -anonymize-pcap)", http.StatusForbidden)
 		return
 	}
 
-	// Get most recent file
-	currentFile := pcapFiles[0]
+	// Prefer the file a running capture source is writing to
+	currentPath := ""
+	for _, src := range m.sources {
+		if recorder, ok := src.(capture.PcapRecorder); ok {
+			if path := recorder.CurrentPcapFile(); path != "" {
+				currentPath = path
+				break
+			}
+		}
+	}
+
+	// Fall back to the most recent pcap file (e.g. replay-only mode)
+	if currentPath == "" {
+		pcapFiles, err := replay.GetPcapFiles("pcaps")
+		if err != nil || len(pcapFiles) == 0 {
+			http.Error(w, "No pcap files available", http.StatusNotFound)
+			return
+		}
+		currentPath = pcapFiles[0].Path
+	}
 
 	// Serve file for download
 	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", currentFile.Filename))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(currentPath)))
 
-	http.ServeFile(w, r, currentFile.Path)
+	http.ServeFile(w, r, currentPath)
 }
 
 // handleListStreams returns a list of all tracked streams
@@ -272,3 +304,297 @@ func (m *Manager) handleGetStreamStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// dnsLogResponse is the body returned by GET /api/dns
+type dnsLogResponse struct {
+	Transactions []stream.DNSTransaction    `json:"transactions"` // Newest first
+	Clients      map[string]*graph.DNSStats `json:"clients"`      // Query statistics by node ID
+}
+
+// handleDNSLog returns recent DNS transactions, optionally filtered by
+// client, name substring and response code, with per-client statistics
+func (m *Manager) handleDNSLog(w http.ResponseWriter, r *http.Request) {
+	if m.streamMgr == nil {
+		http.Error(w, "Stream tracking not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := stream.DNSFilter{
+		Client: query.Get("client"),
+		Name:   query.Get("name"),
+		RCode:  query.Get("rcode"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxDNSLogLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxDNSLogLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+	if len(filter.Client) > 64 || len(filter.Name) > 255 || len(filter.RCode) > 16 {
+		http.Error(w, "Filter too long", http.StatusBadRequest)
+		return
+	}
+
+	response := dnsLogResponse{
+		Transactions: m.streamMgr.GetDNSLog(filter),
+		Clients:      m.graphMgr.GetDNSStats(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// filterStatus describes the BPF filter on one capture source
+type filterStatus struct {
+	Filter    string `json:"filter"`    // User-supplied expression
+	Effective string `json:"effective"` // Installed expression including self-exclusion
+}
+
+// filterRequest is the body accepted by POST /api/filter
+type filterRequest struct {
+	Filter string `json:"filter"`
+}
+
+// handleCaptureFilter reports (GET) or replaces (POST) the live capture BPF filter
+func (m *Manager) handleCaptureFilter(w http.ResponseWriter, r *http.Request) {
+	filterables := make([]capture.Filterable, 0, len(m.sources))
+	for _, src := range m.sources {
+		if f, ok := src.(capture.Filterable); ok {
+			filterables = append(filterables, f)
+		}
+	}
+	if len(filterables) == 0 {
+		http.Error(w, "No live capture supports runtime filters", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req filterRequest
+		r.Body = http.MaxBytesReader(w, r.Body, maxFilterLength+256)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(req.Filter) > maxFilterLength {
+			http.Error(w, fmt.Sprintf("filter too long (max %d characters)", maxFilterLength), http.StatusBadRequest)
+			return
+		}
+		// Apply to every source or none: on failure, sources already
+		// updated go back to their previous filter
+		previous := make([]string, len(filterables))
+		for i, f := range filterables {
+			previous[i] = f.Filter()
+		}
+		for i, f := range filterables {
+			if err := f.SetFilter(req.Filter); err != nil {
+				for j := 0; j < i; j++ {
+					if err := filterables[j].SetFilter(previous[j]); err != nil {
+						log.Printf("Warning: Failed to restore capture filter %q: %v", previous[j], err)
+					}
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := make([]filterStatus, 0, len(filterables))
+	for _, f := range filterables {
+		statuses = append(statuses, filterStatus{
+			Filter:    f.Filter(),
+			Effective: f.EffectiveFilter(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// collectSourceStats gathers packet and loss counters from every source
+func collectSourceStats(sources []capture.Source) []capture.SourceStats {
+	stats := make([]capture.SourceStats, 0, len(sources))
+	for _, src := range sources {
+		stats = append(stats, src.Stats())
+	}
+	return stats
+}
+
+// statusResponse is returned by GET /api/status
+type statusResponse struct {
+	Sources []capture.SourceStats `json:"sources"`
+	Nodes   int                   `json:"nodes"`
+	Edges   int                   `json:"edges"`
+}
+
+// handleStatus reports capture loss accounting and graph size
+func (m *Manager) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshot := m.graphMgr.GetSnapshot()
+	status := statusResponse{
+		Sources: collectSourceStats(m.sources),
+		Nodes:   len(snapshot.Nodes),
+		Edges:   len(snapshot.Edges),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// maxPolicyBodySize bounds POST /api/address-policy and /api/payload-policy request bodies
+const maxPolicyBodySize = 64 * 1024
+
+// handleAddressPolicy reports (GET) or updates (POST) the address inclusion
+// policy. Fields omitted from a POST body keep their current values. The new
+// policy applies to packets parsed from then on.
+func (m *Manager) handleAddressPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		policy := capture.CurrentAddressPolicy()
+		r.Body = http.MaxBytesReader(w, r.Body, maxPolicyBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := capture.SetAddressPolicy(policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(capture.CurrentAddressPolicy()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handlePayloadPolicy reports (GET) or updates (POST) the payload retention
+// policy. Fields omitted from a POST body keep their current values. Data
+// already stored is not rewritten.
+func (m *Manager) handlePayloadPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		policy := capture.CurrentPayloadPolicy()
+		r.Body = http.MaxBytesReader(w, r.Body, maxPolicyBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := capture.SetPayloadPolicy(policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(capture.CurrentPayloadPolicy()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleProtocols returns the protocol registry, which drives the UI legend
+// and filters
+func (m *Manager) handleProtocols(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(capture.CurrentProtocols()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleReloadProtocols re-reads the protocol registry file (POST) and
+// returns the registry now in effect. Packets already in the graph keep the
+// protocol they were detected as.
+func (m *Manager) handleReloadProtocols(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := capture.ReloadProtocols(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Println("Protocol registry reloaded")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(capture.CurrentProtocols()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// tunnelModeRequest is the body accepted by POST /api/tunnel-mode
+type tunnelModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+// handleTunnelMode reports (GET) or changes (POST) whether tunnelled traffic
+// is graphed by its inner hosts or its tunnel endpoints
+func (m *Manager) handleTunnelMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req tunnelModeRequest
+		r.Body = http.MaxBytesReader(w, r.Body, 1024)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		mode, err := capture.ParseTunnelMode(req.Mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		capture.SetTunnelMode(mode)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tunnelModeRequest{Mode: string(capture.CurrentTunnelMode())}); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"os"
 	"time"
 
+	"go-etherape/capture"
 	"go-etherape/graph"
 	"go-etherape/stream"
 )
@@ -37,6 +38,7 @@ type ServerConfig struct {
 	Port            int
 	RateLimitConfig RateLimitConfig
 	StreamMgr       *stream.Manager
+	Sources         []capture.Source // Running capture sources (empty in replay-only mode)
 	ReplayOnlyMode  bool
 	Hostnames       []string // Additional hostnames/IPs for TLS certificate
 }
@@ -59,10 +61,11 @@ func NewServer(bindIP string, port int, graphMgr *graph.Manager) *Server {
 func NewServerWithConfig(config ServerConfig, graphMgr *graph.Manager) *Server {
 	addr := fmt.Sprintf("%s:%d", config.BindIP, config.Port)
 	hub := NewHub(graphMgr)
+	hub.sources = config.Sources
 
 	return &Server{
 		addr:        addr,
-		graphMgr:    &Manager{graphMgr: graphMgr, streamMgr: config.StreamMgr},
+		graphMgr:    &Manager{graphMgr: graphMgr, streamMgr: config.StreamMgr, sources: config.Sources},
 		streamMgr:   config.StreamMgr,
 		hub:         hub,
 		rateLimiter: NewRateLimiter(config.RateLimitConfig),
@@ -74,6 +77,7 @@ func NewServerWithConfig(config ServerConfig, graphMgr *graph.Manager) *Server {
 type Manager struct {
 	graphMgr  *graph.Manager
 	streamMgr *stream.Manager
+	sources   []capture.Source
 }
 
 // Start starts the HTTPS server
@@ -104,10 +108,18 @@ func (s *Server) Start() error {
 	mux.HandleFunc("/api/pcaps", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleListPcaps))
 	mux.HandleFunc("/api/replay", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleReplayPcap))
 	mux.HandleFunc("/api/download", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleDownloadCurrentPcap))
+	mux.HandleFunc("/api/filter", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleCaptureFilter))
+	mux.HandleFunc("/api/status", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleStatus))
+	mux.HandleFunc("/api/address-policy", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleAddressPolicy))
+	mux.HandleFunc("/api/payload-policy", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handlePayloadPolicy))
+	mux.HandleFunc("/api/protocols", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleProtocols))
+	mux.HandleFunc("/api/protocols/reload", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleReloadProtocols))
+	mux.HandleFunc("/api/tunnel-mode", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleTunnelMode))
 	// Stream API endpoints
 	mux.HandleFunc("/api/streams", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleListStreams))
 	mux.HandleFunc("/api/stream", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleGetStream))
 	mux.HandleFunc("/api/streams/stats", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleGetStreamStats))
+	mux.HandleFunc("/api/dns", s.rateLimiter.RateLimitHandlerFunc(s.graphMgr.handleDNSLog))
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	// Create HTTPS server
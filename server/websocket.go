@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"go-etherape/capture"
 	"go-etherape/graph"
 
 	"github.com/gorilla/websocket"
@@ -47,6 +48,14 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	graphMgr   *graph.Manager
+	sources    []capture.Source // Capture sources whose stats are broadcast
+}
+
+// hubMessage is the payload broadcast to clients: the graph snapshot plus
+// per-source capture counters so loss is visible in the UI
+type hubMessage struct {
+	graph.GraphSnapshot
+	CaptureStats []capture.SourceStats `json:"captureStats,omitempty"`
 }
 
 // NewHub creates a new WebSocket hub
@@ -72,8 +81,7 @@ func (h *Hub) Run() {
 			log.Printf("Client connected (total: %d)", len(h.clients))
 
 			// Send initial graph snapshot to new client
-			snapshot := h.graphMgr.GetSnapshot()
-			data, err := json.Marshal(snapshot)
+			data, err := h.snapshotMessage()
 			if err == nil {
 				client.send <- data
 			}
@@ -98,8 +106,7 @@ func (h *Hub) Run() {
 		case <-ticker.C:
 			// Broadcast graph snapshot to all clients
 			if len(h.clients) > 0 {
-				snapshot := h.graphMgr.GetSnapshot()
-				data, err := json.Marshal(snapshot)
+				data, err := h.snapshotMessage()
 				if err == nil {
 					for client := range h.clients {
 						select {
@@ -115,6 +122,14 @@ func (h *Hub) Run() {
 	}
 }
 
+// snapshotMessage encodes the current graph snapshot and capture stats
+func (h *Hub) snapshotMessage() ([]byte, error) {
+	return json.Marshal(hubMessage{
+		GraphSnapshot: h.graphMgr.GetSnapshot(),
+		CaptureStats:  collectSourceStats(h.sources),
+	})
+}
+
 // readPump pumps messages from the WebSocket connection to the hub
 func (c *Client) readPump() {
 	defer func() {
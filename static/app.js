@@ -1,22 +1,6 @@
-// Protocol color mapping (must match server-side)
-const PROTOCOL_COLORS = {
-    'TCP': '#3498db',
-    'UDP': '#2ecc71',
-    'ICMP': '#f39c12',
-    'HTTP': '#e67e22',
-    'HTTPS': '#9b59b6',
-    'DNS': '#1abc9c',
-    'SSH': '#e74c3c',
-    'FTP': '#ff6b9d',
-    'SMTP': '#8b4513',
-    'MySQL': '#34495e',
-    'PostgreSQL': '#16a085',
-    'InfluxDB': '#22ADF6',
-    'Slurm': '#ff7f50',
-    'ARP': '#95a5a6',
-    'IPv6': '#7f8c8d',
-    'Other': '#ecf0f1'
-};
+// Protocol registry from /api/protocols ({name, color, tcp, udp, priority});
+// drives the legend, the protocol filters and the stream protocol list
+let protocolRegistry = [];
 
 // Global state
 let network = null;
@@ -24,6 +8,8 @@ let nodes = new vis.DataSet();
 let edges = new vis.DataSet();
 let ws = null;
 let protocolFilters = new Set();
+let tunnelFilter = ''; // VLAN/MPLS/tunnel ID to show exclusively ('' = all traffic)
+const knownTunnels = new Set();
 let packets = []; // Store captured packets
 let packetCache = new Map(); // Persistent packet cache by ID
 let selectedPacketId = null;
@@ -304,31 +290,101 @@ function setupNetwork() {
 
 // Setup protocol legend and filters
 function setupLegend() {
+    const filtersContainer = document.getElementById('protocolFilters');
+
+    // Tunnel filter; VLAN/MPLS/VXLAN/GRE IDs are added as they are seen
+    const tunnelItem = document.createElement('label');
+    tunnelItem.className = 'filter-item';
+    tunnelItem.id = 'tunnelFilterItem';
+    tunnelItem.innerHTML = `
+        <span>Tunnel:</span>
+        <select id="tunnelFilter"><option value="">All traffic</option></select>
+    `;
+    tunnelItem.querySelector('select').addEventListener('change', handleTunnelFilterChange);
+    filtersContainer.appendChild(tunnelItem);
+
+    loadProtocols();
+}
+
+// Load the protocol registry and rebuild everything generated from it
+async function loadProtocols() {
+    try {
+        const response = await fetch('/api/protocols');
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
+        protocolRegistry = await response.json();
+    } catch (error) {
+        console.error('Failed to load protocol registry:', error);
+        return;
+    }
+    renderLegend();
+    renderStreamProtocolOptions();
+}
+
+// Render the legend and protocol filter checkboxes, keeping filter state
+function renderLegend() {
     const legendContainer = document.getElementById('protocolLegend');
     const filtersContainer = document.getElementById('protocolFilters');
+    const tunnelItem = document.getElementById('tunnelFilterItem');
 
-    Object.entries(PROTOCOL_COLORS).forEach(([protocol, color]) => {
+    legendContainer.innerHTML = '';
+    filtersContainer.querySelectorAll('.filter-item[data-protocol]').forEach(item => item.remove());
+
+    protocolRegistry.forEach(({ name, color }) => {
         // Add to legend
         const legendItem = document.createElement('div');
         legendItem.className = 'legend-item';
         legendItem.innerHTML = `
-            <span class="color-box" style="background-color: ${color}"></span>
-            <span>${protocol}</span>
+            <span class="color-box" style="background-color: ${escapeHtml(color)}"></span>
+            <span>${escapeHtml(name)}</span>
         `;
         legendContainer.appendChild(legendItem);
 
         // Add to filters
         const filterItem = document.createElement('label');
         filterItem.className = 'filter-item';
+        filterItem.dataset.protocol = name;
         filterItem.innerHTML = `
-            <input type="checkbox" value="${protocol}" checked>
-            <span>${protocol}</span>
+            <input type="checkbox" ${protocolFilters.has(name) ? '' : 'checked'}>
+            <span>${escapeHtml(name)}</span>
         `;
-        filterItem.querySelector('input').addEventListener('change', handleFilterChange);
-        filtersContainer.appendChild(filterItem);
+        const input = filterItem.querySelector('input');
+        input.value = name;
+        input.addEventListener('change', handleFilterChange);
+        filtersContainer.insertBefore(filterItem, tunnelItem);
+    });
+}
+
+// Add newly seen tunnel IDs to the tunnel filter
+function registerTunnels(items) {
+    const select = document.getElementById('tunnelFilter');
+    if (!select) return;
+
+    items.forEach(item => {
+        (item.tunnels || []).forEach(id => {
+            if (knownTunnels.has(id)) return;
+            knownTunnels.add(id);
+            const option = document.createElement('option');
+            option.value = id;
+            option.textContent = id;
+            select.appendChild(option);
+        });
     });
 }
 
+// Whether an item is outside the selected tunnel
+function isOutsideTunnel(item) {
+    return tunnelFilter !== '' && !(item.tunnels || []).includes(tunnelFilter);
+}
+
+// Handle tunnel filter changes
+function handleTunnelFilterChange(event) {
+    tunnelFilter = event.target.value;
+    nodes.update(nodes.get().map(node => ({ id: node.id, hidden: isOutsideTunnel(node) })));
+    updateEdgeVisibility();
+}
+
 // Setup dropdown toggles (submenus)
 function setupDropdowns() {
     const statsToggle = document.getElementById('statsToggle');
@@ -383,6 +439,10 @@ function setupDropdowns() {
         legendToggle.addEventListener('click', function(e) {
             e.stopPropagation();
             toggleSubmenu(legendToggle, legendContent);
+            // Pick up registry reloads
+            if (legendContent.classList.contains('show')) {
+                loadProtocols();
+            }
         });
     }
 
@@ -667,6 +727,34 @@ function performSearch(query) {
             });
         }
 
+        // Search TLS server names the node asked for
+        (node.serverNames || []).forEach(name => {
+            if (name.toLowerCase().includes(queryLower)) {
+                matches.push({ type: 'TLS Server', value: name });
+            }
+        });
+
+        // Search the names the node looked up most
+        ((node.dns && node.dns.topDomains) || []).forEach(d => {
+            if (d.name.toLowerCase().includes(queryLower)) {
+                matches.push({ type: 'DNS Name', value: d.name });
+            }
+        });
+
+        // Search InfluxDB measurements the node wrote
+        Object.keys(node.measurements || {}).forEach(name => {
+            if (name.toLowerCase().includes(queryLower)) {
+                matches.push({ type: 'Measurement', value: name });
+            }
+        });
+
+        // Search cluster roles from the slurm.conf
+        (node.roles || []).forEach(role => {
+            if (role.includes(queryLower)) {
+                matches.push({ type: 'Cluster Role', value: role });
+            }
+        });
+
         // Search in tooltip data (contains packets, bytes, etc.)
         if (node.title && node.title.toLowerCase().includes(queryLower)) {
             const titleMatches = extractTitleMatches(node.title, query);
@@ -690,10 +778,11 @@ function performSearch(query) {
     const edgeMatches = new Map(); // Group by node
 
     allEdges.forEach(edge => {
-        // Search protocol name
-        if (edge.protocol && edge.protocol.Name &&
-            edge.protocol.Name.toLowerCase().includes(queryLower)) {
-            addEdgeMatch(edgeMatches, edge, 'Protocol', edge.protocol.Name);
+        // Search every protocol the edge carried
+        if (edge.protocol && edge.protocol.Name) {
+            edgeProtocolNames(edge)
+                .filter(name => name.toLowerCase().includes(queryLower))
+                .forEach(name => addEdgeMatch(edgeMatches, edge, 'Protocol', name));
         }
 
         // Search edge label (contains packet count)
@@ -1389,7 +1478,7 @@ function showPacketInspector(packet) {
             ` : ''}
             <div class="packet-detail-field">
                 <div class="packet-detail-label">Protocol:</div>
-                <div class="packet-detail-value">${packet.protocol}</div>
+                <div class="packet-detail-value">${packet.protocol}${formatConfidence(packet.confidence)}</div>
             </div>
         </div>
 
@@ -1539,7 +1628,7 @@ function handleFilterChange(event) {
 function updateEdgeVisibility() {
     const allEdges = edges.get();
     allEdges.forEach(edge => {
-        const isHidden = protocolFilters.has(edge.protocol.Name);
+        const isHidden = isProtocolFiltered(edge) || isOutsideTunnel(edge);
         edges.update({
             id: edge.id,
             hidden: isHidden
@@ -1547,6 +1636,22 @@ function updateEdgeVisibility() {
     });
 }
 
+// Names of every protocol an edge carried
+function edgeProtocolNames(edge) {
+    const names = Object.keys(edge.protocols || {});
+    return names.length > 0 ? names : [edge.protocol.Name];
+}
+
+// An edge is filtered out only when every protocol it carried is
+function isProtocolFiltered(edge) {
+    return edgeProtocolNames(edge).every(name => protocolFilters.has(name));
+}
+
+// An edge's per-protocol traffic, busiest first
+function sortedEdgeProtocols(edge) {
+    return Object.values(edge.protocols || {}).sort((a, b) => b.byteCount - a.byteCount);
+}
+
 // Connect to WebSocket
 function connectWebSocket() {
     // Don't connect if in replay mode
@@ -1703,6 +1808,8 @@ function updateGraph(data) {
         console.log(`Performance mode: Limiting display to top ${MAX_NODES} nodes and ${MAX_EDGES} edges (total: ${totalNodes} nodes, ${totalEdges} edges)`);
     }
 
+    registerTunnels(data.nodes);
+
     // Sort nodes by packet count (most active first) and limit to MAX_NODES
     const sortedNodes = data.nodes
         .sort((a, b) => b.packetCount - a.packetCount)
@@ -1745,7 +1852,15 @@ function updateGraph(data) {
                 ips: node.ips || [node.id],
                 hostname: node.label,
                 packetCount: node.packetCount,
-                byteCount: node.byteCount
+                byteCount: node.byteCount,
+                interfaces: node.interfaces || [],
+                tunnels: node.tunnels || [],
+                serverNames: node.serverNames || [],
+                tlsFingerprints: node.tlsFingerprints || [],
+                roles: node.roles || [],
+                measurements: node.measurements || {},
+                dns: node.dns || null,
+                hidden: isOutsideTunnel(node)
             };
 
             // For new nodes, find initial position near connected neighbor to prevent explosion
@@ -1848,10 +1963,15 @@ function updateGraph(data) {
         const cached = edgeStateCache.get(edge.id);
         const isNew = !currentEdgeIds.has(edge.id);
 
-        // Only update if: new edge or packet count changed significantly
+        // Only update if: new edge, packet count changed significantly, the
+        // protocol was reclassified or the edge carried a new protocol
+        const protocolNames = edgeProtocolNames(edge).sort().join(',');
         const needsUpdate = isNew ||
             !cached ||
-            Math.abs(cached.packetCount - edge.packetCount) > cached.packetCount * 0.1;
+            Math.abs(cached.packetCount - edge.packetCount) > cached.packetCount * 0.1 ||
+            cached.protocol !== edge.protocol.Name ||
+            cached.confidence !== edge.confidence ||
+            cached.protocolNames !== protocolNames;
 
         if (needsUpdate) {
             edgeUpdates.push({
@@ -1862,15 +1982,27 @@ function updateGraph(data) {
                 title: formatEdgeTooltip(edge),
                 color: { color: edge.protocol.Color },
                 width: Math.log(edge.packetCount + 1) * 0.5 + 1,
+                dashes: !!edge.flowDerived, // Flow-export traffic has no payloads
+                flowDerived: !!edge.flowDerived,
                 protocol: edge.protocol,
-                hidden: protocolFilters.has(edge.protocol.Name),
+                confidence: edge.confidence || '',
+                protocols: edge.protocols || {},
+                hidden: isProtocolFiltered(edge) || isOutsideTunnel(edge),
                 packetCount: edge.packetCount,
-                byteCount: edge.byteCount
+                byteCount: edge.byteCount,
+                interfaces: edge.interfaces || [],
+                tunnels: edge.tunnels || []
             });
         }
 
         // Update cache
-        edgeStateCache.set(edge.id, { packetCount: edge.packetCount, byteCount: edge.byteCount });
+        edgeStateCache.set(edge.id, {
+            packetCount: edge.packetCount,
+            byteCount: edge.byteCount,
+            protocol: edge.protocol.Name,
+            confidence: edge.confidence,
+            protocolNames
+        });
     }
 
     // Remove edges that no longer exist
@@ -1926,7 +2058,8 @@ function updateGraph(data) {
 
 // Format node label
 function formatNodeLabel(node) {
-    return node.label !== node.id ? node.label : node.id;
+    const label = node.label !== node.id ? node.label : node.id;
+    return node.roles && node.roles.length > 0 ? `${label}\n[${node.roles.join(', ')}]` : label;
 }
 
 // Format node tooltip
@@ -1954,9 +2087,42 @@ function formatNodeTooltip(node) {
     }
 
     tooltip += `Packets: ${node.packetCount}\nBytes: ${formatBytes(node.byteCount)}`;
+    if (node.interfaces && node.interfaces.length > 0) {
+        tooltip += `\nInterfaces: ${node.interfaces.join(', ')}`;
+    }
+    if (node.tunnels && node.tunnels.length > 0) {
+        tooltip += `\nTunnels: ${node.tunnels.join(', ')}`;
+    }
+    if (node.serverNames && node.serverNames.length > 0) {
+        tooltip += `\nTLS servers: ${node.serverNames.length}`;
+    }
+    if (node.roles && node.roles.length > 0) {
+        tooltip += `\nCluster roles: ${node.roles.join(', ')}`;
+    }
+    const measurements = Object.keys(node.measurements || {});
+    if (measurements.length > 0) {
+        tooltip += `\nInfluxDB measurements: ${measurements.length}`;
+    }
+    if (node.dns && node.dns.queries > 0) {
+        tooltip += `\nDNS queries: ${node.dns.queries} (${formatPercent(node.dns.nxdomainRate)} NXDOMAIN)`;
+    }
     return tooltip;
 }
 
+// Format a protocol confidence for display after the protocol name
+function formatConfidence(confidence) {
+    return confidence ? ` (${confidence} confidence)` : '';
+}
+
+// Describe what a protocol confidence is based on
+function formatConfidenceSource(confidence) {
+    switch (confidence) {
+        case 'high': return 'Payload signature';
+        case 'low': return 'Port number';
+        default: return 'Transport';
+    }
+}
+
 // Format edge label
 function formatEdgeLabel(edge) {
     return `${edge.protocol.Name} (${edge.packetCount})`;
@@ -1964,8 +2130,14 @@ function formatEdgeLabel(edge) {
 
 // Format edge tooltip (bidirectional)
 function formatEdgeTooltip(edge) {
-    let tooltip = `${edge.from} ↔ ${edge.to}\nProtocol: ${edge.protocol.Name}\n`;
+    let tooltip = `${edge.from} ↔ ${edge.to}\nProtocol: ${edge.protocol.Name}${formatConfidence(edge.confidence)}\n`;
     tooltip += `Total: ${edge.packetCount} pkts, ${formatBytes(edge.byteCount)}\n`;
+    const breakdown = sortedEdgeProtocols(edge);
+    if (breakdown.length > 1) {
+        breakdown.forEach(t => {
+            tooltip += `  ${t.protocol.Name}: ${t.packetCount} pkts, ${formatBytes(t.byteCount)}\n`;
+        });
+    }
     // Show directional breakdown if available
     if (edge.forwardPackets !== undefined || edge.reversePackets !== undefined) {
         const fwdPkts = edge.forwardPackets || 0;
@@ -1975,6 +2147,15 @@ function formatEdgeTooltip(edge) {
         tooltip += `→ ${fwdPkts} pkts (${formatBytes(fwdBytes)})\n`;
         tooltip += `← ${revPkts} pkts (${formatBytes(revBytes)})`;
     }
+    if (edge.interfaces && edge.interfaces.length > 0) {
+        tooltip += `\nInterfaces: ${edge.interfaces.join(', ')}`;
+    }
+    if (edge.tunnels && edge.tunnels.length > 0) {
+        tooltip += `\nTunnels: ${edge.tunnels.join(', ')}`;
+    }
+    if (edge.flowDerived) {
+        tooltip += `\nSource: flow export (no payloads)`;
+    }
     return tooltip;
 }
 
@@ -2044,6 +2225,13 @@ function showNodeDetails(nodeId) {
         <div class="detail-item">
             <strong>Active Connections:</strong> ${connectedEdges.length}
         </div>
+        ${formatListHTML('Interfaces', node.interfaces)}
+        ${formatListHTML('Tunnels', node.tunnels)}
+        ${formatListHTML('TLS server names', node.serverNames)}
+        ${formatListHTML('TLS fingerprints (JA4)', node.tlsFingerprints)}
+        ${formatListHTML('Cluster roles', node.roles)}
+        ${formatListHTML('InfluxDB measurements written', formatMeasurements(node.measurements))}
+        ${formatDNSStatsHTML(node.dns)}
         <h5>Connections:</h5>
         <div class="connections-list">
             ${connectedEdges.map(edge => `
@@ -2078,7 +2266,7 @@ function showEdgeDetails(edgeId) {
         <div class="detail-item">
             <strong>Protocol:</strong>
             <span class="color-box" style="background-color: ${edge.color.color}"></span>
-            ${edge.protocol.Name}
+            ${edge.protocol.Name}${formatConfidence(edge.confidence)}
         </div>
         <div class="detail-item">
             <strong>Packets:</strong> ${edge.packetCount}
@@ -2086,6 +2274,65 @@ function showEdgeDetails(edgeId) {
         <div class="detail-item">
             <strong>Bytes:</strong> ${formatBytes(edge.byteCount)}
         </div>
+        ${formatEdgeProtocolsHTML(edge)}
+        ${edge.flowDerived ? '<div class="detail-item"><strong>Source:</strong> flow export (no payloads)</div>' : ''}
+        ${formatListHTML('Interfaces', edge.interfaces)}
+        ${formatListHTML('Tunnels', edge.tunnels)}
+    `;
+}
+
+// Format a list attribute (interfaces, tunnels) as a detail item
+function formatListHTML(title, values) {
+    if (!values || values.length === 0) {
+        return '';
+    }
+    return `<div class="detail-item"><strong>${title}:</strong> ${escapeHtml(values.join(', '))}</div>`;
+}
+
+// Format InfluxDB points per measurement, most written first
+function formatMeasurements(measurements) {
+    return Object.entries(measurements || {})
+        .sort((a, b) => b[1] - a[1])
+        .map(([name, points]) => `${name} (${points.toLocaleString()} points)`);
+}
+
+// Format a 0-1 ratio as a percentage
+function formatPercent(ratio) {
+    return `${((ratio || 0) * 100).toFixed(1)}%`;
+}
+
+// Format a node's DNS client statistics for the details panel
+function formatDNSStatsHTML(dns) {
+    if (!dns || (dns.queries === 0 && dns.responses === 0)) {
+        return '';
+    }
+    const domains = (dns.topDomains || []).map(d => `${d.name} (${d.queries})`);
+    return `
+        <div class="detail-item">
+            <strong>DNS queries:</strong> ${dns.queries}, ${dns.responses} responses,
+            ${formatPercent(dns.nxdomainRate)} NXDOMAIN, ${dns.failures} failures
+        </div>
+        ${formatListHTML('Top DNS names', domains)}
+    `;
+}
+
+// Format an edge's per-protocol traffic for the details panel
+function formatEdgeProtocolsHTML(edge) {
+    const breakdown = sortedEdgeProtocols(edge);
+    if (breakdown.length < 2) {
+        return '';
+    }
+    return `
+        <h5>Traffic by protocol:</h5>
+        <div class="connections-list">
+            ${breakdown.map(t => `
+                <div class="connection-item">
+                    <span class="color-box" style="background-color: ${escapeHtml(t.protocol.Color)}"></span>
+                    ${escapeHtml(t.protocol.Name)}${formatConfidence(t.confidence)}:
+                    ${t.packetCount} pkts, ${formatBytes(t.byteCount)}, last seen ${new Date(t.lastSeen).toLocaleTimeString()}
+                </div>
+            `).join('')}
+        </div>
     `;
 }
 
@@ -3181,9 +3428,10 @@ let currentStreamTab = 'decoded';
 
 // Generate stream ID from packet data (matches backend logic)
 function generateStreamId(srcIP, srcPort, dstIP, dstPort, protocol) {
-    // Determine stream type based on protocol
+    // Determine stream type based on protocol. QUIC connections are keyed
+    // by connection ID; the server resolves their 5-tuple IDs.
     let streamType = 'TCP';
-    if (protocol === 'UDP' || protocol === 'DNS') {
+    if (protocol === 'UDP' || protocol === 'DNS' || protocol === 'QUIC') {
         streamType = 'UDP';
     }
 
@@ -3198,10 +3446,36 @@ function generateStreamId(srcIP, srcPort, dstIP, dstPort, protocol) {
     return `${streamType}-${src}-${dst}`;
 }
 
+// Registry protocols assigned below the transport layer (see
+// capture.IsApplicationProtocol); every other entry runs over TCP or UDP,
+// whether it was matched by port or by payload signature
+const NON_STREAM_PROTOCOLS = new Set(['ICMP', 'ARP', 'IPv6', 'Tunnel', 'Other']);
+
 // Check if a protocol is stream-capable (TCP or UDP based)
 function isStreamProtocol(protocol) {
-    const streamProtocols = ['TCP', 'UDP', 'HTTP', 'HTTPS', 'DNS', 'SSH', 'FTP', 'SMTP', 'MySQL', 'PostgreSQL', 'Telnet', 'Redis', 'Slurm'];
-    return streamProtocols.includes(protocol);
+    if (protocol === 'TCP' || protocol === 'UDP') {
+        return true;
+    }
+    return !NON_STREAM_PROTOCOLS.has(protocol) && protocolRegistry.some(p => p.name === protocol);
+}
+
+// Fill the stream protocol filter with the registry's TCP/UDP protocols
+function renderStreamProtocolOptions() {
+    const select = document.getElementById('streamProtocolFilter');
+    if (!select) return;
+
+    const selected = select.value || localStorage.getItem('streamProtocolFilter') || '';
+    select.innerHTML = '<option value="">All Protocols</option>';
+    protocolRegistry
+        .filter(p => p.name !== 'TCP' && p.name !== 'UDP' && isStreamProtocol(p.name))
+        .concat([{ name: 'Unknown' }])
+        .forEach(({ name }) => {
+            const option = document.createElement('option');
+            option.value = name;
+            option.textContent = name;
+            select.appendChild(option);
+        });
+    select.value = selected;
 }
 
 // Setup streams functionality
@@ -3303,6 +3577,8 @@ function renderStreamItem(stream) {
             <div class="stream-item-header">
                 <span class="stream-protocol ${protocolClass}">${escapeHtml(stream.protocol)}</span>
                 <span class="stream-type">${escapeHtml(stream.type)}</span>
+                ${stream.confidence ? `<span class="stream-confidence ${escapeHtml(stream.confidence)}">${escapeHtml(stream.confidence)} confidence</span>` : ''}
+                ${stream.writes ? `<span class="stream-writes" title="Operations that change device state">${stream.writes} write${stream.writes === 1 ? '' : 's'}</span>` : ''}
             </div>
             <div class="stream-endpoints">
                 ${escapeHtml(stream.srcIp)}:${stream.srcPort} → ${escapeHtml(stream.dstIp)}:${stream.dstPort}
@@ -3312,6 +3588,7 @@ function renderStreamItem(stream) {
                 <span>${stream.packetCount} packets</span>
                 <span>${formatBytes(stream.byteCount)}</span>
                 <span>${timeAgo}</span>
+                ${stream.interfaces && stream.interfaces.length > 0 ? `<span>${escapeHtml(stream.interfaces.join(', '))}</span>` : ''}
             </div>
         </div>
     `;
@@ -3347,6 +3624,29 @@ async function openStreamDetail(streamId) {
                 <span class="stream-meta-label">Type</span>
                 <span class="stream-meta-value">${escapeHtml(currentStreamData.type)}</span>
             </div>
+            ${currentStreamData.tls && currentStreamData.tls.serverName ? `
+            <div class="stream-meta-item">
+                <span class="stream-meta-label">Server Name</span>
+                <span class="stream-meta-value">${escapeHtml(currentStreamData.tls.serverName)}</span>
+            </div>` : ''}
+            ${currentStreamData.tls && currentStreamData.tls.version ? `
+            <div class="stream-meta-item">
+                <span class="stream-meta-label">TLS</span>
+                <span class="stream-meta-value">${escapeHtml(currentStreamData.tls.version)}</span>
+            </div>` : ''}
+            ${currentStreamData.connectionId ? `
+            <div class="stream-meta-item">
+                <span class="stream-meta-label">Connection ID</span>
+                <span class="stream-meta-value">${escapeHtml(currentStreamData.connectionId)}</span>
+            </div>
+            <div class="stream-meta-item">
+                <span class="stream-meta-label">Migrations</span>
+                <span class="stream-meta-value">${currentStreamData.migrations || 0}</span>
+            </div>` : ''}
+            <div class="stream-meta-item">
+                <span class="stream-meta-label">Identified by</span>
+                <span class="stream-meta-value">${formatConfidenceSource(currentStreamData.confidence)}</span>
+            </div>
             <div class="stream-meta-item">
                 <span class="stream-meta-label">Packets</span>
                 <span class="stream-meta-value">${currentStreamData.packetCount}</span>
@@ -5560,13 +5860,15 @@ function updateWarpSearch(query) {
     // Also search edges for protocol matches
     const allEdges = edges.get();
     allEdges.forEach(edge => {
-        if (edge.protocol && edge.protocol.Name && edge.protocol.Name.toLowerCase().includes(queryLower)) {
+        const matched = edge.protocol && edge.protocol.Name &&
+            edgeProtocolNames(edge).find(name => name.toLowerCase().includes(queryLower));
+        if (matched) {
             // Find the source node for this edge
             const sourceNode = allNodes.find(n => n.id === edge.from);
             if (sourceNode && !matches.find(m => m.node.id === sourceNode.id)) {
                 matches.push({
                     node: sourceNode,
-                    matches: [{ type: 'Protocol', value: edge.protocol.Name }]
+                    matches: [{ type: 'Protocol', value: matched }]
                 });
             }
         }
@@ -0,0 +1,421 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// BACnet APDU types
+const (
+	bacnetConfirmed   = 0
+	bacnetUnconfirmed = 1
+	bacnetSimpleAck   = 2
+	bacnetComplexAck  = 3
+	bacnetError       = 5
+	bacnetReject      = 6
+	bacnetAbort       = 7
+)
+
+// BACnet services with decoded parameters
+const (
+	bacnetReadProperty  = 12
+	bacnetWriteProperty = 15
+	bacnetIAm           = 0
+	bacnetWhoIs         = 8
+)
+
+// bacnetBVLCFunctions names the BACnet/IP virtual link functions
+var bacnetBVLCFunctions = map[byte]string{
+	0x00: "BVLC-Result", 0x01: "Write-BDT", 0x02: "Read-BDT", 0x03: "Read-BDT-Ack",
+	0x04: "Forwarded-NPDU", 0x05: "Register-Foreign-Device", 0x06: "Read-FDT", 0x07: "Read-FDT-Ack",
+	0x08: "Delete-FDT-Entry", 0x09: "Distribute-Broadcast-To-Network",
+	0x0a: "Original-Unicast-NPDU", 0x0b: "Original-Broadcast-NPDU", 0x0c: "Secure-BVLL",
+}
+
+// bacnetConfirmedServices names the confirmed services; bacnetWrites are
+// those that change objects, files or the device itself
+var (
+	bacnetConfirmedServices = map[byte]string{
+		0: "acknowledgeAlarm", 1: "confirmedCOVNotification", 2: "confirmedEventNotification",
+		3: "getAlarmSummary", 4: "getEnrollmentSummary", 5: "subscribeCOV", 6: "atomicReadFile",
+		7: "atomicWriteFile", 8: "addListElement", 9: "removeListElement", 10: "createObject",
+		11: "deleteObject", 12: "readProperty", 14: "readPropertyMultiple", 15: "writeProperty",
+		16: "writePropertyMultiple", 17: "deviceCommunicationControl", 18: "confirmedPrivateTransfer",
+		19: "confirmedTextMessage", 20: "reinitializeDevice", 26: "readRange",
+		28: "subscribeCOVProperty", 29: "getEventInformation",
+	}
+	bacnetWrites = map[byte]bool{7: true, 8: true, 9: true, 10: true, 11: true, 15: true, 16: true, 17: true, 20: true}
+)
+
+// bacnetUnconfirmedServices names the unconfirmed services
+var bacnetUnconfirmedServices = map[byte]string{
+	0: "i-Am", 1: "i-Have", 2: "unconfirmedCOVNotification", 3: "unconfirmedEventNotification",
+	4: "unconfirmedPrivateTransfer", 5: "unconfirmedTextMessage", 6: "timeSynchronization",
+	7: "who-Has", 8: "who-Is", 9: "utcTimeSynchronization", 10: "writeGroup",
+}
+
+// bacnetObjectTypes names the common object types
+var bacnetObjectTypes = map[uint32]string{
+	0: "analog-input", 1: "analog-output", 2: "analog-value", 3: "binary-input",
+	4: "binary-output", 5: "binary-value", 6: "calendar", 8: "device", 10: "file",
+	13: "multi-state-input", 14: "multi-state-output", 15: "notification-class",
+	17: "schedule", 19: "multi-state-value", 20: "trend-log",
+}
+
+// bacnetProperties names the common property identifiers
+var bacnetProperties = map[uint32]string{
+	28: "description", 36: "event-state", 44: "firmware-revision", 70: "model-name",
+	75: "object-identifier", 76: "object-list", 77: "object-name", 79: "object-type",
+	81: "out-of-service", 85: "present-value", 87: "priority-array", 104: "relinquish-default",
+	111: "status-flags", 112: "system-status", 117: "units", 120: "vendor-identifier",
+	121: "vendor-name",
+}
+
+// bacnetTag is a tagged value of BACnet's encoding: application tags carry
+// their data type, context tags a field number
+type bacnetTag struct {
+	number  int
+	context bool
+	opening bool
+	closing bool
+	lvt     int // Length, or the value of application booleans
+	data    []byte
+}
+
+// readBACnetTag reads one tag and its data
+func readBACnetTag(b []byte) (t bacnetTag, rest []byte, ok bool) {
+	if len(b) == 0 {
+		return t, nil, false
+	}
+	t.number, t.context, t.lvt = int(b[0]>>4), b[0]&0x08 != 0, int(b[0]&0x07)
+	b = b[1:]
+	if t.number == 0x0f {
+		if len(b) == 0 {
+			return t, nil, false
+		}
+		t.number, b = int(b[0]), b[1:]
+	}
+	if t.context && (t.lvt == 6 || t.lvt == 7) {
+		t.opening, t.closing = t.lvt == 6, t.lvt == 7
+		return t, b, true
+	}
+	if !t.context && t.number == 1 { // Boolean, valued by its length field
+		return t, b, true
+	}
+	n := t.lvt
+	if n == 5 {
+		if len(b) == 0 {
+			return t, nil, false
+		}
+		n, b = int(b[0]), b[1:]
+		switch {
+		case n == 254 && len(b) >= 2:
+			n, b = int(binary.BigEndian.Uint16(b)), b[2:]
+		case n == 255 && len(b) >= 4:
+			n, b = int(binary.BigEndian.Uint32(b)), b[4:]
+		case n >= 254:
+			return t, nil, false
+		}
+	}
+	if n > len(b) {
+		return t, nil, false
+	}
+	t.data = b[:n]
+	return t, b[n:], true
+}
+
+// uint reads the tag's data as an unsigned integer
+func (t bacnetTag) uint() uint32 {
+	var v uint32
+	for _, c := range t.data[:min(len(t.data), 4)] {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// decodeBACnet decodes BACnet/IP: the virtual link function, then the
+// service of application messages with the objects and properties read
+// and written
+func decodeBACnet(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < 4 || msg[0] != 0x81 {
+		log.add("Malformed BACnet/IP message (%d bytes)", len(msg))
+		return
+	}
+	function := msg[1]
+	npdu := msg[4:]
+	switch function {
+	case 0x04:
+		npdu = msg[min(len(msg), 10):] // After the original source address
+	case 0x09, 0x0a, 0x0b:
+	default:
+		name, ok := bacnetBVLCFunctions[function]
+		if !ok {
+			name = fmt.Sprintf("BVLC function 0x%02x", function)
+		}
+		log.count(name)
+		log.add("%s", name)
+		return
+	}
+
+	apdu, ok := bacnetAPDU(npdu)
+	if !ok {
+		log.count("network message")
+		return
+	}
+	if len(apdu) < 2 {
+		return
+	}
+
+	switch apdu[0] >> 4 {
+	case bacnetConfirmed:
+		if len(apdu) < 4 {
+			return
+		}
+		invoke, off := apdu[2], 3
+		if apdu[0]&0x08 != 0 { // Segmented: sequence number and window size
+			off = 5
+		}
+		if off >= len(apdu) {
+			return
+		}
+		service := apdu[off]
+		name := bacnetServiceName(bacnetConfirmedServices, service)
+		log.count(name)
+		desc := name
+		if args := bacnetServiceArgs(service, apdu[off+1:]); args != "" {
+			desc += " " + args
+		}
+		log.add("#%d %s", invoke, desc)
+		log.request(ProtocolBACnet, desc, bacnetWrites[service])
+	case bacnetUnconfirmed:
+		service := apdu[1]
+		name := bacnetServiceName(bacnetUnconfirmedServices, service)
+		log.count(name)
+		desc := name
+		switch service {
+		case bacnetIAm:
+			if args := bacnetIAmArgs(apdu[2:]); args != "" {
+				desc += " " + args
+			}
+		case bacnetWhoIs:
+			if low, rest, ok := readBACnetTag(apdu[2:]); ok && low.context {
+				if high, _, ok := readBACnetTag(rest); ok && high.context {
+					desc += fmt.Sprintf(" %d-%d", low.uint(), high.uint())
+				}
+			}
+		}
+		log.add("%s", desc)
+		if service != bacnetIAm {
+			log.request(ProtocolBACnet, desc, service == 10) // writeGroup
+		} else if log.summary == "" {
+			log.summary = "BACnet " + desc
+		}
+	case bacnetSimpleAck:
+		if len(apdu) >= 3 {
+			log.add("#%d %s ACK", apdu[1], bacnetServiceName(bacnetConfirmedServices, apdu[2]))
+		}
+	case bacnetComplexAck:
+		if len(apdu) < 3 {
+			return
+		}
+		invoke, off := apdu[1], 2
+		if apdu[0]&0x08 != 0 {
+			off = 4
+		}
+		if off >= len(apdu) {
+			return
+		}
+		service := apdu[off]
+		line := fmt.Sprintf("#%d %s ACK", invoke, bacnetServiceName(bacnetConfirmedServices, service))
+		if service == bacnetReadProperty {
+			if args := bacnetServiceArgs(bacnetWriteProperty, apdu[off+1:]); args != "" {
+				line += " " + args // Same layout as writeProperty requests
+			}
+		}
+		log.add("%s", line)
+	case bacnetError:
+		log.count("error")
+		if len(apdu) >= 3 {
+			line := fmt.Sprintf("#%d %s error", apdu[1], bacnetServiceName(bacnetConfirmedServices, apdu[2]))
+			if class, rest, ok := readBACnetTag(apdu[3:]); ok {
+				if code, _, ok := readBACnetTag(rest); ok {
+					line += fmt.Sprintf(": class %d code %d", class.uint(), code.uint())
+				}
+			}
+			log.add("%s", line)
+		}
+	case bacnetReject, bacnetAbort:
+		kind := "reject"
+		if apdu[0]>>4 == bacnetAbort {
+			kind = "abort"
+		}
+		log.count(kind)
+		if len(apdu) >= 3 {
+			log.add("#%d %s, reason %d", apdu[1], kind, apdu[2])
+		}
+	default:
+		log.count("other APDU")
+	}
+}
+
+// bacnetAPDU skips the network layer header. It returns false for network
+// layer messages, which carry no APDU.
+func bacnetAPDU(npdu []byte) ([]byte, bool) {
+	if len(npdu) < 2 || npdu[0] != 1 {
+		return nil, false
+	}
+	control, off := npdu[1], 2
+	if control&0x80 != 0 {
+		return nil, false
+	}
+	if control&0x20 != 0 { // Destination network and address
+		if off+3 > len(npdu) {
+			return nil, false
+		}
+		off += 3 + int(npdu[off+2])
+	}
+	if control&0x08 != 0 { // Source network and address
+		if off+3 > len(npdu) {
+			return nil, false
+		}
+		off += 3 + int(npdu[off+2])
+	}
+	if control&0x20 != 0 { // Hop count
+		off++
+	}
+	if off > len(npdu) {
+		return nil, false
+	}
+	return npdu[off:], true
+}
+
+// bacnetServiceArgs describes the object, property and value of
+// readProperty and writeProperty requests
+func bacnetServiceArgs(service byte, b []byte) string {
+	if service != bacnetReadProperty && service != bacnetWriteProperty {
+		return ""
+	}
+	var object, property, index, value, priority string
+	for len(b) > 0 {
+		t, rest, ok := readBACnetTag(b)
+		if !ok || !t.context {
+			break
+		}
+		b = rest
+		switch {
+		case t.number == 0 && len(t.data) == 4:
+			object = bacnetObject(t.uint())
+		case t.number == 1:
+			property = bacnetProperty(t.uint())
+		case t.number == 2 && !t.opening:
+			index = fmt.Sprintf("[%d]", t.uint())
+		case t.number == 3 && t.opening:
+			var values []string
+			for len(b) > 0 {
+				v, rest, ok := readBACnetTag(b)
+				if !ok {
+					return strings.TrimSpace(object + " " + property + index)
+				}
+				b = rest
+				if v.closing {
+					break
+				}
+				values = append(values, bacnetValue(v))
+			}
+			value = strings.Join(values, ",")
+		case t.number == 4:
+			priority = fmt.Sprintf(" priority %d", t.uint())
+		}
+	}
+	desc := strings.TrimSpace(object + " " + property + index)
+	if value != "" {
+		desc += "=" + value
+	}
+	return desc + priority
+}
+
+// bacnetIAmArgs describes the device and vendor of an I-Am
+func bacnetIAmArgs(b []byte) string {
+	device, rest, ok := readBACnetTag(b)
+	if !ok || device.context || device.number != 12 {
+		return ""
+	}
+	desc := bacnetObject(device.uint())
+	for i := 0; i < 3; i++ { // Max APDU length, segmentation, vendor ID
+		t, r, ok := readBACnetTag(rest)
+		if !ok {
+			break
+		}
+		rest = r
+		if i == 2 {
+			desc += fmt.Sprintf(" vendor %d", t.uint())
+		}
+	}
+	return desc
+}
+
+// bacnetValue formats an application-tagged value
+func bacnetValue(t bacnetTag) string {
+	if t.context {
+		return fmt.Sprintf("[%d]0x%x", t.number, t.data)
+	}
+	switch t.number {
+	case 0:
+		return "null"
+	case 1:
+		return fmt.Sprint(t.lvt != 0)
+	case 2, 9: // Unsigned, enumerated
+		return fmt.Sprint(t.uint())
+	case 3:
+		if len(t.data) == 0 || len(t.data) > 4 {
+			break
+		}
+		v := int32(t.uint() << (32 - 8*len(t.data)))
+		return fmt.Sprint(v >> (32 - 8*len(t.data)))
+	case 4:
+		if len(t.data) == 4 {
+			return fmt.Sprint(math.Float32frombits(binary.BigEndian.Uint32(t.data)))
+		}
+	case 5:
+		if len(t.data) == 8 {
+			return fmt.Sprint(math.Float64frombits(binary.BigEndian.Uint64(t.data)))
+		}
+	case 7: // Character string, after its encoding
+		if len(t.data) > 0 {
+			return octetString(t.data[1:])
+		}
+	case 12:
+		if len(t.data) == 4 {
+			return bacnetObject(t.uint())
+		}
+	}
+	return octetString(t.data)
+}
+
+// bacnetObject formats an object identifier as type,instance
+func bacnetObject(id uint32) string {
+	typ := id >> 22
+	name, ok := bacnetObjectTypes[typ]
+	if !ok {
+		name = fmt.Sprintf("object-type-%d", typ)
+	}
+	return fmt.Sprintf("%s,%d", name, id&0x3fffff)
+}
+
+// bacnetProperty names a property identifier
+func bacnetProperty(id uint32) string {
+	if name, ok := bacnetProperties[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("property-%d", id)
+}
+
+// bacnetServiceName names a service choice
+func bacnetServiceName(names map[byte]string, service byte) string {
+	if name, ok := names[service]; ok {
+		return name
+	}
+	return fmt.Sprintf("service %d", service)
+}
@@ -0,0 +1,53 @@
+package stream
+
+import "testing"
+
+// bvlc wraps an NPDU in a BACnet/IP virtual link header
+func bvlc(function byte, npdu ...byte) []byte {
+	n := 4 + len(npdu)
+	return append([]byte{0x81, function, byte(n >> 8), byte(n)}, npdu...)
+}
+
+func TestDecodeBACnet(t *testing.T) {
+	whoIs := bvlc(0x0b, 0x01, 0x20, 0xff, 0xff, 0x00, 0xff, 0x10, 0x08, 0x09, 0x00, 0x1a, 0x03, 0xe8)
+	// Forwarded by a BBMD from 192.0.2.5:47808
+	iAm := bvlc(0x04, 192, 0, 2, 5, 0xba, 0xc0, 0x01, 0x00,
+		0x10, 0x00, 0xc4, 0x02, 0x00, 0x00, 0x7b, 0x22, 0x05, 0xc4, 0x91, 0x03, 0x21, 0x0f)
+	read := bvlc(0x0a, 0x01, 0x04, 0x00, 0x05, 0x01, 0x0c, 0x0c, 0x00, 0x00, 0x00, 0x01, 0x19, 0x55)
+	readAck := bvlc(0x0a, 0x01, 0x00, 0x30, 0x01, 0x0c, 0x0c, 0x00, 0x00, 0x00, 0x01, 0x19, 0x55,
+		0x3e, 0x44, 0x41, 0xa8, 0x00, 0x00, 0x3f)
+	write := bvlc(0x0a, 0x01, 0x04, 0x00, 0x05, 0x02, 0x0f, 0x0c, 0x00, 0x40, 0x00, 0x02, 0x19, 0x55,
+		0x3e, 0x44, 0x42, 0x48, 0x00, 0x00, 0x3f, 0x49, 0x08)
+	writeAck := bvlc(0x0a, 0x01, 0x00, 0x20, 0x02, 0x0f)
+	denied := bvlc(0x0a, 0x01, 0x04, 0x00, 0x05, 0x03, 0x0f, 0x0c, 0x01, 0x00, 0x00, 0x00, 0x19, 0x55,
+		0x3e, 0x91, 0x01, 0x3f)
+	deniedErr := bvlc(0x0a, 0x01, 0x00, 0x50, 0x03, 0x0f, 0x91, 0x02, 0x91, 0x28)
+
+	log := decodeAll(decodeBACnet,
+		message{whoIs, true}, message{iAm, false}, message{read, true}, message{readAck, false},
+	)
+	if log.writes != 0 || log.summary != "BACnet readProperty analog-input,1 present-value" {
+		t.Errorf("after a read: %d writes, summary %q", log.writes, log.summary)
+	}
+	for _, m := range []message{
+		{write, true}, {writeAck, false}, {denied, true}, {deniedErr, false},
+		{bvlc(0x05, 0x00, 0x3c), true},
+		{bvlc(0x0b, 0x01, 0x80, 0x00), true},
+	} {
+		decodeBACnet(log, m.data, m.fromClient)
+	}
+	checkLog(t, log, []string{
+		"who-Is 0-1000",
+		"i-Am device,123 vendor 15",
+		"#1 readProperty analog-input,1 present-value",
+		"#1 readProperty ACK analog-input,1 present-value=21",
+		"#2 writeProperty analog-output,2 present-value=50 priority 8",
+		"#2 writeProperty ACK",
+		"#3 writeProperty binary-output,0 present-value=1",
+		"#3 writeProperty error: class 2 code 40",
+		"Register-Foreign-Device",
+	}, "BACnet writeProperty binary-output,0 present-value=1")
+	if log.writes != 2 || log.counts["error"] != 1 || log.counts["network message"] != 1 {
+		t.Errorf("got %d writes and counts %v", log.writes, log.counts)
+	}
+}
@@ -0,0 +1,198 @@
+package stream
+
+import (
+	"strconv"
+	"strings"
+)
+
+// BER tag classes
+const (
+	berUniversal   = 0
+	berApplication = 1
+	berContext     = 2
+)
+
+// Universal BER tags
+const (
+	berInteger     = 2
+	berOctetString = 4
+	berNull        = 5
+	berOID         = 6
+	berEnumerated  = 10
+	berSequence    = 16
+	berGeneralStr  = 27
+)
+
+// berElement is one BER-encoded element. SNMP, LDAP and Kerberos use
+// definite lengths, which Active Directory writes in long form even when
+// short would do, so encoding/asn1's DER rules don't apply.
+type berElement struct {
+	class       int
+	constructed bool
+	tag         int
+	body        []byte
+}
+
+// berHeader reads an element's identifier and length. size is the
+// element's total length; ok is false for malformed and indefinite-length
+// encodings, and size is 0 if the header itself is cut short.
+func berHeader(data []byte) (el berElement, header, size int, ok bool) {
+	if len(data) < 2 {
+		return el, 0, 0, true
+	}
+	el.class = int(data[0] >> 6)
+	el.constructed = data[0]&0x20 != 0
+	el.tag = int(data[0] & 0x1f)
+	off := 1
+	if el.tag == 0x1f {
+		// High tag number form
+		el.tag = 0
+		for {
+			if off >= len(data) {
+				return el, 0, 0, true
+			}
+			b := data[off]
+			off++
+			el.tag = el.tag<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+			if off > 4 {
+				return el, 0, 0, false
+			}
+		}
+	}
+	if off >= len(data) {
+		return el, 0, 0, true
+	}
+
+	n := int(data[off])
+	off++
+	if n&0x80 != 0 {
+		count := n & 0x7f
+		if count == 0 || count > 4 {
+			return el, 0, 0, false
+		}
+		if off+count > len(data) {
+			return el, 0, 0, true
+		}
+		n = 0
+		for _, b := range data[off : off+count] {
+			n = n<<8 | int(b)
+		}
+		off += count
+		if n < 0 || n > maxStreamData {
+			return el, 0, 0, false
+		}
+	}
+	return el, off, off + n, true
+}
+
+// readBER reads one complete element and returns the data after it
+func readBER(data []byte) (berElement, []byte, bool) {
+	el, header, size, ok := berHeader(data)
+	if !ok || size == 0 || size > len(data) {
+		return berElement{}, nil, false
+	}
+	el.body = data[header:size]
+	return el, data[size:], true
+}
+
+// frameBER frames TCP data as back-to-back BER SEQUENCEs, such as LDAP
+// messages. Anything else, e.g. TLS after STARTTLS, ends the framing.
+func frameBER(data []byte) (int, int) {
+	if data[0] != 0x30 {
+		return -1, 0
+	}
+	_, _, size, ok := berHeader(data)
+	if !ok {
+		return -1, 0
+	}
+	return size, 0
+}
+
+// children reads the elements of a constructed element, stopping at the
+// first malformed one
+func (e berElement) children() []berElement {
+	var list []berElement
+	rest := e.body
+	for len(rest) > 0 {
+		child, next, ok := readBER(rest)
+		if !ok {
+			break
+		}
+		list = append(list, child)
+		rest = next
+	}
+	return list
+}
+
+// is reports whether the element has the given class and tag
+func (e berElement) is(class, tag int) bool {
+	return e.class == class && e.tag == tag
+}
+
+// field returns the first child with a context-specific tag, the fields of
+// Kerberos structures and many LDAP choices
+func (e berElement) field(tag int) (berElement, bool) {
+	for _, child := range e.children() {
+		if child.is(berContext, tag) {
+			return child, true
+		}
+	}
+	return berElement{}, false
+}
+
+// explicit returns the element wrapped by an explicit tag
+func (e berElement) explicit() (berElement, bool) {
+	inner, _, ok := readBER(e.body)
+	return inner, ok
+}
+
+// int returns the body as a two's complement integer
+func (e berElement) int() int64 {
+	if len(e.body) == 0 || len(e.body) > 8 {
+		return 0
+	}
+	n := int64(int8(e.body[0]))
+	for _, b := range e.body[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+// uint returns the body as an unsigned integer, as SNMP counters are
+func (e berElement) uint() uint64 {
+	var n uint64
+	for _, b := range e.body {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// oid formats an OBJECT IDENTIFIER body in dotted form
+func (e berElement) oid() string {
+	if len(e.body) == 0 {
+		return ""
+	}
+	var parts []string
+	var n uint64
+	for _, b := range e.body {
+		n = n<<7 | uint64(b&0x7f)
+		if b&0x80 != 0 {
+			if n > 1<<56 {
+				return ""
+			}
+			continue
+		}
+		if len(parts) == 0 {
+			// The first subidentifier encodes the first two arcs
+			first := min(int(n/40), 2)
+			parts = append(parts, strconv.Itoa(first), strconv.FormatUint(n-uint64(first)*40, 10))
+		} else {
+			parts = append(parts, strconv.FormatUint(n, 10))
+		}
+		n = 0
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,41 @@
+package stream
+
+import "testing"
+
+// tlv encodes a BER element from an identifier byte and its contents
+func tlv(id byte, contents ...[]byte) []byte {
+	var body []byte
+	for _, c := range contents {
+		body = append(body, c...)
+	}
+	switch {
+	case len(body) < 0x80:
+		return append([]byte{id, byte(len(body))}, body...)
+	case len(body) < 0x100:
+		return append([]byte{id, 0x81, byte(len(body))}, body...)
+	default:
+		return append([]byte{id, 0x82, byte(len(body) >> 8), byte(len(body))}, body...)
+	}
+}
+
+func TestBERElements(t *testing.T) {
+	// Active Directory writes long-form lengths even for short contents
+	el, rest, ok := readBER([]byte{0x30, 0x84, 0x00, 0x00, 0x00, 0x03, 0x02, 0x01, 0xff, 0xaa})
+	if !ok || len(rest) != 1 || len(el.children()) != 1 || el.children()[0].int() != -1 {
+		t.Errorf("long-form element = %+v, %x, %v", el, rest, ok)
+	}
+	if _, _, ok := readBER([]byte{0x30, 0x80, 0x00, 0x00}); ok {
+		t.Error("indefinite length accepted")
+	}
+	if _, _, ok := readBER([]byte{0x30, 0x05, 0x02, 0x01}); ok {
+		t.Error("truncated element accepted")
+	}
+
+	oid := berElement{body: []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x8b, 0x3c, 0x01}}
+	if got := oid.oid(); got != "1.3.6.1.4.1.1468.1" {
+		t.Errorf("oid = %s, want 1.3.6.1.4.1.1468.1", got)
+	}
+	if got := (berElement{body: []byte{0x00, 0xff, 0xff, 0xff, 0xff}}).uint(); got != 0xffffffff {
+		t.Errorf("uint = %d", got)
+	}
+}
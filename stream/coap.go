@@ -0,0 +1,236 @@
+package stream
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// CoAP options that make up a request URI, and others that are shown
+const (
+	coapUriHost       = 3
+	coapObserve       = 6
+	coapUriPort       = 7
+	coapUriPath       = 11
+	coapContentFormat = 12
+	coapUriQuery      = 15
+)
+
+// coapTypes names the message types
+var coapTypes = [...]string{"CON", "NON", "ACK", "RST"}
+
+// coapMethods names the request codes (class 0); coapWrites are those that
+// change resources
+var (
+	coapMethods = map[byte]string{1: "GET", 2: "POST", 3: "PUT", 4: "DELETE", 5: "FETCH", 6: "PATCH", 7: "iPATCH"}
+	coapWrites  = map[byte]bool{2: true, 3: true, 4: true, 6: true, 7: true}
+)
+
+// coapResponses names the response codes by class.detail
+var coapResponses = map[string]string{
+	"2.01": "Created", "2.02": "Deleted", "2.03": "Valid", "2.04": "Changed", "2.05": "Content",
+	"2.31": "Continue", "4.00": "Bad Request", "4.01": "Unauthorized", "4.02": "Bad Option",
+	"4.03": "Forbidden", "4.04": "Not Found", "4.05": "Method Not Allowed", "4.06": "Not Acceptable",
+	"4.08": "Request Entity Incomplete", "4.09": "Conflict", "4.12": "Precondition Failed",
+	"4.13": "Request Entity Too Large", "4.15": "Unsupported Content-Format",
+	"5.00": "Internal Server Error", "5.01": "Not Implemented", "5.02": "Bad Gateway",
+	"5.03": "Service Unavailable", "5.04": "Gateway Timeout", "5.05": "Proxying Not Supported",
+}
+
+// coapContentFormats names the common Content-Format values
+var coapContentFormats = map[uint32]string{
+	0: "text/plain", 40: "application/link-format", 41: "application/xml",
+	42: "application/octet-stream", 47: "application/exi", 50: "application/json",
+	60: "application/cbor", 110: "application/senml+json", 112: "application/senml+cbor",
+}
+
+// coapOption is one option of a CoAP message
+type coapOption struct {
+	number int
+	value  []byte
+}
+
+// decodeCoAP decodes a CoAP message: requests with their method and URI,
+// and responses, which are matched to their request by token
+func decodeCoAP(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < 4 || msg[0]>>6 != 1 {
+		log.add("Malformed CoAP message (%d bytes)", len(msg))
+		return
+	}
+	typ, tkl, code := coapTypes[msg[0]>>4&0x3], int(msg[0]&0x0f), msg[1]
+	id := binary.BigEndian.Uint16(msg[2:])
+	if tkl > 8 || 4+tkl > len(msg) {
+		log.add("Malformed CoAP message (%d bytes)", len(msg))
+		return
+	}
+	token := hex.EncodeToString(msg[4 : 4+tkl])
+	options, payload := coapOptions(msg[4+tkl:])
+	key := "req:" + token
+
+	if code == 0 {
+		log.count("empty " + typ)
+		if typ == "RST" {
+			log.add("#%d RST", id)
+		}
+		return
+	}
+
+	if code>>5 == 0 {
+		method, ok := coapMethods[code]
+		if !ok {
+			method = fmt.Sprintf("0.%02d", code)
+		}
+		log.count(method)
+		desc := method + " " + coapURI(options)
+		line := fmt.Sprintf("#%d %s %s", id, typ, desc)
+		if format := coapFormat(options); format != "" {
+			line += " [" + format + "]"
+		}
+		if len(payload) > 0 {
+			line += " " + octetString(payload)
+		}
+		log.add("%s", line)
+		log.set(key, desc)
+		log.request(ProtocolCoAP, desc, coapWrites[code])
+		return
+	}
+
+	class := fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+	result := class
+	if name, ok := coapResponses[class]; ok {
+		result += " " + name
+	}
+	log.count(class)
+	line := fmt.Sprintf("#%d %s %s", id, typ, result)
+	req, ok := log.facts[key]
+	if ok {
+		line += " for " + req
+		if !coapHasOption(options, coapObserve) {
+			delete(log.facts, key) // Observe notifications keep coming under the same token
+		}
+	}
+	if len(payload) > 0 {
+		if format := coapFormat(options); format != "" {
+			line += " [" + format + "]"
+		}
+		line += " " + octetString(payload)
+	}
+	log.add("%s", line)
+
+	summarized := log.facts["lastWrite"]
+	if summarized == "" {
+		summarized = log.facts["lastRequest"]
+	}
+	if ok && req == summarized {
+		log.summary = "CoAP " + req + " → " + result
+	}
+}
+
+// coapOptions reads the delta-encoded options up to the payload marker
+func coapOptions(b []byte) ([]coapOption, []byte) {
+	var options []coapOption
+	number := 0
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			return options, b[1:]
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0f)
+		b = b[1:]
+		var ok bool
+		if delta, b, ok = coapExtended(delta, b); !ok {
+			break
+		}
+		if length, b, ok = coapExtended(length, b); !ok || length > len(b) {
+			break
+		}
+		number += delta
+		options = append(options, coapOption{number: number, value: b[:length]})
+		b = b[length:]
+	}
+	return options, nil
+}
+
+// coapExtended reads the extended form of an option delta or length
+func coapExtended(v int, b []byte) (int, []byte, bool) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, false
+		}
+		return int(b[0]) + 13, b[1:], true
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], true
+	case 15:
+		return 0, nil, false // Reserved for the payload marker
+	}
+	return v, b, true
+}
+
+// coapURI assembles a request's URI from its Uri-Host, Uri-Port, Uri-Path
+// and Uri-Query options. The host is only shown when the client sent one.
+func coapURI(options []coapOption) string {
+	var host, port string
+	var path, query []string
+	for _, o := range options {
+		switch o.number {
+		case coapUriHost:
+			host = capture.AnonymizeHostname(string(o.value))
+		case coapUriPort:
+			port = fmt.Sprint(coapUint(o.value))
+		case coapUriPath:
+			path = append(path, string(o.value))
+		case coapUriQuery:
+			query = append(query, string(o.value))
+		}
+	}
+	uri := "/" + strings.Join(path, "/")
+	if len(query) > 0 {
+		uri += "?" + strings.Join(query, "&")
+	}
+	if host != "" {
+		if port != "" {
+			host += ":" + port
+		}
+		uri = "coap://" + host + uri
+	}
+	return uri
+}
+
+// coapFormat names the Content-Format of a message, if it has one
+func coapFormat(options []coapOption) string {
+	for _, o := range options {
+		if o.number == coapContentFormat {
+			f := coapUint(o.value)
+			if name, ok := coapContentFormats[f]; ok {
+				return name
+			}
+			return fmt.Sprintf("format %d", f)
+		}
+	}
+	return ""
+}
+
+// coapHasOption reports whether a message has the option
+func coapHasOption(options []coapOption, number int) bool {
+	for _, o := range options {
+		if o.number == number {
+			return true
+		}
+	}
+	return false
+}
+
+// coapUint reads an option's value as an unsigned integer
+func coapUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b[:min(len(b), 4)] {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
@@ -0,0 +1,60 @@
+package stream
+
+import "testing"
+
+// coapMessage builds a CoAP message with its options already encoded
+func coapMessage(typ, code byte, id uint16, token, options, payload []byte) []byte {
+	msg := []byte{0x40 | typ<<4 | byte(len(token)), code, byte(id >> 8), byte(id)}
+	msg = append(append(msg, token...), options...)
+	if len(payload) > 0 {
+		msg = append(append(msg, 0xff), payload...)
+	}
+	return msg
+}
+
+func TestDecodeCoAP(t *testing.T) {
+	const con, ack, rst = 0, 2, 3
+	get := coapMessage(con, 0x01, 1, []byte{0xbe, 0xef}, []byte("\xb7sensors\x04temp"), nil)
+	content := coapMessage(ack, 0x45, 1, []byte{0xbe, 0xef}, []byte{0xc0}, []byte("21.5"))
+	put := coapMessage(con, 0x03, 2, []byte{0x01}, []byte("\x3alamp.local\x85state\x11\x32"), []byte("on"))
+	changed := coapMessage(ack, 0x44, 2, []byte{0x01}, nil, nil)
+
+	log := decodeAll(decodeCoAP, message{get, true}, message{content, false})
+	if log.writes != 0 || log.summary != "CoAP GET /sensors/temp → 2.05 Content" {
+		t.Errorf("after a read: %d writes, summary %q", log.writes, log.summary)
+	}
+	for _, m := range []message{
+		{put, true},
+		{changed, false},
+		{coapMessage(rst, 0, 3, nil, nil, nil), false},
+		{[]byte{0x00, 0x01, 0x00, 0x04}, true},
+	} {
+		decodeCoAP(log, m.data, m.fromClient)
+	}
+	checkLog(t, log, []string{
+		"#1 CON GET /sensors/temp",
+		`#1 ACK 2.05 Content for GET /sensors/temp [text/plain] "21.5"`,
+		`#2 CON PUT coap://lamp.local/state [application/json] "on"`,
+		"#2 ACK 2.04 Changed for PUT coap://lamp.local/state",
+		"#3 RST",
+		"Malformed CoAP message (4 bytes)",
+	}, "CoAP PUT coap://lamp.local/state → 2.04 Changed")
+	if log.writes != 1 {
+		t.Errorf("got %d writes, want the PUT", log.writes)
+	}
+}
+
+func TestCoAPOptions(t *testing.T) {
+	// Uri-Path, then Uri-Query by a delta of 4 and Size1 by an extended
+	// delta of 45
+	options, payload := coapOptions([]byte("\xb1a\x43x=1\xd1\x20\x0a\xffdata"))
+	if string(payload) != "data" || len(options) != 3 {
+		t.Fatalf("got options %v, payload %q", options, payload)
+	}
+	if got := coapURI(options); got != "/a?x=1" {
+		t.Errorf("URI = %q, want /a?x=1", got)
+	}
+	if options[2].number != 60 || coapUint(options[2].value) != 10 {
+		t.Errorf("got option %d = %x, want Size1 (60) = 10", options[2].number, options[2].value)
+	}
+}
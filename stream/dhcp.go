@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go-etherape/capture"
+)
+
+// DHCP option codes read from messages
+const (
+	dhcpOptPad         = 0
+	dhcpOptHostname    = 12
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptVendorClass = 60
+	dhcpOptEnd         = 255
+)
+
+// dhcpMessageTypes names the values of option 53
+var dhcpMessageTypes = map[byte]string{
+	1: "DISCOVER", 2: "OFFER", 3: "REQUEST", 4: "DECLINE",
+	5: "ACK", 6: "NAK", 7: "RELEASE", 8: "INFORM",
+}
+
+// decodeDHCP decodes a BOOTP/DHCP message
+func decodeDHCP(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < 240 || binary.BigEndian.Uint32(msg[236:]) != 0x63825363 {
+		log.add("Not a DHCP message (%d bytes)", len(msg))
+		return
+	}
+	xid := binary.BigEndian.Uint32(msg[4:])
+	yiaddr := net.IP(msg[16:20])
+	client := "-"
+	if hlen := int(msg[2]); hlen > 0 && hlen <= 16 {
+		client = capture.AnonymizeName(net.HardwareAddr(msg[28 : 28+hlen]).String())
+	}
+
+	typ := "BOOTREQUEST"
+	if msg[0] == 2 {
+		typ = "BOOTREPLY"
+	}
+	var hostname, vendor string
+	var requested, server net.IP
+	var lease time.Duration
+	for opts := msg[240:]; len(opts) > 0; {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			break
+		}
+		value := opts[2 : 2+int(opts[1])]
+		opts = opts[2+len(value):]
+
+		switch code {
+		case dhcpOptMessageType:
+			if len(value) == 1 {
+				if name, ok := dhcpMessageTypes[value[0]]; ok {
+					typ = name
+				}
+			}
+		case dhcpOptHostname:
+			hostname = capture.AnonymizeHostname(string(value))
+		case dhcpOptRequestedIP:
+			if len(value) == 4 {
+				requested = net.IP(value)
+			}
+		case dhcpOptServerID:
+			if len(value) == 4 {
+				server = net.IP(value)
+			}
+		case dhcpOptLeaseTime:
+			if len(value) == 4 {
+				lease = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+			}
+		case dhcpOptVendorClass:
+			vendor = string(value)
+		}
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s xid 0x%08x client %s", typ, xid, client)
+	if hostname != "" {
+		fmt.Fprintf(&line, " host %s", hostname)
+		log.set("host", hostname)
+	}
+	if vendor != "" {
+		fmt.Fprintf(&line, " vendor %q", vendor)
+	}
+	address := ""
+	if requested != nil {
+		address = requested.String()
+		fmt.Fprintf(&line, " requested %s", address)
+	}
+	if !yiaddr.IsUnspecified() {
+		address = yiaddr.String()
+		fmt.Fprintf(&line, " assigned %s", address)
+	}
+	if server != nil {
+		fmt.Fprintf(&line, " server %s", server)
+	}
+	if lease > 0 {
+		fmt.Fprintf(&line, " lease %s", lease)
+	}
+	log.add("%s", line.String())
+	log.count(typ)
+
+	who := client
+	if host := log.facts["host"]; host != "" {
+		who = host
+	}
+	if address != "" {
+		log.summary = fmt.Sprintf("DHCP %s %s for %s", typ, address, who)
+	} else {
+		log.summary = fmt.Sprintf("DHCP %s from %s", typ, who)
+	}
+}
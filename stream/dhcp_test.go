@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// dhcpMessage builds a BOOTP message for client 00:0b:82:01:fc:42 with
+// DHCP options
+func dhcpMessage(op byte, yiaddr [4]byte, options ...byte) []byte {
+	msg := make([]byte, 240)
+	msg[0], msg[1], msg[2] = op, 1, 6
+	binary.BigEndian.PutUint32(msg[4:], 0x3903f326)
+	copy(msg[16:], yiaddr[:])
+	copy(msg[28:], []byte{0x00, 0x0b, 0x82, 0x01, 0xfc, 0x42})
+	binary.BigEndian.PutUint32(msg[236:], 0x63825363)
+	return append(append(msg, options...), dhcpOptEnd)
+}
+
+func TestDecodeDHCP(t *testing.T) {
+	request := dhcpMessage(1, [4]byte{},
+		dhcpOptMessageType, 1, 3,
+		dhcpOptPad,
+		dhcpOptRequestedIP, 4, 192, 0, 2, 100,
+		dhcpOptServerID, 4, 192, 0, 2, 1,
+		dhcpOptHostname, 6, 'l', 'a', 'p', 't', 'o', 'p',
+		dhcpOptVendorClass, 8, 'M', 'S', 'F', 'T', ' ', '5', '.', '0',
+	)
+	ack := dhcpMessage(2, [4]byte{192, 0, 2, 100},
+		dhcpOptMessageType, 1, 5,
+		dhcpOptServerID, 4, 192, 0, 2, 1,
+		dhcpOptLeaseTime, 4, 0, 0, 0x0e, 0x10,
+	)
+
+	log := decodeAll(decodeDHCP, message{request, true}, message{ack, false})
+	checkLog(t, log, []string{
+		`REQUEST xid 0x3903f326 client 00:0b:82:01:fc:42 host laptop vendor "MSFT 5.0" requested 192.0.2.100 server 192.0.2.1`,
+		`ACK xid 0x3903f326 client 00:0b:82:01:fc:42 assigned 192.0.2.100 server 192.0.2.1 lease 1h0m0s`,
+	}, "DHCP ACK 192.0.2.100 for laptop")
+	if log.counts["REQUEST"] != 1 || log.counts["ACK"] != 1 {
+		t.Errorf("got counts %v", log.counts)
+	}
+}
+
+func TestDecodeDHCPMalformed(t *testing.T) {
+	// A missing magic cookie, and an option running past the end
+	noCookie := dhcpMessage(1, [4]byte{})
+	noCookie[236] = 0
+	log := decodeAll(decodeDHCP, message{noCookie, true}, message{[]byte{1, 1, 6}, true})
+	checkLog(t, log, []string{"Not a DHCP message (241 bytes)", "Not a DHCP message (3 bytes)"}, "")
+
+	truncated := dhcpMessage(1, [4]byte{}, dhcpOptMessageType, 1, 1, dhcpOptHostname, 40, 'x')
+	truncated = truncated[:len(truncated)-1] // Drop the end option
+	log = decodeAll(decodeDHCP, message{truncated, true})
+	checkLog(t, log, []string{"DISCOVER xid 0x3903f326 client 00:0b:82:01:fc:42"}, "DHCP DISCOVER from 00:0b:82:01:fc:42")
+}
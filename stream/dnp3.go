@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DNP3 link layer framing
+const (
+	dnp3HeaderLen = 10 // Start bytes, length, control, addresses and CRC
+	dnp3BlockLen  = 16 // User data is sent in blocks, each followed by a CRC
+	dnp3DirMaster = 0x80
+	dnp3FirstFrag = 0x40 // Transport header FIR bit
+)
+
+// dnp3Functions names the application layer function codes
+var dnp3Functions = map[byte]string{
+	0: "Confirm", 1: "Read", 2: "Write", 3: "Select", 4: "Operate", 5: "Direct Operate",
+	6: "Direct Operate No Ack", 7: "Immediate Freeze", 8: "Immediate Freeze No Ack",
+	9: "Freeze and Clear", 10: "Freeze and Clear No Ack", 11: "Freeze at Time",
+	12: "Freeze at Time No Ack", 13: "Cold Restart", 14: "Warm Restart", 15: "Initialize Data",
+	16: "Initialize Application", 17: "Start Application", 18: "Stop Application",
+	19: "Save Configuration", 20: "Enable Unsolicited", 21: "Disable Unsolicited",
+	22: "Assign Class", 23: "Delay Measurement", 24: "Record Current Time", 25: "Open File",
+	26: "Close File", 27: "Delete File", 28: "Get File Info", 29: "Authenticate File",
+	30: "Abort File", 31: "Activate Config", 32: "Authentication Request",
+	33: "Authentication Error", 0x81: "Response", 0x82: "Unsolicited Response",
+	0x83: "Authentication Response",
+}
+
+// dnp3Writes are the functions that change outstation state: writes,
+// controls, counter clears, restarts and configuration changes
+var dnp3Writes = map[byte]bool{
+	2: true, 3: true, 4: true, 5: true, 6: true, 9: true, 10: true, 13: true, 14: true,
+	15: true, 16: true, 17: true, 18: true, 19: true, 22: true, 24: true, 27: true, 31: true,
+}
+
+// dnp3Groups names the common object groups
+var dnp3Groups = map[byte]string{
+	1: "Binary Input", 2: "Binary Input Event", 3: "Double-bit Input", 10: "Binary Output",
+	11: "Binary Output Event", 12: "Binary Command", 20: "Counter", 21: "Frozen Counter",
+	22: "Counter Event", 30: "Analog Input", 32: "Analog Input Event", 40: "Analog Output Status",
+	41: "Analog Output", 50: "Time and Date", 51: "Time and Date CTO", 52: "Time Delay",
+	60: "Class Data", 70: "File Control", 80: "Internal Indications", 110: "Octet String",
+	120: "Authentication",
+}
+
+// frameDNP3 frames DNP3 link layer frames. The length byte counts the
+// header from the control byte on plus the user data, without CRCs.
+func frameDNP3(data []byte) (int, int) {
+	if len(data) < 3 {
+		return 0, 0
+	}
+	if data[0] != 0x05 || data[1] != 0x64 || data[2] < 5 {
+		return -1, 0
+	}
+	user := int(data[2]) - 5
+	return dnp3HeaderLen + user + 2*((user+dnp3BlockLen-1)/dnp3BlockLen), 0
+}
+
+// decodeDNP3 decodes the link addresses, application function and first
+// object header of DNP3 frames. Fragments after the first of a message
+// are only counted.
+func decodeDNP3(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < dnp3HeaderLen {
+		return
+	}
+	fromMaster := msg[3]&dnp3DirMaster != 0
+	dst, src := binary.LittleEndian.Uint16(msg[4:]), binary.LittleEndian.Uint16(msg[6:])
+
+	var user []byte
+	for rest := msg[dnp3HeaderLen:]; len(rest) > 2; {
+		n := min(len(rest)-2, dnp3BlockLen)
+		user = append(user, rest[:n]...)
+		rest = rest[n+2:]
+	}
+	if len(user) == 0 {
+		log.count("link")
+		return
+	}
+	if user[0]&dnp3FirstFrag == 0 {
+		log.count("continued fragment")
+		return
+	}
+	app := user[1:]
+	if len(app) < 2 {
+		return
+	}
+	fc := app[1]
+	name, ok := dnp3Functions[fc]
+	if !ok {
+		name = fmt.Sprintf("Function %d", fc)
+	}
+	log.count(name)
+	objects := app[2:]
+	if fc >= 0x81 && len(app) >= 4 {
+		objects = app[4:] // Internal indications follow the function code
+	}
+
+	desc := name
+	if header := dnp3ObjectHeader(objects); header != "" {
+		desc += " " + header
+	}
+	from, to := "outstation", "master"
+	if fromMaster {
+		from, to = to, from
+	}
+	line := fmt.Sprintf("%s %d -> %s %d: %s", from, src, to, dst, desc)
+	if fc >= 0x81 && len(app) >= 4 && (app[2] != 0 || app[3] != 0) {
+		line += fmt.Sprintf(" (IIN 0x%02x%02x)", app[2], app[3])
+	}
+	log.add("%s", line)
+
+	if fromMaster && fc < 0x81 && fc != 0 {
+		log.request(ProtocolDNP3, fmt.Sprintf("%s (outstation %d)", desc, dst), dnp3Writes[fc])
+	}
+}
+
+// dnp3ObjectHeader describes the first object header of an application
+// message: group, variation and the range or count of its qualifier
+func dnp3ObjectHeader(b []byte) string {
+	if len(b) < 3 {
+		return ""
+	}
+	group, variation, qualifier := b[0], b[1], b[2]
+	desc := fmt.Sprintf("g%dv%d", group, variation)
+	if name, ok := dnp3Groups[group]; ok {
+		if group == 60 && variation >= 1 && variation <= 4 {
+			name = fmt.Sprintf("Class %d Data", variation-1)
+		}
+		desc += " " + name
+	}
+	r := b[3:]
+	switch qualifier & 0x0f {
+	case 0:
+		if len(r) >= 2 {
+			desc += fmt.Sprintf(" [%d-%d]", r[0], r[1])
+		}
+	case 1:
+		if len(r) >= 4 {
+			desc += fmt.Sprintf(" [%d-%d]", binary.LittleEndian.Uint16(r), binary.LittleEndian.Uint16(r[2:]))
+		}
+	case 6:
+		desc += " all"
+	case 7:
+		if len(r) >= 1 {
+			desc += fmt.Sprintf(" count %d", r[0])
+		}
+	case 8:
+		if len(r) >= 2 {
+			desc += fmt.Sprintf(" count %d", binary.LittleEndian.Uint16(r))
+		}
+	}
+	return desc
+}
@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// dnp3Frame builds a DNP3 link frame carrying user data in 16-byte blocks.
+// The decoder doesn't check CRCs, so they are left zero.
+func dnp3Frame(control byte, dst, src uint16, user []byte) []byte {
+	frame := []byte{0x05, 0x64, byte(5 + len(user)), control}
+	frame = binary.LittleEndian.AppendUint16(frame, dst)
+	frame = binary.LittleEndian.AppendUint16(frame, src)
+	frame = append(frame, 0, 0)
+	for len(user) > 0 {
+		n := min(len(user), dnp3BlockLen)
+		frame = append(append(frame, user[:n]...), 0, 0)
+		user = user[n:]
+	}
+	return frame
+}
+
+func TestDecodeDNP3(t *testing.T) {
+	const master, outstation = 1, 10
+	read := dnp3Frame(0xc4, outstation, master, []byte{0xc0, 0xc1, 1, 60, 2, 0x06})
+	response := dnp3Frame(0x44, master, outstation, []byte{0xc0, 0xc1, 0x81, 0x00, 0x02, 30, 1, 0x00, 0, 3})
+	// Direct Operate of one CROB, spanning two blocks
+	operate := dnp3Frame(0xc4, outstation, master, []byte{
+		0xc1, 0xc2, 5, 12, 1, 0x28, 0x01, 0x00, 0x00, 0x00,
+		0x03, 0x01, 0xe8, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	})
+	if size, _ := frameDNP3(operate); size != len(operate) {
+		t.Fatalf("frameDNP3 = %d, want %d", size, len(operate))
+	}
+
+	log := decodeAll(decodeDNP3, message{read, true}, message{response, false})
+	if log.writes != 0 || log.summary != "DNP3 Read g60v2 Class 1 Data all (outstation 10)" {
+		t.Errorf("after a read: %d writes, summary %q", log.writes, log.summary)
+	}
+	decodeDNP3(log, operate, true)
+	decodeDNP3(log, dnp3Frame(0xc4, outstation, master, []byte{0x02, 0x00}), true)
+	decodeDNP3(log, dnp3Frame(0xc0, outstation, master, nil), true)
+
+	checkLog(t, log, []string{
+		"master 1 -> outstation 10: Read g60v2 Class 1 Data all",
+		"outstation 10 -> master 1: Response g30v1 Analog Input [0-3] (IIN 0x0002)",
+		"master 1 -> outstation 10: Direct Operate g12v1 Binary Command count 1",
+	}, "DNP3 Direct Operate g12v1 Binary Command count 1 (outstation 10)")
+	if log.writes != 1 || log.counts["continued fragment"] != 1 || log.counts["link"] != 1 {
+		t.Errorf("got %d writes and counts %v", log.writes, log.counts)
+	}
+}
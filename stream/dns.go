@@ -0,0 +1,319 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"go-etherape/capture"
+)
+
+// Limits for DNS decoding
+const (
+	maxDNSAnswers     = 8    // Answers kept per transaction
+	maxDNSPending     = 64   // Queries awaiting a response per stream
+	maxDNSLogEntries  = 2000 // Transactions kept by the manager
+	maxDNSTXTLen      = 100  // Longer TXT records are cut
+	defaultDNSLogSize = 200  // Transactions returned without a limit
+)
+
+// dnsRCodes names the response codes
+var dnsRCodes = map[layers.DNSResponseCode]string{
+	0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+	6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+}
+
+// DNSTransaction is a DNS query and its response, as far as each was seen
+type DNSTransaction struct {
+	ID        uint16     `json:"id"`
+	StreamID  string     `json:"streamId"`
+	Transport StreamType `json:"transport"`
+	ClientIP  string     `json:"clientIp"`
+	ServerIP  string     `json:"serverIp"`
+	Time      time.Time  `json:"time"` // When the query was seen, or the response if the query wasn't
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	RCode     string     `json:"rcode,omitempty"`   // Empty while unanswered
+	Answers   []string   `json:"answers,omitempty"` // e.g. "A 192.0.2.1", "CNAME example.net"; addresses are anonymized on output
+	Truncated bool       `json:"truncated,omitempty"`
+	LatencyMs float64    `json:"latencyMs,omitempty"` // Query to response
+	queried   bool       // The query was seen
+	fromSrc   bool       // The client is the stream's source
+}
+
+// DNSEvent is a DNS query or response, attributed to the client
+type DNSEvent struct {
+	ClientIP string
+	Name     string
+	RCode    string // Empty for queries
+	fromSrc  bool   // The client is the stream's source
+}
+
+// dnsState pairs a stream's queries with their responses
+type dnsState struct {
+	pending map[uint16]*DNSTransaction // Queries by transaction ID
+	created []*DNSTransaction          // Transactions not yet in the manager's log
+	events  []DNSEvent                 // Queries and responses not yet taken
+	total   int
+}
+
+// frameDNS frames DNS over TCP by its two-byte length prefix
+func frameDNS(data []byte) (int, int) {
+	if len(data) < 2 {
+		return 0, 0
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if n < 12 {
+		return -1, 0
+	}
+	return 2 + n, 2
+}
+
+// decodeDNS decodes a DNS message with gopacket: queries with their name
+// and type, and responses with their code and answers, paired with their
+// query by transaction ID to measure latency
+func decodeDNS(log *messageLog, msg []byte, fromClient bool) {
+	dns, err := parseDNS(msg)
+	if err != nil {
+		log.add("Malformed DNS message (%d bytes): %v", len(msg), err)
+		return
+	}
+	if log.dns == nil {
+		log.dns = &dnsState{pending: make(map[uint16]*DNSTransaction)}
+	}
+	state := log.dns
+	name, typ := "-", "-"
+	if len(dns.Questions) > 0 {
+		name = capture.AnonymizeHostname(strings.ToLower(string(dns.Questions[0].Name)))
+		typ = dnsTypeName(dns.Questions[0].Type)
+	}
+	// The client sent the query, or receives the response
+	fromSrc := fromClient != dns.QR
+
+	if !dns.QR {
+		log.count("queries")
+		log.add("#%d query %s %s", dns.ID, typ, name)
+		if len(state.pending) >= maxDNSPending {
+			for id := range state.pending {
+				delete(state.pending, id)
+				break
+			}
+		}
+		tx := &DNSTransaction{ID: dns.ID, Time: log.seen, Name: name, Type: typ, queried: true, fromSrc: fromSrc}
+		state.pending[dns.ID] = tx
+		state.created = append(state.created, tx)
+		state.events = append(state.events, DNSEvent{Name: name, fromSrc: fromSrc})
+		state.total++
+		log.summary = dnsSummary(tx, state.total)
+		return
+	}
+
+	rcode, ok := dnsRCodes[dns.ResponseCode]
+	if !ok {
+		rcode = fmt.Sprintf("RCODE%d", dns.ResponseCode)
+	}
+	log.count(rcode)
+	tx, ok := state.pending[dns.ID]
+	if ok && tx.Name == name {
+		delete(state.pending, dns.ID)
+		if !tx.Time.IsZero() && !log.seen.IsZero() {
+			tx.LatencyMs = float64(log.seen.Sub(tx.Time).Microseconds()) / 1000
+		}
+	} else {
+		tx = &DNSTransaction{ID: dns.ID, Time: log.seen, Name: name, Type: typ, fromSrc: fromSrc}
+		state.created = append(state.created, tx)
+		state.total++
+	}
+	tx.RCode, tx.Truncated = rcode, dns.TC
+	for _, rr := range dns.Answers {
+		if len(tx.Answers) == maxDNSAnswers {
+			tx.Answers = append(tx.Answers, fmt.Sprintf("+%d more", len(dns.Answers)-maxDNSAnswers))
+			break
+		}
+		if answer := dnsAnswer(rr); answer != "" {
+			tx.Answers = append(tx.Answers, answer)
+		}
+	}
+	state.events = append(state.events, DNSEvent{Name: name, RCode: rcode, fromSrc: fromSrc})
+
+	line := fmt.Sprintf("#%d response %s %s: %s", dns.ID, typ, name, rcode)
+	if len(tx.Answers) > 0 {
+		line += " " + strings.Join(tx.Answers, ", ")
+	}
+	if tx.Truncated {
+		line += " (truncated)"
+	}
+	if tx.queried {
+		line += fmt.Sprintf(" in %.1f ms", tx.LatencyMs)
+	}
+	log.add("%s", line)
+	log.summary = dnsSummary(tx, state.total)
+}
+
+// parseDNS decodes a DNS message. gopacket panics on some truncated
+// questions, which only gopacket.NewPacket recovers from, so a panic here
+// is returned as an error. The message is clipped to its length, as
+// gopacket may otherwise read the reassembled data that follows it.
+func parseDNS(msg []byte) (dns *layers.DNS, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			dns, err = nil, fmt.Errorf("truncated record: %v", r)
+		}
+	}()
+	dns = &layers.DNS{}
+	if err := dns.DecodeFromBytes(msg[:len(msg):len(msg)], gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return dns, nil
+}
+
+// dnsTypeName names a record type
+func dnsTypeName(t layers.DNSType) string {
+	switch t {
+	case 64:
+		return "SVCB"
+	case 65:
+		return "HTTPS"
+	}
+	if name := t.String(); name != "Unknown" {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// dnsAnswer formats an answer record. Names are anonymized; addresses are
+// left to the anonymization of log lines and the DNS log.
+func dnsAnswer(rr layers.DNSResourceRecord) string {
+	typ := dnsTypeName(rr.Type)
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return typ + " " + rr.IP.String()
+	case layers.DNSTypeCNAME:
+		return typ + " " + capture.AnonymizeHostname(string(rr.CNAME))
+	case layers.DNSTypePTR:
+		return typ + " " + capture.AnonymizeHostname(string(rr.PTR))
+	case layers.DNSTypeNS:
+		return typ + " " + capture.AnonymizeHostname(string(rr.NS))
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%s %d %s", typ, rr.MX.Preference, capture.AnonymizeHostname(string(rr.MX.Name)))
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%s %s:%d", typ, capture.AnonymizeHostname(string(rr.SRV.Name)), rr.SRV.Port)
+	case layers.DNSTypeTXT:
+		parts := make([]string, len(rr.TXTs))
+		for i, txt := range rr.TXTs {
+			parts[i] = string(txt)
+		}
+		txt := printable(strings.Join(parts, ""))
+		if len(txt) > maxDNSTXTLen {
+			txt = txt[:maxDNSTXTLen] + "..."
+		}
+		return fmt.Sprintf("%s %q", typ, txt)
+	case layers.DNSTypeOPT:
+		return ""
+	}
+	return fmt.Sprintf("%s (%d bytes)", typ, len(rr.Data))
+}
+
+// dnsSummary describes a stream's latest transaction
+func dnsSummary(tx *DNSTransaction, total int) string {
+	summary := fmt.Sprintf("DNS %s %s", tx.Type, tx.Name)
+	switch {
+	case tx.RCode == "":
+		summary += " (no response)"
+	case tx.RCode == "NOERROR" && len(tx.Answers) > 0:
+		summary += " → " + tx.Answers[0]
+		if len(tx.Answers) > 1 {
+			summary += fmt.Sprintf(" (+%d)", len(tx.Answers)-1)
+		}
+	default:
+		summary += " → " + tx.RCode
+	}
+	if tx.queried && tx.RCode != "" {
+		summary += fmt.Sprintf(", %.1f ms", tx.LatencyMs)
+	}
+	if total > 1 {
+		summary += fmt.Sprintf(" (%d queries)", total)
+	}
+	return summary
+}
+
+// takeDNS moves the stream's new transactions into the manager's log and
+// returns the queries and responses seen since the last call
+func (m *Manager) takeDNS(s *Stream) []DNSEvent {
+	log := s.decodedLog()
+	if log == nil || log.dns == nil {
+		return nil
+	}
+	state := log.dns
+	for _, tx := range state.created {
+		tx.StreamID, tx.Transport = s.ID, s.Type
+		tx.ClientIP, tx.ServerIP = s.SrcIP, s.DstIP
+		if !tx.fromSrc {
+			tx.ClientIP, tx.ServerIP = s.DstIP, s.SrcIP
+		}
+		if len(m.dnsLog) < maxDNSLogEntries {
+			m.dnsLog = append(m.dnsLog, tx)
+		} else {
+			m.dnsLog[m.dnsNext] = tx
+			m.dnsNext = (m.dnsNext + 1) % maxDNSLogEntries
+		}
+	}
+	state.created = nil
+
+	events := state.events
+	for i := range events {
+		events[i].ClientIP = s.DstIP
+		if events[i].fromSrc {
+			events[i].ClientIP = s.SrcIP
+		}
+	}
+	state.events = nil
+	return events
+}
+
+// DNSFilter selects transactions from the DNS log. Empty fields match
+// everything.
+type DNSFilter struct {
+	Client string // Client address
+	Name   string // Substring of the queried name
+	RCode  string // Response code, or "none" for unanswered queries
+	Limit  int    // Most recent transactions returned; 0 uses the default
+}
+
+// GetDNSLog returns the most recent DNS transactions matching the filter,
+// newest first
+func (m *Manager) GetDNSLog(filter DNSFilter) []DNSTransaction {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultDNSLogSize
+	}
+	name := strings.ToLower(filter.Name)
+	result := make([]DNSTransaction, 0, min(limit, len(m.dnsLog)))
+	for i := 0; i < len(m.dnsLog) && len(result) < limit; i++ {
+		// Walk back from the newest entry
+		tx := m.dnsLog[(m.dnsNext-1-i+2*len(m.dnsLog))%len(m.dnsLog)]
+		if filter.Client != "" && tx.ClientIP != filter.Client {
+			continue
+		}
+		if name != "" && !strings.Contains(tx.Name, name) {
+			continue
+		}
+		if filter.RCode != "" && !strings.EqualFold(filter.RCode, tx.RCode) && !(filter.RCode == "none" && tx.RCode == "") {
+			continue
+		}
+		entry := *tx
+		entry.Answers = make([]string, len(tx.Answers))
+		for i, answer := range tx.Answers {
+			entry.Answers[i] = capture.AnonymizeText(answer)
+		}
+		result = append(result, entry)
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"go-etherape/capture"
+)
+
+// truncatedDNSQuery has two questions: a valid one, and a name without its
+// type and class, on which gopacket's decoder panics
+var truncatedDNSQuery = []byte{
+	0x12, 0x34, 0x01, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00, 0x00, 0x01, 0x00, 0x01,
+	0x01, 'a', 0x00,
+}
+
+// udpPacket builds a UDP packet from 192.0.2.1 to 192.0.2.53
+func udpPacket(t *testing.T, srcPort, dstPort uint16, payload []byte) *capture.PacketInfo {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(192, 0, 2, 53)}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+	return testPacket(t, time.Unix(1700000000, 0), ip, udp, gopacket.Payload(payload))
+}
+
+func TestDNSTruncatedQuestionOverUDP(t *testing.T) {
+	m := NewManager(10)
+	m.AddPacket(udpPacket(t, 40000, 53, truncatedDNSQuery))
+
+	if len(m.streams) != 1 {
+		t.Fatalf("got %d streams, want 1", len(m.streams))
+	}
+	for _, s := range m.streams {
+		if s.Protocol != ProtocolDNS {
+			t.Fatalf("got protocol %q, want DNS", s.Protocol)
+		}
+		if len(s.msgs.lines) != 1 || !strings.HasPrefix(s.msgs.lines[0], "Malformed DNS message") {
+			t.Errorf("got lines %q, want a malformed message", s.msgs.lines)
+		}
+	}
+}
+
+func TestDNSTruncatedQuestionOverTCP(t *testing.T) {
+	data := append([]byte{0, byte(len(truncatedDNSQuery))}, truncatedDNSQuery...)
+	size, header := frameDNS(data)
+	if size != len(data) || header != 2 {
+		t.Fatalf("frameDNS = %d, %d", size, header)
+	}
+	log := &messageLog{}
+	decodeDNS(log, data[header:size], true)
+	if len(log.lines) != 1 || !strings.HasPrefix(log.lines[0], "Malformed DNS message") {
+		t.Errorf("got lines %q, want a malformed message", log.lines)
+	}
+}
+
+func TestDNSQueryAndResponse(t *testing.T) {
+	query := &layers.DNS{ID: 7, RD: true, Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+	response := *query
+	response.QR, response.ANCount = true, 1
+	response.Answers = []layers.DNSResourceRecord{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: net.IPv4(192, 0, 2, 80)}}
+
+	log := &messageLog{seen: time.Unix(100, 0)}
+	decodeDNS(log, serializeDNS(t, query), true)
+	log.seen = log.seen.Add(15 * time.Millisecond)
+	decodeDNS(log, serializeDNS(t, &response), false)
+
+	want := []string{"#7 query A example.com", "#7 response A example.com: NOERROR A 192.0.2.80 in 15.0 ms"}
+	if strings.Join(log.lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines %q, want %q", log.lines, want)
+	}
+	if len(log.dns.pending) != 0 || len(log.dns.created) != 1 || log.dns.created[0].LatencyMs != 15 {
+		t.Errorf("query and response were not paired: %+v", log.dns.created)
+	}
+}
+
+// serializeDNS encodes a DNS message
+func serializeDNS(t *testing.T, dns *layers.DNS) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,199 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits for HTTP message decoding
+const (
+	maxHTTPHeaderLen = 16 * 1024       // Longer heads are not HTTP we can frame
+	maxHTTPBodyLen   = 4 * 1024 * 1024 // Decompressed body bytes read
+)
+
+// httpMessage is a parsed HTTP/1.x request or response
+type httpMessage struct {
+	method string // Requests
+	target string
+	status int // Responses
+	reason string
+	header map[string]string // Lowercased names; repeated fields keep the last value
+	body   []byte            // Dechunked and decompressed
+}
+
+// frameHTTP frames HTTP/1.x messages by their Content-Length or chunked
+// transfer coding. Responses without either are framed as their head; the
+// body that follows can't be framed and ends the framing, as does anything
+// that isn't HTTP.
+func frameHTTP(data []byte) (int, int) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(data) > maxHTTPHeaderLen || !httpStartLine(data) {
+			return -1, 0
+		}
+		return 0, 0
+	}
+	m, err := parseHTTPHead(data[:end])
+	if err != nil {
+		return -1, 0
+	}
+	size := end + 4
+	if m.header["transfer-encoding"] != "" {
+		n := httpChunkedLen(data[size:])
+		if n <= 0 {
+			return n, 0
+		}
+		return size + n, 0
+	}
+	if cl := m.header["content-length"]; cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > maxStreamData {
+			return -1, 0
+		}
+		return size + n, 0
+	}
+	return size, 0
+}
+
+// httpStartLine reports whether incomplete data may begin a request or
+// status line
+func httpStartLine(data []byte) bool {
+	line, _, _ := bytes.Cut(data, []byte("\r\n"))
+	method, _, _ := bytes.Cut(line, []byte(" "))
+	if bytes.HasPrefix(method, []byte("HTTP/")) || bytes.HasPrefix([]byte("HTTP/"), method) {
+		return true
+	}
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return len(method) > 0 && len(method) <= 16
+}
+
+// parseHTTPHead parses a start line and header fields
+func parseHTTPHead(head []byte) (*httpMessage, error) {
+	lines := strings.Split(string(head), "\r\n")
+	m := &httpMessage{header: make(map[string]string)}
+	first := strings.SplitN(lines[0], " ", 3)
+	if len(first) < 2 {
+		return nil, fmt.Errorf("invalid start line")
+	}
+	if strings.HasPrefix(first[0], "HTTP/1.") {
+		status, err := strconv.Atoi(first[1])
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("invalid status %q", first[1])
+		}
+		m.status = status
+		if len(first) == 3 {
+			m.reason = first[2]
+		}
+	} else {
+		if len(first) != 3 || !strings.HasPrefix(first[2], "HTTP/1.") || !httpStartLine([]byte(first[0]+" ")) {
+			return nil, fmt.Errorf("invalid request line")
+		}
+		m.method, m.target = first[0], first[1]
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header field")
+		}
+		m.header[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	if te := m.header["transfer-encoding"]; te != "" && !strings.EqualFold(te, "chunked") {
+		return nil, fmt.Errorf("unsupported transfer coding %q", te)
+	}
+	return m, nil
+}
+
+// httpChunkedLen returns the length of a chunked body including its last
+// chunk and trailer: 0 if it is incomplete and -1 if it is malformed
+func httpChunkedLen(b []byte) int {
+	off := 0
+	for {
+		line := bytes.Index(b[off:], []byte("\r\n"))
+		if line < 0 {
+			if len(b)-off > 64 {
+				return -1
+			}
+			return 0
+		}
+		sizeField, _, _ := bytes.Cut(b[off:off+line], []byte(";"))
+		size, err := strconv.ParseInt(strings.TrimSpace(string(sizeField)), 16, 32)
+		if err != nil || size < 0 || size > maxStreamData {
+			return -1
+		}
+		off += line + 2
+		if size == 0 {
+			// Trailer fields, up to an empty line
+			end := bytes.Index(b[off:], []byte("\r\n"))
+			for end > 0 {
+				off += end + 2
+				end = bytes.Index(b[off:], []byte("\r\n"))
+			}
+			if end < 0 {
+				return 0
+			}
+			return off + 2
+		}
+		if off+int(size)+2 > len(b) {
+			return 0
+		}
+		off += int(size) + 2
+	}
+}
+
+// parseHTTPMessage parses a message framed by frameHTTP, decoding its body
+func parseHTTPMessage(msg []byte) (*httpMessage, error) {
+	head, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, fmt.Errorf("incomplete head")
+	}
+	m, err := parseHTTPHead(head)
+	if err != nil {
+		return nil, err
+	}
+	if m.header["transfer-encoding"] != "" {
+		body = httpDechunk(body)
+	}
+	switch strings.ToLower(m.header["content-encoding"]) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("gzip body: %v", err)
+		}
+		body, err = io.ReadAll(io.LimitReader(zr, maxHTTPBodyLen))
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("gzip body: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content coding %q", m.header["content-encoding"])
+	}
+	m.body = body[:min(len(body), maxHTTPBodyLen)]
+	return m, nil
+}
+
+// httpDechunk joins the chunks of a body measured by httpChunkedLen
+func httpDechunk(b []byte) []byte {
+	var body []byte
+	for {
+		line := bytes.Index(b, []byte("\r\n"))
+		if line < 0 {
+			return body
+		}
+		sizeField, _, _ := bytes.Cut(b[:line], []byte(";"))
+		size, err := strconv.ParseInt(strings.TrimSpace(string(sizeField)), 16, 32)
+		b = b[line+2:]
+		if err != nil || size <= 0 || int(size) > len(b) {
+			return body
+		}
+		body = append(body, b[:size]...)
+		b = b[min(len(b), int(size)+2):]
+	}
+}
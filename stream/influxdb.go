@@ -0,0 +1,376 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// Limits for InfluxDB decoding
+const (
+	maxInfluxTagSets      = 3   // Tag sets listed per measurement
+	maxInfluxMeasurements = 3   // Measurements named in summaries
+	maxInfluxQueryLen     = 160 // Longer query text is cut
+)
+
+// influxHostTags are tags whose values name hosts, anonymized like hostnames
+var influxHostTags = map[string]bool{"host": true, "hostname": true, "server": true, "source": true, "node": true}
+
+// influxQLWrite matches InfluxQL statements that change data or schema;
+// fluxWrite matches Flux scripts that write with to()
+var (
+	influxQLWrite = regexp.MustCompile(`(?i)^\s*(DELETE|DROP|CREATE|ALTER|GRANT|REVOKE|KILL|SET)\b|\bINTO\b`)
+	fluxWrite     = regexp.MustCompile(`\|>\s*(to|experimental\.to)\s*\(`)
+)
+
+// influxMeasurement is what one write request carried for a measurement
+type influxMeasurement struct {
+	name    string
+	points  int
+	series  map[string]bool // Distinct tag sets
+	tagSets []string        // First tag sets, as shown
+	fields  []string        // Field keys, in order of appearance
+}
+
+// MeasurementWrite is a number of InfluxDB points a client wrote to a
+// measurement
+type MeasurementWrite struct {
+	ClientIP    string
+	Measurement string
+	Points      int
+}
+
+// addPoints keeps points written to a measurement until the stream's
+// manager takes them for the writer's node
+func (l *messageLog) addPoints(measurement string, points int) {
+	if l.points == nil {
+		l.points = make(map[string]int)
+	}
+	l.points[measurement] += points
+}
+
+// takeMeasurementWrites returns the points written since the last call,
+// attributed to the client that opened the stream
+func (s *Stream) takeMeasurementWrites() []MeasurementWrite {
+	log := s.decodedLog()
+	if log == nil || len(log.points) == 0 {
+		return nil
+	}
+	writes := make([]MeasurementWrite, 0, len(log.points))
+	for measurement, points := range log.points {
+		writes = append(writes, MeasurementWrite{ClientIP: s.SrcIP, Measurement: measurement, Points: points})
+	}
+	log.points = nil
+	return writes
+}
+
+// decodeInfluxDB decodes InfluxDB HTTP API messages: line protocol bodies
+// of /write and /api/v2/write, InfluxQL and Flux queries, and the status of
+// responses. Credentials in query parameters and headers are never shown.
+func decodeInfluxDB(log *messageLog, msg []byte, fromClient bool) {
+	m, err := parseHTTPMessage(msg)
+	if err != nil {
+		log.add("Malformed HTTP message (%d bytes): %v", len(msg), err)
+		return
+	}
+	if m.status != 0 {
+		decodeInfluxResponse(log, m)
+		return
+	}
+	u, err := url.Parse(m.target)
+	if err != nil {
+		log.add("%s with invalid target", m.method)
+		return
+	}
+	log.count(m.method + " " + u.Path)
+	params := u.Query()
+
+	switch u.Path {
+	case "/write", "/api/v2/write":
+		decodeInfluxWrite(log, m, params)
+	case "/query", "/api/v2/query":
+		decodeInfluxQuery(log, m, params)
+	default:
+		log.add("%s %s", m.method, u.Path)
+		if log.summary == "" {
+			log.summary = "InfluxDB " + m.method + " " + u.Path
+		}
+	}
+}
+
+// influxTarget names the database of a request: db and rp for the 1.x API,
+// org and bucket for 2.x, whose queries name only the org
+func influxTarget(params url.Values) string {
+	org, bucket := params.Get("org"), params.Get("bucket")
+	switch {
+	case org != "" && bucket != "":
+		return org + "/" + bucket
+	case org != "" || bucket != "":
+		return org + bucket
+	}
+	db := params.Get("db")
+	if rp := params.Get("rp"); rp != "" && db != "" {
+		db += "." + rp
+	}
+	return orDash(db)
+}
+
+// decodeInfluxWrite logs the measurements, tag sets and point counts of a
+// line protocol body, and keeps the points for the writer's node
+func decodeInfluxWrite(log *messageLog, m *httpMessage, params url.Values) {
+	measurements, invalid := parseLineProtocol(m.body)
+	points := 0
+	for _, meas := range measurements {
+		points += meas.points
+	}
+
+	target := influxTarget(params)
+	line := fmt.Sprintf("write %s: %d points in %d measurements", target, points, len(measurements))
+	if precision := params.Get("precision"); precision != "" {
+		line += ", precision " + precision
+	}
+	if invalid > 0 {
+		line += fmt.Sprintf(", %d invalid lines", invalid)
+	}
+	log.add("%s", line)
+
+	names := make([]string, 0, len(measurements))
+	for _, meas := range measurements {
+		line := fmt.Sprintf("  %s: %d points, %d series", meas.name, meas.points, len(meas.series))
+		if len(meas.fields) > 0 {
+			line += ", fields " + strings.Join(meas.fields, ",")
+		}
+		if len(meas.tagSets) > 0 {
+			line += "; tags " + strings.Join(meas.tagSets, " | ")
+			if more := len(meas.series) - len(meas.tagSets); more > 0 {
+				line += fmt.Sprintf(" | +%d more", more)
+			}
+		}
+		log.add("%s", line)
+		log.addPoints(meas.name, meas.points)
+		if len(names) < maxInfluxMeasurements {
+			names = append(names, fmt.Sprintf("%s (%d)", meas.name, meas.points))
+		}
+	}
+	if more := len(measurements) - len(names); more > 0 {
+		names = append(names, fmt.Sprintf("+%d more", more))
+	}
+	log.request(ProtocolInfluxDB, fmt.Sprintf("write %s: %s", target, strings.Join(names, ", ")), true)
+}
+
+// decodeInfluxQuery logs the query text of InfluxQL and Flux requests: the
+// q parameter of the 1.x API, in the URL or a form body, or the Flux script
+// or JSON query of 2.x
+func decodeInfluxQuery(log *messageLog, m *httpMessage, params url.Values) {
+	contentType, _, _ := strings.Cut(strings.ToLower(m.header["content-type"]), ";")
+	language, q := "InfluxQL", params.Get("q")
+	switch strings.TrimSpace(contentType) {
+	case "application/x-www-form-urlencoded":
+		if form, err := url.ParseQuery(string(m.body)); err == nil {
+			if fq := form.Get("q"); fq != "" {
+				q = fq
+			}
+			if db := form.Get("db"); db != "" && params.Get("db") == "" {
+				params.Set("db", db)
+			}
+		}
+	case "application/vnd.flux":
+		language, q = "Flux", string(m.body)
+	case "application/json":
+		var body struct {
+			Query string `json:"query"`
+			Type  string `json:"type"`
+		}
+		if json.Unmarshal(m.body, &body) == nil {
+			language, q = "Flux", body.Query
+			if strings.EqualFold(body.Type, "influxql") {
+				language = "InfluxQL"
+			}
+		}
+	}
+	q = strings.Join(strings.Fields(q), " ")
+	if len(q) > maxInfluxQueryLen {
+		q = q[:maxInfluxQueryLen] + "..."
+	}
+
+	write := influxQLWrite.MatchString(q)
+	if language == "Flux" {
+		write = fluxWrite.MatchString(q)
+	}
+	log.count(language + " queries")
+	desc := fmt.Sprintf("query %s: %s", influxTarget(params), orDash(q))
+	log.add("%s %s", language, desc)
+	log.request(ProtocolInfluxDB, desc, write)
+}
+
+// decodeInfluxResponse logs a response's status with the server version,
+// the rows of 1.x query results and any error message
+func decodeInfluxResponse(log *messageLog, m *httpMessage) {
+	log.count(fmt.Sprintf("status %d", m.status))
+	line := fmt.Sprintf("%d %s", m.status, m.reason)
+	if version := m.header["x-influxdb-version"]; version != "" && log.facts["version"] == "" {
+		log.set("version", version)
+		line += " from InfluxDB " + version
+	}
+
+	var result struct {
+		Error   string `json:"error"`
+		Message string `json:"message"` // 2.x errors
+		Results []struct {
+			Error  string `json:"error"`
+			Series []struct {
+				Values []json.RawMessage `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	if len(m.body) > 0 && json.Unmarshal(m.body, &result) == nil {
+		series, rows := 0, 0
+		for _, r := range result.Results {
+			if r.Error != "" && result.Error == "" {
+				result.Error = r.Error
+			}
+			series += len(r.Series)
+			for _, s := range r.Series {
+				rows += len(s.Values)
+			}
+		}
+		if len(result.Results) > 0 {
+			line += fmt.Sprintf(": %d series, %d rows", series, rows)
+		}
+		if result.Error == "" {
+			result.Error = result.Message
+		}
+		if result.Error != "" {
+			line += ", error: " + result.Error
+		}
+	} else if len(m.body) > 0 {
+		line += fmt.Sprintf(" (%d bytes)", len(m.body))
+	}
+	log.add("%s", line)
+}
+
+// parseLineProtocol reads the points of a line protocol body by
+// measurement, in order of appearance, and counts lines it can't parse
+func parseLineProtocol(body []byte) ([]*influxMeasurement, int) {
+	var measurements []*influxMeasurement
+	byName := make(map[string]*influxMeasurement)
+	invalid := 0
+	for _, raw := range bytes.Split(body, []byte("\n")) {
+		line := strings.TrimSpace(string(raw))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, tags, fields, ok := parseLinePoint(line)
+		if !ok {
+			invalid++
+			continue
+		}
+		meas := byName[name]
+		if meas == nil {
+			meas = &influxMeasurement{name: name, series: make(map[string]bool)}
+			byName[name] = meas
+			measurements = append(measurements, meas)
+		}
+		meas.points++
+		for _, field := range fields {
+			if !slices.Contains(meas.fields, field) {
+				meas.fields = append(meas.fields, field)
+			}
+		}
+		tagSet := strings.Join(tags, ",")
+		if !meas.series[tagSet] {
+			meas.series[tagSet] = true
+			if len(meas.tagSets) < maxInfluxTagSets && tagSet != "" {
+				meas.tagSets = append(meas.tagSets, tagSet)
+			}
+		}
+	}
+	return measurements, invalid
+}
+
+// parseLinePoint splits one line of line protocol into its measurement,
+// tags as key=value, and field keys. Host tags are anonymized.
+func parseLinePoint(line string) (name string, tags, fields []string, ok bool) {
+	series, rest := splitUnescaped(line, ' ', false)
+	fieldSet, _ := splitUnescaped(rest, ' ', true)
+	if series == "" || fieldSet == "" {
+		return "", nil, nil, false
+	}
+
+	parts := splitAllUnescaped(series, ',', false)
+	name = unescapeLine(parts[0])
+	for _, tag := range parts[1:] {
+		key, value := splitUnescaped(tag, '=', false)
+		key, value = unescapeLine(key), unescapeLine(value)
+		if key == "" || value == "" {
+			return "", nil, nil, false
+		}
+		if influxHostTags[strings.ToLower(key)] {
+			value = capture.AnonymizeHostname(value)
+		}
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+
+	for _, field := range splitAllUnescaped(fieldSet, ',', true) {
+		key, value := splitUnescaped(field, '=', false)
+		if key == "" || value == "" {
+			return "", nil, nil, false
+		}
+		fields = append(fields, unescapeLine(key))
+	}
+	return name, tags, fields, true
+}
+
+// splitUnescaped splits s at the first sep not escaped by a backslash, or
+// inside a quoted string field value when quotes is set
+func splitUnescaped(s string, sep byte, quotes bool) (string, string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+// splitAllUnescaped splits s at every sep found by splitUnescaped
+func splitAllUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	for {
+		part, rest := splitUnescaped(s, sep, quotes)
+		parts = append(parts, part)
+		if len(rest) == 0 && len(part) == len(s) {
+			return parts
+		}
+		s = rest
+	}
+}
+
+// unescapeLine removes the backslashes escaping commas, equals signs and
+// spaces in measurement names, tag keys and values, and field keys
+func unescapeLine(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == ',' || s[i+1] == '=' || s[i+1] == ' ') {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
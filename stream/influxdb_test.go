@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// httpBytes builds an HTTP/1.1 request or response with a Content-Length
+func httpBytes(start string, headers []string, body string) []byte {
+	head := start + "\r\n"
+	for _, h := range headers {
+		head += h + "\r\n"
+	}
+	if body != "" {
+		head += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	}
+	return []byte(head + "\r\n" + body)
+}
+
+func TestParseLineProtocol(t *testing.T) {
+	body := strings.Join([]string{
+		"# Written by the test",
+		"cpu,host=web01,region=eu usage_idle=98.5,usage_user=1.2 1700000000000000000",
+		"cpu,region=eu,host=web02 usage_idle=97",
+		"",
+		"cpu,host=web01,region=eu usage_idle=98.4 1700000000000000001",
+		`disk\ io,path=/data\,ssd,my\ tag=a\=b reads=5i,note="a, b c=d"`,
+		"missing fields",
+		"temp value=",
+	}, "\n")
+	measurements, invalid := parseLineProtocol([]byte(body))
+	if invalid != 2 {
+		t.Errorf("got %d invalid lines, want 2", invalid)
+	}
+	want := []struct {
+		name    string
+		points  int
+		series  int
+		fields  string
+		tagSets string
+	}{
+		{"cpu", 3, 2, "usage_idle,usage_user", "host=web01,region=eu | host=web02,region=eu"},
+		{"disk io", 1, 1, "reads,note", "my tag=a=b,path=/data,ssd"},
+	}
+	if len(measurements) != len(want) {
+		t.Fatalf("got %d measurements, want %d", len(measurements), len(want))
+	}
+	for i, w := range want {
+		m := measurements[i]
+		fields, tagSets := strings.Join(m.fields, ","), strings.Join(m.tagSets, " | ")
+		if m.name != w.name || m.points != w.points || len(m.series) != w.series || fields != w.fields || tagSets != w.tagSets {
+			t.Errorf("got %q: %d points, %d series, fields %s, tags %s; want %q: %d points, %d series, fields %s, tags %s",
+				m.name, m.points, len(m.series), fields, tagSets, w.name, w.points, w.series, w.fields, w.tagSets)
+		}
+	}
+}
+
+func TestDecodeInfluxDB(t *testing.T) {
+	write := httpBytes("POST /write?db=telegraf&rp=autogen&precision=ns&u=admin&p=s3cret HTTP/1.1",
+		[]string{"Host: influx:8086"},
+		"cpu,host=web01 usage_idle=98.5\ncpu,host=web02 usage_idle=97\nmem,host=web01 used=1024i\n")
+	query := httpBytes("GET /query?db=telegraf&q="+url.QueryEscape("SELECT mean(usage_idle) FROM cpu WHERE time > now() - 1h")+" HTTP/1.1",
+		[]string{"Host: influx:8086"}, "")
+	results := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean"],"values":[[0,98.4],[1,98.5]]}]}]}`
+
+	s := &Stream{Protocol: ProtocolInfluxDB, SrcIP: "192.0.2.1"}
+	s.msgs.protocol = ProtocolInfluxDB
+	for _, m := range []message{
+		{write, true},
+		{httpBytes("HTTP/1.1 204 No Content", []string{"X-Influxdb-Version: 1.8.10"}, ""), false},
+		{query, true},
+		{httpBytes("HTTP/1.1 200 OK", []string{"Content-Type: application/json"}, results), false},
+	} {
+		decodeInfluxDB(&s.msgs, m.data, m.fromClient)
+	}
+	checkLog(t, &s.msgs, []string{
+		"write telegraf.autogen: 3 points in 2 measurements, precision ns",
+		"  cpu: 2 points, 2 series, fields usage_idle; tags host=web01 | host=web02",
+		"  mem: 1 points, 1 series, fields used; tags host=web01",
+		"204 No Content from InfluxDB 1.8.10",
+		"InfluxQL query telegraf: SELECT mean(usage_idle) FROM cpu WHERE time > now() - 1h",
+		"200 OK: 1 series, 2 rows",
+	}, "InfluxDB write telegraf.autogen: cpu (2), mem (1)")
+	for _, line := range s.msgs.lines {
+		if strings.Contains(line, "s3cret") {
+			t.Errorf("password shown: %q", line)
+		}
+	}
+
+	// Points are attributed to the writer once
+	writes := s.takeMeasurementWrites()
+	points := make(map[string]int)
+	for _, w := range writes {
+		if w.ClientIP != "192.0.2.1" {
+			t.Errorf("points attributed to %s, want 192.0.2.1", w.ClientIP)
+		}
+		points[w.Measurement] += w.Points
+	}
+	if len(points) != 2 || points["cpu"] != 2 || points["mem"] != 1 {
+		t.Errorf("got measurement writes %v, want cpu 2 and mem 1", points)
+	}
+	if again := s.takeMeasurementWrites(); len(again) != 0 {
+		t.Errorf("points taken twice: %v", again)
+	}
+}
+
+func TestDecodeInfluxQuery(t *testing.T) {
+	const flux = "from(bucket: \"metrics\")\n  |> range(start: -1h)\n  |> to(bucket: \"copy\")"
+	tests := []struct {
+		name  string
+		msg   []byte
+		line  string
+		write bool
+	}{
+		{"InfluxQL form body",
+			httpBytes("POST /query HTTP/1.1", []string{"Content-Type: application/x-www-form-urlencoded"},
+				"db=telegraf&q="+url.QueryEscape("SELECT * INTO cpu_copy FROM cpu")),
+			"InfluxQL query telegraf: SELECT * INTO cpu_copy FROM cpu", true},
+		{"InfluxQL drop",
+			httpBytes("GET /query?q=DROP+MEASUREMENT+cpu&db=telegraf HTTP/1.1", nil, ""),
+			"InfluxQL query telegraf: DROP MEASUREMENT cpu", true},
+		{"Flux read",
+			httpBytes("POST /api/v2/query?org=acme HTTP/1.1", []string{"Content-Type: application/vnd.flux"},
+				"from(bucket: \"metrics\") |> range(start: -1h)"),
+			`Flux query acme: from(bucket: "metrics") |> range(start: -1h)`, false},
+		{"Flux to()",
+			httpBytes("POST /api/v2/query?org=acme HTTP/1.1", []string{"Content-Type: application/vnd.flux"}, flux),
+			`Flux query acme: from(bucket: "metrics") |> range(start: -1h) |> to(bucket: "copy")`, true},
+		{"InfluxQL over the v2 API",
+			httpBytes("POST /api/v2/query?org=acme HTTP/1.1", []string{"Content-Type: application/json"},
+				`{"query":"SHOW MEASUREMENTS","type":"influxql"}`),
+			"InfluxQL query acme: SHOW MEASUREMENTS", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := decodeAll(decodeInfluxDB, message{tt.msg, true})
+			if len(log.lines) != 1 || log.lines[0] != tt.line {
+				t.Errorf("got lines %q, want %q", log.lines, tt.line)
+			}
+			if (log.writes == 1) != tt.write {
+				t.Errorf("got %d writes, want write %v", log.writes, tt.write)
+			}
+		})
+	}
+}
+
+func TestDecodeInfluxDBv2(t *testing.T) {
+	write := httpBytes("POST /api/v2/write?org=acme&bucket=metrics&precision=s HTTP/1.1",
+		[]string{"Authorization: Token abc123"}, "temp,room=lab value=21.5 1700000000\nbad\n")
+	denied := httpBytes("HTTP/1.1 401 Unauthorized", []string{"Content-Type: application/json"},
+		`{"code":"unauthorized","message":"unauthorized access"}`)
+	log := decodeAll(decodeInfluxDB, message{write, true}, message{denied, false})
+	checkLog(t, log, []string{
+		"write acme/metrics: 1 points in 1 measurements, precision s, 1 invalid lines",
+		"  temp: 1 points, 1 series, fields value; tags room=lab",
+		"401 Unauthorized, error: unauthorized access",
+	}, "InfluxDB write acme/metrics: temp (1)")
+}
@@ -0,0 +1,183 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// Kerberos message types, the APPLICATION tags of KDC messages
+const (
+	krbASReq  = 10
+	krbASRep  = 11
+	krbTGSReq = 12
+	krbTGSRep = 13
+	krbError  = 30
+)
+
+// krbMessages names the KDC message types
+var krbMessages = map[int]string{
+	krbASReq: "AS-REQ", krbASRep: "AS-REP", krbTGSReq: "TGS-REQ", krbTGSRep: "TGS-REP", krbError: "KRB-ERROR",
+}
+
+// krbErrors names the common KRB-ERROR codes
+var krbErrors = map[int64]string{
+	6: "C_PRINCIPAL_UNKNOWN", 7: "S_PRINCIPAL_UNKNOWN", 12: "POLICY", 14: "ETYPE_NOSUPP",
+	18: "CLIENT_REVOKED", 23: "KEY_EXPIRED", 24: "PREAUTH_FAILED", 25: "PREAUTH_REQUIRED",
+	31: "INTEGRITY_FAILED", 32: "TKT_EXPIRED", 37: "SKEW", 41: "MODIFIED",
+	52: "RESPONSE_TOO_BIG", 60: "GENERIC", 68: "WRONG_REALM",
+}
+
+// frameKerberos frames Kerberos over TCP: a four-byte length, whose top bit
+// is reserved, before each message
+func frameKerberos(data []byte) (int, int) {
+	if len(data) < 4 {
+		return 0, 0
+	}
+	n := binary.BigEndian.Uint32(data)
+	if n&0x80000000 != 0 || n > maxStreamData || (len(data) > 4 && data[4]&0xe0 != 0x60) {
+		return -1, 0
+	}
+	return 4 + int(n), 4
+}
+
+// decodeKerberos decodes AS and TGS exchanges. Only message types, error
+// codes and principal names are read; tickets, pre-authentication data and
+// encrypted parts are skipped.
+func decodeKerberos(log *messageLog, msg []byte, fromClient bool) {
+	top, _, ok := readBER(msg)
+	name, known := krbMessages[top.tag]
+	if !ok || top.class != berApplication || !known {
+		log.add("Unrecognised Kerberos message (%d bytes)", len(msg))
+		return
+	}
+	seq, ok := top.explicit()
+	if !ok {
+		log.add("%s truncated", name)
+		return
+	}
+	log.count(name)
+
+	var client, service, outcome string
+	switch top.tag {
+	case krbASReq, krbTGSReq:
+		if body, ok := seq.field(4); ok {
+			if req, ok := body.explicit(); ok {
+				realm := krbRealm(req, 2)
+				client = krbPrincipal(req, 1, realm, false)
+				service = krbPrincipal(req, 3, realm, true)
+			}
+		}
+		outcome = "requested"
+	case krbASRep, krbTGSRep:
+		client = krbPrincipal(seq, 4, krbRealm(seq, 3), false)
+		if field, ok := seq.field(5); ok {
+			if ticket, ok := field.explicit(); ok {
+				if tkt, ok := ticket.explicit(); ok {
+					service = krbPrincipal(tkt, 2, krbRealm(tkt, 1), true)
+				}
+			}
+		}
+		outcome = "ticket issued"
+	case krbError:
+		code := int64(-1)
+		if field, ok := seq.field(6); ok {
+			if v, ok := field.explicit(); ok {
+				code = v.int()
+			}
+		}
+		outcome = fmt.Sprintf("error %d", code)
+		if errName, ok := krbErrors[code]; ok {
+			outcome = errName
+		}
+		client = krbPrincipal(seq, 8, krbRealm(seq, 7), false)
+		service = krbPrincipal(seq, 10, krbRealm(seq, 9), true)
+	}
+
+	if top.tag != krbError {
+		log.set("exchange", name[:strings.IndexByte(name, '-')])
+	}
+
+	line := name
+	if client != "" {
+		line += " " + client
+		log.set("client", client)
+	}
+	if service != "" {
+		line += " for " + service
+		log.set("service", service)
+	}
+	if top.tag == krbError {
+		line += ": " + outcome
+	}
+	log.add("%s", line)
+	log.set("outcome", outcome)
+
+	summary := "Kerberos"
+	if e := log.facts["exchange"]; e != "" {
+		summary += " " + e
+	}
+	if c := log.facts["client"]; c != "" {
+		summary += " " + c
+	}
+	if s := log.facts["service"]; s != "" {
+		summary += " for " + s
+	}
+	log.summary = fmt.Sprintf("%s (%s)", summary, log.facts["outcome"])
+}
+
+// krbRealm reads a Realm field, a GeneralString, anonymized like a domain
+func krbRealm(seq berElement, tag int) string {
+	field, ok := seq.field(tag)
+	if !ok {
+		return ""
+	}
+	realm, ok := field.explicit()
+	if !ok {
+		return ""
+	}
+	return capture.AnonymizeHostname(string(realm.body))
+}
+
+// krbPrincipal reads a PrincipalName field as name/instance@REALM. Client
+// names are anonymized as a whole; a service keeps its service class
+// (krbtgt, cifs, HTTP) and has its host anonymized.
+func krbPrincipal(seq berElement, tag int, realm string, isService bool) string {
+	field, ok := seq.field(tag)
+	if !ok {
+		return ""
+	}
+	principal, ok := field.explicit()
+	if !ok {
+		return ""
+	}
+	strs, ok := principal.field(1)
+	if !ok {
+		return ""
+	}
+	list, ok := strs.explicit()
+	if !ok {
+		return ""
+	}
+	var names []string
+	for i, s := range list.children() {
+		switch {
+		case isService && i == 0:
+			names = append(names, string(s.body))
+		case isService:
+			names = append(names, capture.AnonymizeHostname(string(s.body)))
+		default:
+			names = append(names, capture.AnonymizeName(string(s.body)))
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	name := strings.Join(names, "/")
+	if realm != "" {
+		name += "@" + realm
+	}
+	return name
+}
@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// krbName builds a PrincipalName of the given type
+func krbName(nameType byte, names ...string) []byte {
+	var strs [][]byte
+	for _, n := range names {
+		strs = append(strs, tlv(0x1b, []byte(n)))
+	}
+	return tlv(0x30, tlv(0xa0, tlv(0x02, []byte{nameType})), tlv(0xa1, tlv(0x30, strs...)))
+}
+
+var (
+	krbRealmField = tlv(0x1b, []byte("EXAMPLE.COM"))
+	krbTGTName    = krbName(2, "krbtgt", "EXAMPLE.COM")
+)
+
+func TestDecodeKerberos(t *testing.T) {
+	asReq := tlv(0x6a, tlv(0x30,
+		tlv(0xa1, tlv(0x02, []byte{0x05})),
+		tlv(0xa2, tlv(0x02, []byte{krbASReq})),
+		tlv(0xa4, tlv(0x30,
+			tlv(0xa0, tlv(0x03, []byte{0x00, 0x50, 0x80, 0x00, 0x00})),
+			tlv(0xa1, krbName(1, "alice")),
+			tlv(0xa2, krbRealmField),
+			tlv(0xa3, krbTGTName),
+			tlv(0xa7, tlv(0x02, []byte{0x2a})),
+			tlv(0xa8, tlv(0x30, tlv(0x02, []byte{0x12}))),
+		)),
+	))
+	krbErr := tlv(0x7e, tlv(0x30,
+		tlv(0xa0, tlv(0x02, []byte{0x05})),
+		tlv(0xa1, tlv(0x02, []byte{krbError})),
+		tlv(0xa4, tlv(0x18, []byte("20240101000000Z"))),
+		tlv(0xa5, berZero),
+		tlv(0xa6, tlv(0x02, []byte{25})),
+		tlv(0xa9, krbRealmField),
+		tlv(0xaa, krbTGTName),
+	))
+
+	// Over TCP, each message has a four-byte length
+	framed := binary.BigEndian.AppendUint32(nil, uint32(len(asReq)))
+	framed = append(framed, asReq...)
+	size, header := frameKerberos(framed)
+	if size != len(framed) || header != 4 {
+		t.Fatalf("frameKerberos = %d, %d", size, header)
+	}
+
+	log := decodeAll(decodeKerberos, message{framed[header:size], true}, message{krbErr, false})
+	checkLog(t, log, []string{
+		"AS-REQ alice@EXAMPLE.COM for krbtgt/EXAMPLE.COM@EXAMPLE.COM",
+		"KRB-ERROR for krbtgt/EXAMPLE.COM@EXAMPLE.COM: PREAUTH_REQUIRED",
+	}, "Kerberos AS alice@EXAMPLE.COM for krbtgt/EXAMPLE.COM@EXAMPLE.COM (PREAUTH_REQUIRED)")
+}
+
+func TestDecodeKerberosUnrecognised(t *testing.T) {
+	log := decodeAll(decodeKerberos, message{tlv(0x30, berZero), true})
+	checkLog(t, log, []string{"Unrecognised Kerberos message (5 bytes)"}, "")
+	if size, _ := frameKerberos([]byte{0x80, 0, 0, 0x10, 0x6a}); size != -1 {
+		t.Errorf("reserved length bit accepted: %d", size)
+	}
+}
@@ -0,0 +1,273 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// LDAP protocol operations, the APPLICATION tags of LDAPMessage.protocolOp
+const (
+	ldapBindRequest     = 0
+	ldapBindResponse    = 1
+	ldapUnbindRequest   = 2
+	ldapSearchRequest   = 3
+	ldapSearchEntry     = 4
+	ldapSearchDone      = 5
+	ldapSearchReference = 19
+	ldapExtendedRequest = 23
+	ldapExtendedReply   = 24
+)
+
+// ldapOperations names the operations that get a generic log line
+var ldapOperations = map[int]string{
+	6: "modify", 7: "modify result", 8: "add", 9: "add result",
+	10: "delete", 11: "delete result", 12: "modify DN", 13: "modify DN result",
+	14: "compare", 15: "compare result", 16: "abandon", 25: "intermediate response",
+}
+
+// ldapResultCodes names the common LDAPResult codes
+var ldapResultCodes = map[int64]string{
+	0: "success", 1: "operationsError", 2: "protocolError", 3: "timeLimitExceeded",
+	4: "sizeLimitExceeded", 7: "authMethodNotSupported", 8: "strongerAuthRequired",
+	10: "referral", 14: "saslBindInProgress", 16: "noSuchAttribute", 32: "noSuchObject",
+	34: "invalidDNSyntax", 48: "inappropriateAuthentication", 49: "invalidCredentials",
+	50: "insufficientAccessRights", 51: "busy", 52: "unavailable", 53: "unwillingToPerform",
+	68: "entryAlreadyExists",
+}
+
+// ldapScopes names the search scopes
+var ldapScopes = [...]string{"base", "one", "sub", "children"}
+
+// ldapStartTLS is the extended operation that switches the connection to TLS
+const ldapStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// Limits on what is shown of search filters and attribute lists
+const (
+	maxLDAPFilterDepth = 8
+	maxLDAPAttributes  = 8
+)
+
+// decodeLDAP decodes an LDAPMessage: binds, searches and their results.
+// Credentials are never shown.
+func decodeLDAP(log *messageLog, msg []byte, fromClient bool) {
+	top, _, ok := readBER(msg)
+	fields := top.children()
+	if !ok || len(fields) < 2 || !fields[0].is(berUniversal, berInteger) {
+		log.add("Malformed LDAP message (%d bytes)", len(msg))
+		return
+	}
+	id, op := fields[0].int(), fields[1]
+	if op.class != berApplication {
+		log.add("#%d unknown operation", id)
+		return
+	}
+	parts := op.children()
+
+	switch op.tag {
+	case ldapBindRequest:
+		log.count("bind")
+		if len(parts) < 3 {
+			break
+		}
+		dn := anonymizeDN(string(parts[1].body))
+		method := "simple"
+		if parts[2].is(berContext, 3) {
+			method = "SASL"
+			if mech := parts[2].children(); len(mech) > 0 {
+				method = "SASL " + string(mech[0].body)
+			}
+		} else if len(parts[2].body) == 0 {
+			method = "anonymous"
+		}
+		log.add("#%d bind v%d %q (%s)", id, parts[0].int(), dn, method)
+		log.set("bind", dn)
+	case ldapBindResponse:
+		result := ldapResult(parts)
+		log.add("#%d bind result: %s", id, result)
+		log.set("bindResult", result)
+	case ldapUnbindRequest:
+		log.add("#%d unbind", id)
+	case ldapSearchRequest:
+		log.count("search")
+		if len(parts) < 8 {
+			break
+		}
+		base := anonymizeDN(string(parts[0].body))
+		scope := fmt.Sprint(parts[1].int())
+		if s := parts[1].int(); s >= 0 && s < int64(len(ldapScopes)) {
+			scope = ldapScopes[s]
+		}
+		filter := ldapFilter(parts[6], 0)
+		line := fmt.Sprintf("#%d search base %q scope %s filter %s", id, base, scope, filter)
+		if attrs := ldapAttributes(parts[7]); attrs != "" {
+			line += " attributes " + attrs
+		}
+		log.add("%s", line)
+		log.set("searchBase", base)
+		log.set("searchFilter", filter)
+	case ldapSearchEntry:
+		log.count("entry")
+		if len(parts) > 0 {
+			log.add("#%d entry %q", id, anonymizeDN(string(parts[0].body)))
+		}
+	case ldapSearchReference:
+		log.add("#%d search reference", id)
+	case ldapSearchDone:
+		log.add("#%d search done: %s", id, ldapResult(parts))
+	case ldapExtendedRequest:
+		name := ""
+		if len(parts) > 0 && parts[0].is(berContext, 0) {
+			name = string(parts[0].body)
+		}
+		if name == ldapStartTLS {
+			log.add("#%d StartTLS", id)
+			log.set("startTLS", "yes")
+		} else {
+			log.add("#%d extended operation %s", id, name)
+		}
+	case ldapExtendedReply:
+		log.add("#%d extended result: %s", id, ldapResult(parts))
+	default:
+		name, known := ldapOperations[op.tag]
+		if !known {
+			name = fmt.Sprintf("operation %d", op.tag)
+		}
+		if op.tag%2 == 1 && op.tag <= 15 {
+			log.add("#%d %s: %s", id, name, ldapResult(parts))
+		} else {
+			log.add("#%d %s", id, name)
+		}
+	}
+
+	log.summary = ldapSummary(log)
+}
+
+// ldapSummary describes the bind and searches of a connection
+func ldapSummary(log *messageLog) string {
+	var parts []string
+	if dn, ok := log.facts["bind"]; ok {
+		if dn == "" {
+			dn = "anonymous"
+		}
+		bind := "bind " + dn
+		if result := log.facts["bindResult"]; result != "" {
+			bind += " (" + result + ")"
+		}
+		parts = append(parts, bind)
+	}
+	if n := log.counts["search"]; n > 0 {
+		search := fmt.Sprintf("search %s under %q", log.facts["searchFilter"], log.facts["searchBase"])
+		if n > 1 {
+			search = fmt.Sprintf("%d searches, last %s", n, search)
+		}
+		parts = append(parts, search)
+	}
+	if log.facts["startTLS"] != "" {
+		parts = append(parts, "StartTLS")
+	}
+	if len(parts) == 0 {
+		return "LDAP session"
+	}
+	return "LDAP " + strings.Join(parts, "; ")
+}
+
+// ldapResult formats an LDAPResult's code and diagnostic message
+func ldapResult(parts []berElement) string {
+	if len(parts) == 0 {
+		return "-"
+	}
+	code := parts[0].int()
+	result, ok := ldapResultCodes[code]
+	if !ok {
+		result = fmt.Sprintf("code %d", code)
+	}
+	if len(parts) > 2 && len(parts[2].body) > 0 {
+		result += fmt.Sprintf(" (%s)", parts[2].body)
+	}
+	return result
+}
+
+// ldapFilter formats a search filter in RFC 4515 string form, with
+// assertion values anonymized
+func ldapFilter(f berElement, depth int) string {
+	if f.class != berContext || depth > maxLDAPFilterDepth {
+		return "(?)"
+	}
+	switch f.tag {
+	case 0, 1: // and, or
+		op := "&"
+		if f.tag == 1 {
+			op = "|"
+		}
+		var b strings.Builder
+		b.WriteString("(" + op)
+		for _, sub := range f.children() {
+			b.WriteString(ldapFilter(sub, depth+1))
+		}
+		b.WriteString(")")
+		return b.String()
+	case 2: // not
+		if inner, ok := f.explicit(); ok {
+			return "(!" + ldapFilter(inner, depth+1) + ")"
+		}
+	case 3, 5, 6, 8: // equality, greaterOrEqual, lessOrEqual, approxMatch
+		ops := map[int]string{3: "=", 5: ">=", 6: "<=", 8: "~="}
+		if ava := f.children(); len(ava) == 2 {
+			return fmt.Sprintf("(%s%s%s)", ava[0].body, ops[f.tag], capture.AnonymizeName(string(ava[1].body)))
+		}
+	case 4: // substrings
+		if sub := f.children(); len(sub) == 2 {
+			value := "*"
+			for _, part := range sub[1].children() {
+				piece := capture.AnonymizeName(string(part.body))
+				switch part.tag {
+				case 0: // initial
+					value = piece + value
+				case 1: // any
+					value += piece + "*"
+				case 2: // final
+					value += piece
+				}
+			}
+			return fmt.Sprintf("(%s=%s)", sub[0].body, value)
+		}
+	case 7: // present
+		return fmt.Sprintf("(%s=*)", f.body)
+	case 9: // extensibleMatch
+		return "(extensible)"
+	}
+	return "(?)"
+}
+
+// ldapAttributes lists the attributes a search asks for
+func ldapAttributes(list berElement) string {
+	attrs := list.children()
+	names := make([]string, 0, min(len(attrs), maxLDAPAttributes))
+	for i, attr := range attrs {
+		if i == maxLDAPAttributes {
+			names = append(names, fmt.Sprintf("+%d more", len(attrs)-i))
+			break
+		}
+		names = append(names, string(attr.body))
+	}
+	return strings.Join(names, ",")
+}
+
+// anonymizeDN pseudonymizes the values of a distinguished name's RDNs,
+// keeping the attribute types, e.g. uid=<token>,dc=<token>
+func anonymizeDN(dn string) string {
+	if capture.CurrentAnonymizer() == nil || dn == "" {
+		return dn
+	}
+	rdns := strings.Split(dn, ",")
+	for i, rdn := range rdns {
+		if typ, value, ok := strings.Cut(rdn, "="); ok {
+			rdns[i] = typ + "=" + capture.AnonymizeName(strings.TrimSpace(value))
+		} else {
+			rdns[i] = capture.AnonymizeName(rdn)
+		}
+	}
+	return strings.Join(rdns, ",")
+}
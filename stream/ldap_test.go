@@ -0,0 +1,71 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+)
+
+// ldapMessage wraps a protocol operation in an LDAPMessage
+func ldapMessage(id byte, op []byte) []byte {
+	return tlv(0x30, tlv(0x02, []byte{id}), op)
+}
+
+func TestDecodeLDAP(t *testing.T) {
+	bind := ldapMessage(1, tlv(0x60,
+		tlv(0x02, []byte{0x03}),
+		tlv(0x04, []byte("cn=admin,dc=example,dc=com")),
+		tlv(0x80, []byte("s3cret")),
+	))
+	bound := ldapMessage(1, tlv(0x61, tlv(0x0a, []byte{0x00}), tlv(0x04), tlv(0x04)))
+	search := ldapMessage(2, tlv(0x63,
+		tlv(0x04, []byte("dc=example,dc=com")),
+		tlv(0x0a, []byte{0x02}), tlv(0x0a, []byte{0x00}), berZero, berZero, tlv(0x01, []byte{0x00}),
+		tlv(0xa0,
+			tlv(0xa3, tlv(0x04, []byte("objectClass")), tlv(0x04, []byte("person"))),
+			tlv(0xa4, tlv(0x04, []byte("cn")), tlv(0x30, tlv(0x80, []byte("adm")))),
+			tlv(0xa2, tlv(0x87, []byte("disabled"))),
+		),
+		tlv(0x30, tlv(0x04, []byte("cn")), tlv(0x04, []byte("mail"))),
+	))
+	entry := ldapMessage(2, tlv(0x64, tlv(0x04, []byte("cn=admin,dc=example,dc=com")), tlv(0x30)))
+	done := ldapMessage(2, tlv(0x65, tlv(0x0a, []byte{0x00}), tlv(0x04), tlv(0x04)))
+	startTLS := ldapMessage(3, tlv(0x77, tlv(0x80, []byte(ldapStartTLS))))
+
+	log := decodeAll(decodeLDAP,
+		message{bind, true}, message{bound, false}, message{search, true},
+		message{entry, false}, message{done, false}, message{startTLS, true},
+	)
+	checkLog(t, log, []string{
+		`#1 bind v3 "cn=admin,dc=example,dc=com" (simple)`,
+		`#1 bind result: success`,
+		`#2 search base "dc=example,dc=com" scope sub filter (&(objectClass=person)(cn=adm*)(!(disabled=*))) attributes cn,mail`,
+		`#2 entry "cn=admin,dc=example,dc=com"`,
+		`#2 search done: success`,
+		`#3 StartTLS`,
+	}, `LDAP bind cn=admin,dc=example,dc=com (success); search (&(objectClass=person)(cn=adm*)(!(disabled=*))) under "dc=example,dc=com"; StartTLS`)
+	for _, line := range log.lines {
+		if strings.Contains(line, "s3cret") {
+			t.Errorf("password shown: %q", line)
+		}
+	}
+}
+
+func TestDecodeLDAPFailedBind(t *testing.T) {
+	bind := ldapMessage(1, tlv(0x60, tlv(0x02, []byte{0x03}), tlv(0x04), tlv(0x80)))
+	refused := ldapMessage(1, tlv(0x61, tlv(0x0a, []byte{49}), tlv(0x04), tlv(0x04, []byte("80090308: LdapErr"))))
+	log := decodeAll(decodeLDAP, message{bind, true}, message{refused, false})
+	checkLog(t, log, []string{
+		`#1 bind v3 "" (anonymous)`,
+		`#1 bind result: invalidCredentials (80090308: LdapErr)`,
+	}, "LDAP bind anonymous (invalidCredentials (80090308: LdapErr))")
+}
+
+func TestFrameBER(t *testing.T) {
+	msg := ldapMessage(1, tlv(0x42))
+	if size, header := frameBER(append(msg, msg[:3]...)); size != len(msg) || header != 0 {
+		t.Errorf("frameBER = %d, %d; want %d, 0", size, header, len(msg))
+	}
+	if size, _ := frameBER([]byte{0x16, 0x03, 0x01}); size != -1 {
+		t.Errorf("TLS after StartTLS was framed: %d", size)
+	}
+}
@@ -0,0 +1,218 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go-etherape/capture"
+)
+
+// Limits for decoded message logs
+const (
+	maxLogLines   = 200 // Decoded messages kept per stream
+	maxLogLineLen = 300 // Longer lines are cut
+	maxLogFacts   = 64  // Values kept for summaries
+)
+
+// messageLog keeps what a protocol decoder read from a stream, one line
+// per message, plus what the decoder needs for the stream's summary
+type messageLog struct {
+	protocol StreamProtocol    // Decoder that wrote the log
+	lines    []string          // Decoded messages
+	dropped  int               // Lines not kept once the log was full
+	summary  string            // Set by the decoder, shown by generateSummary
+	writes   int               // Operations that change a device's state
+	points   map[string]int    // InfluxDB: points written per measurement, see takeMeasurementWrites
+	dns      *dnsState         // DNS: transactions, see takeDNS
+	seen     time.Time         // Capture time of the packet being decoded
+	counts   map[string]int    // Messages by kind
+	facts    map[string]string // Named values kept by the decoder
+	offsets  [2]int            // TCP: reassembled request and response bytes already decoded
+	stopped  [2]bool           // TCP: direction no longer framed, e.g. after STARTTLS
+}
+
+// messageDecoder decodes one message. fromClient is true for messages sent
+// by the side that opened the stream.
+type messageDecoder func(log *messageLog, msg []byte, fromClient bool)
+
+// messageFramer finds the first message in reassembled TCP data. It returns
+// the message's length including a header of transport framing that is
+// not passed to the decoder; size is 0 if the message is incomplete and -1
+// if the data can't be framed.
+type messageFramer func(data []byte) (size, header int)
+
+// messageProtocol is a protocol whose streams are decoded message by
+// message: each UDP datagram, or each framed message of TCP streams
+type messageProtocol struct {
+	frame     messageFramer // nil for protocols decoded from datagrams only
+	decode    messageDecoder
+	datagrams bool // Framed protocol that also runs over UDP, one message per datagram
+}
+
+var messageProtocols = map[StreamProtocol]messageProtocol{
+	ProtocolDHCP:     {decode: decodeDHCP},
+	ProtocolNTP:      {decode: decodeNTP},
+	ProtocolSNMP:     {decode: decodeSNMP},
+	ProtocolLDAP:     {frame: frameBER, decode: decodeLDAP, datagrams: true},
+	ProtocolKerberos: {frame: frameKerberos, decode: decodeKerberos, datagrams: true},
+	ProtocolSMB:      {frame: frameNetBIOS, decode: decodeSMB},
+	ProtocolRDP:      {frame: frameRDP, decode: decodeRDP},
+	ProtocolSyslog:   {frame: frameSyslog, decode: decodeSyslog, datagrams: true},
+	ProtocolSlurm:    {frame: frameSlurm, decode: decodeSlurm},
+	ProtocolModbus:   {frame: frameMBAP, decode: decodeModbus},
+	ProtocolDNP3:     {frame: frameDNP3, decode: decodeDNP3, datagrams: true},
+	ProtocolS7comm:   {frame: frameTPKT, decode: decodeS7comm},
+	ProtocolBACnet:   {decode: decodeBACnet},
+	ProtocolMQTT:     {frame: frameMQTT, decode: decodeMQTT},
+	ProtocolCoAP:     {decode: decodeCoAP},
+	ProtocolDNS:      {frame: frameDNS, decode: decodeDNS, datagrams: true},
+	ProtocolInfluxDB: {frame: frameHTTP, decode: decodeInfluxDB},
+}
+
+// messageProtocol returns the decoder for the stream's protocol, starting
+// a new log if the protocol changed
+func (s *Stream) messageProtocol() (messageProtocol, bool) {
+	p, ok := messageProtocols[s.Protocol]
+	if ok && s.msgs.protocol != s.Protocol {
+		s.msgs = messageLog{protocol: s.Protocol}
+	}
+	return p, ok
+}
+
+// decodedLog returns the stream's message log, or nil if it was written
+// for a protocol the stream is no longer classified as
+func (s *Stream) decodedLog() *messageLog {
+	if s.msgs.protocol != s.Protocol {
+		return nil
+	}
+	return &s.msgs
+}
+
+// writeCount returns the number of decoded writes in the stream
+func (s *Stream) writeCount() int {
+	if log := s.decodedLog(); log != nil {
+		return log.writes
+	}
+	return 0
+}
+
+// decodeDatagram decodes a UDP payload as one message, captured at now
+func (s *Stream) decodeDatagram(payload []byte, fromClient bool, now time.Time) {
+	p, ok := s.messageProtocol()
+	if !ok || len(payload) == 0 || (p.frame != nil && !p.datagrams) {
+		return
+	}
+	s.msgs.seen = now
+	p.decode(&s.msgs, payload, fromClient)
+}
+
+// decodeMessages decodes the TCP messages reassembled since the last call,
+// which completed with the packet captured at now
+func (s *Stream) decodeMessages(now time.Time) {
+	p, ok := s.messageProtocol()
+	if !ok || p.frame == nil {
+		return
+	}
+	log := &s.msgs
+	log.seen = now
+	for i, data := range [2][]byte{s.RequestData, s.ResponseData} {
+		for !log.stopped[i] && log.offsets[i] < len(data) {
+			size, header := p.frame(data[log.offsets[i]:])
+			if size < 0 {
+				log.stopped[i] = true
+				break
+			}
+			if size == 0 || log.offsets[i]+size > len(data) {
+				break
+			}
+			p.decode(log, data[log.offsets[i]+header:log.offsets[i]+size], i == 0)
+			log.offsets[i] += size
+		}
+	}
+}
+
+// add appends a line for a decoded message
+func (l *messageLog) add(format string, args ...interface{}) {
+	if len(l.lines) >= maxLogLines {
+		l.dropped++
+		return
+	}
+	line := capture.AnonymizeText(printable(fmt.Sprintf(format, args...)))
+	if len(line) > maxLogLineLen {
+		line = line[:maxLogLineLen] + "..."
+	}
+	l.lines = append(l.lines, line)
+}
+
+// count counts a message of the given kind
+func (l *messageLog) count(kind string) {
+	if l.counts == nil {
+		l.counts = make(map[string]int)
+	}
+	l.counts[kind]++
+}
+
+// set keeps a value for the summary
+func (l *messageLog) set(key, value string) {
+	if l.facts == nil {
+		l.facts = make(map[string]string)
+	}
+	if _, ok := l.facts[key]; !ok && len(l.facts) >= maxLogFacts {
+		return
+	}
+	l.facts[key] = value
+}
+
+// request records a request for the summary, which shows the latest write
+// or, while there has been none, the latest request. Writes are counted for
+// the stream list.
+func (l *messageLog) request(protocol StreamProtocol, desc string, write bool) {
+	if write {
+		l.writes++
+		l.set("lastWrite", desc)
+	} else {
+		l.set("lastRequest", desc)
+	}
+	if w := l.facts["lastWrite"]; w != "" {
+		desc = w
+	}
+	l.summary = string(protocol) + " " + desc
+}
+
+// writeMessageLog writes the decoded messages and message counts
+func writeMessageLog(buf *bytes.Buffer, log *messageLog) {
+	fmt.Fprintf(buf, "=== %s MESSAGES ===\n", strings.ToUpper(string(log.protocol)))
+	for _, line := range log.lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	if log.dropped > 0 {
+		fmt.Fprintf(buf, "(%d more not shown)\n", log.dropped)
+	}
+
+	if len(log.counts) > 0 {
+		kinds := make([]string, 0, len(log.counts))
+		for kind := range log.counts {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		buf.WriteString("\n=== MESSAGE COUNTS ===\n")
+		for _, kind := range kinds {
+			fmt.Fprintf(buf, "%s: %d\n", kind, log.counts[kind])
+		}
+	}
+}
+
+// printable replaces control characters and invalid UTF-8 in decoded text
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return '.'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,32 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+)
+
+// message is one message fed to a decoder
+type message struct {
+	data       []byte
+	fromClient bool
+}
+
+// decodeAll runs a decoder over messages in order and returns its log
+func decodeAll(decode messageDecoder, msgs ...message) *messageLog {
+	log := &messageLog{}
+	for _, m := range msgs {
+		decode(log, m.data, m.fromClient)
+	}
+	return log
+}
+
+// checkLog compares a log's lines and summary
+func checkLog(t *testing.T, log *messageLog, lines []string, summary string) {
+	t.Helper()
+	if strings.Join(log.lines, "\n") != strings.Join(lines, "\n") {
+		t.Errorf("got lines\n\t%s\nwant\n\t%s", strings.Join(log.lines, "\n\t"), strings.Join(lines, "\n\t"))
+	}
+	if log.summary != summary {
+		t.Errorf("got summary %q, want %q", log.summary, summary)
+	}
+}
@@ -0,0 +1,218 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// mbapHeaderLen is the length of the Modbus/TCP MBAP header: transaction,
+// protocol and length fields, and the unit identifier
+const mbapHeaderLen = 7
+
+// maxModbusValues limits the register and coil values shown per message
+const maxModbusValues = 16
+
+// modbusFunctions names the public Modbus function codes
+var modbusFunctions = map[byte]string{
+	1: "Read Coils", 2: "Read Discrete Inputs", 3: "Read Holding Registers", 4: "Read Input Registers",
+	5: "Write Single Coil", 6: "Write Single Register", 7: "Read Exception Status", 8: "Diagnostics",
+	11: "Get Comm Event Counter", 12: "Get Comm Event Log", 15: "Write Multiple Coils",
+	16: "Write Multiple Registers", 17: "Report Server ID", 20: "Read File Record",
+	21: "Write File Record", 22: "Mask Write Register", 23: "Read/Write Multiple Registers",
+	24: "Read FIFO Queue", 43: "Encapsulated Interface Transport",
+}
+
+// modbusExceptions names the exception codes of error responses
+var modbusExceptions = map[byte]string{
+	1: "Illegal Function", 2: "Illegal Data Address", 3: "Illegal Data Value",
+	4: "Server Device Failure", 5: "Acknowledge", 6: "Server Device Busy",
+	8: "Memory Parity Error", 10: "Gateway Path Unavailable", 11: "Gateway Target Device Failed to Respond",
+}
+
+// frameMBAP frames Modbus/TCP messages by the length in their MBAP header
+func frameMBAP(data []byte) (int, int) {
+	if len(data) < 6 {
+		return 0, 0
+	}
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	if data[2] != 0 || data[3] != 0 || n < 2 || n > 254 {
+		return -1, 0
+	}
+	return 6 + n, 0
+}
+
+// decodeModbus decodes a Modbus/TCP request or response. Addresses are shown
+// as Modicon references, e.g. 40001 for the first holding register, and
+// responses to reads are matched to their request by transaction ID.
+func decodeModbus(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < mbapHeaderLen+1 {
+		return
+	}
+	tid := binary.BigEndian.Uint16(msg)
+	unit, fc, data := msg[6], msg[7], msg[8:]
+	name := modbusFunction(fc & 0x7f)
+	key := fmt.Sprintf("req:%d", tid)
+
+	if fc&0x80 != 0 {
+		exception := "exception"
+		if len(data) > 0 {
+			exception = modbusException(data[0])
+		}
+		log.count("exception")
+		log.add("#%d unit %d %s failed: %s", tid, unit, name, exception)
+		delete(log.facts, key)
+		return
+	}
+
+	if !fromClient {
+		desc := name + " response"
+		if req, ok := log.facts[key]; ok {
+			delete(log.facts, key)
+			desc = modbusReadResponse(fc, req, data)
+		}
+		log.add("#%d unit %d %s", tid, unit, desc)
+		return
+	}
+
+	log.count(name)
+	desc, write := name, false
+	switch fc {
+	case 1, 2, 3, 4:
+		if len(data) < 4 {
+			break
+		}
+		addr, qty := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+		desc += " " + modbusRange(fc, addr, qty)
+		log.set(key, fmt.Sprintf("%d %d", addr, qty))
+	case 5:
+		write = true
+		if len(data) < 4 {
+			break
+		}
+		value := "OFF"
+		if binary.BigEndian.Uint16(data[2:]) == 0xff00 {
+			value = "ON"
+		}
+		desc += fmt.Sprintf(" %s=%s", modbusRef(fc, binary.BigEndian.Uint16(data)), value)
+	case 6:
+		write = true
+		if len(data) < 4 {
+			break
+		}
+		desc += fmt.Sprintf(" %s=%d", modbusRef(fc, binary.BigEndian.Uint16(data)), binary.BigEndian.Uint16(data[2:]))
+	case 15, 16:
+		write = true
+		if len(data) < 5 {
+			break
+		}
+		addr, qty := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+		values := data[5:min(len(data), 5+int(data[4]))]
+		desc += fmt.Sprintf(" %s=%s", modbusRange(fc, addr, qty), modbusValues(fc, values, int(qty)))
+	case 22:
+		write = true
+		if len(data) < 6 {
+			break
+		}
+		desc += fmt.Sprintf(" %s AND 0x%04x OR 0x%04x", modbusRef(fc, binary.BigEndian.Uint16(data)),
+			binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:]))
+	case 23:
+		write = true
+		if len(data) < 9 {
+			break
+		}
+		readAddr, readQty := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+		writeAddr, writeQty := binary.BigEndian.Uint16(data[4:]), binary.BigEndian.Uint16(data[6:])
+		values := data[9:min(len(data), 9+int(data[8]))]
+		desc += fmt.Sprintf(" read %s, write %s=%s", modbusRange(fc, readAddr, readQty),
+			modbusRange(fc, writeAddr, writeQty), modbusValues(fc, values, int(writeQty)))
+		log.set(key, fmt.Sprintf("%d %d", readAddr, readQty))
+	case 21:
+		write = true
+	}
+	log.add("#%d unit %d %s", tid, unit, desc)
+	log.request(ProtocolModbus, desc, write)
+}
+
+// modbusReadResponse describes the values returned for a read request,
+// whose start address and quantity were kept as "addr qty"
+func modbusReadResponse(fc byte, req string, data []byte) string {
+	name := modbusFunction(fc) + " response"
+	fields := strings.Fields(req)
+	if len(fields) != 2 || len(data) < 1 {
+		return name
+	}
+	addr, _ := strconv.Atoi(fields[0])
+	qty, _ := strconv.Atoi(fields[1])
+	values := data[1:min(len(data), 1+int(data[0]))]
+	return fmt.Sprintf("%s %s=%s", name, modbusRange(fc, uint16(addr), uint16(qty)), modbusValues(fc, values, qty))
+}
+
+// modbusRef formats an address as a Modicon reference, whose first digit
+// is the table: 0 coils, 1 discrete inputs, 3 input registers and 4
+// holding registers. Addresses past 9998 use six-digit references.
+func modbusRef(fc byte, addr uint16) string {
+	table := 4
+	switch fc {
+	case 1, 5, 15:
+		table = 0
+	case 2:
+		table = 1
+	case 4:
+		table = 3
+	}
+	if addr < 9999 {
+		return fmt.Sprintf("%d%04d", table, addr+1)
+	}
+	return fmt.Sprintf("%d%05d", table, int(addr)+1)
+}
+
+// modbusRange formats qty references starting at addr
+func modbusRange(fc byte, addr, qty uint16) string {
+	if qty <= 1 {
+		return modbusRef(fc, addr)
+	}
+	return modbusRef(fc, addr) + "-" + modbusRef(fc, uint16(min(int(addr)+int(qty)-1, 0xffff)))
+}
+
+// modbusValues formats register values, or the bits of coils and discrete
+// inputs, as a list
+func modbusValues(fc byte, data []byte, qty int) string {
+	var values []string
+	switch fc {
+	case 1, 2, 15:
+		for i := 0; i < qty && i/8 < len(data); i++ {
+			values = append(values, strconv.Itoa(int(data[i/8]>>(i%8)&1)))
+		}
+	default:
+		for i := 0; i+1 < len(data); i += 2 {
+			values = append(values, strconv.Itoa(int(binary.BigEndian.Uint16(data[i:]))))
+		}
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	more := ""
+	if len(values) > maxModbusValues {
+		more = fmt.Sprintf(" +%d more", len(values)-maxModbusValues)
+		values = values[:maxModbusValues]
+	}
+	return "[" + strings.Join(values, " ") + more + "]"
+}
+
+// modbusFunction names a function code
+func modbusFunction(fc byte) string {
+	if name, ok := modbusFunctions[fc]; ok {
+		return name
+	}
+	return fmt.Sprintf("Function %d", fc)
+}
+
+// modbusException names an exception code
+func modbusException(code byte) string {
+	if name, ok := modbusExceptions[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("exception %d", code)
+}
@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// mbap builds a Modbus/TCP message for unit 1
+func mbap(tid uint16, fc byte, data ...byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, tid)
+	msg = append(msg, 0, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(2+len(data)))
+	return append(append(msg, 1, fc), data...)
+}
+
+func TestDecodeModbus(t *testing.T) {
+	log := decodeAll(decodeModbus,
+		message{mbap(1, 3, 0x00, 0x00, 0x00, 0x02), true},
+		message{mbap(1, 3, 0x04, 0x00, 0x7b, 0x01, 0xc8), false},
+	)
+	if log.writes != 0 || log.summary != "Modbus Read Holding Registers 40001-40002" {
+		t.Errorf("after a read: %d writes, summary %q", log.writes, log.summary)
+	}
+
+	for _, m := range []message{
+		{mbap(2, 6, 0x00, 0x00, 0x00, 0x7b), true},
+		{mbap(2, 6, 0x00, 0x00, 0x00, 0x7b), false},
+	} {
+		decodeModbus(log, m.data, m.fromClient)
+	}
+	if log.writes != 1 || log.summary != "Modbus Write Single Register 40001=123" {
+		t.Errorf("after a write: %d writes, summary %q", log.writes, log.summary)
+	}
+
+	// Later reads don't replace the write in the summary
+	for _, m := range []message{
+		{mbap(3, 1, 0x00, 0x09, 0x00, 0x03), true},
+		{mbap(3, 1, 0x01, 0x05), false},
+		{mbap(4, 15, 0x00, 0x00, 0x00, 0x03, 0x01, 0x06), true},
+		{mbap(5, 6, 0x27, 0x0f, 0x00, 0x01), true},
+		{mbap(5, 0x86, 0x02), false},
+	} {
+		decodeModbus(log, m.data, m.fromClient)
+	}
+	checkLog(t, log, []string{
+		"#1 unit 1 Read Holding Registers 40001-40002",
+		"#1 unit 1 Read Holding Registers response 40001-40002=[123 456]",
+		"#2 unit 1 Write Single Register 40001=123",
+		"#2 unit 1 Write Single Register response",
+		"#3 unit 1 Read Coils 00010-00012",
+		"#3 unit 1 Read Coils response 00010-00012=[1 0 1]",
+		"#4 unit 1 Write Multiple Coils 00001-00003=[0 1 1]",
+		"#5 unit 1 Write Single Register 410000=1",
+		"#5 unit 1 Write Single Register failed: Illegal Data Address",
+	}, "Modbus Write Single Register 410000=1")
+	if log.writes != 3 || log.counts["exception"] != 1 {
+		t.Errorf("got %d writes and counts %v", log.writes, log.counts)
+	}
+}
+
+func TestFrameMBAP(t *testing.T) {
+	msg := mbap(1, 3, 0x00, 0x00, 0x00, 0x01)
+	if size, header := frameMBAP(append(msg, msg[:4]...)); size != len(msg) || header != 0 {
+		t.Errorf("frameMBAP = %d, %d; want %d, 0", size, header, len(msg))
+	}
+	msg[3] = 1 // Protocol ID other than Modbus
+	if size, _ := frameMBAP(msg); size != -1 {
+		t.Errorf("frameMBAP accepted protocol ID 1: %d", size)
+	}
+}
@@ -0,0 +1,249 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubRel      = 6
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttUnsubscribe = 10
+	mqttDisconnect  = 14
+)
+
+// maxMQTTTopics limits the topics shown per subscription
+const maxMQTTTopics = 8
+
+// mqttPackets names the control packet types
+var mqttPackets = [...]string{
+	"reserved", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+// mqttConnectCodes names the CONNACK return codes of MQTT 3.1 and 3.1.1;
+// mqttReasonCodes the common reason codes of MQTT 5
+var (
+	mqttConnectCodes = map[byte]string{
+		0: "accepted", 1: "unacceptable protocol version", 2: "identifier rejected",
+		3: "server unavailable", 4: "bad user name or password", 5: "not authorized",
+	}
+	mqttReasonCodes = map[byte]string{
+		0x00: "success", 0x80: "unspecified error", 0x84: "unsupported protocol version",
+		0x85: "client identifier not valid", 0x86: "bad user name or password", 0x87: "not authorized",
+		0x88: "server unavailable", 0x89: "server busy", 0x8a: "banned", 0x8c: "bad authentication method",
+	}
+)
+
+// mqttVersions names the protocol levels of CONNECT
+var mqttVersions = map[byte]string{3: "3.1", 4: "3.1.1", 5: "5.0"}
+
+// frameMQTT frames MQTT control packets by their variable-length remaining
+// length. TLS records, whose first byte is no valid packet type and flags
+// combination, end the framing.
+func frameMQTT(data []byte) (int, int) {
+	typ, flags := data[0]>>4, data[0]&0x0f
+	switch {
+	case typ == 0:
+		return -1, 0
+	case typ == mqttPublish:
+	case typ == mqttPubRel || typ == mqttSubscribe || typ == mqttUnsubscribe:
+		if flags != 0x2 {
+			return -1, 0
+		}
+	case flags != 0:
+		return -1, 0
+	}
+	length, n := mqttVarint(data[1:])
+	if n < 0 || length > maxStreamData {
+		return -1, 0
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return 1 + n + length, 0
+}
+
+// mqttVarint reads a variable byte integer, returning its size in bytes:
+// 0 if it is incomplete and -1 if it is longer than four bytes
+func mqttVarint(b []byte) (value, size int) {
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		value |= int(b[i]&0x7f) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, -1
+}
+
+// mqttString reads a length-prefixed string or binary field
+func mqttString(b []byte) (s, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if 2+n > len(b) {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
+
+// mqttSkipProperties skips the properties of MQTT 5 packets
+func mqttSkipProperties(log *messageLog, b []byte) []byte {
+	if log.facts["version"] != "5.0" {
+		return b
+	}
+	length, n := mqttVarint(b)
+	if n <= 0 || n+length > len(b) {
+		return nil
+	}
+	return b[n+length:]
+}
+
+// decodeMQTT decodes MQTT control packets: connections, with the client ID
+// and user name but never the password, publishes with their topic and
+// payload, and subscriptions. Publishes from the client are writes.
+func decodeMQTT(log *messageLog, msg []byte, fromClient bool) {
+	typ, flags := msg[0]>>4, msg[0]&0x0f
+	name := mqttPackets[typ]
+	log.count(name)
+	_, n := mqttVarint(msg[1:])
+	if n <= 0 {
+		return
+	}
+	body := msg[1+n:]
+
+	switch typ {
+	case mqttConnect:
+		protocol, rest, ok := mqttString(body)
+		if !ok || len(rest) < 4 {
+			log.add("Malformed CONNECT")
+			return
+		}
+		version, ok := mqttVersions[rest[0]]
+		if !ok {
+			version = fmt.Sprintf("level %d", rest[0])
+		}
+		log.set("version", version)
+		connectFlags, keepAlive := rest[1], binary.BigEndian.Uint16(rest[2:])
+		rest = mqttSkipProperties(log, rest[4:])
+
+		line := fmt.Sprintf("CONNECT %s %s", protocol, version)
+		clientID, rest, ok := mqttString(rest)
+		if ok {
+			id := capture.AnonymizeName(string(clientID))
+			line += fmt.Sprintf(" client %q", id)
+			log.set("client", id)
+		}
+		if connectFlags&0x04 != 0 && ok { // Will properties, topic and message
+			rest = mqttSkipProperties(log, rest)
+			var topic []byte
+			if topic, rest, ok = mqttString(rest); ok {
+				line += fmt.Sprintf(" will %q", topic)
+				_, rest, ok = mqttString(rest)
+			}
+		}
+		if connectFlags&0x80 != 0 && ok {
+			if user, _, ok := mqttString(rest); ok {
+				line += " user " + capture.AnonymizeName(string(user))
+			}
+		}
+		if connectFlags&0x40 != 0 {
+			line += " with password"
+		}
+		log.add("%s, keepalive %ds", line, keepAlive)
+		if log.summary == "" {
+			log.summary = "MQTT session " + orDash(log.facts["client"])
+		}
+	case mqttConnAck:
+		if len(body) < 2 {
+			return
+		}
+		codes := mqttConnectCodes
+		if log.facts["version"] == "5.0" {
+			codes = mqttReasonCodes
+		}
+		result, ok := codes[body[1]]
+		if !ok {
+			result = fmt.Sprintf("code 0x%02x", body[1])
+		}
+		log.add("CONNACK %s", result)
+	case mqttPublish:
+		topic, rest, ok := mqttString(body)
+		if !ok {
+			log.add("Malformed PUBLISH")
+			return
+		}
+		qos := flags >> 1 & 0x3
+		if qos > 0 && len(rest) >= 2 {
+			rest = rest[2:] // Packet identifier
+		}
+		payload := mqttSkipProperties(log, rest)
+		desc := fmt.Sprintf("PUBLISH %s=%s", topic, octetString(payload))
+		line := desc
+		if qos > 0 {
+			line += fmt.Sprintf(" (qos %d)", qos)
+		}
+		if flags&0x1 != 0 {
+			line += " (retained)"
+		}
+		if !fromClient {
+			line = "delivered " + line
+		}
+		log.add("%s", line)
+		if fromClient {
+			log.request(ProtocolMQTT, desc, true)
+		}
+	case mqttSubscribe, mqttUnsubscribe:
+		if len(body) < 2 {
+			return
+		}
+		id := binary.BigEndian.Uint16(body)
+		rest := mqttSkipProperties(log, body[2:])
+		var topics []string
+		for len(rest) > 0 {
+			topic, tail, ok := mqttString(rest)
+			if !ok {
+				break
+			}
+			rest = tail
+			if typ == mqttSubscribe && len(rest) > 0 {
+				rest = rest[1:] // Subscription options
+			}
+			if len(topics) == maxMQTTTopics {
+				topics = append(topics, "...")
+				break
+			}
+			topics = append(topics, string(topic))
+		}
+		desc := fmt.Sprintf("%s %s", name, strings.Join(topics, ", "))
+		log.add("#%d %s", id, desc)
+		log.request(ProtocolMQTT, desc, false)
+	case mqttSubAck:
+		if len(body) < 2 {
+			return
+		}
+		var granted []string
+		for _, code := range mqttSkipProperties(log, body[2:]) {
+			if code >= 0x80 {
+				granted = append(granted, fmt.Sprintf("failure 0x%02x", code))
+			} else {
+				granted = append(granted, fmt.Sprintf("qos %d", code))
+			}
+		}
+		log.add("#%d SUBACK %s", binary.BigEndian.Uint16(body), strings.Join(granted, ", "))
+	case mqttDisconnect:
+		log.add("DISCONNECT")
+	}
+}
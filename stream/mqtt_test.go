@@ -0,0 +1,108 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+)
+
+// mqttPacket builds a control packet with a variable-length remaining length
+func mqttPacket(header byte, body ...[]byte) []byte {
+	var rest []byte
+	for _, b := range body {
+		rest = append(rest, b...)
+	}
+	msg := []byte{header}
+	for n := len(rest); ; n >>= 7 {
+		if n < 0x80 {
+			msg = append(msg, byte(n))
+			break
+		}
+		msg = append(msg, byte(n&0x7f|0x80))
+	}
+	return append(msg, rest...)
+}
+
+// mqttStr builds a length-prefixed string
+func mqttStr(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func TestDecodeMQTT(t *testing.T) {
+	connect := mqttPacket(mqttConnect<<4, mqttStr("MQTT"), []byte{4, 0xc2, 0x00, 0x3c},
+		mqttStr("sensor-1"), mqttStr("alice"), mqttStr("hunter2"))
+	subscribe := mqttPacket(mqttSubscribe<<4|0x2, []byte{0x00, 0x01}, mqttStr("cmd/#"), []byte{1}, mqttStr("config/+"), []byte{0})
+	publish := mqttPacket(mqttPublish<<4, mqttStr("sensors/temp"), []byte("21.5"))
+	delivered := mqttPacket(mqttPublish<<4|0x3, mqttStr("cmd/reboot"), []byte{0x00, 0x07}, []byte("now"))
+	long := mqttPacket(mqttPublish<<4, mqttStr("logs"), []byte(strings.Repeat("x", 200)))
+	if size, _ := frameMQTT(long); size != len(long) || long[1]&0x80 == 0 {
+		t.Fatalf("frameMQTT = %d, want %d with a two-byte length", size, len(long))
+	}
+
+	log := decodeAll(decodeMQTT,
+		message{connect, true},
+		message{mqttPacket(mqttConnAck<<4, []byte{0, 0}), false},
+		message{subscribe, true},
+		message{mqttPacket(mqttSubAck<<4, []byte{0x00, 0x01, 0x01, 0x80}), false},
+	)
+	if log.writes != 0 || log.summary != "MQTT SUBSCRIBE cmd/#, config/+" {
+		t.Errorf("after subscribing: %d writes, summary %q", log.writes, log.summary)
+	}
+	for _, m := range []message{
+		{publish, true},
+		{delivered, false},
+		{mqttPacket(mqttDisconnect << 4), true},
+	} {
+		decodeMQTT(log, m.data, m.fromClient)
+	}
+	checkLog(t, log, []string{
+		`CONNECT MQTT 3.1.1 client "sensor-1" user alice with password, keepalive 60s`,
+		"CONNACK accepted",
+		"#1 SUBSCRIBE cmd/#, config/+",
+		"#1 SUBACK qos 1, failure 0x80",
+		`PUBLISH sensors/temp="21.5"`,
+		`delivered PUBLISH cmd/reboot="now" (qos 1) (retained)`,
+		"DISCONNECT",
+	}, `MQTT PUBLISH sensors/temp="21.5"`)
+	if log.writes != 1 {
+		t.Errorf("got %d writes, want the client's publish only", log.writes)
+	}
+	for _, line := range log.lines {
+		if strings.Contains(line, "hunter2") {
+			t.Errorf("password shown: %q", line)
+		}
+	}
+}
+
+func TestDecodeMQTT5(t *testing.T) {
+	// Properties follow the variable headers of MQTT 5
+	connect := mqttPacket(mqttConnect<<4, mqttStr("MQTT"), []byte{5, 0x02, 0x00, 0x1e, 0x00}, mqttStr("plc"))
+	publish := mqttPacket(mqttPublish<<4|0x2, mqttStr("plant/valve"), []byte{0x00, 0x09, 0x02, 0x01, 0x01}, []byte("open"))
+	log := decodeAll(decodeMQTT,
+		message{connect, true},
+		message{mqttPacket(mqttConnAck<<4, []byte{0, 0x87, 0}), false},
+		message{publish, true},
+	)
+	checkLog(t, log, []string{
+		`CONNECT MQTT 5.0 client "plc", keepalive 30s`,
+		"CONNACK not authorized",
+		`PUBLISH plant/valve="open" (qos 1)`,
+	}, `MQTT PUBLISH plant/valve="open"`)
+}
+
+func TestFrameMQTT(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"PINGREQ", []byte{0xc0, 0x00}, 2},
+		{"incomplete length", []byte{0x30, 0x80}, 0},
+		{"SUBSCRIBE without its flags", []byte{0x80, 0x02, 0x00, 0x01}, -1},
+		{"TLS record", []byte{0x16, 0x03, 0x01, 0x00, 0x05}, -1},
+	}
+	for _, tt := range tests {
+		if size, _ := frameMQTT(tt.data); size != tt.want {
+			t.Errorf("%s: frameMQTT = %d, want %d", tt.name, size, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ntpEpochOffset is the seconds between the NTP era 0 epoch (1900) and 1970
+const ntpEpochOffset = 2208988800
+
+// ntpModes names the association modes of NTP packets
+var ntpModes = [8]string{
+	"reserved", "symmetric active", "symmetric passive", "client",
+	"server", "broadcast", "control", "private",
+}
+
+// decodeNTP decodes an NTP packet's header
+func decodeNTP(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < 1 {
+		return
+	}
+	version, mode := (msg[0]>>3)&7, msg[0]&7
+	modeName := ntpModes[mode]
+	log.count(modeName)
+	if mode >= 6 || len(msg) < 48 {
+		log.add("v%d %s message (%d bytes)", version, modeName, len(msg))
+		log.summary = fmt.Sprintf("NTP v%d %s", version, modeName)
+		return
+	}
+
+	stratum := msg[1]
+	transmit := ntpTime(msg[40:48])
+	line := fmt.Sprintf("v%d %s", version, modeName)
+	if mode == 3 {
+		log.add("%s, transmit %s", line, transmit)
+		if log.summary == "" {
+			log.summary = fmt.Sprintf("NTP v%d client", version)
+		}
+		return
+	}
+
+	ref := ntpReferenceID(msg[12:16], stratum, version)
+	if stratum == 0 {
+		// Kiss-o'-Death: the reference ID carries the code
+		log.add("%s, kiss code %s", line, ref)
+		log.summary = fmt.Sprintf("NTP v%d kiss-o'-death %s", version, ref)
+		return
+	}
+	log.add("%s, stratum %d, reference %s, transmit %s", line, stratum, ref, transmit)
+	log.summary = fmt.Sprintf("NTP v%d %s, stratum %d (reference %s)", version, modeName, stratum, ref)
+}
+
+// ntpReferenceID formats the reference ID: a clock source name at stratum
+// 0 and 1, else the upstream server's IPv4 address or a hash for IPv6
+func ntpReferenceID(id []byte, stratum, version byte) string {
+	if stratum <= 1 {
+		return printable(string(trimNUL(id)))
+	}
+	if version == 3 || version == 4 {
+		return net.IP(id).String()
+	}
+	return fmt.Sprintf("%08x", binary.BigEndian.Uint32(id))
+}
+
+// ntpTime converts a 64-bit NTP timestamp, or returns "-" for zero
+func ntpTime(ts []byte) string {
+	seconds, fraction := binary.BigEndian.Uint32(ts), binary.BigEndian.Uint32(ts[4:])
+	if seconds == 0 && fraction == 0 {
+		return "-"
+	}
+	unix := int64(seconds) - ntpEpochOffset
+	if seconds < 1<<31 {
+		unix += 1 << 32 // Era 1 starts in 2036
+	}
+	nanos := int64(fraction) * int64(time.Second) >> 32
+	return time.Unix(unix, nanos).UTC().Format(time.RFC3339Nano)
+}
+
+// trimNUL cuts a fixed-size field at its first NUL
+func trimNUL(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,46 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// ntpPacket builds a 48-byte NTP packet transmitted at 2024-01-01T00:00:00.5Z
+func ntpPacket(version, mode, stratum byte, refID []byte) []byte {
+	msg := make([]byte, 48)
+	msg[0] = version<<3 | mode
+	msg[1] = stratum
+	copy(msg[12:16], refID)
+	binary.BigEndian.PutUint32(msg[40:], 0xe93c7f00)
+	binary.BigEndian.PutUint32(msg[44:], 0x80000000)
+	return msg
+}
+
+func TestDecodeNTP(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgs    []message
+		lines   []string
+		summary string
+	}{
+		{"client and server", []message{
+			{ntpPacket(4, 3, 0, nil), true},
+			{ntpPacket(4, 4, 2, []byte{192, 0, 2, 123}), false},
+		}, []string{
+			"v4 client, transmit 2024-01-01T00:00:00.5Z",
+			"v4 server, stratum 2, reference 192.0.2.123, transmit 2024-01-01T00:00:00.5Z",
+		}, "NTP v4 server, stratum 2 (reference 192.0.2.123)"},
+		{"primary server", []message{{ntpPacket(4, 4, 1, []byte("GPS\x00")), false}},
+			[]string{"v4 server, stratum 1, reference GPS, transmit 2024-01-01T00:00:00.5Z"},
+			"NTP v4 server, stratum 1 (reference GPS)"},
+		{"kiss-o'-death", []message{{ntpPacket(4, 4, 0, []byte("RATE")), false}},
+			[]string{"v4 server, kiss code RATE"}, "NTP v4 kiss-o'-death RATE"},
+		{"control message", []message{{[]byte{0x16, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}, true}},
+			[]string{"v2 control message (12 bytes)"}, "NTP v2 control"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkLog(t, decodeAll(decodeNTP, tt.msgs...), tt.lines, tt.summary)
+		})
+	}
+}
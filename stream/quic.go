@@ -0,0 +1,522 @@
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"go-etherape/capture"
+)
+
+// QUIC versions whose Initial packets can be decrypted
+const (
+	quicVersion1 = 0x00000001 // RFC 9000
+	quicVersion2 = 0x6b3343cf // RFC 9369
+)
+
+// Initial salts (RFC 9001 section 5.2, RFC 9369 section 3.3.1)
+var (
+	quicSaltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicSaltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+// Long header packet types, numbered as in version 1
+const (
+	quicInitial   = 0
+	quic0RTT      = 1
+	quicHandshake = 2
+	quicRetry     = 3
+)
+
+// Limits for QUIC connection tracking
+const (
+	quicMaxConnectionIDs = 16        // Connection IDs remembered per connection
+	quicMaxPaths         = 16        // Address/port pairs remembered per connection
+	quicMaxCryptoData    = 64 * 1024 // CRYPTO bytes buffered per direction
+	quicMaxCIDLen        = 20
+)
+
+// quicHeader is the cleartext part of a QUIC packet header
+type quicHeader struct {
+	long       bool
+	version    uint32
+	typ        int // Long header packet type, see quicInitial
+	dcid, scid []byte
+	pnOffset   int // Offset of the protected packet number, 0 if the packet has no length
+	end        int // End of the packet within the datagram
+}
+
+// parseQUICHeader reads the header of the first packet in a datagram.
+// Short headers carry no connection ID length, so only long is set for them.
+func parseQUICHeader(b []byte) (*quicHeader, bool) {
+	if len(b) < 1 {
+		return nil, false
+	}
+	if b[0]&0x80 == 0 {
+		return &quicHeader{}, b[0]&0x40 != 0
+	}
+	if len(b) < 7 {
+		return nil, false
+	}
+
+	h := &quicHeader{long: true, version: binary.BigEndian.Uint32(b[1:5]), typ: int(b[0]>>4) & 3}
+	off := 5
+	dcidLen := int(b[off])
+	if dcidLen > quicMaxCIDLen && h.version != 0 || off+1+dcidLen >= len(b) {
+		return nil, false
+	}
+	h.dcid = b[off+1 : off+1+dcidLen]
+	off += 1 + dcidLen
+	scidLen := int(b[off])
+	if scidLen > quicMaxCIDLen && h.version != 0 || off+1+scidLen > len(b) {
+		return nil, false
+	}
+	h.scid = b[off+1 : off+1+scidLen]
+	off += 1 + scidLen
+	h.end = len(b)
+
+	switch h.version {
+	case quicVersion1:
+	case quicVersion2:
+		// Version 2 rotates the type numbers by one
+		h.typ = (h.typ + 3) & 3
+	default:
+		// Version negotiation or a version whose layout is unknown
+		return h, true
+	}
+	if h.typ == quicRetry {
+		return h, true
+	}
+
+	rest := b[off:]
+	if h.typ == quicInitial {
+		tokenLen, n := readQUICVarint(rest)
+		if n == 0 || uint64(len(rest)-n) < tokenLen {
+			return nil, false
+		}
+		rest = rest[n+int(tokenLen):]
+	}
+	length, n := readQUICVarint(rest)
+	if n == 0 || uint64(len(rest)-n) < length {
+		return nil, false
+	}
+	h.pnOffset = len(b) - len(rest) + n
+	h.end = h.pnOffset + int(length)
+	return h, true
+}
+
+// readQUICVarint decodes a variable-length integer, returning its size or
+// 0 if data is too short
+func readQUICVarint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	n := 1 << (data[0] >> 6)
+	if len(data) < n {
+		return 0, 0
+	}
+	v := uint64(data[0] & 0x3f)
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, n
+}
+
+// quicState follows one QUIC connection across connection IDs and paths
+type quicState struct {
+	version uint32
+	odcid   []byte // Destination ID of the client's first Initial; Initial keys derive from it
+	server  string // Server address and port
+	cids    []string
+	paths   []string // 5-tuple stream IDs the connection was seen on
+	crypto  [2]quicCryptoStream
+}
+
+// quicCryptoStream collects the CRYPTO frames of one direction's Initials
+type quicCryptoStream struct {
+	frames []quicCryptoFrame
+	size   int
+	parsed bool // Hello found, or given up on
+}
+
+type quicCryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// Directions of quicState.crypto
+const (
+	quicClient = 0
+	quicServer = 1
+)
+
+// quicEndpoint formats an address and port as used for quicState.server
+func quicEndpoint(ip string, port uint16) string {
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// resolveQUIC finds the QUIC connection a datagram belongs to by connection
+// ID, falling back to the path it was seen on. If canStart is set, a client
+// Initial with unknown IDs starts a connection. An empty ID means the
+// datagram is not part of a tracked connection. Called with mu held.
+func (m *Manager) resolveQUIC(payload []byte, pathID string, canStart bool) (string, *quicHeader) {
+	hdr, ok := parseQUICHeader(payload)
+	if !ok {
+		return "", nil
+	}
+
+	if hdr.long {
+		for _, cid := range [][]byte{hdr.dcid, hdr.scid} {
+			if id, ok := m.quicCIDs[string(cid)]; ok && len(cid) > 0 {
+				return id, hdr
+			}
+		}
+		if canStart && hdr.typ == quicInitial && hdr.pnOffset > 0 && len(hdr.dcid) > 0 {
+			return "QUIC-" + hex.EncodeToString(hdr.dcid), hdr
+		}
+	} else {
+		// Short headers omit the ID length; try the lengths in use
+		for n := range m.quicCIDLens {
+			if len(payload) <= n {
+				continue
+			}
+			if id, ok := m.quicCIDs[string(payload[1:1+n])]; ok {
+				return id, hdr
+			}
+		}
+	}
+
+	if id, ok := m.quicPaths[pathID]; ok {
+		return id, hdr
+	}
+	return "", nil
+}
+
+// trackQUIC records the connection IDs and path of a datagram and reads
+// its Initial packets. It reports whether this datagram completed the
+// ClientHello. Called with mu held.
+func (m *Manager) trackQUIC(stream *Stream, pkt *capture.PacketInfo, hdr *quicHeader, pathID string) bool {
+	q := stream.quic
+	if q == nil {
+		// The first datagram of a connection is the client's Initial
+		q = &quicState{server: quicEndpoint(pkt.DstIP, pkt.DstPort)}
+		if hdr.long && hdr.typ == quicInitial {
+			q.version = hdr.version
+			q.odcid = append([]byte(nil), hdr.dcid...)
+			m.addQUICConnectionID(stream, q, hdr.dcid)
+		}
+		stream.quic = q
+		stream.ConnectionID = hex.EncodeToString(q.odcid)
+	}
+	m.addQUICPath(stream, q, pathID)
+	if !hdr.long {
+		return false
+	}
+	m.addQUICConnectionID(stream, q, hdr.scid)
+
+	if hdr.typ == quicRetry && hdr.version == q.version {
+		// The client's next Initial is keyed by the ID the server chose
+		q.odcid = append([]byte(nil), hdr.scid...)
+		q.crypto = [2]quicCryptoStream{}
+		return false
+	}
+
+	dir := quicClient
+	if quicEndpoint(pkt.SrcIP, pkt.SrcPort) == q.server {
+		dir = quicServer
+	}
+	return stream.readQUICInitials(q, pkt.AppPayload, dir) && dir == quicClient
+}
+
+// addQUICConnectionID maps a connection ID onto the stream
+func (m *Manager) addQUICConnectionID(stream *Stream, q *quicState, cid []byte) {
+	if len(cid) == 0 || len(q.cids) >= quicMaxConnectionIDs {
+		return
+	}
+	if _, known := m.quicCIDs[string(cid)]; known {
+		return
+	}
+	m.quicCIDs[string(cid)] = stream.ID
+	m.quicCIDLens[len(cid)]++
+	q.cids = append(q.cids, string(cid))
+}
+
+// addQUICPath maps a 5-tuple onto the stream, counting a migration when a
+// connection moves to a new one
+func (m *Manager) addQUICPath(stream *Stream, q *quicState, pathID string) {
+	for _, path := range q.paths {
+		if path == pathID {
+			return
+		}
+	}
+	if len(q.paths) > 0 {
+		stream.Migrations++
+	}
+	if len(q.paths) >= quicMaxPaths {
+		return
+	}
+	if _, known := m.quicPaths[pathID]; !known {
+		m.quicPaths[pathID] = stream.ID
+		q.paths = append(q.paths, pathID)
+	}
+}
+
+// forgetQUIC removes an evicted stream's connection IDs and paths
+func (m *Manager) forgetQUIC(stream *Stream) {
+	q := stream.quic
+	if q == nil {
+		return
+	}
+	for _, cid := range q.cids {
+		delete(m.quicCIDs, cid)
+		if m.quicCIDLens[len(cid)]--; m.quicCIDLens[len(cid)] <= 0 {
+			delete(m.quicCIDLens, len(cid))
+		}
+	}
+	for _, path := range q.paths {
+		delete(m.quicPaths, path)
+	}
+}
+
+// readQUICInitials decrypts the Initial packets of a datagram and parses
+// the TLS hello they carry. It reports whether this call parsed the hello.
+func (s *Stream) readQUICInitials(q *quicState, datagram []byte, dir int) bool {
+	cs := &q.crypto[dir]
+	if q.odcid == nil || cs.parsed {
+		return false
+	}
+	aead, hp, iv, err := quicInitialKeys(q.version, q.odcid, dir == quicServer)
+	if err != nil {
+		cs.parsed = true
+		return false
+	}
+
+	// Datagrams may coalesce Initial, 0-RTT and Handshake packets
+	for len(datagram) > 0 {
+		hdr, ok := parseQUICHeader(datagram)
+		if !ok || !hdr.long || hdr.pnOffset == 0 || hdr.version != q.version {
+			break
+		}
+		if hdr.typ == quicInitial {
+			if payload, ok := openQUICPacket(datagram[:hdr.end], hdr.pnOffset, aead, hp, iv); ok {
+				cs.addFrames(payload)
+			}
+		}
+		datagram = datagram[hdr.end:]
+	}
+
+	found := false
+	for _, msg := range splitHandshakeMessages(cs.contiguous()) {
+		switch {
+		case dir == quicClient && msg.typ == tlsHelloClient:
+			found = s.parseClientHello(msg.body, s.quicClientIsSrc(q), 'q')
+		case dir == quicServer && msg.typ == tlsHelloServer:
+			found = s.parseServerHello(msg.body, s.quicClientIsSrc(q))
+		}
+	}
+	cs.parsed = found || cs.size > quicMaxCryptoData
+	return found
+}
+
+// quicClientIsSrc reports whether the stream's source is the client
+func (s *Stream) quicClientIsSrc(q *quicState) bool {
+	return quicEndpoint(s.SrcIP, s.SrcPort) != q.server
+}
+
+// quicInitialKeys derives the Initial packet protection keys for one side
+// of a connection (RFC 9001 section 5)
+func quicInitialKeys(version uint32, odcid []byte, server bool) (cipher.AEAD, cipher.Block, []byte, error) {
+	salt, prefix := quicSaltV1, "quic "
+	if version == quicVersion2 {
+		salt, prefix = quicSaltV2, "quicv2 "
+	}
+	label := "client in"
+	if server {
+		label = "server in"
+	}
+
+	initial, err := hkdf.Extract(sha256.New, odcid, salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	secret, err := hkdfExpandLabel(initial, label, 32)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := hkdfExpandLabel(secret, prefix+"key", 16)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	iv, err := hkdfExpandLabel(secret, prefix+"iv", 12)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hpKey, err := hkdfExpandLabel(secret, prefix+"hp", 16)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return aead, hp, iv, nil
+}
+
+// hkdfExpandLabel is TLS 1.3's HKDF-Expand-Label with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// openQUICPacket removes header protection from a long header packet and
+// decrypts its payload
+func openQUICPacket(packet []byte, pnOffset int, aead cipher.AEAD, hp cipher.Block, iv []byte) ([]byte, bool) {
+	// The header protection sample starts 4 bytes after the packet number
+	if pnOffset+4+16 > len(packet) {
+		return nil, false
+	}
+	p := append([]byte(nil), packet...)
+	mask := make([]byte, hp.BlockSize())
+	hp.Encrypt(mask, p[pnOffset+4:pnOffset+4+16])
+
+	p[0] ^= mask[0] & 0x0f
+	pnLen := int(p[0]&3) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		p[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(p[pnOffset+i])
+	}
+
+	// Initial packet numbers are small enough that the truncated number is
+	// the full one
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	header := p[:pnOffset+pnLen]
+	payload, err := aead.Open(nil, nonce, p[pnOffset+pnLen:], header)
+	return payload, err == nil
+}
+
+// addFrames collects the CRYPTO frames of a decrypted Initial payload
+func (cs *quicCryptoStream) addFrames(payload []byte) {
+	for len(payload) > 0 {
+		typ, n := readQUICVarint(payload)
+		if n == 0 {
+			return
+		}
+		payload = payload[n:]
+
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK, ACK with ECN counts
+			fields := 4 // Largest acknowledged, delay, range count, first range
+			var rangeCount uint64
+			for i := 0; i < fields; i++ {
+				v, n := readQUICVarint(payload)
+				if n == 0 {
+					return
+				}
+				payload = payload[n:]
+				if i == 2 {
+					rangeCount = v
+				}
+			}
+			extra := 2 * rangeCount
+			if typ == 0x03 {
+				extra += 3
+			}
+			for ; extra > 0; extra-- {
+				_, n := readQUICVarint(payload)
+				if n == 0 {
+					return
+				}
+				payload = payload[n:]
+			}
+		case 0x06: // CRYPTO
+			offset, n := readQUICVarint(payload)
+			if n == 0 {
+				return
+			}
+			payload = payload[n:]
+			length, n := readQUICVarint(payload)
+			if n == 0 || uint64(len(payload)-n) < length {
+				return
+			}
+			data := payload[n : n+int(length)]
+			payload = payload[n+int(length):]
+			if offset+length <= quicMaxCryptoData {
+				cs.frames = append(cs.frames, quicCryptoFrame{offset: offset, data: data})
+				cs.size += len(data)
+			}
+		case 0x1c, 0x1d: // CONNECTION_CLOSE
+			return
+		default:
+			// Other frames are not allowed in Initial packets
+			return
+		}
+	}
+}
+
+// contiguous returns the CRYPTO stream from offset 0 up to the first gap
+func (cs *quicCryptoStream) contiguous() []byte {
+	sort.Slice(cs.frames, func(i, j int) bool { return cs.frames[i].offset < cs.frames[j].offset })
+
+	var out []byte
+	for _, f := range cs.frames {
+		end := f.offset + uint64(len(f.data))
+		switch {
+		case f.offset > uint64(len(out)):
+			return out
+		case end > uint64(len(out)):
+			out = append(out, f.data[uint64(len(out))-f.offset:]...)
+		}
+	}
+	return out
+}
+
+// quicSummary describes a QUIC connection for the stream list
+func quicSummary(stream *Stream) string {
+	version := "QUIC"
+	switch stream.quic.version {
+	case quicVersion1:
+		version = "QUIC v1"
+	case quicVersion2:
+		version = "QUIC v2"
+	}
+	if stream.TLS == nil || stream.TLS.ServerName == "" {
+		return fmt.Sprintf("%s connection (%d packets)", version, stream.PacketCount)
+	}
+
+	summary := version + " to " + stream.TLS.ServerName
+	alpn := stream.TLS.SelectedALPN
+	if alpn == "" && len(stream.TLS.ALPN) > 0 {
+		// The server's choice is encrypted; show the client's preference
+		alpn = stream.TLS.ALPN[0]
+	}
+	if alpn != "" {
+		summary += " (" + alpn + ")"
+	}
+	return summary
+}
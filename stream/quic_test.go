@@ -0,0 +1,208 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"go-etherape/capture"
+)
+
+// Connection IDs of RFC 9001 appendix A
+var (
+	rfc9001DCID       = []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	rfc9001ServerSCID = []byte{0xf0, 0x67, 0xa5, 0x50, 0x2a, 0x42, 0x62, 0xb5}
+)
+
+func TestQUICInitialSecrets(t *testing.T) {
+	// RFC 9001 appendix A.1
+	initial, err := hkdf.Extract(sha256.New, rfc9001DCID, quicSaltV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, "7db5df06e7a69e432496adedb00851923595221596ae2ae9fb8115c1e9ed0a44"); !bytes.Equal(initial, want) {
+		t.Fatalf("initial secret = %x, want %x", initial, want)
+	}
+
+	tests := []struct {
+		label               string
+		secret, key, iv, hp string
+	}{
+		{"client in", "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea",
+			"1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+		{"server in", "3c199828fd139efd216c155ad844cc81fb82fa8d7446fa7d78be803acdda951b",
+			"cf3a5331653c364c88f0f379b6067e37", "0ac1493ca1905853b0bba03e", "c206b8d9b9f0f37644430b490eeaa314"},
+	}
+	for _, tt := range tests {
+		secret, err := hkdfExpandLabel(initial, tt.label, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mustHex(t, tt.secret); !bytes.Equal(secret, want) {
+			t.Errorf("%s secret = %x, want %x", tt.label, secret, want)
+		}
+		for _, derived := range []struct {
+			label string
+			n     int
+			want  string
+		}{{"quic key", 16, tt.key}, {"quic iv", 12, tt.iv}, {"quic hp", 16, tt.hp}} {
+			got, err := hkdfExpandLabel(secret, derived.label, derived.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustHex(t, derived.want); !bytes.Equal(got, want) {
+				t.Errorf("%s %s = %x, want %x", tt.label, derived.label, got, want)
+			}
+		}
+	}
+
+	// Header protection mask for the client Initial's sample (appendix A.2)
+	_, hp, _, err := quicInitialKeys(quicVersion1, rfc9001DCID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := make([]byte, hp.BlockSize())
+	hp.Encrypt(mask, mustHex(t, "d1b1c98dd7689fb8ec11d242b123dc9b"))
+	if want := mustHex(t, "437b9aec36"); !bytes.Equal(mask[:5], want) {
+		t.Errorf("mask = %x, want %x", mask[:5], want)
+	}
+}
+
+// rfc9001ServerInitial is the protected server Initial of RFC 9001 appendix A.3
+func rfc9001ServerInitial(t *testing.T) []byte {
+	return mustHex(t, `
+		cf000000010008f067a5502a4262b5004075c0d95a482cd0991cd25b0aac406a
+		5816b6394100f37a1c69797554780bb38cc5a99f5ede4cf73c3ec2493a1839b3
+		dbcba3f6ea46c5b7684df3548e7ddeb9c3bf9c73cc3f3bded74b562bfb19fb84
+		022f8ef4cdd93795d77d06edbb7aaf2f58891850abbdca3d20398c276456cbc4
+		2158407dd074ee`)
+}
+
+func TestQUICOpenServerInitial(t *testing.T) {
+	packet := rfc9001ServerInitial(t)
+	hdr, ok := parseQUICHeader(packet)
+	if !ok || !hdr.long || hdr.typ != quicInitial || hdr.version != quicVersion1 {
+		t.Fatalf("header = %+v, %v", hdr, ok)
+	}
+	if len(hdr.dcid) != 0 || !bytes.Equal(hdr.scid, rfc9001ServerSCID) || hdr.pnOffset != 18 || hdr.end != len(packet) {
+		t.Fatalf("header = %+v", hdr)
+	}
+
+	aead, hp, iv, err := quicInitialKeys(quicVersion1, rfc9001DCID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, ok := openQUICPacket(packet, hdr.pnOffset, aead, hp, iv)
+	if !ok {
+		t.Fatal("packet did not decrypt")
+	}
+	// An ACK frame, then a CRYPTO frame holding the ServerHello
+	want := append(mustHex(t, "02000000000600405a"), rfc9001ServerHello(t)...)
+	if !bytes.Equal(payload, want) {
+		t.Errorf("payload = %x, want %x", payload, want)
+	}
+
+	// The client's keys don't open it
+	aead, hp, iv, _ = quicInitialKeys(quicVersion1, rfc9001DCID, false)
+	if _, ok := openQUICPacket(packet, hdr.pnOffset, aead, hp, iv); ok {
+		t.Error("server Initial opened with the client's keys")
+	}
+}
+
+// rfc9001ClientInitial protects the client Initial of RFC 9001 appendix A.2:
+// packet number 2 carrying the ClientHello, padded to 1200 bytes
+func rfc9001ClientInitial(t *testing.T) []byte {
+	t.Helper()
+	header := mustHex(t, "c300000001088394c8f03e5157080000449e00000002")
+	const pnOffset, pnLen = 18, 4
+	plaintext := make([]byte, 1162)
+	copy(plaintext, append(mustHex(t, "060040f1"), rfc9001ClientHello(t)...))
+
+	aead, hp, iv, err := quicInitialKeys(quicVersion1, rfc9001DCID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := append([]byte(nil), iv...)
+	nonce[len(nonce)-1] ^= 2
+	packet := aead.Seal(append([]byte(nil), header...), nonce, plaintext, header)
+
+	mask := make([]byte, hp.BlockSize())
+	hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func TestQUICClientInitialMatchesRFC(t *testing.T) {
+	packet := rfc9001ClientInitial(t)
+	// Start of the protected packet in appendix A.2
+	want := mustHex(t, "c000000001088394c8f03e5157080000449e7b9aec34d1b1c98dd7689fb8ec11d242b123dc9b")
+	if len(packet) != 1200 || !bytes.Equal(packet[:len(want)], want) {
+		t.Errorf("packet starts %x (%d bytes), want %x (1200 bytes)", packet[:len(want)], len(packet), want)
+	}
+}
+
+// quicDatagram builds a UDP datagram between client 192.0.2.1:50000 and
+// server 192.0.2.2:443
+func quicDatagram(t *testing.T, ts time.Time, fromClient bool, payload []byte) *capture.PacketInfo {
+	t.Helper()
+	client, server := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: client, DstIP: server}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 443}
+	if !fromClient {
+		ip.SrcIP, ip.DstIP = server, client
+		udp.SrcPort, udp.DstPort = 443, 50000
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	return testPacket(t, ts, ip, udp, gopacket.Payload(payload))
+}
+
+func TestQUICHandshakeMetadata(t *testing.T) {
+	m := NewManager(10)
+	start := time.Unix(1700000000, 0)
+	m.AddPacket(quicDatagram(t, start, true, rfc9001ClientInitial(t)))
+	m.AddPacket(quicDatagram(t, start.Add(time.Millisecond), false, rfc9001ServerInitial(t)))
+
+	s := onlyStream(t, m)
+	if s.ConnectionID != "8394c8f03e515708" {
+		t.Errorf("connection ID = %q, want 8394c8f03e515708", s.ConnectionID)
+	}
+	info := s.TLS
+	if info == nil {
+		t.Fatal("no TLS metadata from the Initials")
+	}
+	checks := []struct{ name, got, want string }{
+		{"client", info.ClientIP, "192.0.2.1"},
+		{"server name", info.ServerName, "example.com"},
+		{"version", info.Version, "TLS 1.3"},
+		{"cipher suite", info.CipherSuite, "TLS_AES_128_GCM_SHA256"},
+		{"JA4", info.JA4, "q" + rfc9001JA4},
+		{"JA3S", info.JA3S, rfc9001JA3S},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestQUICInitialTamperedIsRejected(t *testing.T) {
+	packet := rfc9001ClientInitial(t)
+	packet[len(packet)-1] ^= 1 // Breaks the AEAD tag
+
+	aead, hp, iv, err := quicInitialKeys(quicVersion1, rfc9001DCID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := openQUICPacket(packet, 18, aead, hp, iv); ok {
+		t.Error("tampered packet decrypted")
+	}
+}
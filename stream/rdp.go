@@ -0,0 +1,169 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// X.224 TPDU codes carried in TPKTs
+const (
+	x224ConnectionRequest = 0xe0
+	x224ConnectionConfirm = 0xd0
+	x224Data              = 0xf0
+)
+
+// RDP negotiation structure types
+const (
+	rdpNegRequest  = 1
+	rdpNegResponse = 2
+	rdpNegFailure  = 3
+)
+
+// rdpProtocols names the security protocol flags of RDP negotiation
+var rdpProtocols = []struct {
+	flag uint32
+	name string
+}{
+	{0x1, "TLS"}, {0x2, "CredSSP"}, {0x4, "RDSTLS"}, {0x8, "CredSSP with early auth"}, {0x10, "RDS AAD"},
+}
+
+// rdpFailures names the failure codes of RDP_NEG_FAILURE
+var rdpFailures = map[uint32]string{
+	1: "SSL_REQUIRED_BY_SERVER", 2: "SSL_NOT_ALLOWED_BY_SERVER", 3: "SSL_CERT_NOT_ON_SERVER",
+	4: "INCONSISTENT_FLAGS", 5: "HYBRID_REQUIRED_BY_SERVER", 6: "SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER",
+}
+
+// frameTPKT frames the TPKTs (RFC 1006) that carry X.224 over TCP
+func frameTPKT(data []byte) (int, int) {
+	if data[0] != 3 {
+		return -1, 0
+	}
+	if len(data) < 4 {
+		return 0, 0
+	}
+	n := int(binary.BigEndian.Uint16(data[2:]))
+	if data[1] != 0 || n < 7 {
+		return -1, 0
+	}
+	return n, 0
+}
+
+// frameRDP frames TPKTs and, once standard RDP security is in use, fast-path
+// PDUs. TLS after negotiation ends the framing.
+func frameRDP(data []byte) (int, int) {
+	if data[0] == 3 {
+		return frameTPKT(data)
+	}
+	if data[0]&0x3 != 0 {
+		return -1, 0 // Not a fast-path action, e.g. a TLS record
+	}
+	if len(data) < 2 {
+		return 0, 0
+	}
+	n := int(data[1])
+	if n&0x80 != 0 {
+		if len(data) < 3 {
+			return 0, 0
+		}
+		n = (n&0x7f)<<8 | int(data[2])
+	}
+	if n < 2 {
+		return -1, 0
+	}
+	return n, 0
+}
+
+// decodeRDP decodes connection requests and confirms: the client's cookie
+// (usually its user name) and the security protocols offered and chosen
+func decodeRDP(log *messageLog, msg []byte, fromClient bool) {
+	if msg[0] != 3 {
+		log.count("fast-path")
+		return
+	}
+	if len(msg) < 6 {
+		return
+	}
+	tpdu := msg[4:]
+	switch tpdu[1] & 0xf0 {
+	case x224ConnectionRequest:
+		log.count("connection request")
+		if len(tpdu) < 7 {
+			break
+		}
+		var parts []string
+		rest := tpdu[7:]
+		if line, tail, ok := bytes.Cut(rest, []byte("\r\n")); ok {
+			// Cookie: mstshash=<user> or a load balancer routing token
+			cookie := string(line)
+			if user, found := strings.CutPrefix(cookie, "Cookie: mstshash="); found {
+				user = capture.AnonymizeName(user)
+				parts = append(parts, "user "+user)
+				log.set("user", user)
+			} else {
+				parts = append(parts, "routing token")
+			}
+			rest = tail
+		}
+		if len(rest) >= 8 && rest[0] == rdpNegRequest {
+			offered := rdpProtocolNames(binary.LittleEndian.Uint32(rest[4:]))
+			parts = append(parts, "offers "+offered)
+		}
+		log.add("Connection request %s", strings.Join(parts, ", "))
+	case x224ConnectionConfirm:
+		log.count("connection confirm")
+		rest := tpdu[min(len(tpdu), 7):]
+		if len(rest) < 8 {
+			log.add("Connection confirm: standard RDP security")
+			log.set("security", "standard RDP security")
+			break
+		}
+		value := binary.LittleEndian.Uint32(rest[4:])
+		switch rest[0] {
+		case rdpNegResponse:
+			selected := rdpProtocolNames(value)
+			log.add("Connection confirm: %s", selected)
+			log.set("security", selected)
+		case rdpNegFailure:
+			failure, ok := rdpFailures[value]
+			if !ok {
+				failure = fmt.Sprintf("code %d", value)
+			}
+			log.add("Negotiation failure: %s", failure)
+			log.set("security", "negotiation failed ("+failure+")")
+		}
+	case x224Data:
+		log.count("data")
+	default:
+		log.count("other TPDU")
+	}
+
+	summary := "RDP"
+	if user := log.facts["user"]; user != "" {
+		summary += " as " + user
+	}
+	if security := log.facts["security"]; security != "" {
+		summary += ", " + security
+	}
+	log.summary = summary
+}
+
+// rdpProtocolNames lists the security protocols set in a flags field
+func rdpProtocolNames(flags uint32) string {
+	if flags == 0 {
+		return "standard RDP security"
+	}
+	var names []string
+	for _, p := range rdpProtocols {
+		if flags&p.flag != 0 {
+			names = append(names, p.name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("protocols 0x%x", flags)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,81 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// tpkt wraps an X.224 TPDU in a TPKT
+func tpkt(code byte, data []byte) []byte {
+	tpdu := append([]byte{0, code, 0, 0, 0, 0, 0}, data...)
+	tpdu[0] = byte(len(tpdu) - 1) // Length indicator
+	msg := append([]byte{3, 0}, binary.BigEndian.AppendUint16(nil, uint16(4+len(tpdu)))...)
+	return append(msg, tpdu...)
+}
+
+// rdpNeg builds an RDP negotiation structure
+func rdpNeg(typ byte, value uint32) []byte {
+	return binary.LittleEndian.AppendUint32([]byte{typ, 0, 8, 0}, value)
+}
+
+func TestDecodeRDP(t *testing.T) {
+	request := tpkt(x224ConnectionRequest, append([]byte("Cookie: mstshash=alice\r\n"), rdpNeg(rdpNegRequest, 0xb)...))
+	if size, _ := frameRDP(request); size != len(request) {
+		t.Fatalf("frameRDP = %d, want %d", size, len(request))
+	}
+	log := decodeAll(decodeRDP,
+		message{request, true},
+		message{tpkt(x224ConnectionConfirm, rdpNeg(rdpNegResponse, 0x2)), false},
+	)
+	checkLog(t, log, []string{
+		"Connection request user alice, offers TLS, CredSSP, CredSSP with early auth",
+		"Connection confirm: CredSSP",
+	}, "RDP as alice, CredSSP")
+}
+
+func TestDecodeRDPNegotiation(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgs    []message
+		lines   []string
+		summary string
+	}{
+		{"failure", []message{
+			{tpkt(x224ConnectionRequest, rdpNeg(rdpNegRequest, 0)), true},
+			{tpkt(x224ConnectionConfirm, rdpNeg(rdpNegFailure, 5)), false},
+		}, []string{
+			"Connection request offers standard RDP security",
+			"Negotiation failure: HYBRID_REQUIRED_BY_SERVER",
+		}, "RDP, negotiation failed (HYBRID_REQUIRED_BY_SERVER)"},
+		{"routing token and legacy confirm", []message{
+			{tpkt(x224ConnectionRequest, []byte("Cookie: msts=3640205228.15629.0000\r\n")), true},
+			{tpkt(x224ConnectionConfirm, nil), false},
+		}, []string{
+			"Connection request routing token",
+			"Connection confirm: standard RDP security",
+		}, "RDP, standard RDP security"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkLog(t, decodeAll(decodeRDP, tt.msgs...), tt.lines, tt.summary)
+		})
+	}
+}
+
+func TestFrameRDP(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"fast-path", []byte{0x00, 0x05, 0, 0, 0}, 5},
+		{"fast-path long length", []byte{0x00, 0x81, 0x2c}, 0x12c},
+		{"TLS record", []byte{0x16, 0x03, 0x03, 0x00, 0x10}, -1},
+		{"short TPKT", []byte{0x03, 0x00, 0x00, 0x04}, -1},
+	}
+	for _, tt := range tests {
+		if size, _ := frameRDP(tt.data); size != tt.want {
+			t.Errorf("%s: frameRDP = %d, want %d", tt.name, size, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"go-etherape/capture"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	// maxStreamData caps the reassembled bytes kept per direction (1MB)
+	maxStreamData = 1024 * 1024
+
+	// Out-of-order segments older than this are pushed through with a gap
+	reassemblyFlushTimeout = 10 * time.Second
+	// Connections idle for this long are closed in the assembler
+	reassemblyCloseTimeout = 2 * time.Minute
+	// How often buffered connections are checked for flushing
+	reassemblyFlushInterval = 5 * time.Second
+
+	// Memory limits for out-of-order buffering (pages are ~2KB each)
+	maxBufferedPagesTotal         = 16384
+	maxBufferedPagesPerConnection = 256
+)
+
+// tcpStreamFactory creates reassembly streams bound to a stream Manager
+type tcpStreamFactory struct {
+	mgr *Manager
+}
+
+// New creates a reassembly stream for a new TCP connection
+func (f *tcpStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	return &tcpStream{
+		mgr:      f.mgr,
+		streamID: generateStreamID(netFlow.Src().String(), uint16(tcp.SrcPort), netFlow.Dst().String(), uint16(tcp.DstPort), StreamTypeTCP),
+		clientIP: netFlow.Src().String(),
+		clientPt: uint16(tcp.SrcPort),
+	}
+}
+
+// tcpStream receives ordered application data for one TCP connection
+// and writes it into the matching Stream's request/response buffers.
+type tcpStream struct {
+	mgr      *Manager
+	streamID string
+	clientIP string // Endpoint that sent the first packet seen by the assembler
+	clientPt uint16
+}
+
+// Accept allows streams to be picked up mid-connection (no SYN seen)
+func (t *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	*start = true
+	return true
+}
+
+// ReassembledSG appends in-order data to the stream. Called with the Manager lock held.
+func (t *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	stream, exists := t.mgr.streams[t.streamID]
+	if !exists {
+		// Stream was evicted; drop its data
+		return
+	}
+
+	dir, _, _, skip := sg.Info()
+	available, _ := sg.Lengths()
+
+	// Map the assembler's direction onto the stream's request/response sides
+	clientIsRequester := stream.SrcIP == t.clientIP && stream.SrcPort == t.clientPt
+	isRequest := (dir == reassembly.TCPDirClientToServer) == clientIsRequester
+
+	if skip > 0 {
+		stream.GapBytes += int64(skip)
+	}
+	if available == 0 {
+		return
+	}
+
+	data := sg.Fetch(available)
+	t.mgr.reassembled[stream] = true
+	if isRequest {
+		stream.RequestData = appendCapped(stream.RequestData, data)
+	} else {
+		stream.ResponseData = appendCapped(stream.ResponseData, data)
+	}
+}
+
+// ReassemblyComplete is called when the connection closes or times out
+func (t *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	return true
+}
+
+// appendCapped appends data up to maxStreamData bytes, after applying the
+// payload policy
+func appendCapped(dst, data []byte) []byte {
+	data = capture.RetainStreamData(data, len(dst))
+	remaining := maxStreamData - len(dst)
+	if remaining <= 0 {
+		return dst
+	}
+	if len(data) > remaining {
+		data = data[:remaining]
+	}
+	return append(dst, data...)
+}
+
+// assemblerContext carries the packet timestamp into the assembler
+type assemblerContext struct {
+	ci gopacket.CaptureInfo
+}
+
+func (c *assemblerContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.ci
+}
+
+// newAssembler creates a TCP assembler feeding this Manager
+func (m *Manager) newAssembler() *reassembly.Assembler {
+	pool := reassembly.NewStreamPool(&tcpStreamFactory{mgr: m})
+	assembler := reassembly.NewAssembler(pool)
+	assembler.MaxBufferedPagesTotal = maxBufferedPagesTotal
+	assembler.MaxBufferedPagesPerConnection = maxBufferedPagesPerConnection
+	return assembler
+}
+
+// assembleTCP feeds a TCP segment to the assembler. Must be called with m.mu held.
+func (m *Manager) assembleTCP(netFlow gopacket.Flow, tcp *layers.TCP, timestamp time.Time) {
+	ctx := &assemblerContext{ci: gopacket.CaptureInfo{Timestamp: timestamp}}
+	m.assembler.AssembleWithContext(netFlow, tcp, ctx)
+
+	// Periodically push through stalled out-of-order data and close idle connections
+	if timestamp.Sub(m.lastFlush) >= reassemblyFlushInterval {
+		m.flushStalled(timestamp)
+	}
+}
+
+// StartFlushing periodically pushes through out-of-order data that has
+// waited too long for a missing segment. Packets flush on their own as they
+// arrive, but a connection that goes quiet after a gap needs this timer.
+func (m *Manager) StartFlushing(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(reassemblyFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.FlushStalled()
+			}
+		}
+	}()
+}
+
+// FlushStalled pushes through out-of-order data buffered for longer than
+// the flush timeout, skipping the gaps, and closes idle connections, as of
+// the manager's clock
+func (m *Manager) FlushStalled() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	m.flushStalled(now)
+	m.refreshReassembled(now)
+}
+
+// flushStalled flushes the assembler as of now. Must be called with m.mu held.
+func (m *Manager) flushStalled(now time.Time) {
+	m.assembler.FlushWithOptions(reassembly.FlushOptions{
+		T:  now.Add(-reassemblyFlushTimeout),
+		TC: now.Add(-reassemblyCloseTimeout),
+	})
+	m.lastFlush = now
+}
+
+// refreshReassembled decodes the messages reassembly delivered to streams
+// outside of their own packets, e.g. by a flush. Must be called with m.mu
+// held.
+func (m *Manager) refreshReassembled(now time.Time) {
+	for stream := range m.reassembled {
+		stream.decodeMessages(now)
+		stream.Summary = capture.AnonymizeText(generateSummary(stream))
+	}
+	clear(m.reassembled)
+}
+
+// FlushReassembly pushes all buffered TCP data into streams, skipping any gaps.
+// Used after loading a finished capture so trailing out-of-order data is not lost.
+func (m *Manager) FlushReassembly() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.assembler.FlushAll()
+	m.refreshReassembled(m.clock.Now())
+}
@@ -0,0 +1,134 @@
+package stream
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"go-etherape/capture"
+)
+
+// testClock is a clock the test moves by hand
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// testPacket serializes layers after an Ethernet header and runs the frame
+// through capture.ProcessPacket
+func testPacket(t *testing.T, ts time.Time, ls ...gopacket.SerializableLayer) *capture.PacketInfo {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth}, ls...)...); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = ts
+	info := capture.ProcessPacket(packet)
+	if info == nil {
+		t.Fatal("packet was not processed")
+	}
+	return info
+}
+
+// tcpSegment describes a client to server segment
+type tcpSegment struct {
+	seq  uint32
+	data string
+	syn  bool
+}
+
+// tcpTestPacket builds a segment from 192.0.2.1:40000 to 192.0.2.2:5555
+func tcpTestPacket(t *testing.T, ts time.Time, seg tcpSegment) *capture.PacketInfo {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(192, 0, 2, 2)}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 5555, Seq: seg.seq, SYN: seg.syn, ACK: !seg.syn, PSH: seg.data != "", Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return testPacket(t, ts, ip, tcp, gopacket.Payload(seg.data))
+}
+
+func TestTCPReassembly(t *testing.T) {
+	syn := tcpSegment{seq: 999, syn: true}
+	tests := []struct {
+		name     string
+		segments []tcpSegment
+		want     string
+		gap      int64
+	}{
+		{"in order", []tcpSegment{syn, {seq: 1000, data: "abc"}, {seq: 1003, data: "def"}}, "abcdef", 0},
+		{"reordered", []tcpSegment{syn, {seq: 1003, data: "def"}, {seq: 1000, data: "abc"}}, "abcdef", 0},
+		{"retransmitted", []tcpSegment{syn, {seq: 1000, data: "abc"}, {seq: 1000, data: "abc"}, {seq: 1003, data: "def"}}, "abcdef", 0},
+		{"overlapping", []tcpSegment{syn, {seq: 1000, data: "abcd"}, {seq: 1002, data: "cdef"}}, "abcdef", 0},
+		{"overlap after reordering", []tcpSegment{syn, {seq: 1004, data: "efgh"}, {seq: 1000, data: "abcdef"}}, "abcdefgh", 0},
+		{"retransmitted with more data", []tcpSegment{syn, {seq: 1000, data: "abc"}, {seq: 1000, data: "abcdef"}}, "abcdef", 0},
+		{"gap is held back", []tcpSegment{syn, {seq: 1000, data: "abc"}, {seq: 1006, data: "ghi"}}, "abc", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(10)
+			start := time.Unix(1700000000, 0)
+			for i, seg := range tt.segments {
+				m.AddPacket(tcpTestPacket(t, start.Add(time.Duration(i)*time.Millisecond), seg))
+			}
+			s := onlyStream(t, m)
+			if string(s.RequestData) != tt.want || s.GapBytes != tt.gap {
+				t.Errorf("got %q with %d gap bytes, want %q with %d", s.RequestData, s.GapBytes, tt.want, tt.gap)
+			}
+		})
+	}
+}
+
+func TestTCPReassemblyFlushesStalledGap(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	clock := &testClock{now: start}
+	m := NewManager(10)
+	m.SetClock(clock)
+	m.AddPacket(tcpTestPacket(t, start, tcpSegment{seq: 999, syn: true}))
+	m.AddPacket(tcpTestPacket(t, start, tcpSegment{seq: 1000, data: "abc"}))
+	m.AddPacket(tcpTestPacket(t, start, tcpSegment{seq: 1006, data: "ghi"}))
+
+	// Not stalled for long enough yet
+	clock.now = start.Add(reassemblyFlushTimeout / 2)
+	m.FlushStalled()
+	if s := onlyStream(t, m); string(s.RequestData) != "abc" {
+		t.Fatalf("flushed early: got %q", s.RequestData)
+	}
+
+	// The connection stayed quiet; the timer pushes the data past the gap
+	clock.now = start.Add(2 * reassemblyFlushTimeout)
+	m.FlushStalled()
+	s := onlyStream(t, m)
+	if string(s.RequestData) != "abcghi" || s.GapBytes != 3 {
+		t.Errorf("got %q with %d gap bytes, want \"abcghi\" with 3", s.RequestData, s.GapBytes)
+	}
+}
+
+// onlyStream returns the manager's single stream
+func onlyStream(t *testing.T, m *Manager) *Stream {
+	t.Helper()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.streams) != 1 {
+		t.Fatalf("got %d streams, want 1", len(m.streams))
+	}
+	for _, s := range m.streams {
+		return s
+	}
+	return nil
+}
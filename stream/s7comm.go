@@ -0,0 +1,356 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// S7comm PDU types (ROSCTR) and protocol IDs
+const (
+	s7Job        = 1
+	s7Ack        = 2
+	s7AckData    = 3
+	s7UserData   = 7
+	s7ProtocolID = 0x32
+	s7PlusID     = 0x72
+)
+
+// S7comm functions with decoded parameters
+const (
+	s7ReadVar   = 0x04
+	s7WriteVar  = 0x05
+	s7PIService = 0x28
+	s7SetupComm = 0xf0
+)
+
+// s7Functions names the job functions; s7Writes are those that change
+// PLC memory, programs or run state
+var (
+	s7Functions = map[byte]string{
+		0x00: "CPU Services", 0x04: "Read Var", 0x05: "Write Var", 0x1a: "Request Download",
+		0x1b: "Download Block", 0x1c: "Download Ended", 0x1d: "Start Upload", 0x1e: "Upload",
+		0x1f: "End Upload", 0x28: "PI Service", 0x29: "PLC Stop", 0xf0: "Setup Communication",
+	}
+	s7Writes = map[byte]bool{0x05: true, 0x1a: true, 0x1b: true, 0x1c: true, 0x28: true, 0x29: true}
+)
+
+// s7Areas names memory areas by their address prefix
+var s7Areas = map[byte]string{0x81: "I", 0x82: "Q", 0x83: "M", 0x84: "DB", 0x85: "DI", 0x1c: "C", 0x1d: "T"}
+
+// s7ReturnCodes names the data item return codes
+var s7ReturnCodes = map[byte]string{
+	0x01: "hardware fault", 0x03: "access denied", 0x05: "invalid address",
+	0x06: "data type not supported", 0x07: "data type inconsistent", 0x0a: "object does not exist",
+	0xff: "success",
+}
+
+// decodeS7comm decodes S7comm in COTP over TPKT: the connection's rack and
+// slot, variable reads and writes with their addresses and values, and
+// the names of other jobs. S7comm-plus is only counted.
+func decodeS7comm(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < 6 {
+		return
+	}
+	tpdu := msg[4:]
+	li := int(tpdu[0])
+	if 1+li > len(tpdu) {
+		return
+	}
+	switch tpdu[1] & 0xf0 {
+	case x224ConnectionRequest, x224ConnectionConfirm:
+		kind := "request"
+		if tpdu[1]&0xf0 == x224ConnectionConfirm {
+			kind = "confirm"
+		}
+		log.count("COTP connection " + kind)
+		line := "COTP connection " + kind
+		if li >= 6 {
+			if tsap := s7CalledTSAP(tpdu[7 : 1+li]); tsap != "" {
+				line += " to " + tsap
+				log.set("plc", tsap)
+			}
+		}
+		log.add("%s", line)
+		if log.summary == "" && log.facts["plc"] != "" {
+			log.summary = "S7comm connection to " + log.facts["plc"]
+		}
+		return
+	case x224Data:
+	default:
+		log.count("other TPDU")
+		return
+	}
+
+	pdu := tpdu[1+li:]
+	if len(pdu) == 0 {
+		return
+	}
+	if pdu[0] == s7PlusID {
+		log.count("S7comm-plus")
+		if log.facts["plus"] == "" {
+			log.add("S7comm-plus messages follow")
+			log.set("plus", "yes")
+		}
+		return
+	}
+	if pdu[0] != s7ProtocolID || len(pdu) < 10 {
+		log.count("other data")
+		return
+	}
+
+	rosctr, ref := pdu[1], binary.BigEndian.Uint16(pdu[4:])
+	paramLen, dataLen := int(binary.BigEndian.Uint16(pdu[6:])), int(binary.BigEndian.Uint16(pdu[8:]))
+	headerLen := 10
+	if rosctr == s7Ack || rosctr == s7AckData {
+		headerLen = 12
+	}
+	if len(pdu) < headerLen+paramLen {
+		log.add("#%d truncated S7comm PDU", ref)
+		return
+	}
+	param := pdu[headerLen : headerLen+paramLen]
+	data := pdu[headerLen+paramLen : min(len(pdu), headerLen+paramLen+dataLen)]
+	if rosctr == s7UserData {
+		log.count("userdata")
+		return
+	}
+	if len(param) == 0 {
+		return
+	}
+	fn := param[0]
+	name, ok := s7Functions[fn]
+	if !ok {
+		name = fmt.Sprintf("function 0x%02x", fn)
+	}
+	key := fmt.Sprintf("req:%d", ref)
+
+	if rosctr != s7Job {
+		line := fmt.Sprintf("#%d %s response", ref, name)
+		if pdu[10] != 0 || pdu[11] != 0 {
+			line += fmt.Sprintf(": error class 0x%02x code 0x%02x", pdu[10], pdu[11])
+			delete(log.facts, key)
+		} else {
+			switch fn {
+			case s7ReadVar:
+				addrs := strings.Split(log.facts[key], "|")
+				delete(log.facts, key)
+				count := len(addrs)
+				if len(param) >= 2 {
+					count = int(param[1])
+				}
+				line += " " + strings.Join(s7ReadResults(addrs, data, count), ", ")
+			case s7WriteVar:
+				var results []string
+				for _, code := range data {
+					results = append(results, s7ReturnCode(code))
+				}
+				line += ": " + strings.Join(results, ", ")
+			case s7SetupComm:
+				if len(param) >= 8 {
+					line += fmt.Sprintf(": PDU size %d", binary.BigEndian.Uint16(param[6:]))
+				}
+			}
+		}
+		log.add("%s", line)
+		return
+	}
+
+	log.count(name)
+	desc := name
+	switch fn {
+	case s7ReadVar, s7WriteVar:
+		addrs := s7Items(param)
+		if fn == s7ReadVar {
+			desc += " " + strings.Join(addrs, ", ")
+			log.set(key, strings.Join(addrs, "|"))
+		} else {
+			desc += " " + strings.Join(s7WriteValues(addrs, data), ", ")
+		}
+	case s7PIService:
+		if service := s7PIServiceName(param); service != "" {
+			desc += " " + service
+		}
+	case s7SetupComm:
+		if len(param) >= 8 {
+			desc += fmt.Sprintf(", PDU size %d", binary.BigEndian.Uint16(param[6:]))
+		}
+	}
+	log.add("#%d %s", ref, desc)
+	if fn != s7SetupComm {
+		log.request(ProtocolS7comm, desc, s7Writes[fn])
+	}
+}
+
+// s7CalledTSAP reads the rack and slot from the called TSAP parameter of a
+// COTP connection request or confirm
+func s7CalledTSAP(params []byte) string {
+	for len(params) >= 2 && 2+int(params[1]) <= len(params) {
+		code, value := params[0], params[2:2+int(params[1])]
+		if code == 0xc2 && len(value) == 2 {
+			return fmt.Sprintf("rack %d slot %d", value[1]>>5, value[1]&0x1f)
+		}
+		params = params[2+len(value):]
+	}
+	return ""
+}
+
+// s7Items formats the variable addresses of a Read Var or Write Var job,
+// e.g. DB1.DBW10 or M0.1
+func s7Items(param []byte) []string {
+	if len(param) < 2 {
+		return nil
+	}
+	count, items := int(param[1]), param[2:]
+	var addrs []string
+	for i := 0; i < count && len(items) >= 2; i++ {
+		size := 2 + int(items[1])
+		if size > len(items) {
+			break
+		}
+		item := items[:size]
+		items = items[size:]
+		if item[0] != 0x12 || size != 12 || item[2] != 0x10 {
+			addrs = append(addrs, "item")
+			continue
+		}
+		addrs = append(addrs, s7Address(item))
+	}
+	return addrs
+}
+
+// s7Address formats an S7ANY address item
+func s7Address(item []byte) string {
+	size := "B"
+	switch item[3] { // Transport size
+	case 1:
+		size = "X"
+	case 4, 5:
+		size = "W"
+	case 6, 7, 8:
+		size = "D"
+	}
+	count := binary.BigEndian.Uint16(item[4:])
+	db := binary.BigEndian.Uint16(item[6:])
+	area := item[8]
+	addr := int(item[9])<<16 | int(item[10])<<8 | int(item[11])
+
+	prefix, known := s7Areas[area]
+	bit := size == "X" && known && area != 0x1c && area != 0x1d
+	var ref string
+	switch {
+	case !known:
+		ref = fmt.Sprintf("area 0x%02x %d", area, addr>>3)
+	case area == 0x1c || area == 0x1d: // Counters and timers are numbered
+		ref = fmt.Sprintf("%s%d", prefix, addr)
+	case area == 0x84 || area == 0x85:
+		ref = fmt.Sprintf("%s%d.%s%s%d", prefix, db, prefix, size, addr>>3)
+	case bit:
+		ref = fmt.Sprintf("%s%d", prefix, addr>>3)
+	default:
+		ref = fmt.Sprintf("%s%s%d", prefix, size, addr>>3)
+	}
+	if bit {
+		ref += fmt.Sprintf(".%d", addr&7)
+	}
+	if count > 1 {
+		ref += fmt.Sprintf("[%d]", count)
+	}
+	return ref
+}
+
+// s7DataItems splits the data items of a Read Var response or Write Var
+// job into return codes, transport sizes and values
+func s7DataItems(data []byte, count int) (codes, sizes []byte, values [][]byte) {
+	for i := 0; i < count && len(data) >= 4; i++ {
+		code, size := data[0], data[1]
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if size == 3 || size == 4 || size == 5 { // Lengths in bits
+			n = (n + 7) / 8
+		}
+		if 4+n > len(data) {
+			n = len(data) - 4
+		}
+		codes, sizes, values = append(codes, code), append(sizes, size), append(values, data[4:4+n])
+		data = data[4+n:]
+		if n%2 == 1 && len(data) > 0 { // Items other than the last are padded
+			data = data[1:]
+		}
+	}
+	return codes, sizes, values
+}
+
+// s7WriteValues pairs the addresses of a Write Var job with their values
+func s7WriteValues(addrs []string, data []byte) []string {
+	_, sizes, values := s7DataItems(data, len(addrs))
+	parts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		parts[i] = addr
+		if i < len(values) {
+			parts[i] += "=" + s7Value(sizes[i], values[i])
+		}
+	}
+	return parts
+}
+
+// s7ReadResults pairs the addresses of a Read Var job with the values or
+// errors of its response
+func s7ReadResults(addrs []string, data []byte, count int) []string {
+	codes, sizes, values := s7DataItems(data, count)
+	parts := make([]string, len(codes))
+	for i := range codes {
+		addr := "item"
+		if i < len(addrs) && addrs[i] != "" {
+			addr = addrs[i]
+		}
+		if codes[i] != 0xff {
+			parts[i] = addr + ": " + s7ReturnCode(codes[i])
+			continue
+		}
+		parts[i] = addr + "=" + s7Value(sizes[i], values[i])
+	}
+	return parts
+}
+
+// s7Value formats a data item by its transport size and length
+func s7Value(size byte, b []byte) string {
+	switch {
+	case size == 3 && len(b) == 1: // Bit
+		return fmt.Sprint(b[0] & 1)
+	case size == 7 && len(b) == 4: // Real
+		return fmt.Sprint(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case len(b) == 1:
+		return fmt.Sprint(b[0])
+	case len(b) == 2:
+		return fmt.Sprint(binary.BigEndian.Uint16(b))
+	case len(b) == 4:
+		return fmt.Sprint(binary.BigEndian.Uint32(b))
+	}
+	return octetString(b)
+}
+
+// s7ReturnCode names a data item return code
+func s7ReturnCode(code byte) string {
+	if name, ok := s7ReturnCodes[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("code 0x%02x", code)
+}
+
+// s7PIServiceName reads the service name of a PI service job, e.g.
+// _INSE (activate a block) or P_PROGRAM (start the PLC)
+func s7PIServiceName(param []byte) string {
+	if len(param) < 10 {
+		return ""
+	}
+	off := 10 + int(binary.BigEndian.Uint16(param[8:]))
+	if off >= len(param) {
+		return ""
+	}
+	n := int(param[off])
+	if off+1+n > len(param) {
+		return ""
+	}
+	return string(param[off+1 : off+1+n])
+}
@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// s7PDU wraps an S7comm PDU in a COTP data TPDU and a TPKT. Acknowledgements
+// carry an error class and code after the header.
+func s7PDU(rosctr byte, ref uint16, errCode []byte, param, data []byte) []byte {
+	pdu := []byte{s7ProtocolID, rosctr, 0, 0}
+	pdu = binary.BigEndian.AppendUint16(pdu, ref)
+	pdu = binary.BigEndian.AppendUint16(pdu, uint16(len(param)))
+	pdu = binary.BigEndian.AppendUint16(pdu, uint16(len(data)))
+	pdu = append(append(append(pdu, errCode...), param...), data...)
+	msg := binary.BigEndian.AppendUint16([]byte{3, 0}, uint16(7+len(pdu)))
+	return append(append(msg, 2, x224Data, 0x80), pdu...)
+}
+
+// s7Item builds an S7ANY address item
+func s7Item(transport byte, db uint16, area byte, bitAddr int) []byte {
+	item := []byte{0x12, 0x0a, 0x10, transport, 0x00, 0x01}
+	item = binary.BigEndian.AppendUint16(item, db)
+	return append(item, area, byte(bitAddr>>16), byte(bitAddr>>8), byte(bitAddr))
+}
+
+func TestDecodeS7comm(t *testing.T) {
+	ok := []byte{0, 0}
+	connect := tpkt(x224ConnectionRequest, []byte{0xc1, 0x02, 0x01, 0x00, 0xc2, 0x02, 0x01, 0x02, 0xc0, 0x01, 0x0a})
+	setup := []byte{s7SetupComm, 0x00, 0x00, 0x01, 0x00, 0x01, 0x01, 0xe0}
+	readDB := append([]byte{s7ReadVar, 1}, s7Item(0x04, 1, 0x84, 10*8)...)
+	writeM := append([]byte{s7WriteVar, 1}, s7Item(0x01, 0, 0x83, 1*8+1)...)
+	stop := append([]byte{0x29, 0, 0, 0, 0, 0, 9}, "P_PROGRAM"...)
+
+	log := decodeAll(decodeS7comm,
+		message{connect, true},
+		message{s7PDU(s7Job, 1, nil, setup, nil), true},
+		message{s7PDU(s7AckData, 1, ok, setup, nil), false},
+		message{s7PDU(s7Job, 2, nil, readDB, nil), true},
+		message{s7PDU(s7AckData, 2, ok, []byte{s7ReadVar, 1}, []byte{0xff, 0x04, 0x00, 0x10, 0x00, 0x2a}), false},
+	)
+	if log.writes != 0 || log.summary != "S7comm Read Var DB1.DBW10" {
+		t.Errorf("after a read: %d writes, summary %q", log.writes, log.summary)
+	}
+
+	for _, m := range []message{
+		{s7PDU(s7Job, 3, nil, writeM, []byte{0x00, 0x03, 0x00, 0x01, 0x01}), true},
+		{s7PDU(s7AckData, 3, ok, []byte{s7WriteVar, 1}, []byte{0xff}), false},
+		{s7PDU(s7Job, 4, nil, readDB, nil), true},
+		{s7PDU(s7Job, 5, nil, stop, nil), true},
+		{s7PDU(s7AckData, 5, []byte{0x81, 0x04}, []byte{0x29}, nil), false},
+	} {
+		decodeS7comm(log, m.data, m.fromClient)
+	}
+	checkLog(t, log, []string{
+		"COTP connection request to rack 0 slot 2",
+		"#1 Setup Communication, PDU size 480",
+		"#1 Setup Communication response: PDU size 480",
+		"#2 Read Var DB1.DBW10",
+		"#2 Read Var response DB1.DBW10=42",
+		"#3 Write Var M1.1=1",
+		"#3 Write Var response: success",
+		"#4 Read Var DB1.DBW10",
+		"#5 PLC Stop",
+		"#5 PLC Stop response: error class 0x81 code 0x04",
+	}, "S7comm PLC Stop")
+	if log.writes != 2 {
+		t.Errorf("got %d writes, want Write Var and PLC Stop", log.writes)
+	}
+}
+
+func TestDecodeS7commConnection(t *testing.T) {
+	log := decodeAll(decodeS7comm,
+		message{tpkt(x224ConnectionRequest, []byte{0xc2, 0x02, 0x01, 0x21}), true},
+		message{tpkt(x224Data, nil)[:7], true},
+	)
+	checkLog(t, log, []string{"COTP connection request to rack 1 slot 1"}, "S7comm connection to rack 1 slot 1")
+
+	plus := binary.BigEndian.AppendUint16([]byte{3, 0}, 11)
+	plus = append(plus, 2, x224Data, 0x80, s7PlusID, 0x01, 0x00, 0x00)
+	log = decodeAll(decodeS7comm, message{plus, true}, message{plus, true})
+	checkLog(t, log, []string{"S7comm-plus messages follow"}, "")
+	if log.counts["S7comm-plus"] != 2 || log.writes != 0 {
+		t.Errorf("got counts %v and %d writes", log.counts, log.writes)
+	}
+}
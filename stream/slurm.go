@@ -0,0 +1,192 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Slurm message header layout. Each message is preceded by its length, and
+// the body ends the message, after the header and authentication credential.
+const (
+	slurmMinHeaderLen = 12
+	slurmRCBodyLen    = 4 // RESPONSE_SLURM_RC: a return code
+)
+
+// Message types whose bodies are read
+const (
+	slurmResponseRC    = 8001
+	slurmResponseRCMsg = 8002
+)
+
+// slurmReleases maps the major byte of protocol versions to Slurm releases
+var slurmReleases = map[byte]string{
+	31: "17.02", 32: "17.11", 33: "18.08", 34: "19.05", 35: "20.02", 36: "20.11", 37: "21.08",
+	38: "22.05", 39: "23.02", 40: "23.11", 41: "24.05", 42: "24.11", 43: "25.05", 44: "25.11",
+}
+
+// slurmMessages names the common RPC message types
+var slurmMessages = map[uint16]string{
+	1001: "REQUEST_NODE_REGISTRATION_STATUS", 1002: "MESSAGE_NODE_REGISTRATION_STATUS",
+	1003: "REQUEST_RECONFIGURE", 1004: "REQUEST_RECONFIGURE_WITH_CONFIG", 1005: "REQUEST_SHUTDOWN",
+	1008: "REQUEST_PING", 1009: "REQUEST_CONTROL", 1010: "REQUEST_SET_DEBUG_LEVEL",
+	1011: "REQUEST_HEALTH_CHECK", 1012: "REQUEST_TAKEOVER", 1015: "REQUEST_REBOOT_NODES",
+	1016: "RESPONSE_PING_SLURMD", 1017: "REQUEST_ACCT_GATHER_UPDATE", 1018: "RESPONSE_ACCT_GATHER_UPDATE",
+	1019: "REQUEST_ACCT_GATHER_ENERGY", 1020: "RESPONSE_ACCT_GATHER_ENERGY", 1021: "REQUEST_LICENSE_INFO",
+	1022: "RESPONSE_LICENSE_INFO", 1024: "RESPONSE_NODE_REGISTRATION",
+
+	2001: "REQUEST_BUILD_INFO", 2002: "RESPONSE_BUILD_INFO", 2003: "REQUEST_JOB_INFO",
+	2004: "RESPONSE_JOB_INFO", 2005: "REQUEST_JOB_STEP_INFO", 2006: "RESPONSE_JOB_STEP_INFO",
+	2007: "REQUEST_NODE_INFO", 2008: "RESPONSE_NODE_INFO", 2009: "REQUEST_PARTITION_INFO",
+	2010: "RESPONSE_PARTITION_INFO", 2013: "REQUEST_JOB_ID", 2014: "RESPONSE_JOB_ID",
+	2015: "REQUEST_CONFIG", 2016: "RESPONSE_CONFIG", 2021: "REQUEST_JOB_INFO_SINGLE",
+	2022: "REQUEST_SHARE_INFO", 2023: "RESPONSE_SHARE_INFO", 2024: "REQUEST_RESERVATION_INFO",
+	2025: "RESPONSE_RESERVATION_INFO", 2026: "REQUEST_PRIORITY_FACTORS", 2027: "RESPONSE_PRIORITY_FACTORS",
+	2028: "REQUEST_TOPO_INFO", 2029: "RESPONSE_TOPO_INFO", 2035: "REQUEST_STATS_INFO",
+	2036: "RESPONSE_STATS_INFO", 2039: "REQUEST_JOB_USER_INFO", 2040: "REQUEST_NODE_INFO_SINGLE",
+
+	3001: "REQUEST_UPDATE_JOB", 3002: "REQUEST_UPDATE_NODE",
+
+	4001: "REQUEST_RESOURCE_ALLOCATION", 4002: "RESPONSE_RESOURCE_ALLOCATION",
+	4003: "REQUEST_SUBMIT_BATCH_JOB", 4004: "RESPONSE_SUBMIT_BATCH_JOB", 4005: "REQUEST_BATCH_JOB_LAUNCH",
+
+	5001: "REQUEST_JOB_STEP_CREATE", 5002: "RESPONSE_JOB_STEP_CREATE", 5005: "REQUEST_CANCEL_JOB_STEP",
+	5016: "REQUEST_STEP_COMPLETE", 5017: "REQUEST_COMPLETE_JOB_ALLOCATION", 5018: "REQUEST_COMPLETE_BATCH_SCRIPT",
+
+	6001: "REQUEST_LAUNCH_TASKS", 6002: "RESPONSE_LAUNCH_TASKS", 6003: "MESSAGE_TASK_EXIT",
+	6004: "REQUEST_SIGNAL_TASKS", 6006: "REQUEST_TERMINATE_TASKS", 6007: "REQUEST_REATTACH_TASKS",
+	6008: "RESPONSE_REATTACH_TASKS", 6009: "REQUEST_KILL_TIMELIMIT", 6011: "REQUEST_TERMINATE_JOB",
+	6012: "MESSAGE_EPILOG_COMPLETE", 6013: "REQUEST_ABORT_JOB", 6014: "REQUEST_FILE_BCAST",
+	6016: "REQUEST_KILL_PREEMPTED", 6017: "REQUEST_LAUNCH_PROLOG", 6018: "REQUEST_COMPLETE_PROLOG",
+	6019: "RESPONSE_PROLOG_EXECUTING",
+
+	7001: "SRUN_PING", 7002: "SRUN_TIMEOUT", 7003: "SRUN_NODE_FAIL", 7004: "SRUN_JOB_COMPLETE",
+	7005: "SRUN_USER_MSG", 7007: "SRUN_STEP_MISSING", 7008: "SRUN_REQUEST_SUSPEND",
+	7009: "SRUN_STEP_SIGNAL", 7010: "SRUN_NET_FORWARD",
+
+	8001: "RESPONSE_SLURM_RC", 8002: "RESPONSE_SLURM_RC_MSG", 8003: "RESPONSE_SLURM_REROUTE_MSG",
+	9001:  "RESPONSE_FORWARD_FAILED",
+	10001: "ACCOUNTING_UPDATE_MSG", 10002: "ACCOUNTING_FIRST_REG", 10003: "ACCOUNTING_REGISTER_CTLD",
+	11001: "MESSAGE_COMPOSITE", 11002: "RESPONSE_MESSAGE_COMPOSITE",
+}
+
+// slurmKinds groups message types by what they are used for
+var slurmKinds = map[uint16]string{
+	1001: "heartbeat", 1002: "heartbeat", 1008: "heartbeat", 1011: "heartbeat", 1016: "heartbeat",
+	1017: "heartbeat", 1018: "heartbeat", 1024: "heartbeat", 7001: "heartbeat",
+
+	4005: "launch", 6001: "launch", 6002: "launch", 6017: "launch",
+
+	4001: "job control", 4003: "job control", 5001: "job control", 5005: "job control",
+	6004: "job control", 6006: "job control", 6011: "job control", 6013: "job control",
+	3001: "job control",
+
+	2001: "query", 2003: "query", 2005: "query", 2007: "query", 2009: "query", 2013: "query",
+	2015: "query", 2021: "query", 2022: "query", 2024: "query", 2026: "query", 2028: "query",
+	2035: "query", 2039: "query", 2040: "query",
+}
+
+// frameSlurm frames Slurm RPCs by their four-byte length prefix. Anything
+// without a plausible protocol version after it, such as TLS, ends the
+// framing.
+func frameSlurm(data []byte) (int, int) {
+	if len(data) < 6 {
+		return 0, 0
+	}
+	n := binary.BigEndian.Uint32(data)
+	if n < slurmMinHeaderLen || n > maxStreamData || !slurmVersion(binary.BigEndian.Uint16(data[4:])) {
+		return -1, 0
+	}
+	return 4 + int(n), 4
+}
+
+// slurmVersion reports whether v looks like a protocol version, whose low
+// byte is zero
+func slurmVersion(v uint16) bool {
+	return v&0xff == 0 && v>>8 >= 30 && v>>8 <= 60
+}
+
+// decodeSlurm decodes the header of a Slurm RPC: protocol version, message
+// type, body length and message forwarding. Only return codes are read
+// from bodies, which follow the authentication credential.
+func decodeSlurm(log *messageLog, msg []byte, fromClient bool) {
+	typ, bodyLen, forwards, ok := slurmHeader(msg)
+	if !ok {
+		log.add("Malformed Slurm header (%d bytes)", len(msg))
+		return
+	}
+	version := binary.BigEndian.Uint16(msg)
+
+	release, known := slurmReleases[byte(version>>8)]
+	if !known {
+		release = fmt.Sprintf("protocol 0x%04x", version)
+	}
+	log.set("release", release)
+
+	name, known := slurmMessages[typ]
+	if !known {
+		name = fmt.Sprintf("message type %d", typ)
+	}
+	if kind := slurmKinds[typ]; kind != "" {
+		name += " (" + kind + ")"
+	}
+	log.count(name)
+
+	line := fmt.Sprintf("%s, body %d bytes", name, bodyLen)
+	if forwards > 0 {
+		line += fmt.Sprintf(", forwarded to %d nodes", forwards)
+	}
+	if (typ == slurmResponseRC || typ == slurmResponseRCMsg) && bodyLen >= slurmRCBodyLen && bodyLen <= len(msg) {
+		rc := int32(binary.BigEndian.Uint32(msg[len(msg)-bodyLen:]))
+		line += fmt.Sprintf(", rc=%d", rc)
+		name += fmt.Sprintf(" rc=%d", rc)
+	}
+	log.add("%s", line)
+
+	key := "response"
+	if fromClient {
+		key = "request"
+		log.count("requests")
+	}
+	if _, seen := log.facts[key]; !seen {
+		log.set(key, name)
+	}
+	log.summary = slurmSummary(log)
+}
+
+// slurmHeader reads the message type, body length and forward count of a
+// header. Older releases send a message index before the type, so the
+// layout whose type is known and whose body fits is used.
+func slurmHeader(msg []byte) (typ uint16, bodyLen, forwards int, ok bool) {
+	if len(msg) < slurmMinHeaderLen {
+		return 0, 0, 0, false
+	}
+	read := func(off int) (uint16, int, int) {
+		return binary.BigEndian.Uint16(msg[off:]), int(binary.BigEndian.Uint32(msg[off+2:])), int(binary.BigEndian.Uint16(msg[off+6:]))
+	}
+	for _, off := range []int{4, 6} {
+		if off+8 > len(msg) {
+			break
+		}
+		typ, bodyLen, forwards = read(off)
+		if _, known := slurmMessages[typ]; known && bodyLen <= len(msg)-off-8 {
+			return typ, bodyLen, forwards, true
+		}
+	}
+	typ, bodyLen, forwards = read(4)
+	return typ, bodyLen, forwards, bodyLen <= len(msg)-slurmMinHeaderLen
+}
+
+// slurmSummary names the connection's first RPC and its reply
+func slurmSummary(log *messageLog) string {
+	summary := "Slurm " + log.facts["release"]
+	if req := log.facts["request"]; req != "" {
+		summary += " " + req
+	}
+	if resp := log.facts["response"]; resp != "" {
+		summary += " → " + resp
+	}
+	if n := log.counts["requests"]; n > 1 {
+		summary += fmt.Sprintf(" (+%d more RPCs)", n-1)
+	}
+	return summary
+}
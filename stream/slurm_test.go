@@ -0,0 +1,35 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeSlurmShortMessage(t *testing.T) {
+	for _, msg := range [][]byte{{}, {0x2a}} {
+		log := &messageLog{}
+		decodeSlurm(log, msg, true)
+		if len(log.lines) != 1 || !strings.HasPrefix(log.lines[0], "Malformed Slurm header") {
+			t.Errorf("%d bytes: got lines %q, want a malformed header", len(msg), log.lines)
+		}
+	}
+}
+
+func TestDecodeDatagramSkipsStreamOnlyProtocols(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, protocol := range []StreamProtocol{ProtocolSlurm, ProtocolModbus, ProtocolS7comm, ProtocolMQTT} {
+		s := &Stream{Protocol: protocol}
+		s.decodeDatagram([]byte{0x2a}, true, now)
+		if len(s.msgs.lines) != 0 {
+			t.Errorf("%s: decoded a datagram: %q", protocol, s.msgs.lines)
+		}
+	}
+
+	// Framed protocols that also run over UDP still decode datagrams
+	s := &Stream{Protocol: ProtocolSyslog}
+	s.decodeDatagram([]byte("<34>Oct 11 22:14:15 host su: test"), true, now)
+	if len(s.msgs.lines) == 0 {
+		t.Error("syslog datagram was not decoded")
+	}
+}
@@ -0,0 +1,279 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"go-etherape/capture"
+)
+
+// SMB2 header layout
+const (
+	smb2HeaderLen     = 64
+	smb2FlagResponse  = 0x1
+	smbMaxCompounded  = 32
+	smbSessionMessage = 0x00 // NetBIOS session service message type of SMB data
+)
+
+// SMB2 commands with decoded bodies
+const (
+	smb2Negotiate    = 0
+	smb2SessionSetup = 1
+	smb2TreeConnect  = 3
+)
+
+// smb2Commands names the SMB2 command codes
+var smb2Commands = [...]string{
+	"NEGOTIATE", "SESSION_SETUP", "LOGOFF", "TREE_CONNECT", "TREE_DISCONNECT",
+	"CREATE", "CLOSE", "FLUSH", "READ", "WRITE", "LOCK", "IOCTL", "CANCEL",
+	"ECHO", "QUERY_DIRECTORY", "CHANGE_NOTIFY", "QUERY_INFO", "SET_INFO", "OPLOCK_BREAK",
+}
+
+// smbDialects names the SMB2/3 dialect revisions
+var smbDialects = map[uint16]string{
+	0x0202: "2.0.2", 0x0210: "2.1", 0x02ff: "2.???", 0x0300: "3.0", 0x0302: "3.0.2", 0x0311: "3.1.1",
+}
+
+// smbStatuses names the NT status codes seen in session and tree setup
+var smbStatuses = map[uint32]string{
+	0x00000000: "STATUS_SUCCESS",
+	0xc0000016: "STATUS_MORE_PROCESSING_REQUIRED",
+	0xc0000022: "STATUS_ACCESS_DENIED",
+	0xc0000064: "STATUS_NO_SUCH_USER",
+	0xc000006d: "STATUS_LOGON_FAILURE",
+	0xc0000071: "STATUS_PASSWORD_EXPIRED",
+	0xc0000072: "STATUS_ACCOUNT_DISABLED",
+	0xc00000bb: "STATUS_NOT_SUPPORTED",
+	0xc00000cc: "STATUS_BAD_NETWORK_NAME",
+	0xc000015b: "STATUS_LOGON_TYPE_NOT_GRANTED",
+	0xc0000203: "STATUS_USER_SESSION_DELETED",
+	0xc000035c: "STATUS_NETWORK_SESSION_EXPIRED",
+}
+
+// smbShareTypes names the ShareType of tree connect responses
+var smbShareTypes = map[byte]string{1: "disk", 2: "pipe", 3: "print"}
+
+// frameNetBIOS frames the NetBIOS session service, and SMB's direct TCP
+// transport, which share a four-byte header with the message length
+func frameNetBIOS(data []byte) (int, int) {
+	if len(data) < 4 {
+		return 0, 0
+	}
+	switch data[0] {
+	case smbSessionMessage, 0x81, 0x82, 0x83, 0x84, 0x85: // Message, session request/responses, keepalive
+	default:
+		return -1, 0
+	}
+	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if n > maxStreamData {
+		return -1, 0
+	}
+	return 4 + n, 4
+}
+
+// decodeSMB decodes SMB2/3 negotiation, session setup and tree connects,
+// and counts every other command. Encrypted SMB3 messages are only counted.
+func decodeSMB(log *messageLog, msg []byte, fromClient bool) {
+	if len(msg) < 4 || !bytes.Equal(msg[1:4], []byte("SMB")) {
+		return // NetBIOS session setup or keepalive
+	}
+	switch msg[0] {
+	case 0xfe:
+		for i := 0; i < smbMaxCompounded && len(msg) >= smb2HeaderLen; i++ {
+			next := int(binary.LittleEndian.Uint32(msg[20:]))
+			body := msg[smb2HeaderLen:]
+			if next >= smb2HeaderLen && next <= len(msg) {
+				body = msg[smb2HeaderLen:next]
+			}
+			decodeSMB2(log, msg, body)
+			if next < smb2HeaderLen || next >= len(msg) {
+				break
+			}
+			msg = msg[next:]
+		}
+	case 0xfd:
+		log.count("encrypted")
+		if log.facts["encrypted"] == "" {
+			log.add("Encrypted SMB3 messages follow")
+			log.set("encrypted", "yes")
+		}
+	case 0xfc:
+		log.count("compressed")
+	case 0xff:
+		log.count("SMB1")
+		if len(msg) > 9 && msg[4] == 0x72 && msg[9]&0x80 == 0 { // NEGOTIATE, not a reply
+			log.add("SMB1 NEGOTIATE request%s", smb1Dialects(msg))
+		}
+	}
+	log.summary = smbSummary(log)
+}
+
+// decodeSMB2 decodes one SMB2 header and its command body. Offsets in the
+// body are relative to the start of hdr.
+func decodeSMB2(log *messageLog, hdr, body []byte) {
+	if binary.LittleEndian.Uint16(hdr[4:]) != smb2HeaderLen {
+		log.add("Malformed SMB2 header")
+		return
+	}
+	command := binary.LittleEndian.Uint16(hdr[12:])
+	status := binary.LittleEndian.Uint32(hdr[8:])
+	response := binary.LittleEndian.Uint32(hdr[16:])&smb2FlagResponse != 0
+	messageID := binary.LittleEndian.Uint64(hdr[24:])
+
+	name := fmt.Sprintf("command 0x%x", command)
+	if int(command) < len(smb2Commands) {
+		name = smb2Commands[command]
+	}
+	if !response {
+		log.count(name)
+	}
+	statusName := smbStatus(status)
+
+	switch command {
+	case smb2Negotiate:
+		if !response {
+			if len(body) < 36 {
+				break
+			}
+			count := int(binary.LittleEndian.Uint16(body[2:]))
+			var dialects []string
+			for i := 0; i < count && 36+2*i+2 <= len(body); i++ {
+				dialects = append(dialects, smbDialect(binary.LittleEndian.Uint16(body[36+2*i:])))
+			}
+			log.add("NEGOTIATE request dialects %s", strings.Join(dialects, ", "))
+		} else if len(body) >= 6 {
+			dialect := smbDialect(binary.LittleEndian.Uint16(body[4:]))
+			log.add("NEGOTIATE response dialect %s", dialect)
+			log.set("dialect", dialect)
+		}
+	case smb2SessionSetup:
+		if response {
+			log.add("SESSION_SETUP response: %s", statusName)
+			if status != 0xc0000016 {
+				log.set("session", statusName)
+			}
+		}
+	case smb2TreeConnect:
+		key := fmt.Sprintf("tree:%d", messageID)
+		if !response {
+			if len(body) < 8 {
+				break
+			}
+			offset := int(binary.LittleEndian.Uint16(body[4:]))
+			length := int(binary.LittleEndian.Uint16(body[6:]))
+			if offset < smb2HeaderLen || offset+length > len(hdr) {
+				break
+			}
+			path := smbSharePath(utf16LE(hdr[offset : offset+length]))
+			log.add("TREE_CONNECT %s", path)
+			log.set(key, path)
+			break
+		}
+		path := log.facts[key]
+		delete(log.facts, key)
+		if status != 0 {
+			log.add("TREE_CONNECT response %s: %s", path, statusName)
+			break
+		}
+		shareType := "share"
+		if len(body) > 2 {
+			if t, ok := smbShareTypes[body[2]]; ok {
+				shareType = t
+			}
+		}
+		log.add("TREE_CONNECT response %s: %s, tree 0x%x", path, shareType, binary.LittleEndian.Uint32(hdr[36:]))
+		if path != "" {
+			log.set("share", path)
+		}
+	default:
+		if response && status != 0 && smbStatuses[status] != "" {
+			log.add("%s response: %s", name, statusName)
+		}
+	}
+}
+
+// smbSummary describes the dialect, session outcome and latest share
+func smbSummary(log *messageLog) string {
+	summary := "SMB"
+	if dialect := log.facts["dialect"]; dialect != "" {
+		summary += " " + dialect
+	}
+	if session := log.facts["session"]; session != "" && session != "STATUS_SUCCESS" {
+		return summary + " logon failed: " + session
+	}
+	if share := log.facts["share"]; share != "" {
+		summary += " " + share
+	} else {
+		summary += " session"
+	}
+	if log.facts["encrypted"] != "" {
+		summary += " (encrypted)"
+	}
+	return summary
+}
+
+// smbDialect names a dialect revision
+func smbDialect(d uint16) string {
+	if name, ok := smbDialects[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", d)
+}
+
+// smbStatus names an NT status code
+func smbStatus(s uint32) string {
+	if name, ok := smbStatuses[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08x", s)
+}
+
+// smbSharePath anonymizes the server of a \\server\share path, and the
+// share unless it is an administrative one such as IPC$ or C$
+func smbSharePath(path string) string {
+	if capture.CurrentAnonymizer() == nil {
+		return path
+	}
+	parts := strings.Split(strings.TrimPrefix(path, `\\`), `\`)
+	parts[0] = capture.AnonymizeHostname(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if !strings.HasSuffix(parts[i], "$") {
+			parts[i] = capture.AnonymizeName(parts[i])
+		}
+	}
+	return `\\` + strings.Join(parts, `\`)
+}
+
+// smb1Dialects lists the dialect strings of an SMB1 NEGOTIATE request
+func smb1Dialects(msg []byte) string {
+	const wordCountOffset = 32
+	if len(msg) < wordCountOffset+3 {
+		return ""
+	}
+	data := msg[wordCountOffset+3:] // WordCount (0) and ByteCount
+	var dialects []string
+	for len(data) > 1 && data[0] == 0x02 {
+		end := bytes.IndexByte(data[1:], 0)
+		if end < 0 {
+			break
+		}
+		dialects = append(dialects, string(data[1:1+end]))
+		data = data[end+2:]
+	}
+	if len(dialects) == 0 {
+		return ""
+	}
+	return " dialects " + strings.Join(dialects, ", ")
+}
+
+// utf16LE decodes little-endian UTF-16
+func utf16LE(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,113 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// smb2Message builds an SMB2 header followed by body
+func smb2Message(command uint16, status uint32, response bool, messageID uint64, treeID uint32, body []byte) []byte {
+	hdr := make([]byte, smb2HeaderLen)
+	copy(hdr, "\xfeSMB")
+	binary.LittleEndian.PutUint16(hdr[4:], smb2HeaderLen)
+	binary.LittleEndian.PutUint32(hdr[8:], status)
+	binary.LittleEndian.PutUint16(hdr[12:], command)
+	if response {
+		binary.LittleEndian.PutUint32(hdr[16:], smb2FlagResponse)
+	}
+	binary.LittleEndian.PutUint64(hdr[24:], messageID)
+	binary.LittleEndian.PutUint32(hdr[36:], treeID)
+	return append(hdr, body...)
+}
+
+// smb2TreeConnectRequest builds a TREE_CONNECT request for path
+func smb2TreeConnectRequest(messageID uint64, path string) []byte {
+	var name []byte
+	for _, u := range utf16.Encode([]rune(path)) {
+		name = binary.LittleEndian.AppendUint16(name, u)
+	}
+	body := []byte{9, 0, 0, 0}
+	body = binary.LittleEndian.AppendUint16(body, smb2HeaderLen+8)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(name)))
+	return smb2Message(smb2TreeConnect, 0, false, messageID, 0, append(body, name...))
+}
+
+func TestDecodeSMB(t *testing.T) {
+	negotiate := make([]byte, 36)
+	binary.LittleEndian.PutUint16(negotiate, 36)
+	binary.LittleEndian.PutUint16(negotiate[2:], 3)
+	for _, d := range []uint16{0x0202, 0x0300, 0x0311} {
+		negotiate = binary.LittleEndian.AppendUint16(negotiate, d)
+	}
+	negotiated := []byte{65, 0, 1, 0, 0x11, 0x03}
+	setup := []byte{9, 0, 0, 0, 0, 0, 0, 0}
+	connected := []byte{16, 0, 1, 0, 0, 0, 0, 0}
+
+	log := decodeAll(decodeSMB,
+		message{smb2Message(smb2Negotiate, 0, false, 0, 0, negotiate), true},
+		message{smb2Message(smb2Negotiate, 0, true, 0, 0, negotiated), false},
+		message{smb2Message(smb2SessionSetup, 0xc0000016, true, 1, 0, setup), false},
+		message{smb2Message(smb2SessionSetup, 0, true, 2, 0, setup), false},
+		message{smb2TreeConnectRequest(3, `\\fileserver\projects`), true},
+		message{smb2Message(smb2TreeConnect, 0, true, 3, 5, connected), false},
+		message{append([]byte("\xfdSMB"), make([]byte, 48)...), true},
+		message{append([]byte("\xfdSMB"), make([]byte, 48)...), false},
+	)
+	checkLog(t, log, []string{
+		"NEGOTIATE request dialects 2.0.2, 3.0, 3.1.1",
+		"NEGOTIATE response dialect 3.1.1",
+		"SESSION_SETUP response: STATUS_MORE_PROCESSING_REQUIRED",
+		"SESSION_SETUP response: STATUS_SUCCESS",
+		`TREE_CONNECT \\fileserver\projects`,
+		`TREE_CONNECT response \\fileserver\projects: disk, tree 0x5`,
+		"Encrypted SMB3 messages follow",
+	}, `SMB 3.1.1 \\fileserver\projects (encrypted)`)
+	if log.counts["encrypted"] != 2 {
+		t.Errorf("got %d encrypted messages, want 2", log.counts["encrypted"])
+	}
+}
+
+func TestDecodeSMBLogonFailure(t *testing.T) {
+	log := decodeAll(decodeSMB,
+		message{smb2Message(smb2Negotiate, 0, true, 0, 0, []byte{65, 0, 1, 0, 0x02, 0x02}), false},
+		message{smb2Message(smb2SessionSetup, 0xc000006d, true, 1, 0, []byte{9, 0, 0, 0}), false},
+	)
+	checkLog(t, log, []string{
+		"NEGOTIATE response dialect 2.0.2",
+		"SESSION_SETUP response: STATUS_LOGON_FAILURE",
+	}, "SMB 2.0.2 logon failed: STATUS_LOGON_FAILURE")
+}
+
+func TestDecodeSMBCompounded(t *testing.T) {
+	// CREATE, READ and CLOSE chained with NextCommand
+	var msg []byte
+	for i, command := range []uint16{5, 8, 6} {
+		m := smb2Message(command, 0, false, uint64(10+i), 5, make([]byte, 8))
+		if i < 2 {
+			binary.LittleEndian.PutUint32(m[20:], uint32(len(m)))
+		}
+		msg = append(msg, m...)
+	}
+	log := decodeAll(decodeSMB, message{msg, true})
+	for _, name := range []string{"CREATE", "READ", "CLOSE"} {
+		if log.counts[name] != 1 {
+			t.Errorf("got counts %v, want one each of CREATE, READ and CLOSE", log.counts)
+			break
+		}
+	}
+
+	// A header with the wrong structure size
+	bad := smb2Message(5, 0, false, 0, 0, nil)
+	bad[4] = 0
+	checkLog(t, decodeAll(decodeSMB, message{bad, true}), []string{"Malformed SMB2 header"}, "SMB session")
+}
+
+func TestFrameNetBIOS(t *testing.T) {
+	if size, header := frameNetBIOS([]byte{0x00, 0x00, 0x01, 0x00, 0xfe}); size != 0x104 || header != 4 {
+		t.Errorf("frameNetBIOS = %d, %d; want 260, 4", size, header)
+	}
+	if size, _ := frameNetBIOS([]byte{0x16, 0x03, 0x01, 0x00}); size != -1 {
+		t.Errorf("TLS record framed as NetBIOS: %d", size)
+	}
+}
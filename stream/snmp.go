@@ -0,0 +1,246 @@
+package stream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go-etherape/capture"
+)
+
+// maxSNMPVarBinds is the number of variable bindings shown per message
+const maxSNMPVarBinds = 8
+
+// snmpVersions names the version field's values
+var snmpVersions = map[int64]string{0: "v1", 1: "v2c", 3: "v3"}
+
+// snmpPDUs names the context-specific PDU tags
+var snmpPDUs = [...]string{
+	"get-request", "get-next-request", "get-response", "set-request", "trap",
+	"get-bulk-request", "inform-request", "snmpV2-trap", "report",
+}
+
+// snmpErrors names the error-status values
+var snmpErrors = [...]string{
+	"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr",
+	"noAccess", "wrongType", "wrongLength", "wrongEncoding", "wrongValue",
+	"noCreation", "inconsistentValue", "resourceUnavailable", "commitFailed",
+	"undoFailed", "authorizationError", "notWritable", "inconsistentName",
+}
+
+// snmpTrapOID is the varbind naming the notification in v2 traps and informs
+const snmpTrapOID = "1.3.6.1.6.3.1.1.4.1.0"
+
+// decodeSNMP decodes an SNMP message: version, community or v3 user, PDU
+// type and the OIDs it names
+func decodeSNMP(log *messageLog, msg []byte, fromClient bool) {
+	top, _, ok := readBER(msg)
+	fields := top.children()
+	if !ok || len(fields) < 3 || !fields[0].is(berUniversal, berInteger) {
+		log.add("Malformed SNMP message (%d bytes)", len(msg))
+		return
+	}
+	version, known := snmpVersions[fields[0].int()]
+	if !known {
+		version = fmt.Sprintf("version %d", fields[0].int())
+	}
+
+	var who string
+	var pdu berElement
+	if fields[0].int() == 3 {
+		// msgGlobalData, msgSecurityParameters (holding the USM header)
+		// and the ScopedPDU, which is an OCTET STRING when encrypted
+		if len(fields) < 4 {
+			log.add("%s truncated message", version)
+			return
+		}
+		who = "user " + snmpUser(fields[2])
+		scoped := fields[3]
+		if !scoped.is(berUniversal, berSequence) {
+			log.add("%s encrypted PDU, %s", version, who)
+			log.count("encrypted")
+			log.summary = fmt.Sprintf("SNMPv3 encrypted, %s", who)
+			return
+		}
+		parts := scoped.children()
+		if len(parts) < 3 {
+			log.add("%s truncated scoped PDU, %s", version, who)
+			return
+		}
+		pdu = parts[2]
+	} else {
+		who = fmt.Sprintf("community %q", capture.AnonymizeName(string(fields[1].body)))
+		pdu = fields[2]
+	}
+
+	if pdu.class != berContext || pdu.tag >= len(snmpPDUs) {
+		log.add("%s unknown PDU type %d, %s", version, pdu.tag, who)
+		return
+	}
+	typ := snmpPDUs[pdu.tag]
+	log.count(typ)
+
+	if typ == "trap" {
+		decodeSNMPv1Trap(log, pdu, version, who)
+		return
+	}
+	parts := pdu.children()
+	if len(parts) < 4 {
+		log.add("%s %s truncated, %s", version, typ, who)
+		return
+	}
+	requestID := parts[0].int()
+	bindings := snmpVarBinds(parts[3], typ == "get-response" || strings.Contains(typ, "trap") || typ == "inform-request" || typ == "set-request" || typ == "report")
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %s #%d %s", version, typ, requestID, who)
+	if status := parts[1].int(); typ != "get-bulk-request" && status != 0 {
+		name := strconv.FormatInt(status, 10)
+		if status > 0 && status < int64(len(snmpErrors)) {
+			name = snmpErrors[status]
+		}
+		fmt.Fprintf(&line, " error %s at %d", name, parts[2].int())
+	}
+	if len(bindings) > 0 {
+		line.WriteString(": ")
+		line.WriteString(strings.Join(bindings, ", "))
+	}
+	log.add("%s", line.String())
+
+	switch {
+	case typ == "snmpV2-trap" || typ == "inform-request":
+		notification := "notification"
+		for _, vb := range parts[3].children() {
+			if pair := vb.children(); len(pair) == 2 && pair[0].oid() == snmpTrapOID {
+				notification = pair[1].oid()
+			}
+		}
+		log.summary = fmt.Sprintf("SNMP%s %s %s", version, typ, notification)
+	case typ != "get-response" && typ != "report", log.summary == "":
+		log.summary = fmt.Sprintf("SNMP%s %s %s%s", version, typ, who, snmpOIDSummary(parts[3]))
+	}
+}
+
+// decodeSNMPv1Trap decodes the SNMPv1 Trap-PDU, which has its own layout
+func decodeSNMPv1Trap(log *messageLog, pdu berElement, version, who string) {
+	parts := pdu.children()
+	if len(parts) < 6 {
+		log.add("%s trap truncated, %s", version, who)
+		return
+	}
+	enterprise := parts[0].oid()
+	agent := "-"
+	if len(parts[1].body) == 4 {
+		agent = net.IP(parts[1].body).String()
+	}
+	bindings := snmpVarBinds(parts[5], true)
+	line := fmt.Sprintf("%s trap %s from agent %s generic %d specific %d, %s",
+		version, enterprise, agent, parts[2].int(), parts[3].int(), who)
+	if len(bindings) > 0 {
+		line += ": " + strings.Join(bindings, ", ")
+	}
+	log.add("%s", line)
+	log.summary = fmt.Sprintf("SNMP%s trap %s from %s", version, enterprise, agent)
+}
+
+// snmpUser reads the user name from v3 USM security parameters
+func snmpUser(params berElement) string {
+	usm, _, ok := readBER(params.body)
+	if !ok {
+		return "-"
+	}
+	fields := usm.children()
+	if len(fields) < 4 || len(fields[3].body) == 0 {
+		return "-"
+	}
+	return capture.AnonymizeName(string(fields[3].body))
+}
+
+// snmpVarBinds formats a VarBindList, with values if withValues is set
+func snmpVarBinds(list berElement, withValues bool) []string {
+	var out []string
+	bindings := list.children()
+	for i, vb := range bindings {
+		if i == maxSNMPVarBinds {
+			out = append(out, fmt.Sprintf("(+%d more)", len(bindings)-i))
+			break
+		}
+		pair := vb.children()
+		if len(pair) != 2 {
+			continue
+		}
+		if withValues {
+			out = append(out, pair[0].oid()+" = "+snmpValue(pair[1]))
+		} else {
+			out = append(out, pair[0].oid())
+		}
+	}
+	return out
+}
+
+// snmpOIDSummary names the first OID of a VarBindList and how many follow
+func snmpOIDSummary(list berElement) string {
+	bindings := list.children()
+	if len(bindings) == 0 {
+		return ""
+	}
+	pair := bindings[0].children()
+	if len(pair) == 0 {
+		return ""
+	}
+	s := ": " + pair[0].oid()
+	if len(bindings) > 1 {
+		s += fmt.Sprintf(" (+%d OIDs)", len(bindings)-1)
+	}
+	return s
+}
+
+// snmpValue formats a varbind value
+func snmpValue(v berElement) string {
+	switch v.class {
+	case berUniversal:
+		switch v.tag {
+		case berInteger:
+			return strconv.FormatInt(v.int(), 10)
+		case berOctetString:
+			return octetString(v.body)
+		case berNull:
+			return "null"
+		case berOID:
+			return v.oid()
+		}
+	case berApplication:
+		switch v.tag {
+		case 0: // IpAddress
+			if len(v.body) == 4 {
+				return net.IP(v.body).String()
+			}
+		case 1, 2, 3, 6: // Counter32, Gauge32, TimeTicks, Counter64
+			return strconv.FormatUint(v.uint(), 10)
+		}
+	case berContext:
+		switch v.tag {
+		case 0:
+			return "noSuchObject"
+		case 1:
+			return "noSuchInstance"
+		case 2:
+			return "endOfMibView"
+		}
+	}
+	return "0x" + hex.EncodeToString(v.body[:min(len(v.body), 32)])
+}
+
+// octetString shows printable strings quoted and anything else in hex
+func octetString(b []byte) string {
+	if len(b) > 64 {
+		b = b[:64]
+	}
+	if utf8.Valid(b) && printable(string(b)) == string(b) {
+		return strconv.Quote(string(b))
+	}
+	return "0x" + hex.EncodeToString(b)
+}
@@ -0,0 +1,63 @@
+package stream
+
+import "testing"
+
+// BER elements of SNMP fixtures
+var (
+	sysName     = tlv(0x06, []byte{0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x05, 0x00}) // 1.3.6.1.2.1.1.5.0
+	snmpTrapID  = tlv(0x06, []byte{0x2b, 0x06, 0x01, 0x06, 0x03, 0x01, 0x01, 0x04, 0x01, 0x00})
+	linkDown    = tlv(0x06, []byte{0x2b, 0x06, 0x01, 0x06, 0x03, 0x01, 0x01, 0x05, 0x03})
+	berZero     = tlv(0x02, []byte{0x00})
+	berNullElem = tlv(0x05)
+)
+
+// snmpV2c builds a v2c message for community "public"
+func snmpV2c(pduTag, requestID, status, index byte, varbinds ...[]byte) []byte {
+	return tlv(0x30,
+		tlv(0x02, []byte{0x01}),
+		tlv(0x04, []byte("public")),
+		tlv(pduTag, tlv(0x02, []byte{requestID}), tlv(0x02, []byte{status}), tlv(0x02, []byte{index}), tlv(0x30, varbinds...)),
+	)
+}
+
+func TestDecodeSNMP(t *testing.T) {
+	get := snmpV2c(0xa0, 1, 0, 0, tlv(0x30, sysName, berNullElem))
+	response := snmpV2c(0xa2, 1, 0, 0, tlv(0x30, sysName, tlv(0x04, []byte("router1"))))
+	log := decodeAll(decodeSNMP, message{get, true}, message{response, false})
+	checkLog(t, log, []string{
+		`v2c get-request #1 community "public": 1.3.6.1.2.1.1.5.0`,
+		`v2c get-response #1 community "public": 1.3.6.1.2.1.1.5.0 = "router1"`,
+	}, `SNMPv2c get-request community "public": 1.3.6.1.2.1.1.5.0`)
+
+	// Errors name the failing varbind's index
+	failed := snmpV2c(0xa2, 2, 2, 1, tlv(0x30, sysName, berNullElem))
+	log = decodeAll(decodeSNMP, message{failed, false})
+	checkLog(t, log, []string{`v2c get-response #2 community "public" error noSuchName at 1: 1.3.6.1.2.1.1.5.0 = null`},
+		`SNMPv2c get-response community "public": 1.3.6.1.2.1.1.5.0`)
+
+	trap := snmpV2c(0xa7, 3, 0, 0,
+		tlv(0x30, tlv(0x06, []byte{0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x03, 0x00}), tlv(0x43, []byte{0x01, 0x00})),
+		tlv(0x30, snmpTrapID, linkDown),
+	)
+	log = decodeAll(decodeSNMP, message{trap, false})
+	checkLog(t, log, []string{
+		`v2c snmpV2-trap #3 community "public": 1.3.6.1.2.1.1.3.0 = 256, 1.3.6.1.6.3.1.1.4.1.0 = 1.3.6.1.6.3.1.1.5.3`,
+	}, "SNMPv2c snmpV2-trap 1.3.6.1.6.3.1.1.5.3")
+}
+
+func TestDecodeSNMPv3Encrypted(t *testing.T) {
+	usm := tlv(0x30, tlv(0x04, []byte{0x80, 0x00}), berZero, berZero, tlv(0x04, []byte("monitor")), tlv(0x04), tlv(0x04))
+	msg := tlv(0x30,
+		tlv(0x02, []byte{0x03}),
+		tlv(0x30, berZero, tlv(0x02, []byte{0x05, 0xdc}), tlv(0x04, []byte{0x07}), tlv(0x02, []byte{0x03})),
+		tlv(0x04, usm),
+		tlv(0x04, []byte{0xde, 0xad, 0xbe, 0xef}),
+	)
+	log := decodeAll(decodeSNMP, message{msg, true})
+	checkLog(t, log, []string{"v3 encrypted PDU, user monitor"}, "SNMPv3 encrypted, user monitor")
+}
+
+func TestDecodeSNMPMalformed(t *testing.T) {
+	log := decodeAll(decodeSNMP, message{[]byte{0x30, 0x03, 0x02, 0x01}, true})
+	checkLog(t, log, []string{"Malformed SNMP message (4 bytes)"}, "")
+}
@@ -12,17 +12,22 @@ import (
 	"time"
 
 	"go-etherape/capture"
+
+	"github.com/google/gopacket/reassembly"
 )
 
 // StreamType represents the transport protocol
 type StreamType string
 
 const (
-	StreamTypeTCP StreamType = "TCP"
-	StreamTypeUDP StreamType = "UDP"
+	StreamTypeTCP  StreamType = "TCP"
+	StreamTypeUDP  StreamType = "UDP"
+	StreamTypeQUIC StreamType = "QUIC" // UDP datagrams of one QUIC connection, across address changes
 )
 
-// StreamProtocol represents the detected application protocol
+// StreamProtocol represents the detected application protocol: a protocol
+// registry name, or Unknown. The constants are the protocols whose payloads
+// are summarised.
 type StreamProtocol string
 
 const (
@@ -37,6 +42,22 @@ const (
 	ProtocolPostgres  StreamProtocol = "PostgreSQL"
 	ProtocolRedis     StreamProtocol = "Redis"
 	ProtocolSlurm     StreamProtocol = "Slurm"
+	ProtocolQUIC      StreamProtocol = "QUIC"
+	ProtocolDHCP      StreamProtocol = "DHCP"
+	ProtocolNTP       StreamProtocol = "NTP"
+	ProtocolSNMP      StreamProtocol = "SNMP"
+	ProtocolLDAP      StreamProtocol = "LDAP"
+	ProtocolKerberos  StreamProtocol = "Kerberos"
+	ProtocolSMB       StreamProtocol = "SMB"
+	ProtocolRDP       StreamProtocol = "RDP"
+	ProtocolSyslog    StreamProtocol = "Syslog"
+	ProtocolModbus    StreamProtocol = "Modbus"
+	ProtocolDNP3      StreamProtocol = "DNP3"
+	ProtocolS7comm    StreamProtocol = "S7comm"
+	ProtocolBACnet    StreamProtocol = "BACnet"
+	ProtocolMQTT      StreamProtocol = "MQTT"
+	ProtocolCoAP      StreamProtocol = "CoAP"
+	ProtocolInfluxDB  StreamProtocol = "InfluxDB"
 	ProtocolUnknown   StreamProtocol = "Unknown"
 )
 
@@ -47,47 +68,64 @@ type StreamPacket struct {
 	Length    int       `json:"length"`
 	Payload   []byte    `json:"-"`          // Raw payload (not serialized directly)
 	PayloadB64 string   `json:"payload"`    // Base64 encoded for JSON
+	Fragments  int      `json:"fragments,omitempty"` // IP fragments reassembled into this packet
 }
 
 // Stream represents a TCP or UDP stream
 type Stream struct {
-	ID           string         `json:"id"`
-	Type         StreamType     `json:"type"`
-	Protocol     StreamProtocol `json:"protocol"`
-	SrcIP        string         `json:"srcIp"`
-	SrcPort      uint16         `json:"srcPort"`
-	DstIP        string         `json:"dstIp"`
-	DstPort      uint16         `json:"dstPort"`
-	StartTime    time.Time      `json:"startTime"`
-	LastSeen     time.Time      `json:"lastSeen"`
-	PacketCount  int            `json:"packetCount"`
-	ByteCount    int64          `json:"byteCount"`
-	Packets      []StreamPacket `json:"packets,omitempty"`
-	Summary      string         `json:"summary"`
-	RequestData  []byte         `json:"-"`
-	ResponseData []byte         `json:"-"`
+	ID           string             `json:"id"`
+	Type         StreamType         `json:"type"`
+	Protocol     StreamProtocol     `json:"protocol"`
+	Confidence   capture.Confidence `json:"confidence,omitempty"` // How Protocol was identified
+	SrcIP        string             `json:"srcIp"`
+	SrcPort      uint16             `json:"srcPort"`
+	DstIP        string             `json:"dstIp"`
+	DstPort      uint16             `json:"dstPort"`
+	StartTime    time.Time          `json:"startTime"`
+	LastSeen     time.Time          `json:"lastSeen"`
+	PacketCount  int                `json:"packetCount"`
+	ByteCount    int64              `json:"byteCount"`
+	Packets      []StreamPacket     `json:"packets,omitempty"`
+	Summary      string             `json:"summary"`
+	GapBytes     int64              `json:"gapBytes"`               // Bytes missing from TCP reassembly
+	Interfaces   []string           `json:"interfaces,omitempty"`   // Capture interfaces the stream was seen on
+	RequestData  []byte             `json:"-"`                      // Reassembled client -> server bytes
+	ResponseData []byte             `json:"-"`                      // Reassembled server -> client bytes
+	TLS          *TLSInfo           `json:"tls,omitempty"`          // Handshake metadata of TLS and QUIC streams
+	ConnectionID string             `json:"connectionId,omitempty"` // QUIC: the client's original destination connection ID
+	Migrations   int                `json:"migrations,omitempty"`   // QUIC: times the connection moved to a new address or port
+	tls          tlsState
+	quic         *quicState
+	msgs         messageLog // Messages of protocols decoded one by one, see messages.go
 }
 
 // StreamInfo is a lightweight version for listing
 type StreamInfo struct {
-	ID          string         `json:"id"`
-	Type        StreamType     `json:"type"`
-	Protocol    StreamProtocol `json:"protocol"`
-	SrcIP       string         `json:"srcIp"`
-	SrcPort     uint16         `json:"srcPort"`
-	DstIP       string         `json:"dstIp"`
-	DstPort     uint16         `json:"dstPort"`
-	StartTime   time.Time      `json:"startTime"`
-	LastSeen    time.Time      `json:"lastSeen"`
-	PacketCount int            `json:"packetCount"`
-	ByteCount   int64          `json:"byteCount"`
-	Summary     string         `json:"summary"`
+	ID           string             `json:"id"`
+	Type         StreamType         `json:"type"`
+	Protocol     StreamProtocol     `json:"protocol"`
+	Confidence   capture.Confidence `json:"confidence,omitempty"`
+	SrcIP        string             `json:"srcIp"`
+	SrcPort      uint16             `json:"srcPort"`
+	DstIP        string             `json:"dstIp"`
+	DstPort      uint16             `json:"dstPort"`
+	StartTime    time.Time          `json:"startTime"`
+	LastSeen     time.Time          `json:"lastSeen"`
+	PacketCount  int                `json:"packetCount"`
+	ByteCount    int64              `json:"byteCount"`
+	Summary      string             `json:"summary"`
+	Interfaces   []string           `json:"interfaces,omitempty"`
+	ConnectionID string             `json:"connectionId,omitempty"`
+	Migrations   int                `json:"migrations,omitempty"`
+	Writes       int                `json:"writes,omitempty"` // Decoded operations that change device state
 }
 
 // StreamDetail includes full payload data
 type StreamDetail struct {
 	StreamInfo
 	Packets         []StreamPacket `json:"packets"`
+	GapBytes        int64          `json:"gapBytes"`
+	TLS             *TLSInfo       `json:"tls,omitempty"`
 	RequestPayload  string         `json:"requestPayload"`  // Base64
 	ResponsePayload string         `json:"responsePayload"` // Base64
 	DecodedContent  string         `json:"decodedContent"`  // Human-readable content
@@ -97,7 +135,18 @@ type StreamDetail struct {
 type Manager struct {
 	streams    map[string]*Stream
 	maxStreams int
-	mu         sync.RWMutex
+	// QUIC streams by connection ID and by 5-tuple stream ID, plus the
+	// connection ID lengths in use for short header lookups
+	quicCIDs    map[string]string
+	quicPaths   map[string]string
+	quicCIDLens map[int]int
+	assembler   *reassembly.Assembler // TCP reassembly, guarded by mu
+	reassembled map[*Stream]bool      // Streams given data since their messages were last decoded
+	lastFlush   time.Time
+	dnsLog      []*DNSTransaction // Ring of recent DNS transactions, see GetDNSLog
+	dnsNext     int               // Oldest entry once the ring is full
+	clock       capture.Clock     // Time source for packets without a timestamp
+	mu          sync.RWMutex
 }
 
 // NewManager creates a new stream manager
@@ -105,10 +154,25 @@ func NewManager(maxStreams int) *Manager {
 	if maxStreams <= 0 {
 		maxStreams = 1000
 	}
-	return &Manager{
-		streams:    make(map[string]*Stream),
-		maxStreams: maxStreams,
-	}
+	m := &Manager{
+		streams:     make(map[string]*Stream),
+		maxStreams:  maxStreams,
+		quicCIDs:    make(map[string]string),
+		quicPaths:   make(map[string]string),
+		quicCIDLens: make(map[int]int),
+		reassembled: make(map[*Stream]bool),
+		clock:       capture.SystemClock{},
+	}
+	m.assembler = m.newAssembler()
+	return m
+}
+
+// SetClock replaces the time source for packets without a timestamp.
+// Use the graph manager's capture.PacketClock so both follow capture time.
+func (m *Manager) SetClock(clock capture.Clock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock = clock
 }
 
 // generateStreamID creates a unique stream identifier
@@ -124,22 +188,38 @@ func generateStreamID(srcIP string, srcPort uint16, dstIP string, dstPort uint16
 	return fmt.Sprintf("%s-%s-%s", streamType, src, dst)
 }
 
-// AddPacket adds a packet to the appropriate stream
-func (m *Manager) AddPacket(pkt *capture.PacketInfo) {
+// addInterface appends iface to a list if it is set and not already present
+func addInterface(list []string, iface string) []string {
+	if iface == "" {
+		return list
+	}
+	for _, existing := range list {
+		if existing == iface {
+			return list
+		}
+	}
+	return append(list, iface)
+}
+
+// PacketEvents is what a packet completed in its stream, for callers to
+// attribute to the stream's client
+type PacketEvents struct {
+	TLS          *TLSInfo           // Copy of the TLS metadata when the packet completed a ClientHello
+	Measurements []MeasurementWrite // InfluxDB points written
+	DNS          []DNSEvent         // DNS queries and responses
+}
+
+// AddPacket adds a packet to the appropriate stream and returns what it
+// completed
+func (m *Manager) AddPacket(pkt *capture.PacketInfo) PacketEvents {
 	// Skip nil packets or packets without port info (non-TCP/UDP)
 	if pkt == nil || (pkt.SrcPort == 0 && pkt.DstPort == 0) {
-		return
+		return PacketEvents{}
 	}
 
-	// Determine stream type based on protocol
-	var streamType StreamType
-	switch pkt.Protocol.Name {
-	case "UDP", "DNS":
-		streamType = StreamTypeUDP
-	case "TCP", "HTTP", "HTTPS", "SSH", "FTP", "SMTP", "MySQL", "PostgreSQL":
-		streamType = StreamTypeTCP
-	default:
-		// For any other protocol with ports, assume TCP
+	// Determine stream type from the transport layer
+	streamType := StreamTypeUDP
+	if pkt.TCP != nil {
 		streamType = StreamTypeTCP
 	}
 
@@ -148,8 +228,26 @@ func (m *Manager) AddPacket(pkt *capture.PacketInfo) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// QUIC connections are followed by connection ID rather than 5-tuple.
+	// Once connections are tracked, any datagram may carry one of their
+	// IDs: after a migration the new path has no classification yet.
+	pathID := streamID
+	var quicHdr *quicHeader
+	if streamType == StreamTypeUDP && (pkt.Protocol.Name == string(ProtocolQUIC) || len(m.quicCIDs) > 0) {
+		var quicID string
+		isQUIC := pkt.Protocol.Name == string(ProtocolQUIC)
+		if quicID, quicHdr = m.resolveQUIC(pkt.AppPayload, pathID, isQUIC); quicID != "" {
+			streamID, streamType = quicID, StreamTypeQUIC
+		}
+	}
+
 	stream, exists := m.streams[streamID]
-	now := time.Now()
+
+	// Use the capture timestamp so durations reflect time on the wire
+	now := pkt.Timestamp
+	if now.IsZero() {
+		now = m.clock.Now()
+	}
 
 	if !exists {
 		// Check if we need to evict old streams
@@ -177,13 +275,15 @@ func (m *Manager) AddPacket(pkt *capture.PacketInfo) {
 		direction = "response"
 	}
 
-	// Add packet to stream
+	// Add packet to stream, keeping only what the payload policy allows
+	retained := pkt.RetainedPayload()
 	streamPkt := StreamPacket{
 		Timestamp:  now,
 		Direction:  direction,
 		Length:     len(pkt.Payload),
-		Payload:    pkt.Payload,
-		PayloadB64: base64.StdEncoding.EncodeToString(pkt.Payload),
+		Payload:    retained,
+		PayloadB64: base64.StdEncoding.EncodeToString(retained),
+		Fragments:  pkt.Fragments,
 	}
 
 	// Limit packets per stream
@@ -191,28 +291,59 @@ func (m *Manager) AddPacket(pkt *capture.PacketInfo) {
 		stream.Packets = append(stream.Packets, streamPkt)
 	}
 
-	// Accumulate payload data
-	if direction == "request" {
-		stream.RequestData = append(stream.RequestData, pkt.Payload...)
+	// Accumulate application data. TCP goes through reassembly so that
+	// retransmissions, overlaps and out-of-order segments are resolved by
+	// sequence number; UDP datagrams are appended as they arrive.
+	if pkt.TCP != nil {
+		m.assembleTCP(pkt.NetFlow, pkt.TCP, now)
+	} else if direction == "request" {
+		stream.RequestData = appendCapped(stream.RequestData, pkt.AppPayload)
 	} else {
-		stream.ResponseData = append(stream.ResponseData, pkt.Payload...)
+		stream.ResponseData = appendCapped(stream.ResponseData, pkt.AppPayload)
 	}
 
-	// Limit payload sizes (1MB each)
-	if len(stream.RequestData) > 1024*1024 {
-		stream.RequestData = stream.RequestData[:1024*1024]
+	stream.PacketCount++
+	stream.ByteCount += int64(pkt.Length)
+	stream.Interfaces = addInterface(stream.Interfaces, pkt.Interface)
+	if now.After(stream.LastSeen) {
+		stream.LastSeen = now
 	}
-	if len(stream.ResponseData) > 1024*1024 {
-		stream.ResponseData = stream.ResponseData[:1024*1024]
+
+	// Read TLS handshake metadata from the reassembled data, or from the
+	// Initial packets of QUIC connections
+	hello := stream.updateTLS()
+	if streamType == StreamTypeQUIC {
+		hello = m.trackQUIC(stream, pkt, quicHdr, pathID)
 	}
 
-	stream.PacketCount++
-	stream.ByteCount += int64(pkt.Length)
-	stream.LastSeen = now
+	// Detect protocol, never trading payload evidence for a weaker guess
+	if protocol, confidence := detectProtocol(pkt, stream); confidence == capture.ConfidenceHigh || stream.Confidence != capture.ConfidenceHigh {
+		stream.Protocol, stream.Confidence = protocol, confidence
+	}
+
+	// Decode protocols read message by message, from what the payload
+	// policy lets the stream keep
+	if pkt.TCP != nil {
+		stream.decodeMessages(now)
+	} else {
+		stream.decodeDatagram(capture.RetainStreamData(pkt.AppPayload, 0), direction == "request", now)
+	}
+
+	// Update summary
+	stream.Summary = capture.AnonymizeText(generateSummary(stream))
 
-	// Detect protocol and update summary
-	stream.Protocol = detectProtocol(pkt, stream)
-	stream.Summary = generateSummary(stream)
+	// Reassembly may also have flushed data of other connections
+	delete(m.reassembled, stream)
+	m.refreshReassembled(now)
+
+	events := PacketEvents{
+		Measurements: stream.takeMeasurementWrites(),
+		DNS:          m.takeDNS(stream),
+	}
+	if hello {
+		events.TLS = stream.TLS.clone()
+	}
+	return events
 }
 
 // evictOldestStream removes the oldest stream
@@ -228,65 +359,16 @@ func (m *Manager) evictOldestStream() {
 	}
 
 	if oldestID != "" {
+		m.forgetQUIC(m.streams[oldestID])
 		delete(m.streams, oldestID)
 	}
 }
 
-// detectProtocol identifies the application protocol
-func detectProtocol(pkt *capture.PacketInfo, stream *Stream) StreamProtocol {
-	// Use capture's detected protocol first
-	switch pkt.Protocol.Name {
-	case "HTTP":
-		return ProtocolHTTP
-	case "HTTPS":
-		return ProtocolHTTPS
-	case "DNS":
-		return ProtocolDNS
-	case "SSH":
-		return ProtocolSSH
-	case "FTP":
-		return ProtocolFTP
-	case "SMTP":
-		return ProtocolSMTP
-	case "Telnet":
-		return ProtocolTelnet
-	case "MySQL":
-		return ProtocolMySQL
-	case "PostgreSQL":
-		return ProtocolPostgres
-	case "Redis":
-		return ProtocolRedis
-	case "Slurm":
-		return ProtocolSlurm
-	}
-
-	// Detect from port numbers
-	ports := []uint16{pkt.SrcPort, pkt.DstPort}
-	for _, port := range ports {
-		switch port {
-		case 80, 8080, 8000, 3000:
-			return ProtocolHTTP
-		case 443, 8443:
-			return ProtocolHTTPS
-		case 53:
-			return ProtocolDNS
-		case 22:
-			return ProtocolSSH
-		case 21:
-			return ProtocolFTP
-		case 25, 587, 465:
-			return ProtocolSMTP
-		case 23:
-			return ProtocolTelnet
-		case 3306:
-			return ProtocolMySQL
-		case 5432:
-			return ProtocolPostgres
-		case 6379:
-			return ProtocolRedis
-		case 6817, 6818:
-			return ProtocolSlurm
-		}
+// detectProtocol identifies the application protocol and how it was found
+func detectProtocol(pkt *capture.PacketInfo, stream *Stream) (StreamProtocol, capture.Confidence) {
+	// Capture classifies flows by port rules and payload signatures
+	if capture.IsApplicationProtocol(pkt.Protocol.Name) {
+		return StreamProtocol(pkt.Protocol.Name), pkt.Confidence
 	}
 
 	// Detect from payload patterns
@@ -301,25 +383,35 @@ func detectProtocol(pkt *capture.PacketInfo, stream *Stream) StreamProtocol {
 			strings.HasPrefix(payloadStr, "HEAD ") ||
 			strings.HasPrefix(payloadStr, "OPTIONS ") ||
 			strings.HasPrefix(payloadStr, "HTTP/") {
-			return ProtocolHTTP
+			return ProtocolHTTP, capture.ConfidenceHigh
 		}
 
 		if strings.HasPrefix(payloadStr, "SSH-") {
-			return ProtocolSSH
+			return ProtocolSSH, capture.ConfidenceHigh
 		}
 
 		if strings.HasPrefix(payloadStr, "EHLO ") ||
 			strings.HasPrefix(payloadStr, "HELO ") ||
 			strings.HasPrefix(payloadStr, "MAIL FROM:") {
-			return ProtocolSMTP
+			return ProtocolSMTP, capture.ConfidenceHigh
 		}
 	}
 
-	return ProtocolUnknown
+	return ProtocolUnknown, capture.ConfidenceNone
 }
 
 // generateSummary creates a human-readable summary
 func generateSummary(stream *Stream) string {
+	if stream.quic != nil {
+		return quicSummary(stream)
+	}
+	if stream.TLS != nil {
+		return tlsSummary(stream.TLS)
+	}
+	if log := stream.decodedLog(); log != nil && log.summary != "" {
+		return log.summary
+	}
+
 	switch stream.Protocol {
 	case ProtocolHTTP:
 		return extractHTTPSummary(stream)
@@ -381,12 +473,22 @@ func extractSMTPSummary(stream *Stream) string {
 	// Look for MAIL FROM
 	re := regexp.MustCompile(`MAIL FROM:<([^>]+)>`)
 	if matches := re.FindStringSubmatch(data); len(matches) >= 2 {
-		return fmt.Sprintf("SMTP from %s", matches[1])
+		return fmt.Sprintf("SMTP from %s", anonymizeMailbox(matches[1]))
 	}
 
 	return "SMTP Session"
 }
 
+// anonymizeMailbox pseudonymizes both parts of an email address when
+// anonymization is enabled
+func anonymizeMailbox(addr string) string {
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok {
+		return capture.AnonymizeName(addr)
+	}
+	return capture.AnonymizeName(local) + "@" + capture.AnonymizeHostname(domain)
+}
+
 // GetStreams returns a list of all streams (lightweight info only)
 func (m *Manager) GetStreams() []StreamInfo {
 	m.mu.RLock()
@@ -395,18 +497,23 @@ func (m *Manager) GetStreams() []StreamInfo {
 	streams := make([]StreamInfo, 0, len(m.streams))
 	for _, stream := range m.streams {
 		streams = append(streams, StreamInfo{
-			ID:          stream.ID,
-			Type:        stream.Type,
-			Protocol:    stream.Protocol,
-			SrcIP:       stream.SrcIP,
-			SrcPort:     stream.SrcPort,
-			DstIP:       stream.DstIP,
-			DstPort:     stream.DstPort,
-			StartTime:   stream.StartTime,
-			LastSeen:    stream.LastSeen,
-			PacketCount: stream.PacketCount,
-			ByteCount:   stream.ByteCount,
-			Summary:     stream.Summary,
+			ID:           stream.ID,
+			Type:         stream.Type,
+			Protocol:     stream.Protocol,
+			Confidence:   stream.Confidence,
+			SrcIP:        stream.SrcIP,
+			SrcPort:      stream.SrcPort,
+			DstIP:        stream.DstIP,
+			DstPort:      stream.DstPort,
+			StartTime:    stream.StartTime,
+			LastSeen:     stream.LastSeen,
+			PacketCount:  stream.PacketCount,
+			ByteCount:    stream.ByteCount,
+			Summary:      stream.Summary,
+			Interfaces:   stream.Interfaces,
+			ConnectionID: stream.ConnectionID,
+			Migrations:   stream.Migrations,
+			Writes:       stream.writeCount(),
 		})
 	}
 
@@ -424,26 +531,39 @@ func (m *Manager) GetStream(id string) (*StreamDetail, error) {
 	defer m.mu.RUnlock()
 
 	stream, exists := m.streams[id]
+	if !exists {
+		// A 5-tuple ID of a path taken by a QUIC connection
+		if quicID, ok := m.quicPaths[id]; ok {
+			stream, exists = m.streams[quicID]
+		}
+	}
 	if !exists {
 		return nil, fmt.Errorf("stream not found: %s", id)
 	}
 
 	detail := &StreamDetail{
 		StreamInfo: StreamInfo{
-			ID:          stream.ID,
-			Type:        stream.Type,
-			Protocol:    stream.Protocol,
-			SrcIP:       stream.SrcIP,
-			SrcPort:     stream.SrcPort,
-			DstIP:       stream.DstIP,
-			DstPort:     stream.DstPort,
-			StartTime:   stream.StartTime,
-			LastSeen:    stream.LastSeen,
-			PacketCount: stream.PacketCount,
-			ByteCount:   stream.ByteCount,
-			Summary:     stream.Summary,
+			ID:           stream.ID,
+			Type:         stream.Type,
+			Protocol:     stream.Protocol,
+			Confidence:   stream.Confidence,
+			SrcIP:        stream.SrcIP,
+			SrcPort:      stream.SrcPort,
+			DstIP:        stream.DstIP,
+			DstPort:      stream.DstPort,
+			StartTime:    stream.StartTime,
+			LastSeen:     stream.LastSeen,
+			PacketCount:  stream.PacketCount,
+			ByteCount:    stream.ByteCount,
+			Summary:      stream.Summary,
+			Interfaces:   stream.Interfaces,
+			ConnectionID: stream.ConnectionID,
+			Migrations:   stream.Migrations,
+			Writes:       stream.writeCount(),
 		},
 		Packets:         stream.Packets,
+		GapBytes:        stream.GapBytes,
+		TLS:             stream.TLS.clone(),
 		RequestPayload:  base64.StdEncoding.EncodeToString(stream.RequestData),
 		ResponsePayload: base64.StdEncoding.EncodeToString(stream.ResponseData),
 		DecodedContent:  decodeStreamContent(stream),
@@ -456,8 +576,17 @@ func (m *Manager) GetStream(id string) (*StreamDetail, error) {
 func decodeStreamContent(stream *Stream) string {
 	var buf bytes.Buffer
 
+	if stream.TLS != nil {
+		writeTLSInfo(&buf, stream.TLS)
+		buf.WriteString("\n")
+	}
+	if log := stream.decodedLog(); log != nil && len(log.lines) > 0 {
+		writeMessageLog(&buf, log)
+		buf.WriteString("\n")
+	}
+
 	switch stream.Protocol {
-	case ProtocolHTTP:
+	case ProtocolHTTP, ProtocolInfluxDB:
 		// Show request
 		if len(stream.RequestData) > 0 {
 			buf.WriteString("=== REQUEST ===\n")
@@ -555,18 +684,23 @@ func (m *Manager) GetStreamsByProtocol(protocol StreamProtocol) []StreamInfo {
 	for _, stream := range m.streams {
 		if stream.Protocol == protocol {
 			streams = append(streams, StreamInfo{
-				ID:          stream.ID,
-				Type:        stream.Type,
-				Protocol:    stream.Protocol,
-				SrcIP:       stream.SrcIP,
-				SrcPort:     stream.SrcPort,
-				DstIP:       stream.DstIP,
-				DstPort:     stream.DstPort,
-				StartTime:   stream.StartTime,
-				LastSeen:    stream.LastSeen,
-				PacketCount: stream.PacketCount,
-				ByteCount:   stream.ByteCount,
-				Summary:     stream.Summary,
+				ID:           stream.ID,
+				Type:         stream.Type,
+				Protocol:     stream.Protocol,
+				Confidence:   stream.Confidence,
+				SrcIP:        stream.SrcIP,
+				SrcPort:      stream.SrcPort,
+				DstIP:        stream.DstIP,
+				DstPort:      stream.DstPort,
+				StartTime:    stream.StartTime,
+				LastSeen:     stream.LastSeen,
+				PacketCount:  stream.PacketCount,
+				ByteCount:    stream.ByteCount,
+				Summary:      stream.Summary,
+				Interfaces:   stream.Interfaces,
+				ConnectionID: stream.ConnectionID,
+				Migrations:   stream.Migrations,
+				Writes:       stream.writeCount(),
 			})
 		}
 	}
@@ -583,6 +717,14 @@ func (m *Manager) Clear() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.streams = make(map[string]*Stream)
+	m.quicCIDs = make(map[string]string)
+	m.quicPaths = make(map[string]string)
+	m.quicCIDLens = make(map[int]int)
+	m.assembler = m.newAssembler()
+	m.reassembled = make(map[*Stream]bool)
+	m.lastFlush = time.Time{}
+	m.dnsLog = nil
+	m.dnsNext = 0
 }
 
 // GetStats returns stream statistics
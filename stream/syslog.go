@@ -0,0 +1,186 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go-etherape/capture"
+)
+
+// maxSyslogLine is the longest newline-terminated message framed over TCP
+const maxSyslogLine = 8192
+
+// syslogFacilities and syslogSeverities name the parts of a PRI value
+var (
+	syslogFacilities = [...]string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = [...]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+)
+
+// frameSyslog frames syslog over TCP: octet-counted messages ("LEN <PRI>...")
+// or messages terminated by a newline
+func frameSyslog(data []byte) (int, int) {
+	if data[0] >= '0' && data[0] <= '9' {
+		space := bytes.IndexByte(data[:min(len(data), 7)], ' ')
+		if space < 0 {
+			if len(data) < 7 {
+				return 0, 0
+			}
+			return -1, 0
+		}
+		n, err := strconv.Atoi(string(data[:space]))
+		if err != nil || n > maxStreamData {
+			return -1, 0
+		}
+		return space + 1 + n, space + 1
+	}
+	if data[0] != '<' {
+		return -1, 0
+	}
+	end := bytes.IndexByte(data[:min(len(data), maxSyslogLine)], '\n')
+	if end < 0 {
+		if len(data) >= maxSyslogLine {
+			return -1, 0
+		}
+		return 0, 0
+	}
+	return end + 1, 0
+}
+
+// decodeSyslog decodes a BSD (RFC 3164) or RFC 5424 syslog message
+func decodeSyslog(log *messageLog, msg []byte, fromClient bool) {
+	text := strings.TrimRight(string(msg), "\r\n\x00")
+	if !strings.HasPrefix(text, "<") {
+		log.add("Malformed syslog message (%d bytes)", len(msg))
+		return
+	}
+	pri, end, ok := syslogPRI(text)
+	if !ok {
+		log.add("Malformed syslog priority (%d bytes)", len(msg))
+		return
+	}
+	facility, severity := syslogFacilities[pri/8], pri%8
+	host, app, message := parseSyslog(text[end+1:])
+	host = capture.AnonymizeHostname(host)
+
+	log.count(syslogSeverities[severity])
+	log.add("%s.%s %s %s: %s", facility, syslogSeverities[severity], orDash(host), orDash(app), message)
+	if host != "" {
+		log.set("host", host)
+	}
+	if worst, ok := log.facts["worst"]; !ok || strconv.Itoa(severity) < worst {
+		log.set("worst", strconv.Itoa(severity))
+	}
+
+	total := 0
+	for _, n := range log.counts {
+		total += n
+	}
+	if total == 1 {
+		if len(message) > 60 {
+			message = message[:60] + "..."
+		}
+		log.summary = fmt.Sprintf("Syslog %s.%s %s %s: %s", facility, syslogSeverities[severity], orDash(host), orDash(app), message)
+		return
+	}
+	worst, _ := strconv.Atoi(log.facts["worst"])
+	log.summary = fmt.Sprintf("Syslog from %s: %d messages, most severe %s", orDash(log.facts["host"]), total, syslogSeverities[worst])
+}
+
+// syslogPRI reads the PRI of "<PRI>": one to three digits from 0 to 191.
+// It returns the index of the closing '>'.
+func syslogPRI(text string) (pri, end int, ok bool) {
+	end = strings.IndexByte(text[:min(len(text), 5)], '>')
+	if end < 2 {
+		return 0, 0, false
+	}
+	for _, c := range text[1:end] {
+		if c < '0' || c > '9' {
+			return 0, 0, false
+		}
+	}
+	pri, err := strconv.Atoi(text[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, 0, false
+	}
+	return pri, end, true
+}
+
+// parseSyslog splits what follows the PRI into host, application and
+// message. RFC 5424 messages start with a version; BSD ones with a
+// timestamp, which senders sometimes leave out along with the host.
+func parseSyslog(s string) (host, app, message string) {
+	if rest, ok := strings.CutPrefix(s, "1 "); ok {
+		// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		fields := strings.SplitN(rest, " ", 6)
+		if len(fields) < 6 {
+			return "", "", rest
+		}
+		host, app = nilValue(fields[1]), nilValue(fields[2])
+		return host, app, skipStructuredData(fields[5])
+	}
+
+	// Mmm dd hh:mm:ss
+	if len(s) >= 16 && s[3] == ' ' && s[6] == ' ' && s[9] == ':' && s[12] == ':' && s[15] == ' ' {
+		s = s[16:]
+		if h, rest, ok := strings.Cut(s, " "); ok && !strings.HasSuffix(h, ":") && !strings.Contains(h, "[") {
+			host, s = h, rest
+		}
+	}
+	// TAG[PID]: MSG
+	if i := strings.IndexAny(s, ":["); i > 0 && i <= 48 && !strings.Contains(s[:i], " ") {
+		app = s[:i]
+		if j := strings.Index(s[i:], ": "); j >= 0 {
+			return host, app, s[i+j+2:]
+		}
+	}
+	return host, app, s
+}
+
+// skipStructuredData drops RFC 5424 structured data elements, or the "-"
+// standing in for them, and returns the message after them
+func skipStructuredData(s string) string {
+	if s == "-" {
+		return ""
+	}
+	if rest, ok := strings.CutPrefix(s, "- "); ok {
+		return rest
+	}
+	depth, escaped := 0, false
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ' ' && depth == 0:
+			return s[i+1:]
+		}
+	}
+	return ""
+}
+
+// nilValue maps the RFC 5424 nil value "-" to ""
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// orDash shows empty values as "-"
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
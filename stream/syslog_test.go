@@ -0,0 +1,32 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeSyslogRejectsInvalidPriority(t *testing.T) {
+	for _, msg := range []string{"<-1>boom", "<>boom", "<999>boom", "<13 boom", "<+1>boom", "<0013>boom"} {
+		log := &messageLog{}
+		decodeSyslog(log, []byte(msg), true)
+		if len(log.lines) != 1 || !strings.HasPrefix(log.lines[0], "Malformed syslog priority") {
+			t.Errorf("%q: got lines %q, want a malformed priority", msg, log.lines)
+		}
+		if log.summary != "" {
+			t.Errorf("%q: got summary %q, want none", msg, log.summary)
+		}
+	}
+}
+
+func TestDecodeSyslogPriority(t *testing.T) {
+	log := &messageLog{}
+	decodeSyslog(log, []byte("<191>Oct 16 12:00:00 web1 app: hello"), true)
+	if len(log.lines) != 1 || !strings.HasPrefix(log.lines[0], "local7.debug web1 app: hello") {
+		t.Fatalf("got lines %q", log.lines)
+	}
+	log = &messageLog{}
+	decodeSyslog(log, []byte("<0>1 2024-01-01T00:00:00Z host app - - - panic"), true)
+	if len(log.lines) != 1 || !strings.HasPrefix(log.lines[0], "kern.emerg host app: panic") {
+		t.Fatalf("got lines %q", log.lines)
+	}
+}
@@ -0,0 +1,617 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-etherape/capture"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLSInfo is the metadata of a TLS handshake, read from the cleartext
+// ClientHello, ServerHello and (before TLS 1.3) Certificate messages
+type TLSInfo struct {
+	ClientIP      string           `json:"clientIp"`
+	ServerIP      string           `json:"serverIp"`
+	ServerName    string           `json:"serverName,omitempty"`    // SNI
+	ALPN          []string         `json:"alpn,omitempty"`          // Protocols offered by the client
+	ClientVersion string           `json:"clientVersion,omitempty"` // Highest version offered by the client
+	Version       string           `json:"version,omitempty"`       // Negotiated version
+	CipherSuite   string           `json:"cipherSuite,omitempty"`   // Negotiated cipher suite
+	SelectedALPN  string           `json:"selectedAlpn,omitempty"`  // Protocol chosen by the server
+	JA3           string           `json:"ja3,omitempty"`           // MD5 of the ClientHello fields
+	JA3S          string           `json:"ja3s,omitempty"`          // MD5 of the ServerHello fields
+	JA4           string           `json:"ja4,omitempty"`
+	Certificates  []TLSCertificate `json:"certificates,omitempty"` // Server chain, leaf first; encrypted in TLS 1.3
+}
+
+// TLSCertificate summarises one certificate of the server's chain
+type TLSCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	SANs      []string  `json:"sans,omitempty"` // DNS names and IP addresses
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// TLS record and handshake message types
+const (
+	tlsRecordHandshake  = 22
+	tlsHelloClient      = 1
+	tlsHelloServer      = 2
+	tlsCertificate      = 11
+	tlsMaxHandshakeData = 64 * 1024 // Bytes per direction looked at before giving up
+	tlsMaxCertificates  = 8
+)
+
+// TLS extension types used for metadata and fingerprints
+const (
+	extServerName          = 0
+	extSupportedGroups     = 10
+	extECPointFormats      = 11
+	extSignatureAlgorithms = 13
+	extALPN                = 16
+	extSupportedVersions   = 43
+)
+
+// tlsState tracks handshake parsing for a stream
+type tlsState struct {
+	reqLen, respLen int // Buffer lengths at the last parse
+	client, server  bool
+	certs           bool // Certificate message parsed, or known to be unavailable
+	done            bool
+}
+
+// updateTLS parses the handshake messages buffered so far and reports
+// whether this call found the ClientHello
+func (s *Stream) updateTLS() bool {
+	st := &s.tls
+	if st.done || s.Type != StreamTypeTCP {
+		return false
+	}
+	if len(s.RequestData) == st.reqLen && len(s.ResponseData) == st.respLen {
+		return false
+	}
+	st.reqLen, st.respLen = len(s.RequestData), len(s.ResponseData)
+
+	foundClient := false
+	sides := []struct {
+		data     []byte
+		fromSrc  bool
+		finished bool
+	}{{data: s.RequestData, fromSrc: true}, {data: s.ResponseData}}
+	for i := range sides {
+		side := &sides[i]
+		msgs, isTLS, finished := tlsHandshakeMessages(side.data)
+		side.finished = finished
+		if !isTLS {
+			if len(side.data) > 0 {
+				// Something other than a handshake: not TLS, or picked up mid-connection
+				st.done = true
+				return false
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			switch msg.typ {
+			case tlsHelloClient:
+				if !st.client {
+					st.client = s.parseClientHello(msg.body, side.fromSrc, 't')
+					foundClient = st.client
+				}
+			case tlsHelloServer:
+				if !st.server {
+					st.server = s.parseServerHello(msg.body, side.fromSrc)
+				}
+			case tlsCertificate:
+				if !st.certs {
+					st.certs = s.parseCertificates(msg.body)
+				}
+			}
+		}
+	}
+
+	if s.TLS != nil && s.TLS.Version == tls.VersionName(tls.VersionTLS13) {
+		st.certs = true
+	}
+	st.done = (st.client && st.server && st.certs) ||
+		(sides[0].finished && sides[1].finished) ||
+		len(s.RequestData) > tlsMaxHandshakeData || len(s.ResponseData) > tlsMaxHandshakeData
+	return foundClient
+}
+
+// tlsMessage is a handshake message
+type tlsMessage struct {
+	typ  uint8
+	body []byte
+}
+
+// tlsHandshakeMessages returns the complete handshake messages at the start
+// of a direction's data. isTLS is false if the data does not start with a
+// handshake record; finished is true once a record of another type (e.g.
+// ChangeCipherSpec) ends the cleartext handshake.
+func tlsHandshakeMessages(data []byte) (msgs []tlsMessage, isTLS, finished bool) {
+	if len(data) < 3 {
+		return nil, len(data) == 0 || data[0] == tlsRecordHandshake, false
+	}
+	if data[0] != tlsRecordHandshake || data[1] != 3 {
+		return nil, false, false
+	}
+
+	// Join handshake record fragments; messages may span records
+	var hs []byte
+	for len(data) >= 5 {
+		length := int(data[3])<<8 | int(data[4])
+		if data[0] != tlsRecordHandshake {
+			finished = true
+			break
+		}
+		if len(data) < 5+length {
+			break
+		}
+		hs = append(hs, data[5:5+length]...)
+		data = data[5+length:]
+	}
+
+	return splitHandshakeMessages(hs), true, finished
+}
+
+// splitHandshakeMessages returns the complete messages in a handshake
+// byte stream
+func splitHandshakeMessages(hs []byte) []tlsMessage {
+	var msgs []tlsMessage
+	for len(hs) >= 4 {
+		length := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+		if len(hs) < 4+length {
+			break
+		}
+		msgs = append(msgs, tlsMessage{typ: hs[0], body: hs[4 : 4+length]})
+		hs = hs[4+length:]
+	}
+	return msgs
+}
+
+// clientHello holds the ClientHello fields used for fingerprints
+type clientHello struct {
+	version      uint16
+	ciphers      []uint16
+	extensions   []uint16
+	groups       []uint16
+	pointFormats []uint8
+	sigAlgs      []uint16
+	versions     []uint16 // supported_versions
+	serverName   string
+	alpn         []string
+}
+
+// parseClientHello fills in the client side of s.TLS; transport is the
+// JA4 transport character
+func (s *Stream) parseClientHello(body []byte, fromSrc bool, transport byte) bool {
+	hello, ok := parseClientHello(body)
+	if !ok {
+		return false
+	}
+
+	info := s.tlsInfo(fromSrc)
+	info.ServerName = capture.AnonymizeHostname(hello.serverName)
+	info.ALPN = hello.alpn
+	info.ClientVersion = tlsVersionName(hello.maxVersion())
+	info.JA3 = ja3(hello)
+	info.JA4 = ja4(hello, transport)
+	return true
+}
+
+// parseClientHello decodes a ClientHello message body
+func parseClientHello(body []byte) (*clientHello, bool) {
+	h := &clientHello{}
+	in := cryptobyte.String(body)
+	var sessionID, ciphers, compression cryptobyte.String
+	if !in.ReadUint16(&h.version) || !in.Skip(32) ||
+		!in.ReadUint8LengthPrefixed(&sessionID) ||
+		!in.ReadUint16LengthPrefixed(&ciphers) ||
+		!in.ReadUint8LengthPrefixed(&compression) {
+		return nil, false
+	}
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return nil, false
+		}
+		h.ciphers = append(h.ciphers, c)
+	}
+	if in.Empty() {
+		return h, true
+	}
+
+	var exts cryptobyte.String
+	if !in.ReadUint16LengthPrefixed(&exts) {
+		return nil, false
+	}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		h.extensions = append(h.extensions, typ)
+
+		switch typ {
+		case extServerName:
+			var names cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&names) {
+				continue
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					break
+				}
+				if nameType == 0 {
+					h.serverName = string(name)
+				}
+			}
+		case extALPN:
+			var protos cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&protos) {
+				continue
+			}
+			for !protos.Empty() {
+				var proto cryptobyte.String
+				if !protos.ReadUint8LengthPrefixed(&proto) {
+					break
+				}
+				h.alpn = append(h.alpn, string(proto))
+			}
+		case extSupportedGroups:
+			h.groups = readUint16List(data, 2)
+		case extSignatureAlgorithms:
+			h.sigAlgs = readUint16List(data, 2)
+		case extSupportedVersions:
+			h.versions = readUint16List(data, 1)
+		case extECPointFormats:
+			var formats cryptobyte.String
+			if data.ReadUint8LengthPrefixed(&formats) {
+				h.pointFormats = append([]uint8(nil), formats...)
+			}
+		}
+	}
+	return h, true
+}
+
+// readUint16List reads a list of 16-bit values behind a prefixLen-byte length
+func readUint16List(data cryptobyte.String, prefixLen int) []uint16 {
+	var list cryptobyte.String
+	var ok bool
+	if prefixLen == 1 {
+		ok = data.ReadUint8LengthPrefixed(&list)
+	} else {
+		ok = data.ReadUint16LengthPrefixed(&list)
+	}
+	if !ok {
+		return nil
+	}
+
+	var values []uint16
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			break
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// maxVersion returns the highest version offered, ignoring GREASE
+func (h *clientHello) maxVersion() uint16 {
+	max := uint16(0)
+	for _, v := range h.versions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		return h.version
+	}
+	return max
+}
+
+// parseServerHello fills in the negotiated parameters of s.TLS
+func (s *Stream) parseServerHello(body []byte, fromSrc bool) bool {
+	in := cryptobyte.String(body)
+	var version, cipher uint16
+	var sessionID cryptobyte.String
+	var compression uint8
+	if !in.ReadUint16(&version) || !in.Skip(32) ||
+		!in.ReadUint8LengthPrefixed(&sessionID) ||
+		!in.ReadUint16(&cipher) || !in.ReadUint8(&compression) {
+		return false
+	}
+
+	negotiated := version
+	var extensions []string
+	var selectedALPN string
+	var exts cryptobyte.String
+	if in.ReadUint16LengthPrefixed(&exts) {
+		for !exts.Empty() {
+			var typ uint16
+			var data cryptobyte.String
+			if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+				return false
+			}
+			extensions = append(extensions, strconv.Itoa(int(typ)))
+
+			switch typ {
+			case extSupportedVersions:
+				data.ReadUint16(&negotiated)
+			case extALPN:
+				var protos, proto cryptobyte.String
+				if data.ReadUint16LengthPrefixed(&protos) && protos.ReadUint8LengthPrefixed(&proto) {
+					selectedALPN = string(proto)
+				}
+			}
+		}
+	}
+
+	// The server's side is the opposite of the client's
+	info := s.tlsInfo(!fromSrc)
+	info.Version = tlsVersionName(negotiated)
+	info.CipherSuite = tls.CipherSuiteName(cipher)
+	info.SelectedALPN = selectedALPN
+	info.JA3S = md5Hex(fmt.Sprintf("%d,%d,%s", version, cipher, strings.Join(extensions, "-")))
+	return true
+}
+
+// parseCertificates records the server's certificate chain (TLS 1.2 and
+// earlier, where the Certificate message is sent in the clear)
+func (s *Stream) parseCertificates(body []byte) bool {
+	if s.TLS == nil {
+		return false
+	}
+	in := cryptobyte.String(body)
+	var chain cryptobyte.String
+	if !in.ReadUint24LengthPrefixed(&chain) {
+		return false
+	}
+
+	for !chain.Empty() && len(s.TLS.Certificates) < tlsMaxCertificates {
+		var der cryptobyte.String
+		if !chain.ReadUint24LengthPrefixed(&der) {
+			break
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		s.TLS.Certificates = append(s.TLS.Certificates, summarizeCertificate(cert))
+	}
+	return true
+}
+
+// summarizeCertificate extracts the fields shown for a certificate. With
+// anonymization enabled the subject is reduced to its pseudonymized common
+// name, since its other attributes name the organisation.
+func summarizeCertificate(cert *x509.Certificate) TLSCertificate {
+	summary := TLSCertificate{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+	if capture.CurrentAnonymizer() != nil {
+		summary.Subject = "CN=" + capture.AnonymizeHostname(cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		summary.SANs = append(summary.SANs, capture.AnonymizeHostname(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		summary.SANs = append(summary.SANs, capture.AnonymizeIP(ip.String()))
+	}
+	return summary
+}
+
+// tlsInfo returns the stream's TLS metadata, creating it with the client
+// being the stream's source if clientIsSrc is set
+func (s *Stream) tlsInfo(clientIsSrc bool) *TLSInfo {
+	if s.TLS == nil {
+		s.TLS = &TLSInfo{ClientIP: s.SrcIP, ServerIP: s.DstIP}
+		if !clientIsSrc {
+			s.TLS.ClientIP, s.TLS.ServerIP = s.DstIP, s.SrcIP
+		}
+	}
+	return s.TLS
+}
+
+// clone copies the metadata so it can be used outside the Manager lock
+func (t *TLSInfo) clone() *TLSInfo {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	c.ALPN = append([]string(nil), t.ALPN...)
+	c.Certificates = append([]TLSCertificate(nil), t.Certificates...)
+	return &c
+}
+
+// tlsSummary describes a handshake for the stream list
+func tlsSummary(info *TLSInfo) string {
+	version := info.Version
+	if version == "" {
+		version = "TLS"
+	}
+	summary := version + " handshake"
+	if info.ServerName != "" {
+		summary = version + " to " + info.ServerName
+	}
+	if info.SelectedALPN != "" {
+		summary += " (" + info.SelectedALPN + ")"
+	}
+	return summary
+}
+
+// writeTLSInfo writes the handshake metadata for the decoded stream view
+func writeTLSInfo(buf *bytes.Buffer, info *TLSInfo) {
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(buf, "%-15s %s\n", name+":", value)
+		}
+	}
+	buf.WriteString("=== TLS HANDSHAKE ===\n")
+	field("Client", info.ClientIP)
+	field("Server", info.ServerIP)
+	field("Server name", info.ServerName)
+	field("ALPN offered", strings.Join(info.ALPN, ", "))
+	field("ALPN selected", info.SelectedALPN)
+	field("Client version", info.ClientVersion)
+	field("Version", info.Version)
+	field("Cipher suite", info.CipherSuite)
+	field("JA3", info.JA3)
+	field("JA3S", info.JA3S)
+	field("JA4", info.JA4)
+	for i, cert := range info.Certificates {
+		fmt.Fprintf(buf, "\nCertificate %d\n", i)
+		field("  Subject", cert.Subject)
+		field("  Issuer", cert.Issuer)
+		field("  SANs", strings.Join(cert.SANs, ", "))
+		field("  Valid", cert.NotBefore.UTC().Format(time.RFC3339)+" to "+cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+}
+
+// tlsVersionName names a protocol version, including DTLS and draft versions
+// that crypto/tls does not know
+func tlsVersionName(v uint16) string {
+	switch v {
+	case 0:
+		return ""
+	case 0xfeff:
+		return "DTLS 1.0"
+	case 0xfefd:
+		return "DTLS 1.2"
+	case 0xfefc:
+		return "DTLS 1.3"
+	}
+	return tls.VersionName(v)
+}
+
+// isGREASE reports whether a value is one of the reserved GREASE values
+// (RFC 8701) that clients add to keep servers tolerant of unknown values
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3 computes the JA3 fingerprint of a ClientHello
+func ja3(h *clientHello) string {
+	join := func(values []uint16) string {
+		parts := make([]string, 0, len(values))
+		for _, v := range values {
+			if !isGREASE(v) {
+				parts = append(parts, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(parts, "-")
+	}
+	formats := make([]string, len(h.pointFormats))
+	for i, f := range h.pointFormats {
+		formats[i] = strconv.Itoa(int(f))
+	}
+	return md5Hex(fmt.Sprintf("%d,%s,%s,%s,%s", h.version,
+		join(h.ciphers), join(h.extensions), join(h.groups), strings.Join(formats, "-")))
+}
+
+// ja4 computes the JA4 fingerprint of a ClientHello; transport is 't' for
+// TCP and 'q' for QUIC
+func ja4(h *clientHello, transport byte) string {
+	ciphers := hexValues(h.ciphers, nil)
+	extensions := hexValues(h.extensions, nil)
+	hashedExtensions := hexValues(h.extensions, map[uint16]bool{extServerName: true, extALPN: true})
+
+	sni := 'i'
+	if h.serverName != "" {
+		sni = 'd'
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first := h.alpn[0]
+		if isAlphanumeric(first[0]) && isAlphanumeric(first[len(first)-1]) {
+			alpn = string([]byte{first[0], first[len(first)-1]})
+		} else {
+			encoded := hex.EncodeToString([]byte(first))
+			alpn = string([]byte{encoded[0], encoded[len(encoded)-1]})
+		}
+	}
+	a := fmt.Sprintf("%c%s%c%02d%02d%s", transport, ja4Version(h.maxVersion()), sni,
+		min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sort.Strings(ciphers)
+	sort.Strings(hashedExtensions)
+	c := strings.Join(hashedExtensions, ",")
+	if sigAlgs := hexValues(h.sigAlgs, nil); len(sigAlgs) > 0 {
+		c += "_" + strings.Join(sigAlgs, ",")
+	}
+	return a + "_" + ja4Hash(strings.Join(ciphers, ",")) + "_" + ja4Hash(c)
+}
+
+// ja4Version is the two-character version in JA4's first part
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+	return "00"
+}
+
+// ja4Hash is the truncated SHA-256 used by JA4, all zeros for empty input
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// hexValues formats values as 4-digit hex, dropping GREASE and skip
+func hexValues(values []uint16, skip map[uint16]bool) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) && !skip[v] {
+			out = append(out, fmt.Sprintf("%04x", v))
+		}
+	}
+	return out
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
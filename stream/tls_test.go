@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// mustHex decodes a hex fixture, ignoring whitespace
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// rfc9001ClientHello is the ClientHello of RFC 9001 appendix A.2: SNI
+// example.com, ALPN "alpn", TLS 1.3 with two cipher suites
+func rfc9001ClientHello(t *testing.T) []byte {
+	return mustHex(t, `
+		010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e86804fe3a47
+		f06a2b69484c00000413011302010000c000000010000e00000b6578616d706c
+		652e636f6dff01000100000a00080006001d0017001800100007000504616c70
+		6e000500050100000000003300260024001d00209370b2c9caa47fbabaf4559f
+		edba753de171fa71f50f1ce15d43e994ec74d748002b0003020304000d001000
+		0e0403050306030203080408050806002d00020101001c000240010039003204
+		08ffffffffffffffff05048000ffff07048000ffff0801100104800075300901
+		100f088394c8f03e51570806048000ffff`)
+}
+
+// rfc9001ServerHello is the ServerHello of RFC 9001 appendix A.3
+func rfc9001ServerHello(t *testing.T) []byte {
+	return mustHex(t, `
+		020000560303eefce7f7b37ba1d1632e96677825ddf73988cfc79825df566dc5
+		430b9a045a1200130100002e00330024001d00209d3c940d89690b84d08a6099
+		3c144eca684d1081287c834d5311bcf32bb9da1a002b00020304`)
+}
+
+// Fingerprints of rfc9001ClientHello and rfc9001ServerHello
+const (
+	rfc9001JA3  = "41bc9ae914d6cb3bd0bd0a5453ab7d7f" // 771,4865-4866,0-65281-10-16-5-51-43-13-45-28-57,29-23-24,
+	rfc9001JA4  = "13d0211an_62ed6f6ca7ad_4d634acda6c0"
+	rfc9001JA3S = "eb1d94daa7e0344597e756a1fb6e7054" // 771,4865,51-43
+)
+
+// tlsRecord wraps handshake messages in a handshake record
+func tlsRecord(msgs ...[]byte) []byte {
+	var body []byte
+	for _, m := range msgs {
+		body = append(body, m...)
+	}
+	return append([]byte{tlsRecordHandshake, 0x03, 0x01, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestTLSHandshakeMetadata(t *testing.T) {
+	s := &Stream{Type: StreamTypeTCP, SrcIP: "192.0.2.1", DstIP: "192.0.2.2"}
+	s.RequestData = tlsRecord(rfc9001ClientHello(t))
+	if !s.updateTLS() {
+		t.Fatal("ClientHello was not parsed")
+	}
+	s.ResponseData = append(tlsRecord(rfc9001ServerHello(t)), 0x14, 0x03, 0x03, 0x00, 0x01, 0x01)
+	s.updateTLS()
+
+	info := s.TLS
+	if info == nil {
+		t.Fatal("no TLS metadata")
+	}
+	checks := []struct{ name, got, want string }{
+		{"client", info.ClientIP, "192.0.2.1"},
+		{"server", info.ServerIP, "192.0.2.2"},
+		{"server name", info.ServerName, "example.com"},
+		{"ALPN", strings.Join(info.ALPN, ","), "alpn"},
+		{"client version", info.ClientVersion, "TLS 1.3"},
+		{"version", info.Version, "TLS 1.3"},
+		{"cipher suite", info.CipherSuite, "TLS_AES_128_GCM_SHA256"},
+		{"JA3", info.JA3, rfc9001JA3},
+		{"JA4", info.JA4, "t" + rfc9001JA4},
+		{"JA3S", info.JA3S, rfc9001JA3S},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+		}
+	}
+	if !s.tls.done {
+		t.Error("handshake parsing did not finish after ChangeCipherSpec")
+	}
+}
+
+func TestTLSFingerprintsIgnoreGREASE(t *testing.T) {
+	hello, ok := parseClientHello(rfc9001ClientHello(t)[4:])
+	if !ok {
+		t.Fatal("ClientHello was not parsed")
+	}
+	greased := *hello
+	greased.ciphers = slices.Insert(slices.Clone(hello.ciphers), 0, 0x0a0a)
+	greased.extensions = slices.Insert(slices.Clone(hello.extensions), 0, 0x1a1a)
+	greased.groups = slices.Insert(slices.Clone(hello.groups), 0, 0x2a2a)
+	greased.versions = slices.Insert(slices.Clone(hello.versions), 0, 0x3a3a)
+
+	if got := ja3(&greased); got != rfc9001JA3 {
+		t.Errorf("JA3 = %s, want %s", got, rfc9001JA3)
+	}
+	if got := ja4(&greased, 't'); got != "t"+rfc9001JA4 {
+		t.Errorf("JA4 = %s, want t%s", got, rfc9001JA4)
+	}
+}
+
+func TestTLSNotAHandshake(t *testing.T) {
+	s := &Stream{Type: StreamTypeTCP, RequestData: []byte("GET / HTTP/1.1\r\n\r\n")}
+	if s.updateTLS() || s.TLS != nil || !s.tls.done {
+		t.Errorf("plain HTTP was parsed as TLS: %+v", s.TLS)
+	}
+}